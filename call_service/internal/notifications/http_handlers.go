@@ -0,0 +1,186 @@
+package notifications
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+
+	"gochat/call_service/internal/platform"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterRoutes(r gin.IRouter, db *sql.DB) {
+	initRepository(db)
+
+	r.GET("/call/api/notifications/preferences", getPreferences)
+	r.POST("/call/api/notifications/preferences", updatePreferences)
+
+	r.POST("/call/api/notifications/memberships", joinSpace)
+	r.POST("/call/api/notifications/memberships/leave", leaveSpace)
+	r.POST("/call/api/notifications/activity", recordActivity)
+
+	// The link in the email only shows a confirmation page, so mail scanners
+	// that follow links cannot unsubscribe anyone; the form POSTs the change.
+	r.GET("/call/unsubscribe", confirmUnsubscribe)
+	r.POST("/call/unsubscribe", unsubscribe)
+}
+
+func getPreferences(c *gin.Context) {
+	userID, err := platform.ExtractUserIDFromGin(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	prefs, err := GetPreferences(userID)
+	if err != nil {
+		writeServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, prefs)
+}
+
+func updatePreferences(c *gin.Context) {
+	userID, err := platform.ExtractUserIDFromGin(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req UpdatePreferencesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	prefs, err := UpdatePreferences(userID, req)
+	if err != nil {
+		writeServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, prefs)
+}
+
+func joinSpace(c *gin.Context) {
+	userID, err := platform.ExtractUserIDFromGin(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req MembershipRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	if err := JoinSpace(userID, req); err != nil {
+		writeServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Membership recorded"})
+}
+
+func leaveSpace(c *gin.Context) {
+	userID, err := platform.ExtractUserIDFromGin(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req MembershipRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	if err := LeaveSpace(userID, req); err != nil {
+		writeServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Membership removed"})
+}
+
+func recordActivity(c *gin.Context) {
+	userID, err := platform.ExtractUserIDFromGin(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req ActivityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	notified, err := RecordActivity(userID, req)
+	if err != nil {
+		writeServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"notified": notified})
+}
+
+var unsubscribeConfirmPage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Unsubscribe from Parch emails</title></head>
+<body>
+<p>Stop all emails from Parch?</p>
+<form method="POST" action="/call/unsubscribe">
+<input type="hidden" name="token" value="{{.}}">
+<button type="submit">Unsubscribe</button>
+</form>
+</body>
+</html>
+`))
+
+func confirmUnsubscribe(c *gin.Context) {
+	token := c.Query("token")
+	if err := CheckUnsubscribeToken(token); err != nil {
+		writeUnsubscribeError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := unsubscribeConfirmPage.Execute(c.Writer, token); err != nil {
+		log.Printf("Error rendering unsubscribe page: %v", err)
+	}
+}
+
+func unsubscribe(c *gin.Context) {
+	if err := Unsubscribe(c.PostForm("token")); err != nil {
+		writeUnsubscribeError(c, err)
+		return
+	}
+	c.String(http.StatusOK, "You have been unsubscribed from all Parch emails.")
+}
+
+func writeUnsubscribeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidInput), errors.Is(err, ErrNotFound):
+		c.String(http.StatusBadRequest, "This unsubscribe link is invalid or has expired.")
+	default:
+		c.String(http.StatusInternalServerError, "Could not update your email preferences. Please try again later.")
+	}
+}
+
+func writeServiceError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, platform.ErrUnauthorized):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	case errors.Is(err, ErrInvalidInput):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrMembershipUnproven):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
@@ -0,0 +1,62 @@
+package notifications
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestUnsubscribeConfirmsBeforeChangingPreferences(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conn := newTestRepository(t)
+	ana := insertTestUser(t, conn, "ana")
+	router := gin.New()
+	RegisterRoutes(router, conn)
+
+	var token string
+	if err := conn.QueryRow(`SELECT unsubscribe_token FROM email_preferences WHERE user_id = ?`, ana).Scan(&token); err != nil {
+		t.Fatalf("read token: %v", err)
+	}
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	unsubscribed := func() bool {
+		prefs, err := GetPreferences(ana)
+		if err != nil {
+			t.Fatalf("get preferences: %v", err)
+		}
+		return prefs.UnsubscribedAll
+	}
+
+	// Following the link only shows the form.
+	rec := serve(httptest.NewRequest(http.MethodGet, "/call/unsubscribe?token="+url.QueryEscape(token), nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `method="POST"`) || !strings.Contains(rec.Body.String(), token) {
+		t.Fatalf("expected a confirmation form, got %d:\n%s", rec.Code, rec.Body.String())
+	}
+	if unsubscribed() {
+		t.Fatal("expected GET to leave preferences unchanged")
+	}
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/call/unsubscribe?token=unknown", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown token to be rejected, got %d", rec.Code)
+	}
+
+	// A token in the query string is not enough to change anything.
+	if rec := serve(httptest.NewRequest(http.MethodPost, "/call/unsubscribe?token="+url.QueryEscape(token), nil)); rec.Code != http.StatusBadRequest || unsubscribed() {
+		t.Fatalf("expected a POST without a form token to be rejected, got %d", rec.Code)
+	}
+
+	post := httptest.NewRequest(http.MethodPost, "/call/unsubscribe", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if rec := serve(post); rec.Code != http.StatusOK {
+		t.Fatalf("expected the form POST to unsubscribe, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !unsubscribed() {
+		t.Fatal("expected unsubscribed_all after the form POST")
+	}
+}
@@ -0,0 +1,192 @@
+package notifications
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Membership is proven with a space capability token: the host signs one
+// for each member, and the relay publishes the host's signing key. Joining a
+// space or reporting activity in it needs a token for that host and space.
+
+const (
+	defaultRelayURL        = "http://127.0.0.1:8001"
+	hostKeyCacheTTL        = 5 * time.Minute
+	hostKeyLookupTimeout   = 5 * time.Second
+	capabilityClockSkew    = 90 * time.Second
+	scopeReadHistory       = "read_history"
+	scopeSendMessage       = "send_message"
+	maxCapabilityTokenSize = 4096
+)
+
+var ErrMembershipUnproven = errors.New("membership not proven")
+
+type spaceCapabilityClaims struct {
+	Version    int      `json:"v"`
+	HostUUID   string   `json:"host_uuid"`
+	SpaceUUID  string   `json:"space_uuid"`
+	SubjectKey string   `json:"sub"`
+	Scopes     []string `json:"scopes"`
+	ExpiresAt  int64    `json:"exp"`
+	IssuedAt   int64    `json:"iat"`
+}
+
+// hostKeyLookup fetches a host's current signing public key.
+type hostKeyLookup func(hostUUID string) (string, error)
+
+type cachedHostKey struct {
+	key       string
+	fetchedAt time.Time
+}
+
+// hostKeyCache remembers signing keys for hostKeyCacheTTL. A token that
+// fails against a cached key is retried once with a fresh one, in case the
+// host rotated its key.
+type hostKeyCache struct {
+	mu     sync.Mutex
+	lookup hostKeyLookup
+	keys   map[string]cachedHostKey
+}
+
+var hostKeys = newHostKeyCache(relayHostKeyLookup(relayURLFromEnv()))
+
+func newHostKeyCache(lookup hostKeyLookup) *hostKeyCache {
+	return &hostKeyCache{lookup: lookup, keys: make(map[string]cachedHostKey)}
+}
+
+func (c *hostKeyCache) get(hostUUID string, refresh bool) (string, error) {
+	c.mu.Lock()
+	cached, ok := c.keys[hostUUID]
+	c.mu.Unlock()
+	if ok && !refresh && time.Since(cached.fetchedAt) < hostKeyCacheTTL {
+		return cached.key, nil
+	}
+
+	key, err := c.lookup(hostUUID)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.keys[hostUUID] = cachedHostKey{key: key, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return key, nil
+}
+
+// relayURLFromEnv reads CHAT_RELAY_URL, the relay that lists host signing
+// keys.
+func relayURLFromEnv() string {
+	raw := strings.TrimRight(strings.TrimSpace(os.Getenv("CHAT_RELAY_URL")), "/")
+	if raw == "" {
+		return defaultRelayURL
+	}
+	return raw
+}
+
+func relayHostKeyLookup(relayURL string) hostKeyLookup {
+	client := &http.Client{Timeout: hostKeyLookupTimeout}
+	return func(hostUUID string) (string, error) {
+		resp, err := client.Get(relayURL + "/api/host/" + url.PathEscape(hostUUID))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return "", fmt.Errorf("%w: unknown host", ErrMembershipUnproven)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("relay host lookup returned %d", resp.StatusCode)
+		}
+		var host struct {
+			SigningPublicKey string `json:"signing_public_key"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&host); err != nil {
+			return "", err
+		}
+		if host.SigningPublicKey == "" {
+			return "", fmt.Errorf("%w: host has no signing key", ErrMembershipUnproven)
+		}
+		return host.SigningPublicKey, nil
+	}
+}
+
+// verifyMembership checks that token is a live capability for the space
+// with requiredScope and returns the member key it was issued to.
+func verifyMembership(hostUUID, spaceUUID, token, requiredScope string) (string, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("%w: capability_token is required", ErrMembershipUnproven)
+	}
+	if len(token) > maxCapabilityTokenSize {
+		return "", fmt.Errorf("%w: capability token is too long", ErrMembershipUnproven)
+	}
+
+	key, err := hostKeys.get(hostUUID, false)
+	if err != nil {
+		return "", err
+	}
+	claims, err := parseCapability(token, key)
+	if err != nil {
+		refreshed, lookupErr := hostKeys.get(hostUUID, true)
+		if lookupErr != nil || refreshed == key {
+			return "", err
+		}
+		if claims, err = parseCapability(token, refreshed); err != nil {
+			return "", err
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Version != 1:
+		return "", fmt.Errorf("%w: unsupported capability version", ErrMembershipUnproven)
+	case claims.HostUUID != hostUUID || claims.SpaceUUID != spaceUUID:
+		return "", fmt.Errorf("%w: capability is for another space", ErrMembershipUnproven)
+	case claims.SubjectKey == "":
+		return "", fmt.Errorf("%w: capability has no subject", ErrMembershipUnproven)
+	case claims.ExpiresAt <= 0 || now.Unix() >= claims.ExpiresAt:
+		return "", fmt.Errorf("%w: capability expired", ErrMembershipUnproven)
+	case claims.IssuedAt > now.Add(capabilityClockSkew).Unix():
+		return "", fmt.Errorf("%w: capability issued-at is invalid", ErrMembershipUnproven)
+	}
+	for _, scope := range claims.Scopes {
+		if scope == requiredScope {
+			return claims.SubjectKey, nil
+		}
+	}
+	return "", fmt.Errorf("%w: capability scope denied", ErrMembershipUnproven)
+}
+
+func parseCapability(token, signingPublicKey string) (spaceCapabilityClaims, error) {
+	var claims spaceCapabilityClaims
+	publicKey, err := base64.RawStdEncoding.DecodeString(strings.TrimSpace(signingPublicKey))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		log.Printf("Relay returned an invalid host signing key")
+		return claims, fmt.Errorf("%w: invalid host signing key", ErrMembershipUnproven)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, fmt.Errorf("%w: malformed capability token", ErrMembershipUnproven)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, fmt.Errorf("%w: invalid capability payload", ErrMembershipUnproven)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(publicKey), payload, signature) {
+		return claims, fmt.Errorf("%w: invalid capability signature", ErrMembershipUnproven)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("%w: invalid capability claims", ErrMembershipUnproven)
+	}
+	return claims, nil
+}
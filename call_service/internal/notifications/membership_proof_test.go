@@ -0,0 +1,146 @@
+package notifications
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testHostKey struct {
+	public  string
+	private ed25519.PrivateKey
+}
+
+func newTestHostKey(t *testing.T) testHostKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return testHostKey{public: base64.RawStdEncoding.EncodeToString(pub), private: priv}
+}
+
+func (k testHostKey) sign(t *testing.T, claims spaceCapabilityClaims) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(ed25519.Sign(k.private, payload))
+}
+
+// useHostKeys makes verifyMembership look host keys up in keys instead of
+// asking the relay.
+func useHostKeys(t *testing.T, keys map[string]string) {
+	t.Helper()
+	previous := hostKeys
+	hostKeys = newHostKeyCache(func(hostUUID string) (string, error) {
+		key, ok := keys[hostUUID]
+		if !ok {
+			return "", ErrMembershipUnproven
+		}
+		return key, nil
+	})
+	t.Cleanup(func() { hostKeys = previous })
+}
+
+func validClaims() spaceCapabilityClaims {
+	now := time.Now()
+	return spaceCapabilityClaims{
+		Version:    1,
+		HostUUID:   "host-1",
+		SpaceUUID:  "space-1",
+		SubjectKey: "member-key",
+		Scopes:     []string{scopeReadHistory, scopeSendMessage},
+		ExpiresAt:  now.Add(time.Hour).Unix(),
+		IssuedAt:   now.Unix(),
+	}
+}
+
+func TestVerifyMembership(t *testing.T) {
+	hostKey := newTestHostKey(t)
+	otherKey := newTestHostKey(t)
+	keys := map[string]string{"host-1": hostKey.public}
+	useHostKeys(t, keys)
+
+	withClaims := func(change func(*spaceCapabilityClaims)) string {
+		claims := validClaims()
+		change(&claims)
+		return hostKey.sign(t, claims)
+	}
+	tests := []struct {
+		name    string
+		token   string
+		scope   string
+		wantErr string
+	}{
+		{"valid", hostKey.sign(t, validClaims()), scopeSendMessage, ""},
+		{"missing", "", scopeReadHistory, "capability_token is required"},
+		{"too long", strings.Repeat("a", maxCapabilityTokenSize+1), scopeReadHistory, "too long"},
+		{"malformed", "not-a-token", scopeReadHistory, "malformed"},
+		{"signed by another key", otherKey.sign(t, validClaims()), scopeReadHistory, "invalid capability signature"},
+		{"other space", withClaims(func(c *spaceCapabilityClaims) { c.SpaceUUID = "space-2" }), scopeReadHistory, "another space"},
+		{"other host", withClaims(func(c *spaceCapabilityClaims) { c.HostUUID = "host-2" }), scopeReadHistory, "another space"},
+		{"expired", withClaims(func(c *spaceCapabilityClaims) { c.ExpiresAt = time.Now().Add(-time.Minute).Unix() }), scopeReadHistory, "expired"},
+		{"issued in the future", withClaims(func(c *spaceCapabilityClaims) { c.IssuedAt = time.Now().Add(time.Hour).Unix() }), scopeReadHistory, "issued-at"},
+		{"unknown version", withClaims(func(c *spaceCapabilityClaims) { c.Version = 2 }), scopeReadHistory, "version"},
+		{"no subject", withClaims(func(c *spaceCapabilityClaims) { c.SubjectKey = "" }), scopeReadHistory, "no subject"},
+		{"scope denied", withClaims(func(c *spaceCapabilityClaims) { c.Scopes = []string{scopeReadHistory} }), scopeSendMessage, "scope denied"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			subject, err := verifyMembership("host-1", "space-1", tc.token, tc.scope)
+			if tc.wantErr == "" {
+				if err != nil || subject != "member-key" {
+					t.Fatalf("expected member-key, got %q, %v", subject, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrMembershipUnproven) || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	// A rotated host key is picked up without waiting for the cache to expire.
+	keys["host-1"] = otherKey.public
+	if subject, err := verifyMembership("host-1", "space-1", otherKey.sign(t, validClaims()), scopeReadHistory); err != nil || subject != "member-key" {
+		t.Fatalf("expected the rotated key to verify, got %q, %v", subject, err)
+	}
+	if _, err := verifyMembership("host-9", "space-1", hostKey.sign(t, validClaims()), scopeReadHistory); !errors.Is(err, ErrMembershipUnproven) {
+		t.Fatalf("expected an unknown host to be unproven, got %v", err)
+	}
+}
+
+func TestJoinSpaceStoresTheTokenSubject(t *testing.T) {
+	conn := newTestRepository(t)
+	hostKey := newTestHostKey(t)
+	useHostKeys(t, map[string]string{"host-1": hostKey.public})
+	ana := insertTestUser(t, conn, "ana")
+	ben := insertTestUser(t, conn, "ben")
+
+	token := hostKey.sign(t, validClaims())
+	if err := JoinSpace(ana, MembershipRequest{HostUUID: "host-1", SpaceUUID: "space-1", CapabilityToken: token}); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	var subject string
+	if err := conn.QueryRow(`SELECT subject_key FROM user_space_memberships WHERE user_id = ?`, ana).Scan(&subject); err != nil || subject != "member-key" {
+		t.Fatalf("expected the token subject stored, got %q, %v", subject, err)
+	}
+	// The same token cannot sign up a second account.
+	if err := JoinSpace(ben, MembershipRequest{HostUUID: "host-1", SpaceUUID: "space-1", CapabilityToken: token}); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected a reused token to be refused, got %v", err)
+	}
+	if _, err := RecordActivity(ben, ActivityRequest{HostUUID: "host-1", SpaceUUID: "space-1", CapabilityToken: token}); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected activity from a non-member to be refused, got %v", err)
+	}
+	if err := JoinSpace(ana, MembershipRequest{HostUUID: "host-1", SpaceUUID: ""}); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected a missing space to be invalid, got %v", err)
+	}
+}
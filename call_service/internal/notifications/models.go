@@ -0,0 +1,56 @@
+package notifications
+
+type Preferences struct {
+	UserID          int    `json:"user_id"`
+	InviteEmails    bool   `json:"invite_emails"`
+	ActivityEmails  bool   `json:"activity_emails"`
+	WeeklyEmails    bool   `json:"weekly_emails"`
+	UnsubscribedAll bool   `json:"unsubscribed_all"`
+	UpdatedAt       string `json:"updated_at"`
+}
+
+type UpdatePreferencesRequest struct {
+	InviteEmails    *bool `json:"invite_emails"`
+	ActivityEmails  *bool `json:"activity_emails"`
+	WeeklyEmails    *bool `json:"weekly_emails"`
+	UnsubscribedAll *bool `json:"unsubscribed_all"`
+}
+
+// MembershipRequest joins or leaves a space. Joining needs a capability
+// token the host issued for the space; leaving does not.
+type MembershipRequest struct {
+	HostUUID        string `json:"host_uuid"`
+	SpaceUUID       string `json:"space_uuid"`
+	CapabilityToken string `json:"capability_token,omitempty"`
+}
+
+type ActivityRequest struct {
+	HostUUID        string `json:"host_uuid"`
+	SpaceUUID       string `json:"space_uuid"`
+	CapabilityToken string `json:"capability_token"`
+}
+
+type activityDigest struct {
+	UserID           int
+	Email            string
+	Username         string
+	UnsubscribeToken string
+	HostUUID         string
+	SpaceUUID        string
+	PendingCount     int
+	LastMessageAt    string
+}
+
+type weeklySpace struct {
+	HostUUID      string
+	SpaceUUID     string
+	LastMessageAt string
+}
+
+type weeklyDigest struct {
+	UserID           int
+	Email            string
+	Username         string
+	UnsubscribeToken string
+	Spaces           []weeklySpace
+}
@@ -0,0 +1,428 @@
+package notifications
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNotFound                 = errors.New("not found")
+	ErrForbidden                = errors.New("forbidden")
+	errRepositoryNotInitialized = errors.New("notifications repository not initialized")
+	notificationsDB             *sql.DB
+)
+
+func initRepository(db *sql.DB) {
+	notificationsDB = db
+}
+
+func currentDB() (*sql.DB, error) {
+	if notificationsDB == nil {
+		return nil, errRepositoryNotInitialized
+	}
+	return notificationsDB, nil
+}
+
+// sqliteAgo renders a duration as a SQLite datetime modifier such as "-3600 seconds".
+func sqliteAgo(d time.Duration) string {
+	return fmt.Sprintf("-%d seconds", int64(d/time.Second))
+}
+
+func ensurePreferencesRow(db *sql.DB, userID int) error {
+	_, err := db.Exec(`
+INSERT OR IGNORE INTO email_preferences (user_id, unsubscribe_token)
+SELECT id, lower(hex(randomblob(16))) FROM users WHERE id = ?`, userID)
+	return err
+}
+
+func repoGetPreferences(userID int) (Preferences, error) {
+	db, err := currentDB()
+	if err != nil {
+		return Preferences{}, err
+	}
+	if err := ensurePreferencesRow(db, userID); err != nil {
+		return Preferences{}, err
+	}
+
+	var p Preferences
+	err = db.QueryRow(`
+SELECT user_id, invite_emails, activity_emails, weekly_emails, unsubscribed_all, updated_at
+FROM email_preferences
+WHERE user_id = ?`, userID).Scan(
+		&p.UserID,
+		&p.InviteEmails,
+		&p.ActivityEmails,
+		&p.WeeklyEmails,
+		&p.UnsubscribedAll,
+		&p.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Preferences{}, ErrNotFound
+		}
+		return Preferences{}, err
+	}
+	return p, nil
+}
+
+func repoUpdatePreferences(userID int, p Preferences) (Preferences, error) {
+	db, err := currentDB()
+	if err != nil {
+		return Preferences{}, err
+	}
+
+	res, err := db.Exec(`
+UPDATE email_preferences
+SET invite_emails = ?,
+    activity_emails = ?,
+    weekly_emails = ?,
+    unsubscribed_all = ?,
+    updated_at = datetime('now')
+WHERE user_id = ?`,
+		p.InviteEmails, p.ActivityEmails, p.WeeklyEmails, p.UnsubscribedAll, userID)
+	if err != nil {
+		return Preferences{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Preferences{}, ErrNotFound
+	}
+	return repoGetPreferences(userID)
+}
+
+func repoFindUnsubscribeToken(token string) error {
+	db, err := currentDB()
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := db.QueryRow(`
+SELECT EXISTS (SELECT 1 FROM email_preferences WHERE unsubscribe_token = ?)`, token).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func repoUnsubscribeByToken(token string) error {
+	db, err := currentDB()
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec(`
+UPDATE email_preferences
+SET unsubscribed_all = 1, updated_at = datetime('now')
+WHERE unsubscribe_token = ?`, token)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func repoUpsertMembership(userID int, hostUUID, spaceUUID, subjectKey string) error {
+	db, err := currentDB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var claimed bool
+	if err := tx.QueryRow(`
+SELECT EXISTS (
+    SELECT 1
+    FROM user_space_memberships
+    WHERE host_uuid = ? AND space_uuid = ? AND subject_key = ? AND user_id != ? AND is_active = 1
+)`,
+		hostUUID, spaceUUID, subjectKey, userID).Scan(&claimed); err != nil {
+		return err
+	}
+	if claimed {
+		return ErrForbidden
+	}
+
+	if _, err := tx.Exec(`
+INSERT INTO user_host_memberships (user_id, host_uuid)
+VALUES (?, ?)
+ON CONFLICT(user_id, host_uuid) DO UPDATE SET last_seen_at = datetime('now')`,
+		userID, hostUUID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+INSERT INTO user_space_memberships (user_id, host_uuid, space_uuid, is_active, subject_key)
+VALUES (?, ?, ?, 1, ?)
+ON CONFLICT(user_id, host_uuid, space_uuid) DO UPDATE SET
+    is_active = 1,
+    subject_key = excluded.subject_key,
+    last_seen_at = datetime('now')`,
+		userID, hostUUID, spaceUUID, subjectKey); err != nil {
+		return err
+	}
+	// Opening a space counts as reading it; pending activity no longer needs a digest.
+	if _, err := tx.Exec(`
+UPDATE user_space_message_counters
+SET pending_count = 0
+WHERE user_id = ? AND host_uuid = ? AND space_uuid = ?`,
+		userID, hostUUID, spaceUUID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func repoDeactivateMembership(userID int, hostUUID, spaceUUID string) error {
+	db, err := currentDB()
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec(`
+UPDATE user_space_memberships
+SET is_active = 0, last_seen_at = datetime('now')
+WHERE user_id = ? AND host_uuid = ? AND space_uuid = ?`,
+		userID, hostUUID, spaceUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func repoIncrementSpaceCounters(senderUserID int, hostUUID, spaceUUID, subjectKey string) (int, error) {
+	db, err := currentDB()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var (
+		active     bool
+		joinedWith string
+	)
+	err = tx.QueryRow(`
+SELECT is_active, subject_key
+FROM user_space_memberships
+WHERE user_id = ? AND host_uuid = ? AND space_uuid = ?`,
+		senderUserID, hostUUID, spaceUUID).Scan(&active, &joinedWith)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrForbidden
+		}
+		return 0, err
+	}
+	if !active || joinedWith != subjectKey {
+		return 0, ErrForbidden
+	}
+
+	if _, err := tx.Exec(`
+UPDATE user_space_memberships
+SET last_seen_at = datetime('now')
+WHERE user_id = ? AND host_uuid = ? AND space_uuid = ?`,
+		senderUserID, hostUUID, spaceUUID); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`
+INSERT INTO user_space_message_counters (user_id, host_uuid, space_uuid, pending_count, last_message_at)
+SELECT m.user_id, m.host_uuid, m.space_uuid, 1, datetime('now')
+FROM user_space_memberships m
+WHERE m.host_uuid = ? AND m.space_uuid = ? AND m.is_active = 1 AND m.user_id != ?
+ON CONFLICT(user_id, host_uuid, space_uuid) DO UPDATE SET
+    pending_count = pending_count + 1,
+    last_message_at = excluded.last_message_at`,
+		hostUUID, spaceUUID, senderUserID)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func repoListDueActivityDigests(throttle time.Duration, limit int) ([]activityDigest, error) {
+	db, err := currentDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+SELECT
+    c.user_id,
+    u.email,
+    u.username,
+    p.unsubscribe_token,
+    c.host_uuid,
+    c.space_uuid,
+    c.pending_count,
+    COALESCE(c.last_message_at, '')
+FROM user_space_message_counters c
+JOIN users u ON u.id = c.user_id
+JOIN email_preferences p ON p.user_id = c.user_id
+JOIN user_space_memberships m
+    ON m.user_id = c.user_id
+    AND m.host_uuid = c.host_uuid
+    AND m.space_uuid = c.space_uuid
+WHERE c.pending_count > 0
+    AND m.is_active = 1
+    AND p.activity_emails = 1
+    AND p.unsubscribed_all = 0
+    AND (c.last_emailed_at IS NULL OR c.last_emailed_at <= datetime('now', ?))
+ORDER BY c.last_message_at ASC
+LIMIT ?`, sqliteAgo(throttle), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var digests []activityDigest
+	for rows.Next() {
+		var d activityDigest
+		if err := rows.Scan(
+			&d.UserID,
+			&d.Email,
+			&d.Username,
+			&d.UnsubscribeToken,
+			&d.HostUUID,
+			&d.SpaceUUID,
+			&d.PendingCount,
+			&d.LastMessageAt,
+		); err != nil {
+			return nil, err
+		}
+		digests = append(digests, d)
+	}
+	return digests, rows.Err()
+}
+
+// repoMarkActivityDigestSent subtracts only the count that was mailed so
+// messages recorded while the email was in flight are kept for the next digest.
+func repoMarkActivityDigestSent(d activityDigest) error {
+	db, err := currentDB()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+UPDATE user_space_message_counters
+SET pending_count = MAX(pending_count - ?, 0),
+    last_emailed_at = datetime('now')
+WHERE user_id = ? AND host_uuid = ? AND space_uuid = ?`,
+		d.PendingCount, d.UserID, d.HostUUID, d.SpaceUUID)
+	return err
+}
+
+func repoListDueWeeklyDigests(interval time.Duration, limit int) ([]weeklyDigest, error) {
+	db, err := currentDB()
+	if err != nil {
+		return nil, err
+	}
+
+	ago := sqliteAgo(interval)
+	rows, err := db.Query(`
+SELECT
+    u.id,
+    u.email,
+    u.username,
+    p.unsubscribe_token,
+    c.host_uuid,
+    c.space_uuid,
+    c.last_message_at
+FROM email_preferences p
+JOIN users u ON u.id = p.user_id
+JOIN user_space_message_counters c ON c.user_id = p.user_id
+JOIN user_space_memberships m
+    ON m.user_id = c.user_id
+    AND m.host_uuid = c.host_uuid
+    AND m.space_uuid = c.space_uuid
+WHERE p.weekly_emails = 1
+    AND p.unsubscribed_all = 0
+    AND COALESCE(p.last_weekly_sent_at, p.created_at) <= datetime('now', ?)
+    AND m.is_active = 1
+    AND c.last_message_at >= datetime('now', ?)
+    AND p.user_id IN (
+        -- The batch only takes users who have something to report; a user
+        -- without recent activity is never marked sent and would otherwise
+        -- hold a slot in every batch.
+        SELECT p2.user_id
+        FROM email_preferences p2
+        WHERE p2.weekly_emails = 1
+            AND p2.unsubscribed_all = 0
+            AND COALESCE(p2.last_weekly_sent_at, p2.created_at) <= datetime('now', ?)
+            AND EXISTS (
+                SELECT 1
+                FROM user_space_message_counters c2
+                JOIN user_space_memberships m2
+                    ON m2.user_id = c2.user_id
+                    AND m2.host_uuid = c2.host_uuid
+                    AND m2.space_uuid = c2.space_uuid
+                WHERE c2.user_id = p2.user_id
+                    AND m2.is_active = 1
+                    AND c2.last_message_at >= datetime('now', ?)
+            )
+        ORDER BY COALESCE(p2.last_weekly_sent_at, p2.created_at) ASC
+        LIMIT ?
+    )
+ORDER BY u.id ASC, c.last_message_at DESC`, ago, ago, ago, ago, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var digests []weeklyDigest
+	for rows.Next() {
+		var (
+			userID   int
+			email    string
+			username string
+			token    string
+			space    weeklySpace
+		)
+		if err := rows.Scan(&userID, &email, &username, &token, &space.HostUUID, &space.SpaceUUID, &space.LastMessageAt); err != nil {
+			return nil, err
+		}
+		if len(digests) == 0 || digests[len(digests)-1].UserID != userID {
+			digests = append(digests, weeklyDigest{
+				UserID:           userID,
+				Email:            email,
+				Username:         username,
+				UnsubscribeToken: token,
+			})
+		}
+		last := &digests[len(digests)-1]
+		last.Spaces = append(last.Spaces, space)
+	}
+	return digests, rows.Err()
+}
+
+func repoMarkWeeklyDigestSent(userID int) error {
+	db, err := currentDB()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+UPDATE email_preferences
+SET last_weekly_sent_at = datetime('now')
+WHERE user_id = ?`, userID)
+	return err
+}
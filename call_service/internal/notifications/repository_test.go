@@ -0,0 +1,169 @@
+package notifications
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"gochat/db"
+)
+
+// newTestRepository applies call_service's migrations to a fresh database and
+// points the repository at it.
+func newTestRepository(t *testing.T) *sql.DB {
+	t.Helper()
+	conn, err := db.InitSQLite(filepath.Join(t.TempDir(), "call.db"))
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	files, err := filepath.Glob(filepath.Join("..", "..", "relay-migrations", "*.up.sql"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("find migrations: %v", err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		schema, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("read %s: %v", file, err)
+		}
+		if _, err := conn.Exec(string(schema)); err != nil {
+			t.Fatalf("apply %s: %v", filepath.Base(file), err)
+		}
+	}
+	initRepository(conn)
+	t.Cleanup(func() {
+		initRepository(nil)
+		conn.Close()
+	})
+	return conn
+}
+
+func insertTestUser(t *testing.T, conn *sql.DB, username string) int {
+	t.Helper()
+	res, err := conn.Exec(`INSERT INTO users (username, email, password) VALUES (?, ?, 'x')`, username, username+"@example.com")
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	return int(id)
+}
+
+func pendingCount(t *testing.T, conn *sql.DB, userID int, hostUUID, spaceUUID string) int {
+	t.Helper()
+	var count int
+	err := conn.QueryRow(`
+SELECT pending_count FROM user_space_message_counters
+WHERE user_id = ? AND host_uuid = ? AND space_uuid = ?`, userID, hostUUID, spaceUUID).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("read pending count: %v", err)
+	}
+	return count
+}
+
+func TestMembershipsAndActivityCounters(t *testing.T) {
+	conn := newTestRepository(t)
+	ana := insertTestUser(t, conn, "ana")
+	ben := insertTestUser(t, conn, "ben")
+	cat := insertTestUser(t, conn, "cat")
+	outsider := insertTestUser(t, conn, "dee")
+
+	for _, m := range []struct {
+		userID int
+		key    string
+	}{{ana, "key-ana"}, {ben, "key-ben"}, {cat, "key-cat"}} {
+		if err := repoUpsertMembership(m.userID, "host-1", "space-1", m.key); err != nil {
+			t.Fatalf("join user %d: %v", m.userID, err)
+		}
+	}
+	// A member key already enrolled by one account cannot enrol another.
+	if err := repoUpsertMembership(outsider, "host-1", "space-1", "key-ana"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected a claimed key to be refused, got %v", err)
+	}
+	if err := repoDeactivateMembership(cat, "host-1", "space-1"); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	if err := repoDeactivateMembership(outsider, "host-1", "space-1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected leaving an unjoined space to be not found, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		userID int
+		key    string
+	}{
+		{"not a member", outsider, "key-dee"},
+		{"left the space", cat, "key-cat"},
+		{"another member's key", ana, "key-ben"},
+	} {
+		if _, err := repoIncrementSpaceCounters(tc.userID, "host-1", "space-1", tc.key); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("%s: expected forbidden, got %v", tc.name, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		notified, err := repoIncrementSpaceCounters(ana, "host-1", "space-1", "key-ana")
+		if err != nil {
+			t.Fatalf("record activity: %v", err)
+		}
+		if notified != 1 {
+			t.Fatalf("expected only ben notified, got %d", notified)
+		}
+	}
+	if got := pendingCount(t, conn, ben, "host-1", "space-1"); got != 2 {
+		t.Fatalf("expected ben to have 2 pending, got %d", got)
+	}
+	if got := pendingCount(t, conn, ana, "host-1", "space-1") + pendingCount(t, conn, cat, "host-1", "space-1"); got != 0 {
+		t.Fatalf("expected no pending for the sender or a former member, got %d", got)
+	}
+
+	// Opening the space again counts as reading it.
+	if err := repoUpsertMembership(ben, "host-1", "space-1", "key-ben"); err != nil {
+		t.Fatalf("rejoin: %v", err)
+	}
+	if got := pendingCount(t, conn, ben, "host-1", "space-1"); got != 0 {
+		t.Fatalf("expected rejoining to clear pending, got %d", got)
+	}
+}
+
+func TestPreferencesAndUnsubscribeToken(t *testing.T) {
+	conn := newTestRepository(t)
+	ana := insertTestUser(t, conn, "ana")
+
+	prefs, err := GetPreferences(ana)
+	if err != nil {
+		t.Fatalf("get preferences: %v", err)
+	}
+	if !prefs.ActivityEmails || !prefs.WeeklyEmails || prefs.UnsubscribedAll {
+		t.Fatalf("unexpected default preferences: %+v", prefs)
+	}
+	off := false
+	if prefs, err = UpdatePreferences(ana, UpdatePreferencesRequest{WeeklyEmails: &off}); err != nil || prefs.WeeklyEmails || !prefs.ActivityEmails {
+		t.Fatalf("unexpected preferences after update: %+v, %v", prefs, err)
+	}
+
+	var token string
+	if err := conn.QueryRow(`SELECT unsubscribe_token FROM email_preferences WHERE user_id = ?`, ana).Scan(&token); err != nil {
+		t.Fatalf("read token: %v", err)
+	}
+	if err := CheckUnsubscribeToken(token); err != nil {
+		t.Fatalf("check token: %v", err)
+	}
+	if err := CheckUnsubscribeToken("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected an unknown token to be not found, got %v", err)
+	}
+	if err := Unsubscribe(" "); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected a blank token to be invalid, got %v", err)
+	}
+	if err := Unsubscribe(token); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+	if prefs, _ = GetPreferences(ana); !prefs.UnsubscribedAll {
+		t.Fatalf("expected unsubscribed_all after unsubscribe: %+v", prefs)
+	}
+}
@@ -0,0 +1,121 @@
+package notifications
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidInput = errors.New("invalid input")
+
+const maxIdentifierLength = 128
+
+func GetPreferences(userID int) (Preferences, error) {
+	return repoGetPreferences(userID)
+}
+
+func UpdatePreferences(userID int, req UpdatePreferencesRequest) (Preferences, error) {
+	current, err := repoGetPreferences(userID)
+	if err != nil {
+		return Preferences{}, err
+	}
+
+	if req.InviteEmails != nil {
+		current.InviteEmails = *req.InviteEmails
+	}
+	if req.ActivityEmails != nil {
+		current.ActivityEmails = *req.ActivityEmails
+	}
+	if req.WeeklyEmails != nil {
+		current.WeeklyEmails = *req.WeeklyEmails
+	}
+	if req.UnsubscribedAll != nil {
+		current.UnsubscribedAll = *req.UnsubscribedAll
+	}
+
+	return repoUpdatePreferences(userID, current)
+}
+
+// CheckUnsubscribeToken reports whether token belongs to an account, without
+// changing anything.
+func CheckUnsubscribeToken(token string) error {
+	token, err := normalizeUnsubscribeToken(token)
+	if err != nil {
+		return err
+	}
+	return repoFindUnsubscribeToken(token)
+}
+
+func Unsubscribe(token string) error {
+	token, err := normalizeUnsubscribeToken(token)
+	if err != nil {
+		return err
+	}
+	return repoUnsubscribeByToken(token)
+}
+
+func normalizeUnsubscribeToken(token string) (string, error) {
+	token = strings.TrimSpace(token)
+	if token == "" || len(token) > maxIdentifierLength {
+		return "", wrapInvalid("token is required")
+	}
+	return token, nil
+}
+
+// JoinSpace records membership once the caller proves it with a capability
+// token. The token's member key is stored with the membership, so one key
+// cannot sign several accounts up to the same space.
+func JoinSpace(userID int, req MembershipRequest) error {
+	hostUUID, spaceUUID, err := normalizeSpaceRef(req.HostUUID, req.SpaceUUID)
+	if err != nil {
+		return err
+	}
+	subjectKey, err := verifyMembership(hostUUID, spaceUUID, req.CapabilityToken, scopeReadHistory)
+	if err != nil {
+		return err
+	}
+	return repoUpsertMembership(userID, hostUUID, spaceUUID, subjectKey)
+}
+
+func LeaveSpace(userID int, req MembershipRequest) error {
+	hostUUID, spaceUUID, err := normalizeSpaceRef(req.HostUUID, req.SpaceUUID)
+	if err != nil {
+		return err
+	}
+	return repoDeactivateMembership(userID, hostUUID, spaceUUID)
+}
+
+// RecordActivity bumps the pending counter of every other active member of the
+// space. The sender must be an active member holding a send_message token
+// for the key it joined with, so counters cannot be spammed into spaces the
+// caller does not belong to.
+func RecordActivity(senderUserID int, req ActivityRequest) (int, error) {
+	hostUUID, spaceUUID, err := normalizeSpaceRef(req.HostUUID, req.SpaceUUID)
+	if err != nil {
+		return 0, err
+	}
+	subjectKey, err := verifyMembership(hostUUID, spaceUUID, req.CapabilityToken, scopeSendMessage)
+	if err != nil {
+		return 0, err
+	}
+	return repoIncrementSpaceCounters(senderUserID, hostUUID, spaceUUID, subjectKey)
+}
+
+func normalizeSpaceRef(hostUUID, spaceUUID string) (string, string, error) {
+	hostUUID = strings.TrimSpace(hostUUID)
+	spaceUUID = strings.TrimSpace(spaceUUID)
+	if hostUUID == "" {
+		return "", "", wrapInvalid("host_uuid is required")
+	}
+	if spaceUUID == "" {
+		return "", "", wrapInvalid("space_uuid is required")
+	}
+	if len(hostUUID) > maxIdentifierLength || len(spaceUUID) > maxIdentifierLength {
+		return "", "", wrapInvalid("identifier is too long")
+	}
+	return hostUUID, spaceUUID, nil
+}
+
+func wrapInvalid(message string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidInput, message)
+}
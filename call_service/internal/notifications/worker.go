@@ -0,0 +1,177 @@
+package notifications
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWorkerInterval   = 5 * time.Minute
+	defaultActivityThrottle = 6 * time.Hour
+	weeklyDigestInterval    = 7 * 24 * time.Hour
+	digestBatchSize         = 200
+)
+
+// Mailer delivers a plain-text email. main.go wires this to SendEmail.
+type Mailer func(recipient, subject, body string) error
+
+type WorkerConfig struct {
+	Interval         time.Duration
+	ActivityThrottle time.Duration
+	PublicBaseURL    string
+	Send             Mailer
+}
+
+// WorkerConfigFromEnv reads NOTIFICATION_WORKER_INTERVAL and
+// NOTIFICATION_ACTIVITY_THROTTLE (Go durations) and PUBLIC_BASE_URL.
+func WorkerConfigFromEnv(send Mailer) WorkerConfig {
+	return WorkerConfig{
+		Interval:         durationFromEnv("NOTIFICATION_WORKER_INTERVAL", defaultWorkerInterval),
+		ActivityThrottle: durationFromEnv("NOTIFICATION_ACTIVITY_THROTTLE", defaultActivityThrottle),
+		PublicBaseURL:    strings.TrimSpace(os.Getenv("PUBLIC_BASE_URL")),
+		Send:             send,
+	}
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s=%q, using %s", key, raw, fallback)
+		return fallback
+	}
+	return d
+}
+
+// StartWorker runs the digest loop until ctx is cancelled.
+func StartWorker(ctx context.Context, db *sql.DB, cfg WorkerConfig) {
+	initRepository(db)
+	if cfg.Send == nil {
+		log.Println("Notification worker disabled: no mailer configured")
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultWorkerInterval
+	}
+	if cfg.ActivityThrottle <= 0 {
+		cfg.ActivityThrottle = defaultActivityThrottle
+	}
+
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				runDigestPass(ctx, cfg)
+			}
+		}
+	}()
+}
+
+func runDigestPass(ctx context.Context, cfg WorkerConfig) {
+	digests, err := repoListDueActivityDigests(cfg.ActivityThrottle, digestBatchSize)
+	if err != nil {
+		log.Printf("Error listing activity digests: %v", err)
+	}
+	for _, d := range digests {
+		if ctx.Err() != nil {
+			return
+		}
+		subject, body := renderActivityDigest(d, cfg.PublicBaseURL)
+		if err := cfg.Send(d.Email, subject, body); err != nil {
+			log.Printf("Error sending activity digest to user %d: %v", d.UserID, err)
+			continue
+		}
+		if err := repoMarkActivityDigestSent(d); err != nil {
+			log.Printf("Error marking activity digest sent for user %d: %v", d.UserID, err)
+		}
+	}
+
+	weekly, err := repoListDueWeeklyDigests(weeklyDigestInterval, digestBatchSize)
+	if err != nil {
+		log.Printf("Error listing weekly digests: %v", err)
+		return
+	}
+	for _, d := range weekly {
+		if ctx.Err() != nil {
+			return
+		}
+		subject, body := renderWeeklyDigest(d, cfg.PublicBaseURL)
+		if err := cfg.Send(d.Email, subject, body); err != nil {
+			log.Printf("Error sending weekly digest to user %d: %v", d.UserID, err)
+			continue
+		}
+		if err := repoMarkWeeklyDigestSent(d.UserID); err != nil {
+			log.Printf("Error marking weekly digest sent for user %d: %v", d.UserID, err)
+		}
+	}
+}
+
+func renderActivityDigest(d activityDigest, baseURL string) (string, string) {
+	noun := "messages"
+	if d.PendingCount == 1 {
+		noun = "message"
+	}
+	subject := fmt.Sprintf("%d new %s on Parch", d.PendingCount, noun)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\n", d.Username)
+	fmt.Fprintf(&b, "There are %d new %s in space %s on host %s since your last visit.\n\n", d.PendingCount, noun, d.SpaceUUID, d.HostUUID)
+	if link := buildPublicURL(baseURL, "/", nil); link != "" {
+		fmt.Fprintf(&b, "Open Parch to catch up: %s\n\n", link)
+	}
+	writeUnsubscribeFooter(&b, baseURL, d.UnsubscribeToken)
+	return subject, b.String()
+}
+
+func renderWeeklyDigest(d weeklyDigest, baseURL string) (string, string) {
+	subject := "Your weekly Parch summary"
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\n", d.Username)
+	b.WriteString("Spaces with activity this week:\n")
+	for _, s := range d.Spaces {
+		fmt.Fprintf(&b, "- space %s on host %s (last message %s UTC)\n", s.SpaceUUID, s.HostUUID, s.LastMessageAt)
+	}
+	b.WriteString("\n")
+	if link := buildPublicURL(baseURL, "/", nil); link != "" {
+		fmt.Fprintf(&b, "Open Parch to catch up: %s\n\n", link)
+	}
+	writeUnsubscribeFooter(&b, baseURL, d.UnsubscribeToken)
+	return subject, b.String()
+}
+
+func writeUnsubscribeFooter(b *strings.Builder, baseURL, token string) {
+	link := buildPublicURL(baseURL, "/call/unsubscribe", url.Values{"token": {token}})
+	if link == "" {
+		b.WriteString("You can change your email preferences from your account page.\n")
+		return
+	}
+	fmt.Fprintf(b, "Unsubscribe from all Parch emails: %s\n", link)
+}
+
+func buildPublicURL(base, path string, query url.Values) string {
+	if base == "" {
+		return ""
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	u.Path = path
+	u.RawQuery = query.Encode()
+	return u.String()
+}
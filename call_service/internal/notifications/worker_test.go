@@ -0,0 +1,155 @@
+package notifications
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sentMail struct {
+	recipient string
+	subject   string
+	body      string
+}
+
+type recordingMailer struct {
+	sent []sentMail
+}
+
+func (m *recordingMailer) send(recipient, subject, body string) error {
+	m.sent = append(m.sent, sentMail{recipient: recipient, subject: subject, body: body})
+	return nil
+}
+
+func (m *recordingMailer) take() []sentMail {
+	sent := m.sent
+	m.sent = nil
+	sort.Slice(sent, func(i, j int) bool {
+		if sent[i].recipient != sent[j].recipient {
+			return sent[i].recipient < sent[j].recipient
+		}
+		return sent[i].subject < sent[j].subject
+	})
+	return sent
+}
+
+func mustExec(t *testing.T, conn *sql.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := conn.Exec(query, args...); err != nil {
+		t.Fatalf("exec %q: %v", query, err)
+	}
+}
+
+func TestDigestPassHonoursPreferencesAndThrottle(t *testing.T) {
+	conn := newTestRepository(t)
+	users := map[string]int{}
+	for _, name := range []string{"ana", "ben", "cat", "dee", "eve"} {
+		users[name] = insertTestUser(t, conn, name)
+		if err := repoUpsertMembership(users[name], "host-1", "space-1", "key-"+name); err != nil {
+			t.Fatalf("join %s: %v", name, err)
+		}
+	}
+	mustExec(t, conn, `UPDATE email_preferences SET activity_emails = 0 WHERE user_id = ?`, users["cat"])
+	mustExec(t, conn, `UPDATE email_preferences SET unsubscribed_all = 1 WHERE user_id = ?`, users["dee"])
+	// Weekly digests only go to accounts at least a week old.
+	mustExec(t, conn, `UPDATE email_preferences SET created_at = datetime('now', '-8 days')`)
+
+	for i := 0; i < 3; i++ {
+		if _, err := repoIncrementSpaceCounters(users["ana"], "host-1", "space-1", "key-ana"); err != nil {
+			t.Fatalf("record activity: %v", err)
+		}
+	}
+	if err := repoDeactivateMembership(users["eve"], "host-1", "space-1"); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+
+	mailer := &recordingMailer{}
+	cfg := WorkerConfig{ActivityThrottle: 6 * time.Hour, PublicBaseURL: "https://parch.example", Send: mailer.send}
+	runDigestPass(context.Background(), cfg)
+
+	sent := mailer.take()
+	want := []sentMail{
+		{recipient: "ben@example.com", subject: "3 new messages on Parch"},
+		{recipient: "ben@example.com", subject: "Your weekly Parch summary"},
+		{recipient: "cat@example.com", subject: "Your weekly Parch summary"},
+	}
+	if len(sent) != len(want) {
+		t.Fatalf("expected %d emails, got %+v", len(want), sent)
+	}
+	for i := range want {
+		if sent[i].recipient != want[i].recipient || sent[i].subject != want[i].subject {
+			t.Fatalf("email %d: expected %+v, got %+v", i, want[i], sent[i])
+		}
+	}
+	var benToken string
+	if err := conn.QueryRow(`SELECT unsubscribe_token FROM email_preferences WHERE user_id = ?`, users["ben"]).Scan(&benToken); err != nil {
+		t.Fatalf("read token: %v", err)
+	}
+	if !strings.Contains(sent[0].body, "https://parch.example/call/unsubscribe?token="+benToken) {
+		t.Fatalf("expected ben's unsubscribe link in the digest, got:\n%s", sent[0].body)
+	}
+
+	// Activity inside the throttle window waits; the weekly digest is not due
+	// again for a week.
+	if _, err := repoIncrementSpaceCounters(users["ana"], "host-1", "space-1", "key-ana"); err != nil {
+		t.Fatalf("record activity: %v", err)
+	}
+	runDigestPass(context.Background(), cfg)
+	if sent := mailer.take(); len(sent) != 0 {
+		t.Fatalf("expected no email inside the throttle window, got %+v", sent)
+	}
+
+	mustExec(t, conn, `UPDATE user_space_message_counters SET last_emailed_at = datetime('now', '-7 hours')`)
+	runDigestPass(context.Background(), cfg)
+	sent = mailer.take()
+	if len(sent) != 1 || sent[0].recipient != "ben@example.com" || sent[0].subject != "1 new message on Parch" {
+		t.Fatalf("expected one digest for the new message, got %+v", sent)
+	}
+}
+
+// A user with nothing to report is never marked sent, so the weekly batch
+// must not be filled with such users ahead of one that has activity.
+func TestWeeklyDigestBatchSkipsQuietUsers(t *testing.T) {
+	conn := newTestRepository(t)
+	quiet := insertTestUser(t, conn, "quiet")
+	sender := insertTestUser(t, conn, "sender")
+	reader := insertTestUser(t, conn, "reader")
+	for userID, key := range map[int]string{quiet: "key-quiet", sender: "key-sender", reader: "key-reader"} {
+		if err := repoUpsertMembership(userID, "host-1", "space-1", key); err != nil {
+			t.Fatalf("join: %v", err)
+		}
+	}
+	if err := repoUpsertMembership(reader, "host-1", "space-2", "key-reader-2"); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	mustExec(t, conn, `UPDATE email_preferences SET created_at = datetime('now', '-8 days')`)
+	mustExec(t, conn, `UPDATE email_preferences SET created_at = datetime('now', '-30 days') WHERE user_id = ?`, quiet)
+	mustExec(t, conn, `DELETE FROM user_space_memberships WHERE user_id = ?`, quiet)
+
+	if _, err := repoIncrementSpaceCounters(sender, "host-1", "space-1", "key-sender"); err != nil {
+		t.Fatalf("record activity: %v", err)
+	}
+	if err := repoUpsertMembership(sender, "host-1", "space-2", "key-sender-2"); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	if _, err := repoIncrementSpaceCounters(sender, "host-1", "space-2", "key-sender-2"); err != nil {
+		t.Fatalf("record activity: %v", err)
+	}
+
+	digests, err := repoListDueWeeklyDigests(weeklyDigestInterval, 1)
+	if err != nil {
+		t.Fatalf("list weekly digests: %v", err)
+	}
+	if len(digests) != 1 || digests[0].UserID != reader || len(digests[0].Spaces) != 2 {
+		t.Fatalf("expected one digest for the reader covering both spaces, got %+v", digests)
+	}
+	if err := repoMarkWeeklyDigestSent(reader); err != nil {
+		t.Fatalf("mark sent: %v", err)
+	}
+	if digests, err = repoListDueWeeklyDigests(weeklyDigestInterval, 1); err != nil || len(digests) != 0 {
+		t.Fatalf("expected nothing due after sending, got %+v, %v", digests, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"embed"
 	"gochat/call_service/internal/gm"
+	"gochat/call_service/internal/notifications"
 	"gochat/db"
 	"log"
 	"net/http"
@@ -95,7 +96,7 @@ func main() {
 
 	// Init DB
 	var err error
-	db.HostDB, err = db.InitDB(dbName, MigrationFiles, "relay-migrations")
+	db.HostDB, err = db.InitDB(dbName, MigrationFiles, "relay-migrations", nil)
 	if err != nil {
 		log.Fatal("Error opening database:", err)
 	}
@@ -142,6 +143,8 @@ func main() {
 	r.POST("/call/create-portal-session", HandleCreatePortalSession)
 	// GM marketplace endpoints
 	gm.RegisterRoutes(r, db.HostDB)
+	// Chat activity notification endpoints
+	notifications.RegisterRoutes(r, db.HostDB)
 	// Internal SFU auth endpoints (used by Caddy forward_auth)
 	r.GET("/internal/validate-sfu-token", HandleValidateSFUToken)
 	r.GET("/internal/validate-ip", HandleValidateIP)
@@ -175,6 +178,11 @@ func main() {
 	r.Static("/call/assets", filepath.Join(staticDir, "call", "assets"))
 	r.Static("/call/static", staticDir)
 
+	// Background chat activity digests
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	defer stopWorker()
+	notifications.StartWorker(workerCtx, db.HostDB, notifications.WorkerConfigFromEnv(SendEmail))
+
 	// Create HTTP server manually so we can shut it down
 	server := &http.Server{
 		Addr:    port,
@@ -194,6 +202,7 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down server...")
+	stopWorker()
 
 	// Gracefully shut down HTTP server
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_user_space_memberships_subject;
+
+ALTER TABLE user_space_memberships DROP COLUMN subject_key;
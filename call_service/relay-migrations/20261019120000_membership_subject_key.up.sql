@@ -0,0 +1,8 @@
+-- The member key from the capability token that proved the membership.
+-- Rows from before proofs were required have none and must rejoin.
+ALTER TABLE user_space_memberships ADD COLUMN subject_key TEXT NOT NULL DEFAULT '';
+
+UPDATE user_space_memberships SET is_active = 0;
+
+CREATE INDEX IF NOT EXISTS idx_user_space_memberships_subject
+ON user_space_memberships (host_uuid, space_uuid, subject_key);
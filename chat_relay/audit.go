@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// handleGetAuditLog pages through a space's audit log. Only the space author
+// holds the remove_space_user scope, and the host checks authorship again.
+func handleGetAuditLog(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[GetAuditLogClient](wsMsg.Data)
+	if err != nil || data.BeforeID < 0 {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid audit log data"}})
+		return
+	}
+	if !requireSpaceCapability(client, data.SpaceUUID, "", data.CapabilityToken, scopeRemoveSpaceUser, "Unauthorized space access") {
+		return
+	}
+
+	SendToAuthor(client, WSMessage{
+		Type: "get_audit_log_request",
+		Data: GetAuditLogRequest{
+			SpaceUUID:                 data.SpaceUUID,
+			BeforeID:                  data.BeforeID,
+			RequesterUserID:           client.UserID,
+			RequesterUserPublicKey:    client.PublicKey,
+			RequesterUserEncPublicKey: client.EncPublicKey,
+			ClientUUID:                client.ClientUUID,
+		},
+	})
+}
+
+func handleGetAuditLogRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[GetAuditLogResponse](wsMsg.Data)
+	if err != nil {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid audit log response data"}})
+		return
+	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
+	entries := data.Entries
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+
+	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
+		Type: "get_audit_log_success",
+		Data: GetAuditLogSuccess{SpaceUUID: data.SpaceUUID, Entries: entries, HasMore: data.HasMore},
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayIntegrationGetAuditLog(t *testing.T) {
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "judy")
+
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "get_audit_log",
+		Data: GetAuditLogClient{SpaceUUID: member.spaceUUID, CapabilityToken: member.token},
+	})
+	mustReadUnauthorizedError(t, member.conn)
+
+	adminToken := env.mustIssueCapabilityToken(t, member.auth.PublicKey, member.spaceUUID, []string{scopeRemoveSpaceUser}, 5*time.Minute)
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "get_audit_log",
+		Data: GetAuditLogClient{SpaceUUID: member.spaceUUID, BeforeID: 40, CapabilityToken: adminToken},
+	})
+	requestMsg := author.mustNextType("get_audit_log_request")
+	request, err := decodeData[GetAuditLogRequest](requestMsg.Data)
+	if err != nil || request.BeforeID != 40 || request.RequesterUserPublicKey != member.auth.PublicKey || request.ClientUUID == "" {
+		t.Fatalf("unexpected get_audit_log_request: %v %+v", err, request)
+	}
+
+	author.mustSend(WSMessage{
+		Type: "get_audit_log_response",
+		Data: GetAuditLogResponse{
+			SpaceUUID: member.spaceUUID,
+			Entries: []AuditEntry{{
+				ID:        39,
+				SpaceUUID: member.spaceUUID,
+				Action:    "create_channel",
+				Details:   map[string]string{"name": "general"},
+				PrevHash:  "aa",
+				Hash:      "bb",
+				Signature: "sig",
+			}},
+			HasMore:    true,
+			ClientUUID: request.ClientUUID,
+		},
+	})
+	logMsg := mustReadType(t, member.conn, "get_audit_log_success", testReadTimeout)
+	page, err := decodeData[GetAuditLogSuccess](logMsg.Data)
+	if err != nil || !page.HasMore || len(page.Entries) != 1 || page.Entries[0].Hash != "bb" || page.Entries[0].Details["name"] != "general" {
+		t.Fatalf("unexpected get_audit_log_success: %v %+v", err, page)
+	}
+}
@@ -88,15 +88,25 @@ func handleAuthPubKey(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
-	userID := deriveSessionUserID(data.PublicKey)
-	username := normalizeUsername(data.Username, data.PublicKey)
-	deviceID := strings.TrimSpace(data.DeviceID)
-	if deviceID == "" {
-		deviceID = "unknown-" + client.ClientUUID
+	// A device key fixes the device ID. Without one the session names its
+	// own, which is only trusted until the identity registers a device key.
+	deviceID, err := verifyDeviceCredential(client.HostUUID, ed25519.PublicKey(publicKeyBytes), data)
+	if err != nil {
+		safeSend(client, conn, WSMessage{Type: "authentication-error", Data: ChatError{Content: "Invalid device credential: " + err.Error()}})
+		return
 	}
-	if len(deviceID) > 128 {
-		deviceID = deviceID[:128]
+	if deviceID == "" {
+		deviceID = strings.TrimSpace(data.DeviceID)
+		if deviceID == "" || isKeyedDeviceID(deviceID) {
+			deviceID = "unknown-" + client.ClientUUID
+		}
+		if len(deviceID) > 128 {
+			deviceID = deviceID[:128]
+		}
 	}
+
+	userID := deriveSessionUserID(data.PublicKey)
+	username := normalizeUsername(data.Username, data.PublicKey)
 	deviceName := strings.TrimSpace(data.DeviceName)
 	if deviceName == "" {
 		deviceName = "Unknown Device"
@@ -111,7 +121,24 @@ func handleAuthPubKey(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
+	quota := nodeQuota(currentHostQuota(host))
 	host.mu.Lock()
+	if isDeviceRevokedLocked(host, data.PublicKey, deviceID) {
+		host.mu.Unlock()
+		safeSend(client, conn, WSMessage{Type: "authentication-error", Data: ChatError{Content: "This device has been revoked"}})
+		return
+	}
+	if requiresDeviceKeyLocked(host, data.PublicKey, deviceID) {
+		host.mu.Unlock()
+		safeSend(client, conn, WSMessage{Type: "authentication-error", Data: ChatError{Content: "This identity requires a registered device key"}})
+		return
+	}
+	if exceeded := admitSessionLocked(host, quota, client, data.PublicKey); exceeded != nil {
+		host.mu.Unlock()
+		safeSend(client, conn, WSMessage{Type: "join_error", Data: exceeded})
+		noteQuotaRejection(host)
+		return
+	}
 	client.UserID = userID
 	client.Username = username
 	client.PublicKey = data.PublicKey
@@ -169,6 +196,7 @@ func handleUpdateUsernameRes(client *Client, conn *websocket.Conn, wsMsg *WSMess
 		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid update username response"}})
 		return
 	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
 
 	host, exists := GetHost(client.HostUUID)
 	if exists {
@@ -63,6 +63,9 @@ func validateEnvelopeForRelay(envelope map[string]interface{}) error {
 	if len(raw) > maxEnvelopePayloadBytes {
 		return fmt.Errorf("encrypted envelope exceeds %d bytes", maxEnvelopePayloadBytes)
 	}
+	if kind, epoch, ok := senderKeyEnvelope(envelope); ok {
+		return validateSenderKeyEnvelope(envelope, kind, epoch)
+	}
 	if wrappedRaw, ok := envelope["wrapped_keys"]; ok {
 		wrappedKeys, ok := wrappedRaw.([]interface{})
 		if !ok {
@@ -74,3 +77,33 @@ func validateEnvelopeForRelay(envelope map[string]interface{}) error {
 	}
 	return nil
 }
+
+func validateSenderKeyEnvelope(envelope map[string]interface{}, kind string, epoch int64) error {
+	if epoch <= 0 {
+		return fmt.Errorf("invalid sender key epoch")
+	}
+	_, hasWrapped := envelope["wrapped_keys"]
+	switch kind {
+	case envelopeKindSenderKey:
+		wrappedKeys, ok := envelope["wrapped_keys"].([]interface{})
+		if !ok {
+			return fmt.Errorf("invalid wrapped_keys format")
+		}
+		if len(wrappedKeys) == 0 || len(wrappedKeys) > maxEnvelopeWrappedKeys {
+			return fmt.Errorf("invalid wrapped_keys count")
+		}
+		if _, hasCiphertext := envelope["ciphertext"]; hasCiphertext {
+			return fmt.Errorf("sender key envelopes carry no message content")
+		}
+	case envelopeKindMessage:
+		if hasWrapped {
+			return fmt.Errorf("sender key messages carry no wrapped_keys")
+		}
+		if stringValue(envelope["ciphertext"]) == "" || stringValue(envelope["content_iv"]) == "" {
+			return fmt.Errorf("missing message ciphertext")
+		}
+	default:
+		return fmt.Errorf("unknown sender key envelope kind")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import "testing"
+
+func TestRelayIntegrationChatSaveAcknowledgements(t *testing.T) {
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "grace")
+
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "chat",
+		Data: ChatData{
+			Envelope:        map[string]interface{}{"message_id": "m-1", "ciphertext": "ok"},
+			CapabilityToken: member.token,
+		},
+	})
+	saveMsg := author.mustNextType("save_chat_message_request")
+	save, err := decodeData[SaveChatMessageRequest](saveMsg.Data)
+	if err != nil {
+		t.Fatalf("decode save_chat_message_request: %v", err)
+	}
+	if save.ClientUUID == "" {
+		t.Fatalf("expected the sender's client uuid in save_chat_message_request")
+	}
+
+	author.mustSend(WSMessage{
+		Type: "save_chat_message_response",
+		Data: SaveChatMessageResponse{
+			MessageID:   "m-1",
+			ChannelUUID: member.channelUUID,
+			ID:          42,
+			Timestamp:   "2026-10-18T09:00:00Z",
+			ClientUUID:  save.ClientUUID,
+		},
+	})
+	savedMsg := mustReadType(t, member.conn, "chat_saved", testReadTimeout)
+	saved, err := decodeData[ChatSaved](savedMsg.Data)
+	if err != nil {
+		t.Fatalf("decode chat_saved: %v", err)
+	}
+	if saved.MessageID != "m-1" || saved.ID != 42 || saved.Timestamp != "2026-10-18T09:00:00Z" || saved.ChannelUUID != member.channelUUID {
+		t.Fatalf("unexpected chat_saved: %+v", saved)
+	}
+
+	author.mustSend(WSMessage{
+		Type: "save_chat_message_response",
+		Data: SaveChatMessageResponse{
+			MessageID:   "m-2",
+			ChannelUUID: member.channelUUID,
+			Error:       "Duplicate message",
+			ClientUUID:  save.ClientUUID,
+		},
+	})
+	failedMsg := mustReadType(t, member.conn, "chat_save_failed", testReadTimeout)
+	failed, err := decodeData[ChatSaveFailed](failedMsg.Data)
+	if err != nil {
+		t.Fatalf("decode chat_save_failed: %v", err)
+	}
+	if failed.MessageID != "m-2" || failed.Error != "Duplicate message" {
+		t.Fatalf("unexpected chat_save_failed: %+v", failed)
+	}
+}
+
+func TestRelayIntegrationStrictDeliveryBroadcastsAfterSave(t *testing.T) {
+	strictChatDelivery = true
+	t.Cleanup(func() { strictChatDelivery = false })
+
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "heidi")
+
+	envelope := map[string]interface{}{"message_id": "m-strict", "ciphertext": "ok"}
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "chat",
+		Data: ChatData{Envelope: envelope, CapabilityToken: member.token},
+	})
+	saveMsg := author.mustNextType("save_chat_message_request")
+	save, err := decodeData[SaveChatMessageRequest](saveMsg.Data)
+	if err != nil {
+		t.Fatalf("decode save_chat_message_request: %v", err)
+	}
+	if !save.Strict {
+		t.Fatalf("expected a strict save request")
+	}
+
+	author.mustSend(WSMessage{
+		Type: "save_chat_message_response",
+		Data: SaveChatMessageResponse{
+			MessageID:   "m-strict",
+			ChannelUUID: member.channelUUID,
+			ID:          9,
+			Seq:         7,
+			Timestamp:   "2026-10-18T09:00:00Z",
+			Envelope:    save.Envelope,
+			ClientUUID:  save.ClientUUID,
+		},
+	})
+	// The first chat the sender sees must be the host-sequenced one; an
+	// early broadcast would arrive first without a seq.
+	chatMsg := mustReadType(t, member.conn, "chat", testReadTimeout)
+	chat, err := decodeData[ChatPayload](chatMsg.Data)
+	if err != nil {
+		t.Fatalf("decode chat: %v", err)
+	}
+	if chat.Seq != 7 || chat.Envelope["message_id"] != "m-strict" {
+		t.Fatalf("unexpected strict broadcast: %+v", chat)
+	}
+	savedMsg := mustReadType(t, member.conn, "chat_saved", testReadTimeout)
+	if saved, _ := decodeData[ChatSaved](savedMsg.Data); saved.Seq != 7 {
+		t.Fatalf("expected seq 7 in chat_saved, got %+v", saved)
+	}
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster mode lets several relay nodes serve the same hosts. Each node keeps
+// its own connections in Hosts and learns from the others, over a pub/sub
+// bus, which node holds each host author and each client connection. Traffic
+// for a connection on another node is forwarded there; broadcasts go to every
+// node and each one delivers to its own members.
+
+const (
+	clusterSubjectPrefix = "parch.relay."
+	clusterSubjectAll    = clusterSubjectPrefix + "all"
+
+	// Every node republishes its routes on this interval so lost
+	// announcements heal, and forgets nodes that stay silent for longer than
+	// clusterNodeTimeout.
+	clusterStateInterval = 15 * time.Second
+	clusterNodeTimeout   = 3 * clusterStateInterval
+)
+
+const (
+	clusterHello               = "hello"
+	clusterState               = "state"
+	clusterNodeDown            = "node_down"
+	clusterAuthorOnline        = "author_online"
+	clusterAuthorOffline       = "author_offline"
+	clusterClientOnline        = "client_online"
+	clusterClientOffline       = "client_offline"
+	clusterToAuthor            = "to_author"
+	clusterToClient            = "to_client"
+	clusterToUser              = "to_user"
+	clusterBroadcastChannel    = "broadcast_channel"
+	clusterBroadcastSpace      = "broadcast_space"
+	clusterAuthorResponse      = "author_response"
+	clusterHealthAck           = "health_ack"
+	clusterChannelMapped       = "channel_mapped"
+	clusterChannelRemoved      = "channel_removed"
+	clusterSpaceRemoved        = "space_removed"
+	clusterSpaceUserRemoved    = "space_user_removed"
+	clusterReissueCapabilities = "reissue_capabilities"
+	clusterHostKeyRotated      = "host_key_rotated"
+	clusterHostPurged          = "host_purged"
+	clusterDeviceDenyList      = "device_deny_list"
+	clusterSenderKeysStale     = "sender_keys_stale"
+
+	// clusterAuthorRequestIDs is the author_online value for an author
+	// that echoes request_id.
+	clusterAuthorRequestIDs = "request_ids"
+)
+
+// clusterBus is the transport between relay nodes. Delivery is at most once
+// and in order per subject.
+type clusterBus interface {
+	Publish(subject string, payload []byte) error
+	// Subscribe calls handle for every message published on subject until
+	// the bus is closed.
+	Subscribe(subject string, handle func(payload []byte)) error
+	Close() error
+}
+
+// clusterStore is state every node must agree on, kept next to the bus.
+// redisBus provides it; a node whose bus does not keeps that state locally.
+type clusterStore interface {
+	// ClaimOnce reports whether key was unclaimed, and claims it for ttl.
+	ClaimOnce(key string, ttl time.Duration) (bool, error)
+	// Increment adds one to the counter at key, which expires ttl after
+	// the last increment, and returns the new count.
+	Increment(key string, ttl time.Duration) (int64, error)
+}
+
+type clusterMessage struct {
+	Kind       string     `json:"kind"`
+	Node       string     `json:"node"`
+	HostUUID   string     `json:"host_uuid,omitempty"`
+	ClientUUID string     `json:"client_uuid,omitempty"`
+	Target     string     `json:"target,omitempty"`
+	Value      string     `json:"value,omitempty"`
+	UserID     int        `json:"user_id,omitempty"`
+	Message    *WSMessage `json:"message,omitempty"`
+	Authors    []string   `json:"authors,omitempty"`
+	Clients    []string   `json:"clients,omitempty"`
+}
+
+type clusterNode struct {
+	id  string
+	bus clusterBus
+
+	mu          sync.Mutex
+	authorNodes map[string]string // host UUID -> node holding its author
+	clientNodes map[string]string // client UUID -> node holding the connection
+	lastSeen    map[string]time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// relayCluster is nil when the relay runs on its own; every method below is
+// a no-op on a nil node so call sites need no cluster checks.
+var relayCluster *clusterNode
+
+func clusterNodeSubject(nodeID string) string {
+	return clusterSubjectPrefix + "node." + nodeID
+}
+
+// startCluster joins the bus as nodeID and asks the other nodes for their
+// routes.
+func startCluster(nodeID string, bus clusterBus) (*clusterNode, error) {
+	n := &clusterNode{
+		id:          nodeID,
+		bus:         bus,
+		authorNodes: make(map[string]string),
+		clientNodes: make(map[string]string),
+		lastSeen:    make(map[string]time.Time),
+		stop:        make(chan struct{}),
+	}
+	if err := bus.Subscribe(clusterSubjectAll, n.handle); err != nil {
+		return nil, err
+	}
+	if err := bus.Subscribe(clusterNodeSubject(nodeID), n.handle); err != nil {
+		return nil, err
+	}
+	n.publishAll(clusterMessage{Kind: clusterHello})
+	go n.run()
+	return n, nil
+}
+
+func (n *clusterNode) Close() error {
+	if n == nil {
+		return nil
+	}
+	n.stopOnce.Do(func() { close(n.stop) })
+	n.publishAll(clusterMessage{Kind: clusterNodeDown})
+	return n.bus.Close()
+}
+
+// claimOnce claims key in the cluster store. shared is false when there is
+// no cluster store, and the caller keeps track of the key itself.
+func (n *clusterNode) claimOnce(key string, ttl time.Duration) (claimed bool, shared bool, err error) {
+	if n == nil {
+		return false, false, nil
+	}
+	store, ok := n.bus.(clusterStore)
+	if !ok {
+		return false, false, nil
+	}
+	claimed, err = store.ClaimOnce(clusterSubjectPrefix+key, ttl)
+	return claimed, true, err
+}
+
+// increment counts key in the cluster store. shared is false when there is
+// no cluster store, and the caller counts locally.
+func (n *clusterNode) increment(key string, ttl time.Duration) (count int64, shared bool, err error) {
+	if n == nil {
+		return 0, false, nil
+	}
+	store, ok := n.bus.(clusterStore)
+	if !ok {
+		return 0, false, nil
+	}
+	count, err = store.Increment(clusterSubjectPrefix+key, ttl)
+	return count, true, err
+}
+
+// liveNodes is how many relay nodes, this one included, have been heard from
+// within clusterNodeTimeout.
+func (n *clusterNode) liveNodes() int {
+	if n == nil {
+		return 1
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return 1 + len(n.lastSeen)
+}
+
+func (n *clusterNode) run() {
+	ticker := time.NewTicker(clusterStateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case now := <-ticker.C:
+			n.publishState()
+			n.pruneSilentNodes(now)
+		}
+	}
+}
+
+func (n *clusterNode) publish(subject string, msg clusterMessage) {
+	msg.Node = n.id
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("cluster: encode %s: %v", msg.Kind, err)
+		return
+	}
+	if err := n.bus.Publish(subject, payload); err != nil {
+		log.Printf("cluster: publish %s: %v", msg.Kind, err)
+	}
+}
+
+func (n *clusterNode) publishAll(msg clusterMessage) {
+	n.publish(clusterSubjectAll, msg)
+}
+
+func (n *clusterNode) publishTo(nodeID string, msg clusterMessage) {
+	n.publish(clusterNodeSubject(nodeID), msg)
+}
+
+// publishHostEvent tells every other node about a change to a host's shared
+// state, such as a deleted space.
+func (n *clusterNode) publishHostEvent(msg clusterMessage) {
+	if n == nil {
+		return
+	}
+	n.publishAll(msg)
+}
+
+func (n *clusterNode) publishState() {
+	authors, clients := localRoutes()
+	n.publishAll(clusterMessage{Kind: clusterState, Authors: authors, Clients: clients})
+}
+
+// localRoutes lists the hosts whose author and the clients connected to this
+// node.
+func localRoutes() ([]string, []string) {
+	hostsMu.Lock()
+	hosts := make([]*Host, 0, len(Hosts))
+	for _, host := range Hosts {
+		hosts = append(hosts, host)
+	}
+	hostsMu.Unlock()
+
+	var authors, clients []string
+	for _, host := range hosts {
+		host.mu.Lock()
+		if host.AuthorConn != nil {
+			authors = append(authors, host.UUID)
+		}
+		for clientUUID := range host.ClientConnsByUUID {
+			clients = append(clients, clientUUID)
+		}
+		host.mu.Unlock()
+	}
+	return authors, clients
+}
+
+func (n *clusterNode) announceAuthor(hostUUID string, requestIDs bool) {
+	if n == nil {
+		return
+	}
+	msg := clusterMessage{Kind: clusterAuthorOnline, HostUUID: hostUUID}
+	if requestIDs {
+		msg.Value = clusterAuthorRequestIDs
+	}
+	n.publishAll(msg)
+}
+
+func (n *clusterNode) withdrawAuthor(hostUUID string) {
+	if n == nil {
+		return
+	}
+	n.publishAll(clusterMessage{Kind: clusterAuthorOffline, HostUUID: hostUUID})
+}
+
+func (n *clusterNode) announceClient(clientUUID string) {
+	if n == nil {
+		return
+	}
+	n.publishAll(clusterMessage{Kind: clusterClientOnline, ClientUUID: clientUUID})
+}
+
+func (n *clusterNode) withdrawClient(clientUUID string) {
+	if n == nil {
+		return
+	}
+	n.publishAll(clusterMessage{Kind: clusterClientOffline, ClientUUID: clientUUID})
+}
+
+func (n *clusterNode) authorNode(hostUUID string) (string, bool) {
+	if n == nil {
+		return "", false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	nodeID, ok := n.authorNodes[hostUUID]
+	return nodeID, ok
+}
+
+func (n *clusterNode) clientNode(clientUUID string) (string, bool) {
+	if n == nil || clientUUID == "" {
+		return "", false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	nodeID, ok := n.clientNodes[clientUUID]
+	return nodeID, ok
+}
+
+// forwardToAuthor sends msg to the host author on another node. clientUUID is
+// the requesting client, told about the failure if that author is gone.
+func (n *clusterNode) forwardToAuthor(hostUUID, clientUUID string, msg WSMessage) bool {
+	nodeID, ok := n.authorNode(hostUUID)
+	if !ok {
+		return false
+	}
+	n.publishTo(nodeID, clusterMessage{Kind: clusterToAuthor, HostUUID: hostUUID, ClientUUID: clientUUID, Message: &msg})
+	return true
+}
+
+func (n *clusterNode) forwardToClient(hostUUID, clientUUID string, msg WSMessage) bool {
+	nodeID, ok := n.clientNode(clientUUID)
+	if !ok {
+		return false
+	}
+	n.publishTo(nodeID, clusterMessage{Kind: clusterToClient, HostUUID: hostUUID, ClientUUID: clientUUID, Message: &msg})
+	return true
+}
+
+// forwardToUser asks every node to deliver msg to the user's connection;
+// users are found by identity, so there is no single node to address.
+func (n *clusterNode) forwardToUser(hostUUID string, userID int, publicKey string, msg WSMessage) {
+	if n == nil {
+		return
+	}
+	n.publishAll(clusterMessage{Kind: clusterToUser, HostUUID: hostUUID, UserID: userID, Value: publicKey, Message: &msg})
+}
+
+func (n *clusterNode) forwardBroadcast(kind, hostUUID, target string, msg WSMessage) {
+	if n == nil {
+		return
+	}
+	n.publishAll(clusterMessage{Kind: kind, HostUUID: hostUUID, Target: target, Message: &msg})
+}
+
+// forwardAuthorResponse hands a response from a local host author to the node
+// holding the client it answers. Response handlers update that client's
+// routing state, so they have to run where its connection lives.
+func (n *clusterNode) forwardAuthorResponse(hostUUID string, wsMsg WSMessage) bool {
+	if n == nil || !isAuthorPassthroughType(wsMsg.Type) {
+		return false
+	}
+	switch wsMsg.Type {
+	case "relay_health_check_ack", "reissue_capabilities", "device_deny_list":
+		return false
+	case "error":
+		// An error answering a request is forwarded too, so the node that
+		// tracks the request sees it answered.
+		if wsMsg.RequestID == "" {
+			return false
+		}
+	}
+	clientUUID := authorResponseClientUUID(wsMsg.Data)
+	if wsMsg.RequestID != "" {
+		entry, ok := hostRequests.answer(hostUUID, wsMsg.RequestID)
+		if !ok {
+			return false
+		}
+		clientUUID = entry.clientUUID
+	}
+	if clientUUID == "" || hostHasLocalClient(hostUUID, clientUUID) {
+		return false
+	}
+	nodeID, ok := n.clientNode(clientUUID)
+	if !ok {
+		return false
+	}
+	n.publishTo(nodeID, clusterMessage{Kind: clusterAuthorResponse, HostUUID: hostUUID, ClientUUID: clientUUID, Message: &wsMsg})
+	return true
+}
+
+// authorResponseClientUUID reads the requesting client from a response.
+// delete_space_response predates the snake_case field names.
+func authorResponseClientUUID(raw interface{}) string {
+	data, err := decodeData[map[string]interface{}](raw)
+	if err != nil {
+		return ""
+	}
+	for _, key := range []string{"client_uuid", "ClientUUID"} {
+		if value, ok := data[key].(string); ok && strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func hostHasLocalClient(hostUUID, clientUUID string) bool {
+	host, exists := GetHost(hostUUID)
+	if !exists {
+		return false
+	}
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	_, ok := host.ClientConnsByUUID[clientUUID]
+	return ok
+}
+
+func (n *clusterNode) handle(payload []byte) {
+	var msg clusterMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Printf("cluster: invalid message: %v", err)
+		return
+	}
+	if msg.Node == "" || msg.Node == n.id {
+		return
+	}
+	n.markSeen(msg.Node)
+
+	switch msg.Kind {
+	case clusterHello:
+		n.publishState()
+	case clusterState:
+		n.applyState(msg.Node, msg.Authors, msg.Clients)
+	case clusterNodeDown:
+		n.dropNode(msg.Node)
+	case clusterAuthorOnline:
+		n.mu.Lock()
+		n.authorNodes[msg.HostUUID] = msg.Node
+		n.mu.Unlock()
+		demoteLocalAuthor(msg.HostUUID)
+		if host, exists := GetHost(msg.HostUUID); exists {
+			host.mu.Lock()
+			host.AuthorRequestIDs = msg.Value == clusterAuthorRequestIDs
+			host.mu.Unlock()
+		}
+	case clusterAuthorOffline:
+		n.mu.Lock()
+		wasAuthorNode := n.authorNodes[msg.HostUUID] == msg.Node
+		if wasAuthorNode {
+			delete(n.authorNodes, msg.HostUUID)
+		}
+		n.mu.Unlock()
+		if wasAuthorNode {
+			hostRequests.failHost(msg.HostUUID, "The host disconnected before answering")
+		}
+	case clusterClientOnline:
+		n.mu.Lock()
+		n.clientNodes[msg.ClientUUID] = msg.Node
+		n.mu.Unlock()
+	case clusterClientOffline:
+		n.mu.Lock()
+		if n.clientNodes[msg.ClientUUID] == msg.Node {
+			delete(n.clientNodes, msg.ClientUUID)
+		}
+		n.mu.Unlock()
+	case clusterHealthAck:
+		resolveHostHealthCheck(msg.Value)
+	case clusterHostKeyRotated:
+		applyRotatedHostKey(msg.HostUUID, msg.Value)
+	case clusterHostPurged:
+		purgeHostState(msg.HostUUID)
+	case clusterDeviceDenyList:
+		if msg.Message != nil {
+			applyDeviceDenyList(msg.HostUUID, msg.Message.Data)
+		}
+	case clusterToAuthor, clusterToClient, clusterToUser, clusterBroadcastChannel, clusterBroadcastSpace, clusterAuthorResponse:
+		if msg.Message != nil {
+			n.deliver(msg)
+		}
+	case clusterReissueCapabilities:
+		n.reissueLocalCapabilities(msg)
+	case clusterChannelMapped, clusterChannelRemoved, clusterSpaceRemoved, clusterSpaceUserRemoved, clusterSenderKeysStale:
+		applyHostEvent(msg)
+	default:
+		log.Printf("cluster: unknown message kind %q", msg.Kind)
+	}
+}
+
+// deliver hands forwarded traffic to the connections on this node only;
+// nothing here forwards again.
+func (n *clusterNode) deliver(msg clusterMessage) {
+	switch msg.Kind {
+	case clusterToAuthor:
+		// The requesting node times the request out; this entry only routes
+		// the answer back to it.
+		if msg.Message.RequestID != "" {
+			hostRequests.track(msg.Message.RequestID, msg.HostUUID, msg.ClientUUID, msg.Message.Type, false)
+		}
+		if msg.Message.Type == "reissue_capabilities_request" {
+			trackForwardedReissue(msg.HostUUID, msg.Message.Data)
+		}
+		if !sendToLocalAuthor(msg.HostUUID, *msg.Message) && msg.ClientUUID != "" {
+			n.publishTo(msg.Node, clusterMessage{
+				Kind:       clusterToClient,
+				HostUUID:   msg.HostUUID,
+				ClientUUID: msg.ClientUUID,
+				Message:    &WSMessage{Type: "author_error", Data: ChatError{Content: "Failed to connect to the host"}},
+			})
+		}
+	case clusterToClient:
+		sendToLocalClient(msg.HostUUID, msg.ClientUUID, *msg.Message)
+	case clusterToUser:
+		sendToLocalUser(msg.HostUUID, msg.UserID, msg.Value, *msg.Message)
+	case clusterBroadcastChannel:
+		broadcastToLocalChannel(msg.HostUUID, msg.Target, *msg.Message)
+	case clusterBroadcastSpace:
+		broadcastToLocalSpace(msg.HostUUID, msg.Target, *msg.Message)
+	case clusterAuthorResponse:
+		// The stand-in author has no connection, which also keeps
+		// dispatchMessage from forwarding the response again.
+		author := &Client{HostUUID: msg.HostUUID, IsHostAuthor: true}
+		dispatchMessage(author, nil, *msg.Message)
+	}
+}
+
+// reissueLocalCapabilities sends the author's node the members connected
+// here, so a reissue after a key rotation reaches the whole cluster.
+func (n *clusterNode) reissueLocalCapabilities(msg clusterMessage) {
+	host, exists := GetHost(msg.HostUUID)
+	if !exists {
+		return
+	}
+	host.mu.Lock()
+	requests := reissueRequestsLocked(host)
+	host.mu.Unlock()
+	if len(requests) == 0 {
+		return
+	}
+	n.publishTo(msg.Node, clusterMessage{
+		Kind:     clusterToAuthor,
+		HostUUID: msg.HostUUID,
+		Message: &WSMessage{
+			Type: "reissue_capabilities_request",
+			Data: ReissueCapabilitiesRequest{Clients: requests},
+		},
+	})
+}
+
+// trackForwardedReissue adds routing entries for a reissue batch another node
+// built, so the host's tagged answers are not dropped here as unknown.
+func trackForwardedReissue(hostUUID string, raw interface{}) {
+	data, err := decodeData[ReissueCapabilitiesRequest](raw)
+	if err != nil {
+		log.Printf("cluster: decoding forwarded reissue: %v", err)
+		return
+	}
+	for _, request := range data.Clients {
+		if request.RequestID != "" {
+			hostRequests.track(request.RequestID, hostUUID, request.ClientUUID, "get_dash_data_request", false)
+		}
+	}
+}
+
+func applyHostEvent(msg clusterMessage) {
+	host, exists := GetHost(msg.HostUUID)
+	if !exists {
+		return
+	}
+	switch msg.Kind {
+	case clusterChannelMapped:
+		host.mu.Lock()
+		host.ChannelToSpace[msg.Value] = msg.Target
+		host.mu.Unlock()
+	case clusterChannelRemoved:
+		host.mu.Lock()
+		delete(host.ChannelToSpace, msg.Value)
+		delete(host.SenderKeys, msg.Value)
+		host.mu.Unlock()
+	case clusterSpaceRemoved:
+		host.mu.Lock()
+		removeSpaceStateLocked(host, msg.Target)
+		host.mu.Unlock()
+	case clusterSpaceUserRemoved:
+		removeLocalSpaceUser(host, msg.Target, msg.UserID, msg.Value)
+	case clusterSenderKeysStale:
+		host.mu.Lock()
+		markSenderKeysStaleLocked(host, msg.Target)
+		host.mu.Unlock()
+	}
+}
+
+func (n *clusterNode) markSeen(nodeID string) {
+	n.mu.Lock()
+	n.lastSeen[nodeID] = time.Now()
+	n.mu.Unlock()
+}
+
+// applyState replaces everything known about nodeID with its latest
+// snapshot.
+func (n *clusterNode) applyState(nodeID string, authors, clients []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.forgetNodeLocked(nodeID)
+	for _, hostUUID := range authors {
+		n.authorNodes[hostUUID] = nodeID
+	}
+	for _, clientUUID := range clients {
+		n.clientNodes[clientUUID] = nodeID
+	}
+}
+
+func (n *clusterNode) dropNode(nodeID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.forgetNodeLocked(nodeID)
+	delete(n.lastSeen, nodeID)
+}
+
+func (n *clusterNode) forgetNodeLocked(nodeID string) {
+	for hostUUID, owner := range n.authorNodes {
+		if owner == nodeID {
+			delete(n.authorNodes, hostUUID)
+		}
+	}
+	for clientUUID, owner := range n.clientNodes {
+		if owner == nodeID {
+			delete(n.clientNodes, clientUUID)
+		}
+	}
+}
+
+func (n *clusterNode) pruneSilentNodes(now time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for nodeID, seen := range n.lastSeen {
+		if now.Sub(seen) > clusterNodeTimeout {
+			log.Printf("cluster: node %s went silent, dropping its routes", nodeID)
+			n.forgetNodeLocked(nodeID)
+			delete(n.lastSeen, nodeID)
+		}
+	}
+}
+
+// demoteLocalAuthor drops a local author session once the host has
+// authenticated on another node, as a second session on this node would.
+func demoteLocalAuthor(hostUUID string) {
+	host, exists := GetHost(hostUUID)
+	if !exists {
+		return
+	}
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	if host.AuthorConn == nil {
+		return
+	}
+	if prev, ok := host.ClientsByConn[host.AuthorConn]; ok && prev != nil {
+		prev.IsHostAuthor = false
+	}
+	host.AuthorConn = nil
+}
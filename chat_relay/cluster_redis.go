@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisBus carries cluster traffic over Redis pub/sub.
+type redisBus struct {
+	client *redis.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	subs []*redis.PubSub
+}
+
+func newRedisBus(url string) (*redisBus, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := client.Ping(ctx).Err(); err != nil {
+		cancel()
+		_ = client.Close()
+		return nil, err
+	}
+	return &redisBus{client: client, ctx: ctx, cancel: cancel}, nil
+}
+
+func (b *redisBus) Publish(subject string, payload []byte) error {
+	return b.client.Publish(b.ctx, subject, payload).Err()
+}
+
+func (b *redisBus) Subscribe(subject string, handle func(payload []byte)) error {
+	sub := b.client.Subscribe(b.ctx, subject)
+	// Wait for the subscription to be confirmed so nothing published after
+	// Subscribe returns is missed.
+	if _, err := sub.Receive(b.ctx); err != nil {
+		_ = sub.Close()
+		return err
+	}
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+
+	go func() {
+		for msg := range sub.Channel() {
+			handle([]byte(msg.Payload))
+		}
+	}()
+	return nil
+}
+
+func (b *redisBus) ClaimOnce(key string, ttl time.Duration) (bool, error) {
+	return b.client.SetNX(b.ctx, key, 1, ttl).Result()
+}
+
+func (b *redisBus) Increment(key string, ttl time.Duration) (int64, error) {
+	pipe := b.client.TxPipeline()
+	count := pipe.Incr(b.ctx, key)
+	pipe.Expire(b.ctx, key, ttl)
+	if _, err := pipe.Exec(b.ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+func (b *redisBus) Close() error {
+	b.mu.Lock()
+	for _, sub := range b.subs {
+		_ = sub.Close()
+	}
+	b.subs = nil
+	b.mu.Unlock()
+	b.cancel()
+	return b.client.Close()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+)
+
+// memoryBus is an in-process clusterBus; every subscription gets its own
+// ordered queue like a Redis subscriber.
+type memoryBus struct {
+	mu     sync.Mutex
+	subs   map[string][]chan []byte
+	closed bool
+}
+
+func newMemoryBus() *memoryBus {
+	return &memoryBus{subs: make(map[string][]chan []byte)}
+}
+
+func (b *memoryBus) Publish(subject string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	for _, ch := range b.subs[subject] {
+		ch <- append([]byte(nil), payload...)
+	}
+	return nil
+}
+
+func (b *memoryBus) Subscribe(subject string, handle func(payload []byte)) error {
+	ch := make(chan []byte, 256)
+	b.mu.Lock()
+	b.subs[subject] = append(b.subs[subject], ch)
+	b.mu.Unlock()
+	go func() {
+		for payload := range ch {
+			handle(payload)
+		}
+	}()
+	return nil
+}
+
+func (b *memoryBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for _, chans := range b.subs {
+		for _, ch := range chans {
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// scriptedNode stands in for another relay node: the test reads what the
+// relay under test sends it and publishes its replies by hand.
+type scriptedNode struct {
+	t     *testing.T
+	id    string
+	bus   *memoryBus
+	inbox chan clusterMessage
+}
+
+func newScriptedNode(t *testing.T, bus *memoryBus, id string) *scriptedNode {
+	t.Helper()
+	node := &scriptedNode{t: t, id: id, bus: bus, inbox: make(chan clusterMessage, 256)}
+	receive := func(payload []byte) {
+		var msg clusterMessage
+		if err := json.Unmarshal(payload, &msg); err != nil || msg.Node == id {
+			return
+		}
+		node.inbox <- msg
+	}
+	_ = bus.Subscribe(clusterSubjectAll, receive)
+	_ = bus.Subscribe(clusterNodeSubject(id), receive)
+	return node
+}
+
+func (s *scriptedNode) publish(subject string, msg clusterMessage) {
+	s.t.Helper()
+	msg.Node = s.id
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		s.t.Fatalf("encode cluster message: %v", err)
+	}
+	if err := s.bus.Publish(subject, payload); err != nil {
+		s.t.Fatalf("publish cluster message: %v", err)
+	}
+}
+
+func (s *scriptedNode) next(kind string) clusterMessage {
+	s.t.Helper()
+	timer := time.NewTimer(testReadTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			s.t.Fatalf("timed out waiting for cluster message %q", kind)
+		case msg := <-s.inbox:
+			if msg.Kind == kind {
+				return msg
+			}
+		}
+	}
+}
+
+func startTestCluster(t *testing.T) *scriptedNode {
+	t.Helper()
+	bus := newMemoryBus()
+	remote := newScriptedNode(t, bus, "node-b")
+	node, err := startCluster("node-a", bus)
+	if err != nil {
+		t.Fatalf("start cluster: %v", err)
+	}
+	relayCluster = node
+	t.Cleanup(func() {
+		relayCluster = nil
+		_ = node.Close()
+	})
+	remote.next(clusterHello)
+	return remote
+}
+
+func waitForRoute(t *testing.T, lookup func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testReadTimeout)
+	for !lookup() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for cluster route")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisBusDeliversPublishedMessages(t *testing.T) {
+	server := miniredis.RunT(t)
+	bus, err := newRedisBus("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("connect redis bus: %v", err)
+	}
+	defer bus.Close()
+
+	received := make(chan string, 1)
+	if err := bus.Subscribe("parch.relay.test", func(payload []byte) { received <- string(payload) }); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := bus.Publish("parch.relay.test", []byte("hello")); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	select {
+	case got := <-received:
+		if got != "hello" {
+			t.Fatalf("expected hello, got %q", got)
+		}
+	case <-time.After(testReadTimeout):
+		t.Fatal("timed out waiting for redis message")
+	}
+}
+
+func TestClusterRoutesClientTrafficToRemoteAuthor(t *testing.T) {
+	env := newRelayIntegrationEnv(t)
+	remote := startTestCluster(t)
+
+	remote.publish(clusterSubjectAll, clusterMessage{Kind: clusterAuthorOnline, HostUUID: env.hostUUID})
+	waitForRoute(t, func() bool {
+		_, ok := relayCluster.authorNode(env.hostUUID)
+		return ok
+	})
+
+	client := env.dialWS(t)
+	defer client.Close()
+	mustWriteMessage(t, client, WSMessage{Type: "join_host", Data: JoinHost{UUID: env.hostUUID}})
+
+	// The health check reaches the author through its node and the ack
+	// comes back over the bus.
+	check := remote.next(clusterToAuthor)
+	if check.Message == nil || check.Message.Type != "relay_health_check" {
+		t.Fatalf("expected a forwarded health check, got %+v", check)
+	}
+	health, err := decodeData[RelayHealthCheck](check.Message.Data)
+	if err != nil || health.Nonce == "" {
+		t.Fatalf("decode health check: %v %+v", err, health)
+	}
+	remote.publish(clusterSubjectAll, clusterMessage{Kind: clusterHealthAck, HostUUID: env.hostUUID, Value: health.Nonce})
+
+	mustReadType(t, client, "join_ack", testReadTimeout)
+	challengeMsg := mustReadType(t, client, "auth_challenge", testReadTimeout)
+	challenge, _ := decodeData[AuthChallenge](challengeMsg.Data)
+	authenticateClient(t, env, client, challenge.Challenge, "bob")
+
+	mustWriteMessage(t, client, WSMessage{Type: "get_dash_data", Data: map[string]interface{}{}})
+	forwarded := remote.next(clusterToAuthor)
+	if forwarded.Message == nil || forwarded.Message.Type != "get_dash_data_request" {
+		t.Fatalf("expected a forwarded get_dash_data_request, got %+v", forwarded)
+	}
+	request, err := decodeData[GetDashDataRequest](forwarded.Message.Data)
+	if err != nil {
+		t.Fatalf("decode get_dash_data_request: %v", err)
+	}
+
+	// The author's response is handled on the node holding the client.
+	spaceUUID := uuid.NewString()
+	remote.publish(clusterNodeSubject("node-a"), clusterMessage{
+		Kind:     clusterAuthorResponse,
+		HostUUID: env.hostUUID,
+		Message: &WSMessage{
+			Type: "get_dash_data_response",
+			Data: GetDashDataResponse{
+				User:       DashDataUser{ID: 7, Username: "bob", PublicKey: request.UserPublicKey},
+				Spaces:     []DashDataSpace{{UUID: spaceUUID, Name: "Engineering"}},
+				ClientUUID: request.ClientUUID,
+			},
+		},
+	})
+	dashMsg := mustReadType(t, client, "dash_data_payload", testReadTimeout)
+	dash, err := decodeData[GetDashDataSuccess](dashMsg.Data)
+	if err != nil || len(dash.Spaces) != 1 || dash.Spaces[0].UUID != spaceUUID {
+		t.Fatalf("unexpected dash data: %v %+v", err, dash)
+	}
+
+	// Space broadcasts from the other node reach members connected here.
+	token := env.mustIssueCapabilityToken(t, request.UserPublicKey, spaceUUID, []string{scopeReadHistory}, time.Minute)
+	mustWriteMessage(t, client, WSMessage{Type: "join_all_spaces", Data: JoinAllSpacesClient{
+		SpaceUUIDs:       []string{spaceUUID},
+		CapabilityTokens: map[string]string{spaceUUID: token},
+	}})
+	mustReadType(t, client, "join_all_spaces_success", testReadTimeout)
+	remote.publish(clusterSubjectAll, clusterMessage{
+		Kind:     clusterBroadcastSpace,
+		HostUUID: env.hostUUID,
+		Target:   spaceUUID,
+		Message:  &WSMessage{Type: "leave_space_update", Data: LeaveSpaceUpdate{SpaceUUID: spaceUUID, UserID: 9}},
+	})
+	mustReadType(t, client, "leave_space_update", testReadTimeout)
+}
+
+func TestClusterForwardsAuthorResponsesForRemoteClients(t *testing.T) {
+	env := newRelayIntegrationEnv(t)
+	remote := startTestCluster(t)
+	author := env.connectAuthor(t)
+	remote.next(clusterAuthorOnline)
+
+	remoteClientUUID := uuid.NewString()
+	remote.publish(clusterSubjectAll, clusterMessage{Kind: clusterClientOnline, ClientUUID: remoteClientUUID})
+	waitForRoute(t, func() bool {
+		_, ok := relayCluster.clientNode(remoteClientUUID)
+		return ok
+	})
+
+	// Requests from the other node reach the local author.
+	remote.publish(clusterNodeSubject("node-a"), clusterMessage{
+		Kind:       clusterToAuthor,
+		HostUUID:   env.hostUUID,
+		ClientUUID: remoteClientUUID,
+		Message:    &WSMessage{Type: "get_messages_request", Data: GetMessagesRequest{ClientUUID: remoteClientUUID}},
+	})
+	author.mustNextType("get_messages_request")
+
+	author.mustSend(WSMessage{
+		Type: "get_messages_response",
+		Data: GetMessagesResponse{ChannelUUID: "channel-1", ClientUUID: remoteClientUUID},
+	})
+	response := remote.next(clusterAuthorResponse)
+	if response.Message == nil || response.Message.Type != "get_messages_response" || response.ClientUUID != remoteClientUUID {
+		t.Fatalf("expected the response forwarded to node-b, got %+v", response)
+	}
+
+	// With a request_id the answer follows the request, not the payload,
+	// and an error answer is forwarded so node-b sees the request answered.
+	remote.publish(clusterNodeSubject("node-a"), clusterMessage{
+		Kind:       clusterToAuthor,
+		HostUUID:   env.hostUUID,
+		ClientUUID: remoteClientUUID,
+		Message:    &WSMessage{Type: "get_messages_request", Data: GetMessagesRequest{}, RequestID: "req-remote"},
+	})
+	if tagged := author.mustNextType("get_messages_request"); tagged.RequestID != "req-remote" {
+		t.Fatalf("expected the request_id to reach the author, got %+v", tagged)
+	}
+	author.mustSend(WSMessage{
+		Type:      "get_messages_response",
+		Data:      GetMessagesResponse{ChannelUUID: "channel-1", ClientUUID: "someone-else"},
+		RequestID: "req-remote",
+	})
+	response = remote.next(clusterAuthorResponse)
+	if response.ClientUUID != remoteClientUUID || response.Message == nil || response.Message.RequestID != "req-remote" {
+		t.Fatalf("expected the tagged response routed to the requester, got %+v", response)
+	}
+	author.mustSend(WSMessage{Type: "error", Data: ChatError{Content: "late failure"}, RequestID: "req-remote"})
+	if failure := remote.next(clusterAuthorResponse); failure.Message == nil || failure.Message.Type != "error" || failure.ClientUUID != remoteClientUUID {
+		t.Fatalf("expected the tagged error forwarded, got %+v", failure)
+	}
+
+	SendToClient(env.hostUUID, remoteClientUUID, WSMessage{Type: "error", Data: ChatError{Content: "hi"}})
+	direct := remote.next(clusterToClient)
+	if direct.ClientUUID != remoteClientUUID || direct.Message == nil || direct.Message.Type != "error" {
+		t.Fatalf("expected a forwarded client message, got %+v", direct)
+	}
+
+	remote.publish(clusterSubjectAll, clusterMessage{Kind: clusterNodeDown})
+	waitForRoute(t, func() bool {
+		_, ok := relayCluster.clientNode(remoteClientUUID)
+		return !ok
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// keyedDevicePrefix marks device IDs the relay derived from a device key.
+// Unkeyed sessions cannot claim it.
+const keyedDevicePrefix = "key-"
+
+func deviceCertificateMessage(publicKey, devicePublicKey string) string {
+	return fmt.Sprintf("parch-device-cert:%s:%s", publicKey, devicePublicKey)
+}
+
+func deviceAuthMessage(hostUUID, challenge, publicKey string) string {
+	return fmt.Sprintf("parch-device-auth:%s:%s:%s", hostUUID, challenge, publicKey)
+}
+
+// keyedDeviceID derives the device ID from the device public key, so a
+// device cannot pick its own ID.
+func keyedDeviceID(devicePublicKey []byte) string {
+	sum := sha256.Sum256(devicePublicKey)
+	return keyedDevicePrefix + base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+func isKeyedDeviceID(deviceID string) bool {
+	return strings.HasPrefix(deviceID, keyedDevicePrefix)
+}
+
+// verifyDeviceCredential checks that the session holds a device key the
+// identity certified and returns the device ID derived from it. It returns
+// "" when the session presented no device key.
+func verifyDeviceCredential(hostUUID string, identityKey ed25519.PublicKey, data AuthPubKeyClient) (string, error) {
+	if data.DevicePublicKey == "" && data.DeviceCertificate == "" && data.DeviceSignature == "" {
+		return "", nil
+	}
+	devicePublicKey, err := base64.RawStdEncoding.DecodeString(data.DevicePublicKey)
+	if err != nil || len(devicePublicKey) != ed25519.PublicKeySize {
+		return "", errors.New("bad device public key")
+	}
+	certificate, err := base64.RawStdEncoding.DecodeString(data.DeviceCertificate)
+	if err != nil || !ed25519.Verify(identityKey, []byte(deviceCertificateMessage(data.PublicKey, data.DevicePublicKey)), certificate) {
+		return "", errors.New("the identity did not certify this device key")
+	}
+	signature, err := base64.RawStdEncoding.DecodeString(data.DeviceSignature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(devicePublicKey), []byte(deviceAuthMessage(hostUUID, data.Challenge, data.PublicKey)), signature) {
+		return "", errors.New("bad device signature")
+	}
+	return keyedDeviceID(devicePublicKey), nil
+}
+
+// registeredDeviceID is the device ID the host should record for client.
+// Sessions that did not name a device get a per-connection placeholder, which
+// is not worth keeping in the registry.
+func registeredDeviceID(client *Client) string {
+	if strings.HasPrefix(client.DeviceID, "unknown-") {
+		return ""
+	}
+	return client.DeviceID
+}
+
+func isDeviceRevokedLocked(host *Host, publicKey, deviceID string) bool {
+	devices, ok := host.RevokedDevices[publicKey]
+	if !ok {
+		return false
+	}
+	_, revoked := devices[deviceID]
+	return revoked
+}
+
+// requiresDeviceKeyLocked reports whether a session for publicKey on
+// deviceID is refused because the identity has registered a device key and
+// this session did not present one.
+func requiresDeviceKeyLocked(host *Host, publicKey, deviceID string) bool {
+	if isKeyedDeviceID(deviceID) {
+		return false
+	}
+	_, keyed := host.KeyedIdentities[publicKey]
+	return keyed
+}
+
+func handleListDevices(client *Client, conn *websocket.Conn) {
+	SendToAuthor(client, WSMessage{
+		Type: "list_devices_request",
+		Data: ListDevicesRequest{
+			UserID:           client.UserID,
+			UserPublicKey:    client.PublicKey,
+			UserEncPublicKey: client.EncPublicKey,
+			Username:         client.Username,
+			ClientUUID:       client.ClientUUID,
+		},
+	})
+}
+
+func handleListDevicesRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[ListDevicesResponse](wsMsg.Data)
+	if err != nil {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid list devices response data"}})
+		return
+	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
+
+	devices := data.Devices
+	if devices == nil {
+		devices = []RegisteredDevice{}
+	}
+	if host, exists := GetHost(client.HostUUID); exists {
+		host.mu.Lock()
+		if targetConn, ok := host.ClientConnsByUUID[data.ClientUUID]; ok {
+			if target := host.ClientsByConn[targetConn]; target != nil {
+				online := make(map[string]bool)
+				for _, active := range activeDevicesForPublicKeyLocked(host, target.PublicKey, target.ClientUUID) {
+					online[active.DeviceID] = true
+				}
+				for i := range devices {
+					devices[i].Online = online[devices[i].DeviceID]
+					devices[i].IsCurrent = devices[i].DeviceID == target.DeviceID
+				}
+			}
+		}
+		host.mu.Unlock()
+	}
+
+	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
+		Type: "list_devices_success",
+		Data: ListDevicesSuccess{Devices: devices},
+	})
+}
+
+func handleRevokeDevice(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[RevokeDeviceClient](wsMsg.Data)
+	if err != nil || strings.TrimSpace(data.DeviceID) == "" {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid revoke device data"}})
+		return
+	}
+	deviceID := strings.TrimSpace(data.DeviceID)
+	if deviceID == client.DeviceID {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Cannot revoke the device you are using"}})
+		return
+	}
+
+	SendToAuthor(client, WSMessage{
+		Type: "revoke_device_request",
+		Data: RevokeDeviceRequest{
+			UserID:           client.UserID,
+			UserPublicKey:    client.PublicKey,
+			UserEncPublicKey: client.EncPublicKey,
+			Username:         client.Username,
+			DeviceID:         deviceID,
+			ClientUUID:       client.ClientUUID,
+		},
+	})
+}
+
+func handleRevokeDeviceRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[RevokeDeviceResponse](wsMsg.Data)
+	if err != nil {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid revoke device response data"}})
+		return
+	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
+
+	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
+		Type: "revoke_device_success",
+		Data: RevokeDeviceSuccess{DeviceID: data.DeviceID},
+	})
+}
+
+// handleDeviceDenyList installs the host's deny list here and on every other
+// relay node.
+func handleDeviceDenyList(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	if !client.IsHostAuthor {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Only the host can revoke devices"}})
+		return
+	}
+	if !applyDeviceDenyList(client.HostUUID, wsMsg.Data) {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid device deny list"}})
+		return
+	}
+	relayCluster.publishHostEvent(clusterMessage{Kind: clusterDeviceDenyList, HostUUID: client.HostUUID, Message: wsMsg})
+}
+
+// applyDeviceDenyList replaces the host's deny list and disconnects live
+// sessions on revoked devices, and unkeyed sessions of identities that now
+// have a device key. Their read loops clean them up.
+func applyDeviceDenyList(hostUUID string, raw interface{}) bool {
+	data, err := decodeData[DeviceDenyList](raw)
+	if err != nil {
+		return false
+	}
+	host, exists := GetHost(hostUUID)
+	if !exists {
+		return true
+	}
+
+	revoked := make(map[string]map[string]struct{})
+	for _, device := range data.Devices {
+		if device.UserPublicKey == "" || device.DeviceID == "" {
+			continue
+		}
+		if revoked[device.UserPublicKey] == nil {
+			revoked[device.UserPublicKey] = make(map[string]struct{})
+		}
+		revoked[device.UserPublicKey][device.DeviceID] = struct{}{}
+	}
+	keyed := make(map[string]struct{}, len(data.KeyedIdentities))
+	for _, publicKey := range data.KeyedIdentities {
+		if publicKey != "" {
+			keyed[publicKey] = struct{}{}
+		}
+	}
+
+	host.mu.Lock()
+	host.RevokedDevices = revoked
+	host.KeyedIdentities = keyed
+	var conns []*websocket.Conn
+	for conn, candidate := range host.ClientsByConn {
+		if candidate == nil || candidate.PublicKey == "" {
+			continue
+		}
+		if isDeviceRevokedLocked(host, candidate.PublicKey, candidate.DeviceID) || requiresDeviceKeyLocked(host, candidate.PublicKey, candidate.DeviceID) {
+			conns = append(conns, conn)
+		}
+	}
+	host.mu.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	return true
+}
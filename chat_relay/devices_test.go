@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func authenticateDevice(t *testing.T, env *relayIntegrationEnv, conn *websocket.Conn, priv ed25519.PrivateKey, deviceID string) {
+	t.Helper()
+	challenge := env.joinHost(t, conn)
+	publicKey := base64.RawStdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+	encPublicKey := base64.RawStdEncoding.EncodeToString([]byte("enc-" + publicKey[:8]))
+	sig := ed25519.Sign(priv, []byte(authMessage(env.hostUUID, challenge, encPublicKey)))
+	mustWriteMessage(t, conn, WSMessage{
+		Type: "auth_pubkey",
+		Data: AuthPubKeyClient{
+			PublicKey:    publicKey,
+			EncPublicKey: encPublicKey,
+			DeviceID:     deviceID,
+			DeviceName:   "Test " + deviceID,
+			Username:     "dana",
+			Challenge:    challenge,
+			Signature:    base64.RawStdEncoding.EncodeToString(sig),
+		},
+	})
+}
+
+func TestRelayIntegrationDeviceDenyList(t *testing.T) {
+	env := newRelayIntegrationEnv(t)
+	author := env.connectAuthor(t)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ed25519 key: %v", err)
+	}
+	publicKey := base64.RawStdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+
+	phone := env.dialWS(t)
+	defer phone.Close()
+	authenticateDevice(t, env, phone, priv, "phone")
+	mustReadType(t, phone, "auth_pubkey_success", testReadTimeout)
+
+	laptop := env.dialWS(t)
+	defer laptop.Close()
+	authenticateDevice(t, env, laptop, priv, "laptop")
+	mustReadType(t, laptop, "auth_pubkey_success", testReadTimeout)
+
+	// A device cannot revoke itself.
+	mustWriteMessage(t, laptop, WSMessage{Type: "revoke_device", Data: RevokeDeviceClient{DeviceID: "laptop"}})
+	mustReadType(t, laptop, "error", testReadTimeout)
+
+	mustWriteMessage(t, laptop, WSMessage{Type: "revoke_device", Data: RevokeDeviceClient{DeviceID: "phone"}})
+	requestMsg := author.mustNextType("revoke_device_request")
+	request, err := decodeData[RevokeDeviceRequest](requestMsg.Data)
+	if err != nil || request.DeviceID != "phone" || request.UserPublicKey != publicKey {
+		t.Fatalf("unexpected revoke_device_request: %v %+v", err, request)
+	}
+	author.mustSend(WSMessage{Type: "revoke_device_response", Data: RevokeDeviceResponse{DeviceID: "phone", ClientUUID: request.ClientUUID}})
+	author.mustSend(WSMessage{Type: "device_deny_list", Data: DeviceDenyList{Devices: []RevokedDevice{{UserPublicKey: publicKey, DeviceID: "phone"}}}})
+	mustReadType(t, laptop, "revoke_device_success", testReadTimeout)
+
+	// The live session on the revoked device is dropped.
+	for {
+		if _, err := readOneMessage(phone, testReadTimeout); err != nil {
+			break
+		}
+	}
+
+	again := env.dialWS(t)
+	defer again.Close()
+	authenticateDevice(t, env, again, priv, "phone")
+	errMsg := mustReadType(t, again, "authentication-error", testReadTimeout)
+	if data, _ := decodeData[ChatError](errMsg.Data); data.Content != "This device has been revoked" {
+		t.Fatalf("unexpected authentication error: %+v", data)
+	}
+}
+
+func authenticateKeyedDevice(t *testing.T, env *relayIntegrationEnv, conn *websocket.Conn, priv, certifier, devicePriv ed25519.PrivateKey, claimedDeviceID string) {
+	t.Helper()
+	challenge := env.joinHost(t, conn)
+	publicKey := base64.RawStdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+	encPublicKey := base64.RawStdEncoding.EncodeToString([]byte("enc-" + publicKey[:8]))
+	devicePublicKey := base64.RawStdEncoding.EncodeToString(devicePriv.Public().(ed25519.PublicKey))
+	sig := ed25519.Sign(priv, []byte(authMessage(env.hostUUID, challenge, encPublicKey)))
+	certificate := ed25519.Sign(certifier, []byte(deviceCertificateMessage(publicKey, devicePublicKey)))
+	deviceSig := ed25519.Sign(devicePriv, []byte(deviceAuthMessage(env.hostUUID, challenge, publicKey)))
+	mustWriteMessage(t, conn, WSMessage{
+		Type: "auth_pubkey",
+		Data: AuthPubKeyClient{
+			PublicKey:         publicKey,
+			EncPublicKey:      encPublicKey,
+			DeviceID:          claimedDeviceID,
+			DeviceName:        "Keyed device",
+			Username:          "dana",
+			Challenge:         challenge,
+			Signature:         base64.RawStdEncoding.EncodeToString(sig),
+			DevicePublicKey:   devicePublicKey,
+			DeviceCertificate: base64.RawStdEncoding.EncodeToString(certificate),
+			DeviceSignature:   base64.RawStdEncoding.EncodeToString(deviceSig),
+		},
+	})
+}
+
+func mustGenerateKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ed25519 key: %v", err)
+	}
+	return priv
+}
+
+func expectAuthenticationError(t *testing.T, conn *websocket.Conn, content string) {
+	t.Helper()
+	errMsg := mustReadType(t, conn, "authentication-error", testReadTimeout)
+	if data, _ := decodeData[ChatError](errMsg.Data); data.Content != content {
+		t.Fatalf("expected authentication error %q, got %+v", content, data)
+	}
+}
+
+func TestRelayIntegrationKeyedDevicesCannotDodgeRevocation(t *testing.T) {
+	env := newRelayIntegrationEnv(t)
+	author := env.connectAuthor(t)
+
+	priv := mustGenerateKey(t)
+	publicKey := base64.RawStdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+	phoneKey, laptopKey := mustGenerateKey(t), mustGenerateKey(t)
+	phoneID := keyedDeviceID(phoneKey.Public().(ed25519.PublicKey))
+
+	phone := env.dialWS(t)
+	defer phone.Close()
+	authenticateKeyedDevice(t, env, phone, priv, priv, phoneKey, "")
+	mustReadType(t, phone, "auth_pubkey_success", testReadTimeout)
+
+	laptop := env.dialWS(t)
+	defer laptop.Close()
+	authenticateKeyedDevice(t, env, laptop, priv, priv, laptopKey, "")
+	mustReadType(t, laptop, "auth_pubkey_success", testReadTimeout)
+
+	// Until the host reports a device key, unkeyed sessions still sign in.
+	tablet := env.dialWS(t)
+	defer tablet.Close()
+	authenticateDevice(t, env, tablet, priv, "tablet")
+	mustReadType(t, tablet, "auth_pubkey_success", testReadTimeout)
+
+	// The laptop revokes the phone by the ID the relay derived for it.
+	mustWriteMessage(t, laptop, WSMessage{Type: "revoke_device", Data: RevokeDeviceClient{DeviceID: phoneID}})
+	request, err := decodeData[RevokeDeviceRequest](author.mustNextType("revoke_device_request").Data)
+	if err != nil || request.DeviceID != phoneID {
+		t.Fatalf("unexpected revoke_device_request: %v %+v", err, request)
+	}
+	author.mustSend(WSMessage{Type: "revoke_device_response", Data: RevokeDeviceResponse{DeviceID: phoneID, ClientUUID: request.ClientUUID}})
+	author.mustSend(WSMessage{Type: "device_deny_list", Data: DeviceDenyList{
+		Devices:         []RevokedDevice{{UserPublicKey: publicKey, DeviceID: phoneID}},
+		KeyedIdentities: []string{publicKey},
+	}})
+	mustReadType(t, laptop, "revoke_device_success", testReadTimeout)
+
+	// Both the revoked phone and the unkeyed tablet are dropped.
+	for _, dropped := range []*websocket.Conn{phone, tablet} {
+		for {
+			if _, err := readOneMessage(dropped, testReadTimeout); err != nil {
+				break
+			}
+		}
+	}
+
+	// The phone's key maps to the revoked ID whatever ID it claims.
+	again := env.dialWS(t)
+	defer again.Close()
+	authenticateKeyedDevice(t, env, again, priv, priv, phoneKey, "brand-new-device")
+	expectAuthenticationError(t, again, "This device has been revoked")
+
+	// Leaving out the device key, or claiming a keyed ID without one, is refused.
+	for _, deviceID := range []string{"", "fresh-id", phoneID[:len(phoneID)-1] + "x"} {
+		unkeyed := env.dialWS(t)
+		authenticateDevice(t, env, unkeyed, priv, deviceID)
+		expectAuthenticationError(t, unkeyed, "This identity requires a registered device key")
+		unkeyed.Close()
+	}
+
+	// A device key the identity did not certify is refused.
+	forged := env.dialWS(t)
+	defer forged.Close()
+	authenticateKeyedDevice(t, env, forged, priv, mustGenerateKey(t), mustGenerateKey(t), "")
+	expectAuthenticationError(t, forged, "Invalid device credential: the identity did not certify this device key")
+
+	// The laptop keeps working.
+	mustWriteMessage(t, laptop, WSMessage{Type: "list_devices"})
+	if request := author.mustNextType("list_devices_request"); request.Type != "list_devices_request" {
+		t.Fatalf("expected list_devices_request, got %s", request.Type)
+	}
+}
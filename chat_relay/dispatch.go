@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,7 +22,18 @@ func isAuthorPassthroughType(msgType string) bool {
 		"leave_space_success",
 		"remove_space_user_success",
 		"get_messages_response",
+		"save_chat_message_response",
 		"relay_health_check_ack",
+		"reissue_capabilities",
+		"list_devices_response",
+		"revoke_device_response",
+		"device_deny_list",
+		"identity_migrate_response",
+		"report_response",
+		"list_reports_response",
+		"resolve_report_response",
+		"get_audit_log_response",
+		"export_space_response",
 		"error":
 		return true
 	default:
@@ -33,7 +45,7 @@ func allowPreAuthMessage(client *Client, msgType string) bool {
 	if msgType == "auth_pubkey" || msgType == "host_auth" {
 		return true
 	}
-	return client.IsHostAuthor && isAuthorPassthroughType(msgType)
+	return client.IsHostAuthor && (isAuthorPassthroughType(msgType) || msgType == "get_quota_usage")
 }
 
 func touchClientLastSeen(client *Client) {
@@ -49,6 +61,16 @@ func touchClientLastSeen(client *Client) {
 	host.mu.Unlock()
 }
 
+func hostTagsRequests(hostUUID string) bool {
+	host, exists := GetHost(hostUUID)
+	if !exists {
+		return false
+	}
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	return host.AuthorRequestIDs
+}
+
 func dispatchMessage(client *Client, conn *websocket.Conn, wsMsg WSMessage) {
 	if !client.IsAuthenticated && !allowPreAuthMessage(client, wsMsg.Type) {
 		safeSend(client, conn, WSMessage{
@@ -60,6 +82,25 @@ func dispatchMessage(client *Client, conn *websocket.Conn, wsMsg WSMessage) {
 	if client.IsAuthenticated {
 		touchClientLastSeen(client)
 	}
+	// A tagged response must answer a request this relay is tracking for the
+	// same host; anything else is late past the grace period or forged.
+	if client.IsHostAuthor && wsMsg.RequestID != "" && isAuthorPassthroughType(wsMsg.Type) {
+		if _, ok := hostRequests.answer(client.HostUUID, wsMsg.RequestID); !ok {
+			log.Printf("Dropping %s for unknown request %s", wsMsg.Type, wsMsg.RequestID)
+			return
+		}
+	}
+	// An author that tags requests tags every response; routing an untagged
+	// one by its payload client_uuid is left to legacy hosts.
+	if client.IsHostAuthor && wsMsg.RequestID == "" && strings.HasSuffix(wsMsg.Type, "_response") && hostTagsRequests(client.HostUUID) {
+		log.Printf("Dropping untagged %s from a host that tags requests", wsMsg.Type)
+		return
+	}
+	// Responses for a client on another relay node are handled there. Only
+	// a connected author forwards; a forwarded response arrives without one.
+	if client.IsHostAuthor && conn != nil && relayCluster.forwardAuthorResponse(client.HostUUID, wsMsg) {
+		return
+	}
 
 	switch wsMsg.Type {
 	case "auth_pubkey":
@@ -70,10 +111,16 @@ func dispatchMessage(client *Client, conn *websocket.Conn, wsMsg WSMessage) {
 		handleGetDashData(client, conn)
 	case "get_dash_data_response":
 		handleGetDashDatRes(client, conn, &wsMsg)
+	case "reissue_capabilities":
+		handleReissueCapabilities(client, conn)
 	case "update_username":
 		handleUpdateUsername(client, conn, &wsMsg)
 	case "update_username_response":
 		handleUpdateUsernameRes(client, conn, &wsMsg)
+	case "identity_migrate":
+		handleIdentityMigrate(client, conn, &wsMsg)
+	case "identity_migrate_response":
+		handleIdentityMigrateRes(client, conn, &wsMsg)
 	case "create_space":
 		handleCreateSpace(client, conn, &wsMsg)
 	case "create_space_response":
@@ -126,10 +173,46 @@ func dispatchMessage(client *Client, conn *websocket.Conn, wsMsg WSMessage) {
 		leaveChannel(client)
 	case "chat":
 		handleChatMessage(client, conn, &wsMsg)
+	case "save_chat_message_response":
+		handleSaveChatMessageRes(client, conn, &wsMsg)
 	case "get_messages":
 		handleGetMessages(client, conn, &wsMsg)
 	case "get_messages_response":
 		handleGetMessagesRes(client, conn, &wsMsg)
+	case "list_devices":
+		handleListDevices(client, conn)
+	case "list_devices_response":
+		handleListDevicesRes(client, conn, &wsMsg)
+	case "revoke_device":
+		handleRevokeDevice(client, conn, &wsMsg)
+	case "revoke_device_response":
+		handleRevokeDeviceRes(client, conn, &wsMsg)
+	case "device_deny_list":
+		handleDeviceDenyList(client, conn, &wsMsg)
+	case "report_message":
+		handleReportMessage(client, conn, &wsMsg)
+	case "report_user":
+		handleReportUser(client, conn, &wsMsg)
+	case "report_response":
+		handleReportRes(client, conn, &wsMsg)
+	case "list_reports":
+		handleListReports(client, conn, &wsMsg)
+	case "list_reports_response":
+		handleListReportsRes(client, conn, &wsMsg)
+	case "resolve_report":
+		handleResolveReport(client, conn, &wsMsg)
+	case "resolve_report_response":
+		handleResolveReportRes(client, conn, &wsMsg)
+	case "get_audit_log":
+		handleGetAuditLog(client, conn, &wsMsg)
+	case "get_audit_log_response":
+		handleGetAuditLogRes(client, conn, &wsMsg)
+	case "export_space":
+		handleExportSpace(client, conn, &wsMsg)
+	case "export_space_response":
+		handleExportSpaceRes(client, conn, &wsMsg)
+	case "get_quota_usage":
+		handleGetQuotaUsage(client, conn)
 	case "relay_health_check_ack":
 		handleRelayHealthCheckAck(client, conn, &wsMsg)
 	case "error":
@@ -138,6 +221,15 @@ func dispatchMessage(client *Client, conn *websocket.Conn, wsMsg WSMessage) {
 			safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid error data"}})
 			return
 		}
+		if wsMsg.RequestID != "" {
+			if entry, ok := hostRequests.answer(client.HostUUID, wsMsg.RequestID); ok {
+				SendToClient(client.HostUUID, entry.clientUUID, WSMessage{
+					Type: "host_error",
+					Data: RequestFailure{RequestID: wsMsg.RequestID, RequestType: entry.msgType, Content: data.Content},
+				})
+			}
+			return
+		}
 		SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/rand"
+	"gochat/db"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// On shutdown the relay drains instead of dropping hijacked websockets:
+// joins are refused, every client and host author is told to come back
+// later, send queues get a chance to flush, hosts are marked offline, and
+// each connection gets a close frame before the process exits.
+
+// defaultDrainTimeout bounds the whole drain unless
+// CHAT_RELAY_DRAIN_TIMEOUT says otherwise.
+const defaultDrainTimeout = 10 * time.Second
+
+// relayReconnectAfter and relayReconnectJitter make up the reconnect hint.
+// The jitter spreads clients out so a restarted relay is not hit by all of
+// them at once.
+const (
+	relayReconnectAfter  = 2 * time.Second
+	relayReconnectJitter = 3 * time.Second
+)
+
+const drainPollInterval = 20 * time.Millisecond
+
+// socketRegistry tracks every open websocket, joined to a host or not, so
+// the drain can close all of them.
+type socketRegistry struct {
+	mu       sync.Mutex
+	conns    map[*websocket.Conn]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+var liveSockets = newSocketRegistry()
+
+func newSocketRegistry() *socketRegistry {
+	return &socketRegistry{conns: make(map[*websocket.Conn]struct{})}
+}
+
+// add registers a new connection; it fails once the relay is draining.
+func (s *socketRegistry) add(conn *websocket.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// remove is called once the connection's read loop and cleanup are done.
+func (s *socketRegistry) remove(conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; !ok {
+		return
+	}
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+func (s *socketRegistry) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// startDrain stops new connections and joins.
+func (s *socketRegistry) startDrain() {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+}
+
+func (s *socketRegistry) snapshot() []*websocket.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]*websocket.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// wait reports whether every connection finished before the deadline.
+func (s *socketRegistry) wait(deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// rejectDraining turns away a connection that arrived after the drain
+// started.
+func rejectDraining(conn *websocket.Conn) {
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "relay shutting down")
+	_ = conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+}
+
+func reconnectHint() time.Duration {
+	jitter, err := rand.Int(rand.Reader, big.NewInt(int64(relayReconnectJitter/time.Millisecond)))
+	if err != nil {
+		return relayReconnectAfter
+	}
+	return relayReconnectAfter + time.Duration(jitter.Int64())*time.Millisecond
+}
+
+// localClients returns every client joined to a host on this node.
+func localClients() []*Client {
+	hostsMu.Lock()
+	hosts := make([]*Host, 0, len(Hosts))
+	for _, host := range Hosts {
+		hosts = append(hosts, host)
+	}
+	hostsMu.Unlock()
+
+	var clients []*Client
+	for _, host := range hosts {
+		host.mu.Lock()
+		for _, client := range host.ClientsByConn {
+			clients = append(clients, client)
+		}
+		host.mu.Unlock()
+	}
+	return clients
+}
+
+// localAuthorHosts returns the hosts whose author is connected to this node.
+func localAuthorHosts() []string {
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+	var hostUUIDs []string
+	for uuid, host := range Hosts {
+		host.mu.Lock()
+		if host.AuthorConn != nil {
+			hostUUIDs = append(hostUUIDs, uuid)
+		}
+		host.mu.Unlock()
+	}
+	return hostUUIDs
+}
+
+func waitForSendQueues(clients []*Client, deadline time.Time) bool {
+	for time.Now().Before(deadline) {
+		pending := false
+		for _, client := range clients {
+			if client.unsent.Load() > 0 {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			return true
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return false
+}
+
+// markHostsOffline clears the online flag of the hosts this relay serves. A
+// clustered node only clears the hosts whose author it holds; the others
+// are still reachable through the rest of the cluster.
+func markHostsOffline() {
+	if relayCluster == nil {
+		if _, err := db.HostDB.Exec(`UPDATE hosts SET online = 0 WHERE online = 1`); err != nil {
+			log.Println("Database error marking hosts offline:", err)
+		}
+		return
+	}
+	for _, hostUUID := range localAuthorHosts() {
+		HandleUpdateHostOffline(hostUUID)
+	}
+}
+
+// drainRelay runs the shutdown sequence. Half the timeout goes to flushing
+// send queues; the rest to closing connections, after which any left are
+// cut.
+func drainRelay(timeout time.Duration) {
+	start := time.Now()
+	flushDeadline := start.Add(timeout / 2)
+	closeDeadline := start.Add(timeout)
+
+	liveSockets.startDrain()
+
+	clients := localClients()
+	for _, client := range clients {
+		safeSend(client, client.Conn, WSMessage{
+			Type: "relay_shutdown",
+			Data: RelayShutdown{
+				Reason:           "The relay is restarting",
+				ReconnectAfterMs: reconnectHint().Milliseconds(),
+			},
+		})
+	}
+	if !waitForSendQueues(clients, flushDeadline) {
+		log.Println("Drain: some send queues did not flush in time")
+	}
+
+	markHostsOffline()
+
+	conns := liveSockets.snapshot()
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "relay shutting down")
+	for _, conn := range conns {
+		_ = conn.WriteControl(websocket.CloseMessage, closeMsg, closeDeadline)
+	}
+	// Peers answer the close frame, which ends their read loops and runs
+	// the usual cleanup.
+	if liveSockets.wait(closeDeadline) {
+		log.Printf("Drained %d connections in %s", len(conns), time.Since(start).Round(time.Millisecond))
+		return
+	}
+	remaining := liveSockets.snapshot()
+	log.Printf("Drain: closing %d connections that did not close in time", len(remaining))
+	for _, conn := range remaining {
+		_ = conn.Close()
+	}
+	liveSockets.wait(time.Now().Add(time.Second))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"gochat/db"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRelayIntegrationDrain(t *testing.T) {
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := env.dialWS(t)
+	defer member.Close()
+	env.joinHost(t, member)
+	// A connection that never joined a host still gets a close frame.
+	idle := env.dialWS(t)
+	defer idle.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		drainRelay(4 * time.Second)
+		close(drained)
+	}()
+	t.Cleanup(func() { <-drained })
+
+	for _, msg := range []WSMessage{author.mustNextType("relay_shutdown"), mustReadType(t, member, "relay_shutdown", testReadTimeout)} {
+		notice, err := decodeData[RelayShutdown](msg.Data)
+		if err != nil {
+			t.Fatalf("decode relay_shutdown: %v", err)
+		}
+		if notice.ReconnectAfterMs < relayReconnectAfter.Milliseconds() ||
+			notice.ReconnectAfterMs > (relayReconnectAfter+relayReconnectJitter).Milliseconds() {
+			t.Fatalf("unexpected reconnect hint %dms", notice.ReconnectAfterMs)
+		}
+	}
+
+	for name, conn := range map[string]*websocket.Conn{"member": member, "idle": idle} {
+		_, err := readOneMessage(conn, testReadTimeout)
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+			t.Fatalf("%s: expected a going-away close frame, got %v", name, err)
+		}
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(testReadTimeout):
+		t.Fatal("drain did not finish")
+	}
+
+	var online int
+	if err := db.HostDB.QueryRow(`SELECT online FROM hosts WHERE uuid = ?`, env.hostUUID).Scan(&online); err != nil {
+		t.Fatalf("query host: %v", err)
+	}
+	if online != 0 {
+		t.Fatal("expected the drain to mark the host offline")
+	}
+	hostsMu.Lock()
+	host := Hosts[env.hostUUID]
+	hostsMu.Unlock()
+	host.mu.Lock()
+	remaining := len(host.ClientsByConn)
+	host.mu.Unlock()
+	if remaining != 0 {
+		t.Fatalf("expected every client cleaned up, %d left", remaining)
+	}
+
+	// The relay no longer takes connections.
+	late := env.dialWS(t)
+	defer late.Close()
+	_, err := readOneMessage(late, testReadTimeout)
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater {
+		t.Fatalf("expected a try-again-later close frame, got %v", err)
+	}
+}
@@ -46,8 +46,15 @@ func registerOrCreateHost(hostUUID string) (*Host, error) {
 	return host, nil
 }
 
-func registerClient(host *Host, conn *websocket.Conn, clientIP string, isHostCandidate bool) *Client {
+// registerClient adds the connection to the host, unless the host's client
+// quota turns it away.
+func registerClient(host *Host, conn *websocket.Conn, clientIP string, isHostCandidate bool) (*Client, *QuotaExceeded) {
+	quota := nodeQuota(currentHostQuota(host))
 	host.mu.Lock()
+	if exceeded := admitClientLocked(host, quota, conn, isHostCandidate); exceeded != nil {
+		host.mu.Unlock()
+		return nil, exceeded
+	}
 
 	if oldClient, ok := host.ClientsByConn[conn]; ok {
 		// If old client was authenticated, unregister their IP
@@ -60,15 +67,16 @@ func registerClient(host *Host, conn *websocket.Conn, clientIP string, isHostCan
 			delete(host.ClientsByPublicKey, oldClient.PublicKey)
 		}
 		delete(host.ClientsByConn, conn)
-		close(oldClient.SendQueue)
-		close(oldClient.Done)
+		oldClient.close()
 	}
 
 	clientUUID := uuid.New().String()
 	userChallenge := newAuthChallenge()
 	hostChallenge := ""
+	queueSize := clientSendQueueSize
 	if isHostCandidate {
 		hostChallenge = newAuthChallenge()
+		queueSize = authorSendQueueSize
 	}
 	client := &Client{
 		Conn:              conn,
@@ -80,31 +88,32 @@ func registerClient(host *Host, conn *websocket.Conn, clientIP string, isHostCan
 		IsHostCandidate:   isHostCandidate,
 		IsHostAuthor:      false,
 		IsAuthenticated:   false,
-		SendQueue:         make(chan WSMessage, 64),
+		SendQueue:         make(chan WSMessage, queueSize),
 		Done:              make(chan struct{}),
 	}
 
 	host.ClientsByConn[conn] = client
 	host.ClientConnsByUUID[clientUUID] = conn
 	host.mu.Unlock()
+	relayCluster.announceClient(clientUUID)
 
 	go client.WritePump()
 
-	client.SendQueue <- WSMessage{
+	safeSend(client, conn, WSMessage{
 		Type: "join_ack",
 		Data: "Joined host successfully",
-	}
-	client.SendQueue <- WSMessage{
+	})
+	safeSend(client, conn, WSMessage{
 		Type: "auth_challenge",
 		Data: AuthChallenge{Challenge: userChallenge},
-	}
+	})
 	if isHostCandidate && hostChallenge != "" {
-		client.SendQueue <- WSMessage{
+		safeSend(client, conn, WSMessage{
 			Type: "host_auth_challenge",
 			Data: HostAuthChallenge{Challenge: hostChallenge},
-		}
+		})
 	}
-	return client
+	return client, nil
 }
 
 func findHostClientByIdentity(host *Host, userID int, userPublicKey string) (*Client, bool) {
@@ -252,6 +261,7 @@ func removeSpaceStateLocked(host *Host, spaceUUID string) {
 			continue
 		}
 		delete(host.ChannelToSpace, channelUUID)
+		delete(host.SenderKeys, channelUUID)
 		if channel, ok := host.Channels[channelUUID]; ok {
 			channel.mu.Lock()
 			for conn := range channel.Users {
@@ -346,6 +356,8 @@ func handleGetDashData(client *Client, conn *websocket.Conn) {
 	host.mu.Lock()
 	userID := host.ClientsByConn[conn].UserID
 	username := host.ClientsByConn[conn].Username
+	deviceID := registeredDeviceID(client)
+	deviceName := client.DeviceName
 	host.mu.Unlock()
 
 	SendToAuthor(client, WSMessage{ // Regular client assuming host is already logged in
@@ -356,6 +368,8 @@ func handleGetDashData(client *Client, conn *websocket.Conn) {
 			UserEncPublicKey: client.EncPublicKey,
 			Username:         username,
 			ClientUUID:       client.ClientUUID,
+			DeviceID:         deviceID,
+			DeviceName:       deviceName,
 		},
 	})
 }
@@ -366,6 +380,7 @@ func handleGetDashDatRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage)
 		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid dashboard data"}})
 		return
 	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
 
 	if host, exists := GetHost(client.HostUUID); exists {
 		var activeDevices []ActiveDevice
@@ -460,6 +475,7 @@ func handleCreateSpaceRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage
 		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid create space response data"}})
 		return
 	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
 
 	host, exists := GetHost(client.HostUUID)
 	if !exists {
@@ -533,7 +549,7 @@ func handleDeleteSpaceRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage
 		return
 	}
 
-	clientUUID := data["ClientUUID"]
+	clientUUID := responseClientUUID(client, wsMsg, data["ClientUUID"])
 	spaceUUID := data["SpaceUUID"]
 
 	if spaceUUID != "" {
@@ -542,6 +558,7 @@ func handleDeleteSpaceRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage
 			removeSpaceStateLocked(host, spaceUUID)
 			host.mu.Unlock()
 		}
+		relayCluster.publishHostEvent(clusterMessage{Kind: clusterSpaceRemoved, HostUUID: client.HostUUID, Target: spaceUUID})
 	}
 
 	SendToClient(client.HostUUID, clientUUID, WSMessage{
@@ -579,12 +596,14 @@ func handleCreateChannelRes(client *Client, conn *websocket.Conn, wsMsg *WSMessa
 		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid create channel response data"}})
 		return
 	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
 
 	if host, exists := GetHost(client.HostUUID); exists {
 		host.mu.Lock()
 		host.ChannelToSpace[data.Channel.UUID] = data.SpaceUUID
 		host.mu.Unlock()
 	}
+	relayCluster.publishHostEvent(clusterMessage{Kind: clusterChannelMapped, HostUUID: client.HostUUID, Target: data.SpaceUUID, Value: data.Channel.UUID})
 
 	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
 		Type: "create_channel_success",
@@ -639,12 +658,15 @@ func handleDeleteChannelRes(client *Client, conn *websocket.Conn, wsMsg *WSMessa
 		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid delete channel success data"}})
 		return
 	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
 
 	if host, exists := GetHost(client.HostUUID); exists {
 		host.mu.Lock()
 		delete(host.ChannelToSpace, data.UUID)
+		delete(host.SenderKeys, data.UUID)
 		host.mu.Unlock()
 	}
+	relayCluster.publishHostEvent(clusterMessage{Kind: clusterChannelRemoved, HostUUID: client.HostUUID, Value: data.UUID})
 
 	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
 		Type: "delete_channel_success",
@@ -689,6 +711,7 @@ func handleInviteUserRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage)
 		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid invite user response data"}})
 		return
 	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
 	// send back to inviter
 	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
 		Type: "invite_user_success",
@@ -697,27 +720,8 @@ func handleInviteUserRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage)
 		},
 	})
 
-	// send to invitee
-	host, exists := GetHost(client.HostUUID)
-	if !exists {
-		log.Printf("host %s not found\n", client.HostUUID)
-		SendToClient(client.HostUUID, client.ClientUUID, WSMessage{
-			Type: "author_error",
-			Data: ChatError{Content: "Failed to connect to the host"},
-		})
-		return
-	}
-
-	host.mu.Lock()
-	inviteeClient, ok := findHostClientByIdentity(host, data.UserID, data.UserPublicKey)
-	if !ok {
-		host.mu.Unlock()
-		log.Println("SendToClient: invitee not connected to host")
-		return
-	}
-	host.mu.Unlock()
-
-	SendToClient(client.HostUUID, inviteeClient.ClientUUID, WSMessage{
+	// send to invitee, who may be connected to another relay node
+	SendToUser(client.HostUUID, data.UserID, data.UserPublicKey, WSMessage{
 		Type: "invite_user_update",
 		Data: InviteUserUpdate{
 			Invite: data.Invite,
@@ -750,6 +754,7 @@ func handleAcceptInviteRes(client *Client, conn *websocket.Conn, wsMsg *WSMessag
 		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid accept invite response data"}})
 		return
 	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
 
 	host, exists := GetHost(client.HostUUID)
 	if !exists {
@@ -825,6 +830,7 @@ func handleDeclineInviteRes(client *Client, conn *websocket.Conn, wsMsg *WSMessa
 		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid decline invite response data"}})
 		return
 	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
 	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
 		Type: "decline_invite_success",
 		Data: DeclineInviteSuccess{
@@ -859,6 +865,7 @@ func handleLeaveSpaceRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage)
 		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid leave space response data"}})
 		return
 	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
 
 	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
 		Type: "leave_space_success",
@@ -885,6 +892,7 @@ func handleLeaveSpaceRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage)
 	}
 
 	host.mu.Lock()
+	markSenderKeysStaleLocked(host, data.SpaceUUID)
 	leaveConn, ok := host.ClientConnsByUUID[data.ClientUUID]
 	if ok {
 		leaveClient := host.ClientsByConn[leaveConn]
@@ -893,6 +901,7 @@ func handleLeaveSpaceRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage)
 		}
 	}
 	host.mu.Unlock()
+	relayCluster.publishHostEvent(clusterMessage{Kind: clusterSenderKeysStale, HostUUID: host.UUID, Target: data.SpaceUUID})
 
 }
 
@@ -957,12 +966,20 @@ func joinChannel(client *Client, channelUUID string, capabilityToken string) {
 		return
 	}
 
+	quota := nodeQuota(currentHostQuota(host))
 	host.mu.Lock()
 	if _, ok := host.Channels[channelUUID]; !ok {
 		host.Channels[channelUUID] = &Channel{Users: make(map[*websocket.Conn]int)}
 	}
 	channel := host.Channels[channelUUID]
 	channel.mu.Lock()
+	if exceeded := admitSubscriberLocked(host, quota, channel, client.Conn); exceeded != nil {
+		channel.mu.Unlock()
+		host.mu.Unlock()
+		SendToClient(client.HostUUID, client.ClientUUID, WSMessage{Type: "quota_exceeded", Data: exceeded})
+		noteQuotaRejection(host)
+		return
+	}
 	channel.Users[client.Conn] = client.UserID
 	channel.mu.Unlock()
 	host.ChannelSubscriptions[client.Conn] = channelUUID
@@ -1101,10 +1118,24 @@ func handleRemoveSpaceUserRes(client *Client, conn *websocket.Conn, wsMsg *WSMes
 		return
 	}
 
+	removeLocalSpaceUser(host, data.SpaceUUID, data.UserID, data.UserPublicKey)
+	relayCluster.publishHostEvent(clusterMessage{
+		Kind:     clusterSpaceUserRemoved,
+		HostUUID: client.HostUUID,
+		Target:   data.SpaceUUID,
+		UserID:   data.UserID,
+		Value:    data.UserPublicKey,
+	})
+}
+
+// removeLocalSpaceUser drops the user's connection on this node from the
+// space and tells it to leave.
+func removeLocalSpaceUser(host *Host, spaceUUID string, userID int, userPublicKey string) {
 	host.mu.Lock()
-	removeClient, ok := findHostClientByIdentity(host, data.UserID, data.UserPublicKey)
+	markSenderKeysStaleLocked(host, spaceUUID)
+	removeClient, ok := findHostClientByIdentity(host, userID, userPublicKey)
 	if ok && removeClient != nil {
-		pruneClientFromSpaceLocked(host, removeClient, data.SpaceUUID)
+		pruneClientFromSpaceLocked(host, removeClient, spaceUUID)
 	} else {
 		ok = false
 	}
@@ -1112,12 +1143,11 @@ func handleRemoveSpaceUserRes(client *Client, conn *websocket.Conn, wsMsg *WSMes
 
 	if ok {
 		// tell connected user to leave
-		SendToClient(client.HostUUID, removeClient.ClientUUID, WSMessage{
+		SendToClient(host.UUID, removeClient.ClientUUID, WSMessage{
 			Type: "leave_space_success",
 			Data: "",
 		})
 	}
-
 }
 
 func handleChatMessage(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
@@ -1204,7 +1234,23 @@ func handleChatMessage(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
-	if channelUUID != "" {
+	distributedEpoch, accepted := acceptSenderKeyEnvelope(client, conn, host, channelUUID, data.Envelope)
+	if !accepted {
+		return
+	}
+
+	if exceeded := takeHostMessage(host, time.Now()); exceeded != nil {
+		safeSend(client, conn, WSMessage{Type: "quota_exceeded", Data: exceeded})
+		noteQuotaRejection(host)
+		return
+	}
+	// Only now is the distribution on its way to the members; in strict
+	// delivery it reaches them once the host has stored it.
+	if distributedEpoch != 0 {
+		recordSenderKey(host, channelUUID, client.PublicKey, distributedEpoch, stringValue(data.Envelope["message_id"]), strictChatDelivery)
+	}
+
+	if channelUUID != "" && !strictChatDelivery {
 		BroadcastToChannel(client.HostUUID, channelUUID, WSMessage{
 			Type: "chat",
 			Data: ChatPayload{
@@ -1224,10 +1270,60 @@ func handleChatMessage(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
 			Username:         client.Username,
 			ChannelUUID:      channelUUID,
 			Envelope:         data.Envelope,
+			ClientUUID:       client.ClientUUID,
+			Strict:           strictChatDelivery,
 		},
 	})
 }
 
+// strictChatDelivery holds chat back until the host has stored it, so every
+// live message carries the host's per-channel sequence number. Set by
+// CHAT_RELAY_STRICT_DELIVERY.
+var strictChatDelivery bool
+
+// handleSaveChatMessageRes tells the sender whether the host stored its
+// message. In strict delivery it also broadcasts the stored message.
+func handleSaveChatMessageRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	if !client.IsHostAuthor {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Only the host can confirm messages"}})
+		return
+	}
+	data, err := decodeData[SaveChatMessageResponse](wsMsg.Data)
+	if err != nil {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid save chat message response data"}})
+		return
+	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
+	if strictChatDelivery {
+		if host, ok := GetHost(client.HostUUID); ok {
+			settleSenderKey(host, data.ChannelUUID, data.MessageID, data.Error == "")
+		}
+	}
+
+	if data.Error == "" && data.Envelope != nil && data.ChannelUUID != "" {
+		timestamp, err := time.Parse(time.RFC3339, data.Timestamp)
+		if err != nil {
+			timestamp = time.Now().UTC()
+		}
+		BroadcastToChannel(client.HostUUID, data.ChannelUUID, WSMessage{
+			Type: "chat",
+			Data: ChatPayload{Envelope: data.Envelope, Timestamp: timestamp, Seq: data.Seq},
+		})
+	}
+
+	if data.Error != "" {
+		SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
+			Type: "chat_save_failed",
+			Data: ChatSaveFailed{MessageID: data.MessageID, ChannelUUID: data.ChannelUUID, Error: data.Error},
+		})
+		return
+	}
+	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
+		Type: "chat_saved",
+		Data: ChatSaved{MessageID: data.MessageID, ChannelUUID: data.ChannelUUID, ID: data.ID, Timestamp: data.Timestamp, Seq: data.Seq},
+	})
+}
+
 func handleGetMessages(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
 	data, err := decodeData[GetMessagesClient](wsMsg.Data)
 	if err != nil {
@@ -1308,6 +1404,8 @@ func handleGetMessages(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
 			ChannelUUID:    channelUUID,
 			ClientUUID:     client.ClientUUID,
 			BeforeUnixTime: data.BeforeUnixTime,
+			FromSeq:        data.FromSeq,
+			ToSeq:          data.ToSeq,
 		},
 	})
 }
@@ -1318,13 +1416,16 @@ func handleGetMessagesRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage
 		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid chat message response data"}})
 		return
 	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
 
 	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
 		Type: "get_messages_success",
 		Data: GetMessagesSuccess{
 			Messages:        data.Messages,
+			SenderKeys:      data.SenderKeys,
 			ChannelUUID:     data.ChannelUUID,
 			HasMoreMessages: data.HasMoreMessages,
+			FromSeq:         data.FromSeq,
 		},
 	})
 }
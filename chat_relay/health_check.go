@@ -32,36 +32,49 @@ func popHostHealthCheck(nonce string) (chan struct{}, bool) {
 	return ch, ok
 }
 
-func resolveHostHealthCheck(nonce string) {
-	if ch, ok := popHostHealthCheck(nonce); ok {
+func resolveHostHealthCheck(nonce string) bool {
+	ch, ok := popHostHealthCheck(nonce)
+	if ok {
 		select {
 		case ch <- struct{}{}:
 		default:
 		}
 	}
+	return ok
 }
 
 func ensureHostResponsive(host *Host, timeout time.Duration) error {
 	host.mu.Lock()
 	authorConn := host.AuthorConn
-	if authorConn == nil {
-		host.mu.Unlock()
-		return fmt.Errorf("host author is offline")
-	}
-	authorClient := host.ClientsByConn[authorConn]
-	if authorClient == nil || !authorClient.IsHostAuthor {
-		host.mu.Unlock()
-		return fmt.Errorf("host author session missing")
+	var authorClient *Client
+	if authorConn != nil {
+		authorClient = host.ClientsByConn[authorConn]
+		if authorClient == nil || !authorClient.IsHostAuthor {
+			host.mu.Unlock()
+			return fmt.Errorf("host author session missing")
+		}
 	}
 	host.mu.Unlock()
 
+	// In cluster mode the author may be connected to another relay node; the
+	// ack comes back over the bus.
+	_, remote := relayCluster.authorNode(host.UUID)
+	if authorClient == nil && !remote {
+		return fmt.Errorf("host author is offline")
+	}
+
 	nonce := uuid.NewString()
 	done := registerHostHealthCheck(nonce)
 
-	safeSend(authorClient, authorConn, WSMessage{
+	check := WSMessage{
 		Type: "relay_health_check",
 		Data: RelayHealthCheck{Nonce: nonce},
-	})
+	}
+	if authorClient != nil {
+		safeSend(authorClient, authorConn, check)
+	} else {
+		relayCluster.forwardToAuthor(host.UUID, "", check)
+	}
 
 	select {
 	case <-done:
@@ -83,5 +96,7 @@ func handleRelayHealthCheckAck(client *Client, conn *websocket.Conn, wsMsg *WSMe
 	if data.Nonce == "" {
 		return
 	}
-	resolveHostHealthCheck(data.Nonce)
+	if !resolveHostHealthCheck(data.Nonce) {
+		relayCluster.publishHostEvent(clusterMessage{Kind: clusterHealthAck, HostUUID: client.HostUUID, Value: data.Nonce})
+	}
 }
@@ -12,6 +12,21 @@ import (
 	"github.com/google/uuid"
 )
 
+// clientHostColumns matches scanClientHost.
+const clientHostColumns = `id, uuid, name, description, icon_url, software_version, signing_public_key, COALESCE(online, 0)`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanClientHost(row rowScanner) (ClientHost, error) {
+	var host ClientHost
+	var online int
+	err := row.Scan(&host.ID, &host.UUID, &host.Name, &host.Description, &host.IconURL, &host.SoftwareVersion, &host.SigningPublicKey, &online)
+	host.Online = online == 1
+	return host, err
+}
+
 func HandleGetHostsByUUIDs(c *gin.Context) {
 	var req UUIDListRequest
 	if err := c.ShouldBindJSON(&req); err != nil || len(req.UUIDs) == 0 {
@@ -26,7 +41,7 @@ func HandleGetHostsByUUIDs(c *gin.Context) {
 		args[i] = uuid
 	}
 
-	query := `SELECT uuid, name, online FROM hosts WHERE uuid IN (` + strings.Join(placeholders, ",") + `)`
+	query := `SELECT uuid, name, description, icon_url, online FROM hosts WHERE uuid IN (` + strings.Join(placeholders, ",") + `)`
 	rows, err := db.HostDB.Query(query, args...)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Database query error"})
@@ -36,15 +51,17 @@ func HandleGetHostsByUUIDs(c *gin.Context) {
 
 	var results []gin.H
 	for rows.Next() {
-		var uuid, name string
+		var uuid, name, description, iconURL string
 		var online int
-		if err := rows.Scan(&uuid, &name, &online); err != nil {
+		if err := rows.Scan(&uuid, &name, &description, &iconURL, &online); err != nil {
 			continue
 		}
 		results = append(results, gin.H{
-			"uuid":   uuid,
-			"name":   name,
-			"online": online,
+			"uuid":        uuid,
+			"name":        name,
+			"description": description,
+			"icon_url":    iconURL,
+			"online":      online,
 		})
 	}
 
@@ -54,9 +71,9 @@ func HandleGetHostsByUUIDs(c *gin.Context) {
 func HandleGetHost(c *gin.Context) {
 	uuid := c.Param("uuid")
 
-	var name string
-	query := `SELECT name FROM hosts WHERE uuid = ?`
-	err := db.HostDB.QueryRow(query, uuid).Scan(&name)
+	var name, description, iconURL, softwareVersion, signingPublicKey string
+	query := `SELECT name, description, icon_url, software_version, signing_public_key FROM hosts WHERE uuid = ?`
+	err := db.HostDB.QueryRow(query, uuid).Scan(&name, &description, &iconURL, &softwareVersion, &signingPublicKey)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(404, gin.H{"error": "Host not found by uuid"})
@@ -67,8 +84,12 @@ func HandleGetHost(c *gin.Context) {
 	}
 
 	c.JSON(200, gin.H{
-		"name": name,
-		"uuid": uuid,
+		"name":               name,
+		"uuid":               uuid,
+		"description":        description,
+		"icon_url":           iconURL,
+		"software_version":   softwareVersion,
+		"signing_public_key": signingPublicKey,
 	})
 }
 
@@ -138,14 +159,12 @@ func registerOrUpdateHost(hostUUID, name, signingPublicKey string) (ClientHost,
 	}
 
 	if err == sql.ErrNoRows {
-		var host ClientHost
 		insertQuery := `
 			INSERT INTO hosts (uuid, name, signing_public_key)
 			VALUES (?, ?, ?)
-			RETURNING id, uuid, name, signing_public_key
-		`
-		if insertErr := db.HostDB.QueryRow(insertQuery, hostUUID, name, signingPublicKey).
-			Scan(&host.ID, &host.UUID, &host.Name, &host.SigningPublicKey); insertErr != nil {
+			RETURNING ` + clientHostColumns
+		host, insertErr := scanClientHost(db.HostDB.QueryRow(insertQuery, hostUUID, name, signingPublicKey))
+		if insertErr != nil {
 			return ClientHost{}, http.StatusInternalServerError, insertErr
 		}
 		return host, http.StatusCreated, nil
@@ -153,10 +172,9 @@ func registerOrUpdateHost(hostUUID, name, signingPublicKey string) (ClientHost,
 
 	trimmedExistingKey := strings.TrimSpace(existingSigningKey)
 	if trimmedExistingKey != "" && trimmedExistingKey != signingPublicKey {
-		return ClientHost{}, http.StatusConflict, fmt.Errorf("host signing key mismatch for existing host UUID")
+		return ClientHost{}, http.StatusConflict, fmt.Errorf("host signing key mismatch for existing host UUID; use key rotation to replace it")
 	}
 
-	var host ClientHost
 	updateQuery := `
 		UPDATE hosts
 		SET name = ?,
@@ -165,10 +183,9 @@ func registerOrUpdateHost(hostUUID, name, signingPublicKey string) (ClientHost,
 				ELSE signing_public_key
 			END
 		WHERE uuid = ?
-		RETURNING id, uuid, name, signing_public_key
-	`
-	if updateErr := db.HostDB.QueryRow(updateQuery, name, signingPublicKey, hostUUID).
-		Scan(&host.ID, &host.UUID, &host.Name, &host.SigningPublicKey); updateErr != nil {
+		RETURNING ` + clientHostColumns
+	host, updateErr := scanClientHost(db.HostDB.QueryRow(updateQuery, name, signingPublicKey, hostUUID))
+	if updateErr != nil {
 		return ClientHost{}, http.StatusInternalServerError, updateErr
 	}
 
@@ -56,13 +56,16 @@ func handleHostAuth(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
 		}
 	}
 	host.AuthorConn = conn
+	host.AuthorRequestIDs = data.RequestIDs
 	client.IsHostAuthor = true
 	client.HostAuthChallenge = newAuthChallenge()
 	host.mu.Unlock()
 
 	HandleUpdateHostOnline(host.UUID)
+	relayCluster.announceAuthor(host.UUID, data.RequestIDs)
 	safeSend(client, conn, WSMessage{
 		Type: "host_auth_success",
 		Data: "Host authenticated",
 	})
+	safeSend(client, conn, WSMessage{Type: "quota_usage", Data: hostQuotaUsage(host)})
 }
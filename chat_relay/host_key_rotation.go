@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"gochat/db"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Rotation statements are only accepted close to when they were signed so a
+// captured request cannot be replayed later.
+const hostKeyRotationMaxSkew = 5 * time.Minute
+
+func hostKeyRotationMessage(hostUUID, oldSigningPublicKey, newSigningPublicKey string, issuedAt int64) string {
+	return fmt.Sprintf("parch-host-rotate-key:%s:%s:%s:%d", hostUUID, oldSigningPublicKey, newSigningPublicKey, issuedAt)
+}
+
+func HandleRotateHostKey(c *gin.Context) {
+	var req RotateHostKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid rotate key request"})
+		return
+	}
+
+	host, statusCode, err := rotateHostSigningKey(req, time.Now().UTC())
+	if err != nil {
+		if statusCode == http.StatusInternalServerError {
+			log.Printf("rotate host key failed for %s: %v", req.UUID, err)
+			c.JSON(statusCode, gin.H{"error": "Failed to rotate host key"})
+			return
+		}
+		c.JSON(statusCode, gin.H{"error": err.Error()})
+		return
+	}
+
+	applyRotatedHostKey(host.UUID, host.SigningPublicKey)
+	relayCluster.publishHostEvent(clusterMessage{Kind: clusterHostKeyRotated, HostUUID: host.UUID, Value: host.SigningPublicKey})
+	c.JSON(statusCode, host)
+}
+
+func verifyHostKeyRotation(req RotateHostKeyRequest, now time.Time) error {
+	if _, err := uuid.Parse(req.UUID); err != nil {
+		return fmt.Errorf("uuid must be a valid UUID")
+	}
+	oldKey, err := parseHostSigningPublicKey(req.OldSigningPublicKey)
+	if err != nil {
+		return fmt.Errorf("old signing key: %w", err)
+	}
+	newKey, err := parseHostSigningPublicKey(req.NewSigningPublicKey)
+	if err != nil {
+		return fmt.Errorf("new signing key: %w", err)
+	}
+	if oldKey.Equal(newKey) {
+		return fmt.Errorf("new signing key must differ from the current key")
+	}
+
+	issuedAt := time.Unix(req.IssuedAt, 0)
+	if req.IssuedAt <= 0 || issuedAt.Before(now.Add(-hostKeyRotationMaxSkew)) || issuedAt.After(now.Add(hostKeyRotationMaxSkew)) {
+		return fmt.Errorf("rotation statement is expired or not yet valid")
+	}
+
+	message := []byte(hostKeyRotationMessage(req.UUID, req.OldSigningPublicKey, req.NewSigningPublicKey, req.IssuedAt))
+	signature, err := base64.RawStdEncoding.DecodeString(req.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize || !ed25519.Verify(oldKey, message, signature) {
+		return fmt.Errorf("invalid rotation signature")
+	}
+	newKeySignature, err := base64.RawStdEncoding.DecodeString(req.NewKeySignature)
+	if err != nil || len(newKeySignature) != ed25519.SignatureSize || !ed25519.Verify(newKey, message, newKeySignature) {
+		return fmt.Errorf("invalid new key signature")
+	}
+	return nil
+}
+
+// rotateHostSigningKey swaps hosts.signing_public_key and records the retired
+// key. Re-submitting a rotation that already happened succeeds so a host that
+// lost the response can finish its side of the rotation.
+func rotateHostSigningKey(req RotateHostKeyRequest, now time.Time) (ClientHost, int, error) {
+	req.UUID = strings.TrimSpace(req.UUID)
+	req.OldSigningPublicKey = strings.TrimSpace(req.OldSigningPublicKey)
+	req.NewSigningPublicKey = strings.TrimSpace(req.NewSigningPublicKey)
+	if err := verifyHostKeyRotation(req, now); err != nil {
+		return ClientHost{}, http.StatusBadRequest, err
+	}
+
+	tx, err := db.HostDB.Begin()
+	if err != nil {
+		return ClientHost{}, http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	host, err := scanClientHost(tx.QueryRow(`SELECT `+clientHostColumns+` FROM hosts WHERE uuid = ?`, req.UUID))
+	if err == sql.ErrNoRows {
+		return ClientHost{}, http.StatusNotFound, fmt.Errorf("host not found")
+	}
+	if err != nil {
+		return ClientHost{}, http.StatusInternalServerError, err
+	}
+	currentKey := strings.TrimSpace(host.SigningPublicKey)
+
+	if currentKey == req.NewSigningPublicKey {
+		var replacedBy string
+		err := tx.QueryRow(`
+			SELECT replaced_by_key FROM host_signing_key_history
+			 WHERE host_uuid = ? AND signing_public_key = ?
+		`, req.UUID, req.OldSigningPublicKey).Scan(&replacedBy)
+		if err == nil && replacedBy == req.NewSigningPublicKey {
+			return host, http.StatusOK, nil
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return ClientHost{}, http.StatusInternalServerError, err
+		}
+	}
+	if currentKey != req.OldSigningPublicKey {
+		return ClientHost{}, http.StatusConflict, fmt.Errorf("rotation statement does not match the current host signing key")
+	}
+
+	var retired int
+	if err := tx.QueryRow(`
+		SELECT COUNT(*) FROM host_signing_key_history
+		 WHERE host_uuid = ? AND signing_public_key = ?
+	`, req.UUID, req.NewSigningPublicKey).Scan(&retired); err != nil {
+		return ClientHost{}, http.StatusInternalServerError, err
+	}
+	if retired > 0 {
+		return ClientHost{}, http.StatusConflict, fmt.Errorf("new signing key was previously retired for this host")
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO host_signing_key_history (host_uuid, signing_public_key, replaced_by_key, rotation_signature)
+		VALUES (?, ?, ?, ?)
+	`, req.UUID, req.OldSigningPublicKey, req.NewSigningPublicKey, req.Signature); err != nil {
+		return ClientHost{}, http.StatusInternalServerError, err
+	}
+	if _, err := tx.Exec(`UPDATE hosts SET signing_public_key = ? WHERE uuid = ?`, req.NewSigningPublicKey, req.UUID); err != nil {
+		return ClientHost{}, http.StatusInternalServerError, err
+	}
+	if err := tx.Commit(); err != nil {
+		return ClientHost{}, http.StatusInternalServerError, err
+	}
+
+	host.SigningPublicKey = req.NewSigningPublicKey
+	return host, http.StatusOK, nil
+}
+
+// applyRotatedHostKey switches a live host to the new key. The current author
+// session authenticated with the old key, so it is demoted and challenged
+// again; the host answers with the new key once it has reloaded its config.
+func applyRotatedHostKey(hostUUID, signingPublicKey string) {
+	host, exists := GetHost(hostUUID)
+	if !exists {
+		return
+	}
+
+	host.mu.Lock()
+	if host.SigningPublicKey == signingPublicKey {
+		host.mu.Unlock()
+		return
+	}
+	host.SigningPublicKey = signingPublicKey
+	authorConn := host.AuthorConn
+	var authorClient *Client
+	challenge := ""
+	if authorConn != nil {
+		authorClient = host.ClientsByConn[authorConn]
+		if authorClient != nil {
+			authorClient.IsHostAuthor = false
+			challenge = newAuthChallenge()
+			authorClient.HostAuthChallenge = challenge
+		}
+		host.AuthorConn = nil
+	}
+	host.mu.Unlock()
+
+	if authorClient == nil {
+		return
+	}
+	safeSend(authorClient, authorConn, WSMessage{
+		Type: "host_key_rotated",
+		Data: HostKeyRotated{SigningPublicKey: signingPublicKey},
+	})
+	safeSend(authorClient, authorConn, WSMessage{
+		Type: "host_auth_challenge",
+		Data: HostAuthChallenge{Challenge: challenge},
+	})
+}
+
+// handleReissueCapabilities asks the host for fresh dashboard data on behalf
+// of every connected member so capabilities signed by a retired key are
+// replaced without waiting for them to expire.
+func handleReissueCapabilities(client *Client, conn *websocket.Conn) {
+	if !client.IsHostAuthor {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Only the host can reissue capabilities"}})
+		return
+	}
+	host, exists := GetHost(client.HostUUID)
+	if !exists {
+		return
+	}
+
+	host.mu.Lock()
+	requests := reissueRequestsLocked(host)
+	host.mu.Unlock()
+
+	// One batched message rather than a get_dash_data_request per member,
+	// which would fill the author's send queue on a busy host.
+	safeSend(client, conn, WSMessage{
+		Type: "reissue_capabilities_request",
+		Data: ReissueCapabilitiesRequest{Clients: requests},
+	})
+	relayCluster.publishHostEvent(clusterMessage{Kind: clusterReissueCapabilities, HostUUID: client.HostUUID})
+}
+
+// reissueRequestsLocked builds the batch for the members connected to this
+// node. Each entry carries its own request ID so the host's answers route
+// like any other response; the entries are untimed, since a member did not
+// ask for them.
+func reissueRequestsLocked(host *Host) []GetDashDataRequest {
+	requests := make([]GetDashDataRequest, 0, len(host.ClientsByConn))
+	for _, member := range host.ClientsByConn {
+		if member == nil || !member.IsAuthenticated || member.PublicKey == "" {
+			continue
+		}
+		requestID := uuid.NewString()
+		hostRequests.track(requestID, host.UUID, member.ClientUUID, "get_dash_data_request", false)
+		requests = append(requests, GetDashDataRequest{
+			RequestID:        requestID,
+			UserID:           member.UserID,
+			UserPublicKey:    member.PublicKey,
+			UserEncPublicKey: member.EncPublicKey,
+			Username:         member.Username,
+			ClientUUID:       member.ClientUUID,
+			DeviceID:         registeredDeviceID(member),
+			DeviceName:       member.DeviceName,
+		})
+	}
+	return requests
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"gochat/db"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type testSigningKey struct {
+	public  string
+	private ed25519.PrivateKey
+}
+
+func newTestSigningKey(t *testing.T) testSigningKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return testSigningKey{public: base64.RawStdEncoding.EncodeToString(pub), private: priv}
+}
+
+func signedRotation(hostUUID string, oldKey, newKey testSigningKey, issuedAt time.Time) RotateHostKeyRequest {
+	message := []byte(hostKeyRotationMessage(hostUUID, oldKey.public, newKey.public, issuedAt.Unix()))
+	return RotateHostKeyRequest{
+		UUID:                hostUUID,
+		OldSigningPublicKey: oldKey.public,
+		NewSigningPublicKey: newKey.public,
+		IssuedAt:            issuedAt.Unix(),
+		Signature:           base64.RawStdEncoding.EncodeToString(ed25519.Sign(oldKey.private, message)),
+		NewKeySignature:     base64.RawStdEncoding.EncodeToString(ed25519.Sign(newKey.private, message)),
+	}
+}
+
+func rotateHostKeyRequest(t *testing.T, body RotateHostKeyRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("marshal payload: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	req := httptest.NewRequest(http.MethodPost, "/api/rotate_host_key", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	c.Request = req
+
+	HandleRotateHostKey(c)
+	return rec
+}
+
+func registerRotationTestHost(t *testing.T, key testSigningKey) string {
+	t.Helper()
+	rec, resp := registerHostRequest(t, map[string]string{
+		"name":               "Rotating Host",
+		"signing_public_key": key.public,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register host: %d %s", rec.Code, rec.Body.String())
+	}
+	hostUUID, _ := resp["uuid"].(string)
+	return hostUUID
+}
+
+func storedHostSigningKey(t *testing.T, hostUUID string) string {
+	t.Helper()
+	var key string
+	if err := db.HostDB.QueryRow(`SELECT signing_public_key FROM hosts WHERE uuid = ?`, hostUUID).Scan(&key); err != nil {
+		t.Fatalf("query host key: %v", err)
+	}
+	return key
+}
+
+func TestRotateHostKeySwapsKeyAndRecordsHistory(t *testing.T) {
+	setupHostRegistrationDB(t)
+	oldKey, newKey := newTestSigningKey(t), newTestSigningKey(t)
+	hostUUID := registerRotationTestHost(t, oldKey)
+
+	rec := rotateHostKeyRequest(t, signedRotation(hostUUID, oldKey, newKey, time.Now()))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d body=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if got := storedHostSigningKey(t, hostUUID); got != newKey.public {
+		t.Fatalf("expected rotated key %q, got %q", newKey.public, got)
+	}
+
+	var retiredKey, replacedBy string
+	if err := db.HostDB.QueryRow(
+		`SELECT signing_public_key, replaced_by_key FROM host_signing_key_history WHERE host_uuid = ?`,
+		hostUUID,
+	).Scan(&retiredKey, &replacedBy); err != nil {
+		t.Fatalf("query key history: %v", err)
+	}
+	if retiredKey != oldKey.public || replacedBy != newKey.public {
+		t.Fatalf("unexpected history row: retired=%q replaced_by=%q", retiredKey, replacedBy)
+	}
+
+	// The old key can no longer re-register the host; the new one can.
+	if rec, _ := registerHostRequest(t, map[string]string{
+		"uuid": hostUUID, "name": "Rotating Host", "signing_public_key": oldKey.public,
+	}); rec.Code != http.StatusConflict {
+		t.Fatalf("expected old key registration to conflict, got %d", rec.Code)
+	}
+	if rec, _ := registerHostRequest(t, map[string]string{
+		"uuid": hostUUID, "name": "Rotating Host", "signing_public_key": newKey.public,
+	}); rec.Code != http.StatusOK {
+		t.Fatalf("expected new key registration to succeed, got %d", rec.Code)
+	}
+}
+
+func TestRotateHostKeyIsIdempotentForTheSameRotation(t *testing.T) {
+	setupHostRegistrationDB(t)
+	oldKey, newKey := newTestSigningKey(t), newTestSigningKey(t)
+	hostUUID := registerRotationTestHost(t, oldKey)
+
+	if rec := rotateHostKeyRequest(t, signedRotation(hostUUID, oldKey, newKey, time.Now())); rec.Code != http.StatusOK {
+		t.Fatalf("first rotation: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := rotateHostKeyRequest(t, signedRotation(hostUUID, oldKey, newKey, time.Now())); rec.Code != http.StatusOK {
+		t.Fatalf("expected retried rotation to succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var historyRows int
+	if err := db.HostDB.QueryRow(`SELECT COUNT(*) FROM host_signing_key_history WHERE host_uuid = ?`, hostUUID).Scan(&historyRows); err != nil {
+		t.Fatalf("count history: %v", err)
+	}
+	if historyRows != 1 {
+		t.Fatalf("expected one history row, got %d", historyRows)
+	}
+}
+
+func TestRotateHostKeyRejectsInvalidStatements(t *testing.T) {
+	setupHostRegistrationDB(t)
+	oldKey, newKey, otherKey := newTestSigningKey(t), newTestSigningKey(t), newTestSigningKey(t)
+	hostUUID := registerRotationTestHost(t, oldKey)
+
+	forgedOld := signedRotation(hostUUID, oldKey, newKey, time.Now())
+	forgedOld.Signature = signedRotation(hostUUID, otherKey, newKey, time.Now()).Signature
+
+	noPossession := signedRotation(hostUUID, oldKey, newKey, time.Now())
+	noPossession.NewKeySignature = noPossession.Signature
+
+	cases := []struct {
+		name string
+		req  RotateHostKeyRequest
+		code int
+	}{
+		{"signed by wrong key", forgedOld, http.StatusBadRequest},
+		{"new key not proven", noPossession, http.StatusBadRequest},
+		{"stale statement", signedRotation(hostUUID, oldKey, newKey, time.Now().Add(-time.Hour)), http.StatusBadRequest},
+		{"old key is not current", signedRotation(hostUUID, otherKey, newKey, time.Now()), http.StatusConflict},
+	}
+	for _, tc := range cases {
+		if rec := rotateHostKeyRequest(t, tc.req); rec.Code != tc.code {
+			t.Fatalf("%s: expected %d, got %d body=%s", tc.name, tc.code, rec.Code, rec.Body.String())
+		}
+	}
+	if got := storedHostSigningKey(t, hostUUID); got != oldKey.public {
+		t.Fatalf("expected key to stay %q, got %q", oldKey.public, got)
+	}
+}
+
+func TestRotateHostKeyRejectsRetiredKey(t *testing.T) {
+	setupHostRegistrationDB(t)
+	firstKey, secondKey := newTestSigningKey(t), newTestSigningKey(t)
+	hostUUID := registerRotationTestHost(t, firstKey)
+
+	if rec := rotateHostKeyRequest(t, signedRotation(hostUUID, firstKey, secondKey, time.Now())); rec.Code != http.StatusOK {
+		t.Fatalf("rotation: %d %s", rec.Code, rec.Body.String())
+	}
+	rec := rotateHostKeyRequest(t, signedRotation(hostUUID, secondKey, firstKey, time.Now()))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected rotating back to a retired key to conflict, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gochat/db"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Host management requests are signed by the host signing key over
+// hostManagementMessage and sent with these headers. The signed path is the
+// route template, e.g. /api/host/:uuid, so a proxy that rewrites the
+// request path does not break the signature.
+const (
+	hostTimestampHeader = "X-Parch-Host-Timestamp"
+	hostSignatureHeader = "X-Parch-Host-Signature"
+
+	hostRequestMaxSkew   = 5 * time.Minute
+	maxHostRequestBytes  = 16 * 1024
+	maxHostNameRunes     = 80
+	maxHostDescRunes     = 500
+	maxHostIconURLLength = 512
+	maxHostVersionRunes  = 64
+)
+
+var (
+	usedHostSignaturesMu sync.Mutex
+	usedHostSignatures   = make(map[string]time.Time)
+)
+
+func hostManagementMessage(method, path, hostUUID string, timestamp int64, body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf("parch-host-manage:%s:%s:%s:%d:%s",
+		method, path, hostUUID, timestamp, base64.RawStdEncoding.EncodeToString(sum[:]))
+}
+
+// rememberHostSignature reports whether signature is new within the accepted
+// skew window, so a captured request cannot be replayed. In cluster mode the
+// signatures are shared through the cluster store, so a request accepted by
+// one node is refused by every other.
+func rememberHostSignature(signature string, now time.Time) (bool, error) {
+	if claimed, shared, err := relayCluster.claimOnce("host-signature."+signature, 2*hostRequestMaxSkew); shared {
+		return claimed, err
+	}
+
+	usedHostSignaturesMu.Lock()
+	defer usedHostSignaturesMu.Unlock()
+
+	for sig, expires := range usedHostSignatures {
+		if now.After(expires) {
+			delete(usedHostSignatures, sig)
+		}
+	}
+	if _, seen := usedHostSignatures[signature]; seen {
+		return false, nil
+	}
+	usedHostSignatures[signature] = now.Add(2 * hostRequestMaxSkew)
+	return true, nil
+}
+
+// authenticateHostRequest verifies the signed headers for the host named in
+// the :uuid path parameter and returns the request body it covered.
+func authenticateHostRequest(c *gin.Context, now time.Time) (string, []byte, bool) {
+	hostUUID := strings.TrimSpace(c.Param("uuid"))
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxHostRequestBytes))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return "", nil, false
+	}
+
+	timestamp, err := strconv.ParseInt(strings.TrimSpace(c.GetHeader(hostTimestampHeader)), 10, 64)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Missing or invalid request timestamp"})
+		return "", nil, false
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-hostRequestMaxSkew)) || signedAt.After(now.Add(hostRequestMaxSkew)) {
+		c.JSON(401, gin.H{"error": "Request timestamp is outside the allowed window"})
+		return "", nil, false
+	}
+	signatureHeader := strings.TrimSpace(c.GetHeader(hostSignatureHeader))
+	signature, err := base64.RawStdEncoding.DecodeString(signatureHeader)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		c.JSON(401, gin.H{"error": "Missing or invalid request signature"})
+		return "", nil, false
+	}
+
+	var signingPublicKey string
+	err = db.HostDB.QueryRow(`SELECT signing_public_key FROM hosts WHERE uuid = ?`, hostUUID).Scan(&signingPublicKey)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"error": "Host not found by uuid"})
+		return "", nil, false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error finding host"})
+		return "", nil, false
+	}
+	publicKey, err := parseHostSigningPublicKey(signingPublicKey)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Host has no usable signing key"})
+		return "", nil, false
+	}
+
+	if !ed25519.Verify(publicKey, []byte(hostManagementMessage(c.Request.Method, c.FullPath(), hostUUID, timestamp, body)), signature) {
+		c.JSON(401, gin.H{"error": "Invalid request signature"})
+		return "", nil, false
+	}
+	fresh, err := rememberHostSignature(signatureHeader, now)
+	if err != nil {
+		log.Printf("host %s request replay check failed: %v", hostUUID, err)
+		c.JSON(503, gin.H{"error": "Replay check unavailable, try again"})
+		return "", nil, false
+	}
+	if !fresh {
+		c.JSON(401, gin.H{"error": "Request was already used"})
+		return "", nil, false
+	}
+	return hostUUID, body, true
+}
+
+func HandleUpdateHost(c *gin.Context) {
+	hostUUID, body, ok := authenticateHostRequest(c, time.Now().UTC())
+	if !ok {
+		return
+	}
+
+	var req UpdateHostRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid update host request"})
+		return
+	}
+	host, err := updateHostMetadata(hostUUID, req)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, gin.H{"error": "Host not found by uuid"})
+			return
+		}
+		if _, invalid := err.(hostValidationError); invalid {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("update host %s failed: %v", hostUUID, err)
+		c.JSON(500, gin.H{"error": "Failed to update host"})
+		return
+	}
+	c.JSON(200, host)
+}
+
+func HandleDeregisterHost(c *gin.Context) {
+	hostUUID, _, ok := authenticateHostRequest(c, time.Now().UTC())
+	if !ok {
+		return
+	}
+
+	if _, err := db.HostDB.Exec(`DELETE FROM hosts WHERE uuid = ?`, hostUUID); err != nil {
+		log.Printf("deregister host %s failed: %v", hostUUID, err)
+		c.JSON(500, gin.H{"error": "Failed to deregister host"})
+		return
+	}
+	purgeHostState(hostUUID)
+	relayCluster.publishHostEvent(clusterMessage{Kind: clusterHostPurged, HostUUID: hostUUID})
+	c.JSON(200, gin.H{"uuid": hostUUID, "deregistered": true})
+}
+
+type hostValidationError string
+
+func (e hostValidationError) Error() string { return string(e) }
+
+func updateHostMetadata(hostUUID string, req UpdateHostRequest) (ClientHost, error) {
+	sets := make([]string, 0, 4)
+	args := make([]interface{}, 0, 5)
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxHostNameRunes {
+			return ClientHost{}, hostValidationError(fmt.Sprintf("name must be 1-%d characters", maxHostNameRunes))
+		}
+		sets = append(sets, "name = ?")
+		args = append(args, name)
+	}
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		if utf8.RuneCountInString(description) > maxHostDescRunes {
+			return ClientHost{}, hostValidationError(fmt.Sprintf("description must be at most %d characters", maxHostDescRunes))
+		}
+		sets = append(sets, "description = ?")
+		args = append(args, description)
+	}
+	if req.IconURL != nil {
+		iconURL := strings.TrimSpace(*req.IconURL)
+		if iconURL != "" {
+			parsed, err := url.Parse(iconURL)
+			if err != nil || parsed.Scheme != "https" || parsed.Host == "" || len(iconURL) > maxHostIconURLLength {
+				return ClientHost{}, hostValidationError("icon_url must be an https URL")
+			}
+		}
+		sets = append(sets, "icon_url = ?")
+		args = append(args, iconURL)
+	}
+	if req.SoftwareVersion != nil {
+		version := strings.TrimSpace(*req.SoftwareVersion)
+		if utf8.RuneCountInString(version) > maxHostVersionRunes {
+			return ClientHost{}, hostValidationError(fmt.Sprintf("software_version must be at most %d characters", maxHostVersionRunes))
+		}
+		sets = append(sets, "software_version = ?")
+		args = append(args, version)
+	}
+	if len(sets) == 0 {
+		return ClientHost{}, hostValidationError("no fields to update")
+	}
+
+	sets = append(sets, "updated_at = CURRENT_TIMESTAMP")
+	args = append(args, hostUUID)
+	query := `UPDATE hosts SET ` + strings.Join(sets, ", ") + ` WHERE uuid = ? RETURNING ` + clientHostColumns
+	return scanClientHost(db.HostDB.QueryRow(query, args...))
+}
+
+// purgeHostState drops a deregistered host from memory and disconnects every
+// session attached to it. Each socket loop then runs its normal cleanup.
+func purgeHostState(hostUUID string) {
+	hostsMu.Lock()
+	host, exists := Hosts[hostUUID]
+	delete(Hosts, hostUUID)
+	hostsMu.Unlock()
+	if !exists {
+		return
+	}
+
+	host.mu.Lock()
+	conns := make([]*websocket.Conn, 0, len(host.ClientsByConn))
+	for conn := range host.ClientsByConn {
+		conns = append(conns, conn)
+	}
+	host.mu.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
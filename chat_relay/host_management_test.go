@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"gochat/db"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func signedHostRequest(key testSigningKey, method, hostUUID string, payload []byte, signedAt time.Time) *http.Request {
+	return signedHostRequestForPath(key, method, hostUUID, "/api/host/:uuid", payload, signedAt)
+}
+
+func signedHostRequestForPath(key testSigningKey, method, hostUUID, signedPath string, payload []byte, signedAt time.Time) *http.Request {
+	message := hostManagementMessage(method, signedPath, hostUUID, signedAt.Unix(), payload)
+	req := httptest.NewRequest(method, "/api/host/"+hostUUID, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(hostTimestampHeader, strconv.FormatInt(signedAt.Unix(), 10))
+	req.Header.Set(hostSignatureHeader, base64.RawStdEncoding.EncodeToString(ed25519.Sign(key.private, []byte(message))))
+	return req
+}
+
+func serveHostManagement(t *testing.T, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.PATCH("/api/host/:uuid", HandleUpdateHost)
+	r.DELETE("/api/host/:uuid", HandleDeregisterHost)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUpdateHostChangesMetadata(t *testing.T) {
+	setupHostRegistrationDB(t)
+	key := newTestSigningKey(t)
+	hostUUID := registerRotationTestHost(t, key)
+
+	payload := []byte(`{"name":"Renamed Host","description":"A quiet place","icon_url":"https://example.com/icon.png","software_version":"1.4.0"}`)
+	rec := serveHostManagement(t, signedHostRequest(key, http.MethodPatch, hostUUID, payload, time.Now()))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d body=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var host ClientHost
+	if err := json.Unmarshal(rec.Body.Bytes(), &host); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if host.Name != "Renamed Host" || host.Description != "A quiet place" ||
+		host.IconURL != "https://example.com/icon.png" || host.SoftwareVersion != "1.4.0" {
+		t.Fatalf("unexpected host after update: %+v", host)
+	}
+
+	// Omitted fields are left alone.
+	rec = serveHostManagement(t, signedHostRequest(key, http.MethodPatch, hostUUID, []byte(`{"description":""}`), time.Now()))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d body=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var name, description string
+	if err := db.HostDB.QueryRow(`SELECT name, description FROM hosts WHERE uuid = ?`, hostUUID).Scan(&name, &description); err != nil {
+		t.Fatalf("query host: %v", err)
+	}
+	if name != "Renamed Host" || description != "" {
+		t.Fatalf("unexpected stored metadata: name=%q description=%q", name, description)
+	}
+}
+
+func TestUpdateHostRejectsUnauthenticatedRequests(t *testing.T) {
+	setupHostRegistrationDB(t)
+	key, otherKey := newTestSigningKey(t), newTestSigningKey(t)
+	hostUUID := registerRotationTestHost(t, key)
+	payload := []byte(`{"name":"Hijacked"}`)
+
+	tampered := signedHostRequest(key, http.MethodPatch, hostUUID, []byte(`{"name":"Fine"}`), time.Now())
+	tampered.Body = io.NopCloser(bytes.NewReader(payload))
+
+	cases := []struct {
+		name string
+		req  *http.Request
+		code int
+	}{
+		{"wrong key", signedHostRequest(otherKey, http.MethodPatch, hostUUID, payload, time.Now()), http.StatusUnauthorized},
+		{"body changed after signing", tampered, http.StatusUnauthorized},
+		{"stale timestamp", signedHostRequest(key, http.MethodPatch, hostUUID, payload, time.Now().Add(-time.Hour)), http.StatusUnauthorized},
+		{"unknown host", signedHostRequest(key, http.MethodPatch, "00000000-0000-0000-0000-000000000000", payload, time.Now()), http.StatusNotFound},
+		{"invalid icon url", signedHostRequest(key, http.MethodPatch, hostUUID, []byte(`{"icon_url":"http://example.com/a.png"}`), time.Now()), http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		if rec := serveHostManagement(t, tc.req); rec.Code != tc.code {
+			t.Fatalf("%s: expected %d, got %d body=%s", tc.name, tc.code, rec.Code, rec.Body.String())
+		}
+	}
+
+	var name string
+	if err := db.HostDB.QueryRow(`SELECT name FROM hosts WHERE uuid = ?`, hostUUID).Scan(&name); err != nil {
+		t.Fatalf("query host: %v", err)
+	}
+	if name != "Rotating Host" {
+		t.Fatalf("expected name to be unchanged, got %q", name)
+	}
+}
+
+func TestUpdateHostRejectsReplayedRequest(t *testing.T) {
+	setupHostRegistrationDB(t)
+	key := newTestSigningKey(t)
+	hostUUID := registerRotationTestHost(t, key)
+
+	payload := []byte(`{"name":"Once"}`)
+	signedAt := time.Now()
+	if rec := serveHostManagement(t, signedHostRequest(key, http.MethodPatch, hostUUID, payload, signedAt)); rec.Code != http.StatusOK {
+		t.Fatalf("first request: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serveHostManagement(t, signedHostRequest(key, http.MethodPatch, hostUUID, payload, signedAt)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected replay to be rejected, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUpdateHostRejectsConcretePathSignature(t *testing.T) {
+	setupHostRegistrationDB(t)
+	key := newTestSigningKey(t)
+	hostUUID := registerRotationTestHost(t, key)
+
+	req := signedHostRequestForPath(key, http.MethodPatch, hostUUID, "/api/host/"+hostUUID, []byte(`{"name":"Concrete"}`), time.Now())
+	if rec := serveHostManagement(t, req); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a signature over the concrete path to be rejected, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUpdateHostRejectsReplayOnAnotherClusterNode(t *testing.T) {
+	setupHostRegistrationDB(t)
+	key := newTestSigningKey(t)
+	hostUUID := registerRotationTestHost(t, key)
+
+	server := miniredis.RunT(t)
+	joinNode := func(id string) *clusterNode {
+		bus, err := newRedisBus("redis://" + server.Addr())
+		if err != nil {
+			t.Fatalf("connect redis bus: %v", err)
+		}
+		node, err := startCluster(id, bus)
+		if err != nil {
+			t.Fatalf("start node %s: %v", id, err)
+		}
+		t.Cleanup(func() { _ = node.Close() })
+		return node
+	}
+	first, second := joinNode("node-a"), joinNode("node-b")
+	t.Cleanup(func() { relayCluster = nil })
+
+	payload := []byte(`{"name":"Once"}`)
+	signedAt := time.Now()
+	relayCluster = first
+	if rec := serveHostManagement(t, signedHostRequest(key, http.MethodPatch, hostUUID, payload, signedAt)); rec.Code != http.StatusOK {
+		t.Fatalf("first request: %d %s", rec.Code, rec.Body.String())
+	}
+	// The second node is another process with its own memory.
+	usedHostSignaturesMu.Lock()
+	usedHostSignatures = make(map[string]time.Time)
+	usedHostSignaturesMu.Unlock()
+	relayCluster = second
+	if rec := serveHostManagement(t, signedHostRequest(key, http.MethodPatch, hostUUID, payload, signedAt)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected replay on another node to be rejected, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDeregisterHostPurgesRelayState(t *testing.T) {
+	setupHostRegistrationDB(t)
+	oldKey, key := newTestSigningKey(t), newTestSigningKey(t)
+	hostUUID := registerRotationTestHost(t, oldKey)
+	if rec := rotateHostKeyRequest(t, signedRotation(hostUUID, oldKey, key, time.Now())); rec.Code != http.StatusOK {
+		t.Fatalf("rotation: %d %s", rec.Code, rec.Body.String())
+	}
+
+	hostsMu.Lock()
+	prevHosts := Hosts
+	Hosts = map[string]*Host{hostUUID: {
+		UUID:          hostUUID,
+		ClientsByConn: map[*websocket.Conn]*Client{},
+	}}
+	hostsMu.Unlock()
+	t.Cleanup(func() {
+		hostsMu.Lock()
+		Hosts = prevHosts
+		hostsMu.Unlock()
+	})
+
+	rec := serveHostManagement(t, signedHostRequest(key, http.MethodDelete, hostUUID, nil, time.Now()))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d body=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	if _, exists := GetHost(hostUUID); exists {
+		t.Fatalf("expected host to be removed from memory")
+	}
+	for _, query := range []string{
+		`SELECT COUNT(*) FROM hosts WHERE uuid = ?`,
+		`SELECT COUNT(*) FROM host_signing_key_history WHERE host_uuid = ?`,
+	} {
+		var count int
+		if err := db.HostDB.QueryRow(query, hostUUID).Scan(&count); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if count != 0 {
+			t.Fatalf("expected no rows after deregistration for %q, got %d", query, count)
+		}
+	}
+}
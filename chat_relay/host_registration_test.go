@@ -17,18 +17,14 @@ func setupHostRegistrationDB(t *testing.T) {
 	t.Helper()
 
 	dbPath := filepath.Join(t.TempDir(), "host_registration.sqlite")
-	hostDB, err := db.InitSQLite(dbPath)
+	hostDB, err := openRelayDatabase(dbPath)
 	if err != nil {
-		t.Fatalf("init sqlite: %v", err)
+		t.Fatalf("open relay db: %v", err)
 	}
 
 	prevHostDB := db.HostDB
 	db.HostDB = hostDB
 
-	if err := ensureChatRelaySchema(); err != nil {
-		t.Fatalf("ensure relay schema: %v", err)
-	}
-
 	t.Cleanup(func() {
 		db.HostDB = prevHostDB
 		_ = hostDB.Close()
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Every request the relay forwards to a host author carries a request_id.
+// The relay remembers which client asked; responses are routed by that ID
+// rather than by the client_uuid in their payload, and a client whose host
+// stays silent past the deadline gets request_timeout instead of waiting
+// forever.
+
+// defaultHostRequestTimeout is how long the host has to answer unless
+// CHAT_RELAY_HOST_REQUEST_TIMEOUT says otherwise.
+const defaultHostRequestTimeout = 15 * time.Second
+
+// hostRequestGrace keeps a request routable after its deadline or first
+// answer: some requests are answered with several messages (a resolved
+// report also removes a member), and a late answer still updates the
+// client's state.
+const hostRequestGrace = 30 * time.Second
+
+type pendingHostRequest struct {
+	hostUUID   string
+	clientUUID string
+	msgType    string
+	answered   bool
+	// timer is nil on routing-only entries, kept by the node holding the
+	// host author for requests another node tracks.
+	timer *time.Timer
+}
+
+type pendingHostRequests struct {
+	mu      sync.Mutex
+	byID    map[string]*pendingHostRequest
+	timeout time.Duration
+}
+
+var hostRequests = &pendingHostRequests{
+	byID:    make(map[string]*pendingHostRequest),
+	timeout: defaultHostRequestTimeout,
+}
+
+func (p *pendingHostRequests) setTimeout(timeout time.Duration) {
+	p.mu.Lock()
+	p.timeout = timeout
+	p.mu.Unlock()
+}
+
+// track records a request. A timed entry tells the client when the host
+// misses the deadline; an untimed one only routes responses.
+func (p *pendingHostRequests) track(requestID, hostUUID, clientUUID, msgType string, timed bool) {
+	entry := &pendingHostRequest{hostUUID: hostUUID, clientUUID: clientUUID, msgType: msgType}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.byID[requestID] = entry
+	if !timed {
+		time.AfterFunc(p.timeout+hostRequestGrace, func() { p.forget(requestID) })
+		return
+	}
+	entry.timer = time.AfterFunc(p.timeout, func() { p.expire(requestID) })
+}
+
+func (p *pendingHostRequests) expire(requestID string) {
+	p.mu.Lock()
+	entry, ok := p.byID[requestID]
+	timedOut := ok && !entry.answered
+	if timedOut {
+		entry.answered = true
+	}
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	if timedOut {
+		log.Printf("Host %s did not answer %s (%s) in time", entry.hostUUID, entry.msgType, requestID)
+		SendToClient(entry.hostUUID, entry.clientUUID, WSMessage{
+			Type: "request_timeout",
+			Data: RequestFailure{RequestID: requestID, RequestType: entry.msgType, Content: "The host did not answer in time"},
+		})
+	}
+	time.AfterFunc(hostRequestGrace, func() { p.forget(requestID) })
+}
+
+func (p *pendingHostRequests) forget(requestID string) {
+	p.mu.Lock()
+	delete(p.byID, requestID)
+	p.mu.Unlock()
+}
+
+// answer marks the request answered and returns the client that made it. A
+// host can only answer its own requests.
+func (p *pendingHostRequests) answer(hostUUID, requestID string) (*pendingHostRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.byID[requestID]
+	if !ok || entry.hostUUID != hostUUID {
+		return nil, false
+	}
+	if !entry.answered {
+		entry.answered = true
+		if entry.timer != nil {
+			entry.timer.Stop()
+			time.AfterFunc(hostRequestGrace, func() { p.forget(requestID) })
+		}
+	}
+	copied := *entry
+	return &copied, true
+}
+
+// failHost answers every open request this node tracks for the host with
+// host_error, for when its author goes away before replying.
+func (p *pendingHostRequests) failHost(hostUUID, reason string) {
+	type failed struct {
+		requestID string
+		entry     pendingHostRequest
+	}
+	var failures []failed
+	p.mu.Lock()
+	for requestID, entry := range p.byID {
+		if entry.hostUUID != hostUUID || entry.answered || entry.timer == nil {
+			continue
+		}
+		entry.answered = true
+		entry.timer.Stop()
+		failures = append(failures, failed{requestID: requestID, entry: *entry})
+		delete(p.byID, requestID)
+	}
+	p.mu.Unlock()
+
+	for _, f := range failures {
+		SendToClient(hostUUID, f.entry.clientUUID, WSMessage{
+			Type: "host_error",
+			Data: RequestFailure{RequestID: f.requestID, RequestType: f.entry.msgType, Content: reason},
+		})
+	}
+}
+
+// newHostRequest stamps msg with a fresh request ID and tracks it for the
+// client, with a deadline when the host's author echoes request IDs.
+func newHostRequest(host *Host, clientUUID string, msg *WSMessage) {
+	host.mu.Lock()
+	timed := host.AuthorRequestIDs
+	host.mu.Unlock()
+	msg.RequestID = uuid.NewString()
+	hostRequests.track(msg.RequestID, host.UUID, clientUUID, msg.Type, timed)
+}
+
+// responseClientUUID picks the client a host response goes to: the one that
+// made the request when the response carries a request_id, otherwise the
+// payload's client_uuid, which only hosts that predate request IDs rely on;
+// dispatchMessage drops untagged responses from any other host.
+func responseClientUUID(client *Client, wsMsg *WSMessage, payloadClientUUID string) string {
+	if wsMsg.RequestID == "" {
+		return payloadClientUUID
+	}
+	entry, ok := hostRequests.answer(client.HostUUID, wsMsg.RequestID)
+	if !ok {
+		return ""
+	}
+	return entry.clientUUID
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func setHostRequestTimeout(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	hostRequests.setTimeout(timeout)
+	t.Cleanup(func() { hostRequests.setTimeout(defaultHostRequestTimeout) })
+}
+
+func TestRelayIntegrationHostResponsesRouteByRequestID(t *testing.T) {
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "kim")
+
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "report_user",
+		Data: ReportUserClient{SpaceUUID: member.spaceUUID, UserPublicKey: "pub-spam", CapabilityToken: member.token},
+	})
+	requestMsg := author.mustNextType("report_user_request")
+	request, _ := decodeData[ReportUserRequest](requestMsg.Data)
+	if requestMsg.RequestID == "" {
+		t.Fatal("expected the forwarded request to carry a request_id")
+	}
+
+	// A tagged response names an unknown request: dropped, even though the
+	// payload points at the member.
+	author.mustSend(WSMessage{
+		Type:      "report_response",
+		Data:      ReportResponse{ReportID: 1, Kind: "user", SpaceUUID: member.spaceUUID, ClientUUID: request.ClientUUID},
+		RequestID: "forged",
+	})
+	// The real answer reaches the requester whatever client_uuid it claims.
+	author.mustSend(WSMessage{
+		Type:      "report_response",
+		Data:      ReportResponse{ReportID: 2, Kind: "user", SpaceUUID: member.spaceUUID, ClientUUID: "someone-else"},
+		RequestID: requestMsg.RequestID,
+	})
+	reportMsg := mustReadType(t, member.conn, "report_success", testReadTimeout)
+	if report, _ := decodeData[ReportSuccess](reportMsg.Data); report.ReportID != 2 {
+		t.Fatalf("expected the response routed by request_id, got %+v", report)
+	}
+	if msg, err := readOneMessage(member.conn, 300*time.Millisecond); err == nil {
+		t.Fatalf("expected nothing else for the member, got %+v", msg)
+	}
+}
+
+// Hosts that never declared request_ids keep answering by client_uuid, and
+// their requests do not time out.
+func TestRelayIntegrationLegacyHostRequestsDoNotTimeOut(t *testing.T) {
+	setHostRequestTimeout(t, 100*time.Millisecond)
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "mo")
+
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "report_user",
+		Data: ReportUserClient{SpaceUUID: member.spaceUUID, UserPublicKey: "pub-spam", CapabilityToken: member.token},
+	})
+	requestMsg := author.mustNextType("report_user_request")
+	request, _ := decodeData[ReportUserRequest](requestMsg.Data)
+	time.Sleep(300 * time.Millisecond)
+	author.mustSend(WSMessage{
+		Type: "report_response",
+		Data: ReportResponse{ReportID: 3, Kind: "user", SpaceUUID: member.spaceUUID, ClientUUID: request.ClientUUID},
+	})
+	reportMsg := mustReadType(t, member.conn, "report_success", testReadTimeout)
+	if report, _ := decodeData[ReportSuccess](reportMsg.Data); report.ReportID != 3 {
+		t.Fatalf("unexpected report_success: %+v", report)
+	}
+}
+
+func TestRelayIntegrationHostRequestTimeoutsAndErrors(t *testing.T) {
+	setHostRequestTimeout(t, 200*time.Millisecond)
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	env.authorRequestIDs = true
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "lin")
+
+	report := WSMessage{
+		Type: "report_user",
+		Data: ReportUserClient{SpaceUUID: member.spaceUUID, UserPublicKey: "pub-spam", CapabilityToken: member.token},
+	}
+
+	// The host never answers.
+	mustWriteMessage(t, member.conn, report)
+	silent := author.mustNextType("report_user_request")
+	timeoutMsg := mustReadType(t, member.conn, "request_timeout", testReadTimeout)
+	timeout, _ := decodeData[RequestFailure](timeoutMsg.Data)
+	if timeout.RequestID != silent.RequestID || timeout.RequestType != "report_user_request" || timeout.Content == "" {
+		t.Fatalf("unexpected request_timeout: %+v", timeout)
+	}
+
+	// The host answers with an error.
+	mustWriteMessage(t, member.conn, report)
+	failing := author.mustNextType("report_user_request")
+	author.mustSend(WSMessage{
+		Type:      "error",
+		Data:      ChatError{Content: "Database failed to file report"},
+		RequestID: failing.RequestID,
+	})
+	errorMsg := mustReadType(t, member.conn, "host_error", testReadTimeout)
+	hostErr, _ := decodeData[RequestFailure](errorMsg.Data)
+	if hostErr.RequestID != failing.RequestID || hostErr.Content != "Database failed to file report" {
+		t.Fatalf("unexpected host_error: %+v", hostErr)
+	}
+	// The host drops before answering.
+	setHostRequestTimeout(t, time.Minute)
+	mustWriteMessage(t, member.conn, report)
+	author.mustNextType("report_user_request")
+	author.close()
+	dropMsg := mustReadType(t, member.conn, "host_error", testReadTimeout)
+	if dropped, _ := decodeData[RequestFailure](dropMsg.Data); dropped.RequestType != "report_user_request" {
+		t.Fatalf("unexpected host_error after disconnect: %+v", dropped)
+	}
+	// Answered requests never time out. A failed read ends the websocket,
+	// so this check comes last.
+	if msg, err := readOneMessage(member.conn, 400*time.Millisecond); err == nil {
+		t.Fatalf("expected no timeout for answered requests, got %+v", msg)
+	}
+}
+
+// Once the author tags requests, an untagged response is not routed by its
+// payload client_uuid. Batched reissues tag each member's entry instead.
+func TestRelayIntegrationTaggingHostsMustTagResponses(t *testing.T) {
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	env.authorRequestIDs = true
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "ana")
+
+	author.mustSend(WSMessage{Type: "reissue_capabilities"})
+	batchMsg := author.mustNextType("reissue_capabilities_request")
+	batch, _ := decodeData[ReissueCapabilitiesRequest](batchMsg.Data)
+	if len(batch.Clients) != 1 || batch.Clients[0].RequestID == "" {
+		t.Fatalf("expected one tagged reissue entry, got %+v", batch.Clients)
+	}
+	author.mustSend(WSMessage{
+		Type:      "get_dash_data_response",
+		Data:      GetDashDataResponse{User: DashDataUser{Username: member.auth.Username, PublicKey: member.auth.PublicKey}},
+		RequestID: batch.Clients[0].RequestID,
+	})
+	mustReadType(t, member.conn, "dash_data_payload", testReadTimeout)
+
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "report_user",
+		Data: ReportUserClient{SpaceUUID: member.spaceUUID, UserPublicKey: "pub-spam", CapabilityToken: member.token},
+	})
+	requestMsg := author.mustNextType("report_user_request")
+	request, _ := decodeData[ReportUserRequest](requestMsg.Data)
+	author.mustSend(WSMessage{
+		Type: "report_response",
+		Data: ReportResponse{ReportID: 4, Kind: "user", SpaceUUID: member.spaceUUID, ClientUUID: request.ClientUUID},
+	})
+	if msg, err := readOneMessage(member.conn, 300*time.Millisecond); err == nil {
+		t.Fatalf("expected the untagged response dropped, got %+v", msg)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// handleIdentityMigrate hands an identity over to the keys this session
+// signed in with. The host checks the old key's signature; the relay only
+// supplies the new keys the session has already proved.
+func handleIdentityMigrate(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[IdentityMigrateClient](wsMsg.Data)
+	oldPublicKey := strings.TrimSpace(data.OldPublicKey)
+	if err != nil || oldPublicKey == "" || data.IssuedAt <= 0 || data.Signature == "" {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid identity migration data"}})
+		return
+	}
+	if oldPublicKey == client.PublicKey {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Sign in with the new identity before migrating"}})
+		return
+	}
+
+	SendToAuthor(client, WSMessage{
+		Type: "identity_migrate_request",
+		Data: IdentityMigrateRequest{
+			OldPublicKey:    oldPublicKey,
+			NewPublicKey:    client.PublicKey,
+			NewEncPublicKey: client.EncPublicKey,
+			IssuedAt:        data.IssuedAt,
+			Signature:       data.Signature,
+			ClientUUID:      client.ClientUUID,
+		},
+	})
+}
+
+func handleIdentityMigrateRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[IdentityMigrateResponse](wsMsg.Data)
+	if err != nil {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid identity migration response"}})
+		return
+	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
+
+	host, exists := GetHost(client.HostUUID)
+	if exists {
+		host.mu.Lock()
+		if targetConn, ok := host.ClientConnsByUUID[data.ClientUUID]; ok {
+			if target := host.ClientsByConn[targetConn]; target != nil {
+				if target.UserID > 0 {
+					delete(host.ClientsByUserID, target.UserID)
+				}
+				target.UserID = data.UserID
+				target.Username = firstNonEmpty(data.Username, target.Username)
+				if target.UserID > 0 {
+					host.ClientsByUserID[target.UserID] = target
+				}
+			}
+		}
+		host.mu.Unlock()
+	}
+
+	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
+		Type: "identity_migrate_success",
+		Data: IdentityMigrateSuccess{
+			UserID:          data.UserID,
+			Username:        data.Username,
+			OldPublicKey:    data.OldPublicKey,
+			NewPublicKey:    data.NewPublicKey,
+			NewEncPublicKey: data.NewEncPublicKey,
+		},
+	})
+
+	for _, spaceUUID := range data.SpaceUUIDs {
+		BroadcastToSpace(client.HostUUID, spaceUUID, WSMessage{
+			Type: "identity_key_changed",
+			Data: IdentityKeyChanged{
+				SpaceUUID:       spaceUUID,
+				UserID:          data.UserID,
+				Username:        data.Username,
+				OldPublicKey:    data.OldPublicKey,
+				NewPublicKey:    data.NewPublicKey,
+				NewEncPublicKey: data.NewEncPublicKey,
+			},
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRelayIntegrationIdentityMigrateNotifiesSpaces(t *testing.T) {
+	env := newRelayIntegrationEnv(t)
+	author := env.connectAuthor(t)
+
+	client := env.dialWS(t)
+	defer client.Close()
+	challenge := env.joinHost(t, client)
+	auth := authenticateClient(t, env, client, challenge, "erin")
+
+	spaceUUID := uuid.NewString()
+	mustWriteMessage(t, client, WSMessage{Type: "get_dash_data", Data: map[string]interface{}{}})
+	dashRequestMsg := author.mustNextType("get_dash_data_request")
+	dashRequest, err := decodeData[GetDashDataRequest](dashRequestMsg.Data)
+	if err != nil {
+		t.Fatalf("decode get_dash_data_request: %v", err)
+	}
+	author.mustSend(WSMessage{
+		Type: "get_dash_data_response",
+		Data: GetDashDataResponse{
+			User:       DashDataUser{ID: 12, Username: "erin", PublicKey: auth.PublicKey},
+			Spaces:     []DashDataSpace{{UUID: spaceUUID, Name: "Engineering"}},
+			ClientUUID: dashRequest.ClientUUID,
+		},
+	})
+	mustReadType(t, client, "dash_data_payload", testReadTimeout)
+
+	token := env.mustIssueCapabilityToken(t, auth.PublicKey, spaceUUID, []string{scopeReadHistory}, time.Minute)
+	mustWriteMessage(t, client, WSMessage{Type: "join_all_spaces", Data: JoinAllSpacesClient{
+		SpaceUUIDs:       []string{spaceUUID},
+		CapabilityTokens: map[string]string{spaceUUID: token},
+	}})
+	mustReadType(t, client, "join_all_spaces_success", testReadTimeout)
+
+	// Migrating onto the key the session already uses is refused here.
+	mustWriteMessage(t, client, WSMessage{Type: "identity_migrate", Data: IdentityMigrateClient{
+		OldPublicKey: auth.PublicKey,
+		IssuedAt:     time.Now().Unix(),
+		Signature:    "sig",
+	}})
+	mustReadType(t, client, "error", testReadTimeout)
+
+	mustWriteMessage(t, client, WSMessage{Type: "identity_migrate", Data: IdentityMigrateClient{
+		OldPublicKey: "old-key",
+		IssuedAt:     time.Now().Unix(),
+		Signature:    "sig",
+	}})
+	requestMsg := author.mustNextType("identity_migrate_request")
+	request, err := decodeData[IdentityMigrateRequest](requestMsg.Data)
+	if err != nil {
+		t.Fatalf("decode identity_migrate_request: %v", err)
+	}
+	if request.OldPublicKey != "old-key" || request.NewPublicKey != auth.PublicKey || request.NewEncPublicKey != auth.EncPublicKey {
+		t.Fatalf("expected the session keys as the new identity, got %+v", request)
+	}
+
+	author.mustSend(WSMessage{
+		Type: "identity_migrate_response",
+		Data: IdentityMigrateResponse{
+			UserID:          12,
+			Username:        "erin",
+			OldPublicKey:    request.OldPublicKey,
+			NewPublicKey:    request.NewPublicKey,
+			NewEncPublicKey: request.NewEncPublicKey,
+			SpaceUUIDs:      []string{spaceUUID},
+			ClientUUID:      request.ClientUUID,
+		},
+	})
+	successMsg := mustReadType(t, client, "identity_migrate_success", testReadTimeout)
+	if success, _ := decodeData[IdentityMigrateSuccess](successMsg.Data); success.UserID != 12 || success.NewPublicKey != auth.PublicKey {
+		t.Fatalf("unexpected identity_migrate_success: %+v", success)
+	}
+	changedMsg := mustReadType(t, client, "identity_key_changed", testReadTimeout)
+	changed, err := decodeData[IdentityKeyChanged](changedMsg.Data)
+	if err != nil || changed.SpaceUUID != spaceUUID || changed.OldPublicKey != "old-key" || changed.NewPublicKey != auth.PublicKey {
+		t.Fatalf("unexpected identity_key_changed: %v %+v", err, changed)
+	}
+}
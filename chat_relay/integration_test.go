@@ -25,6 +25,9 @@ type relayIntegrationEnv struct {
 	hostUUID          string
 	server            *httptest.Server
 	signingPrivateKey ed25519.PrivateKey
+	// authorRequestIDs makes authors declare that they echo request_id, so
+	// the relay times out requests they leave unanswered.
+	authorRequestIDs bool
 }
 
 type authorPeer struct {
@@ -52,16 +55,13 @@ func newRelayIntegrationEnvWithSigningKey(t *testing.T, withSigningKey bool) *re
 		t.Fatalf("create temp dir: %v", err)
 	}
 	dbPath := filepath.Join(tempDir, "relay_integration.sqlite")
-	hostDB, err := db.InitSQLite(dbPath)
+	hostDB, err := openRelayDatabase(dbPath)
 	if err != nil {
-		t.Fatalf("init sqlite: %v", err)
+		t.Fatalf("open relay db: %v", err)
 	}
 
 	prevHostDB := db.HostDB
 	db.HostDB = hostDB
-	if err := ensureChatRelaySchema(); err != nil {
-		t.Fatalf("ensure relay schema: %v", err)
-	}
 
 	hostUUID := uuid.NewString()
 	signingPublicKey := ""
@@ -103,6 +103,9 @@ func newRelayIntegrationEnvWithSigningKey(t *testing.T, withSigningKey bool) *re
 	chatRateByClient = make(map[string][]time.Time)
 	chatRateMu.Unlock()
 
+	prevLiveSockets := liveSockets
+	liveSockets = newSocketRegistry()
+
 	r := gin.New()
 	r.GET("/ws", HandleSocket)
 	server := httptest.NewServer(r)
@@ -142,6 +145,8 @@ func newRelayIntegrationEnvWithSigningKey(t *testing.T, withSigningKey bool) *re
 		chatRateByClient = prevChatRates
 		chatRateMu.Unlock()
 
+		liveSockets = prevLiveSockets
+
 		db.HostDB = prevHostDB
 		_ = hostDB.Close()
 
@@ -237,8 +242,9 @@ func (e *relayIntegrationEnv) joinHostAsAuthor(t *testing.T, conn *websocket.Con
 	mustWriteMessage(t, conn, WSMessage{
 		Type: "host_auth",
 		Data: HostAuthClient{
-			Challenge: hostChallenge.Challenge,
-			Signature: base64.RawStdEncoding.EncodeToString(signature),
+			Challenge:  hostChallenge.Challenge,
+			Signature:  base64.RawStdEncoding.EncodeToString(signature),
+			RequestIDs: e.authorRequestIDs,
 		},
 	})
 	mustReadType(t, conn, "host_auth_success", testReadTimeout)
@@ -440,6 +446,55 @@ func authenticateClient(t *testing.T, env *relayIntegrationEnv, conn *websocket.
 	return success
 }
 
+// channelMember is an authenticated client that has joined one channel with a
+// capability token allowing it to chat there.
+type channelMember struct {
+	conn        *websocket.Conn
+	auth        AuthPubKeySuccess
+	spaceUUID   string
+	channelUUID string
+	token       string
+}
+
+func joinChatChannel(t *testing.T, env *relayIntegrationEnv, author *authorPeer, username string) channelMember {
+	t.Helper()
+	client := env.dialWS(t)
+	t.Cleanup(func() { _ = client.Close() })
+	challenge := env.joinHost(t, client)
+	auth := authenticateClient(t, env, client, challenge, username)
+
+	mustWriteMessage(t, client, WSMessage{Type: "get_dash_data", Data: map[string]interface{}{}})
+	requestMsg := author.mustNextType("get_dash_data_request")
+	request, _ := decodeData[GetDashDataRequest](requestMsg.Data)
+	spaceUUID := uuid.NewString()
+	channelUUID := uuid.NewString()
+	scopes := []string{scopeJoinChannel, scopeSendMessage, scopeReadHistory}
+	token := env.mustIssueCapabilityToken(t, auth.PublicKey, spaceUUID, scopes, 5*time.Minute)
+	author.mustSend(WSMessage{
+		Type: "get_dash_data_response",
+		Data: GetDashDataResponse{
+			User: DashDataUser{ID: request.UserID, Username: auth.Username, PublicKey: auth.PublicKey},
+			Spaces: []DashDataSpace{{
+				UUID:     spaceUUID,
+				Name:     "Chat",
+				Channels: []DashDataChannel{{UUID: channelUUID, Name: "general", SpaceUUID: spaceUUID}},
+			}},
+			ClientUUID: request.ClientUUID,
+		},
+		RequestID: requestMsg.RequestID,
+	})
+	mustReadType(t, client, "dash_data_payload", testReadTimeout)
+	mustWriteMessage(t, client, WSMessage{Type: "join_all_spaces", Data: JoinAllSpacesClient{
+		SpaceUUIDs:       []string{spaceUUID},
+		CapabilityTokens: map[string]string{spaceUUID: token},
+	}})
+	mustReadType(t, client, "join_all_spaces_success", testReadTimeout)
+	mustWriteMessage(t, client, WSMessage{Type: "join_channel", Data: JoinUUID{UUID: channelUUID, CapabilityToken: token}})
+	mustReadType(t, client, "joined_channel", testReadTimeout)
+
+	return channelMember{conn: client, auth: auth, spaceUUID: spaceUUID, channelUUID: channelUUID, token: token}
+}
+
 func TestRelayIntegrationAuthenticationFlow(t *testing.T) {
 	env := newRelayIntegrationEnv(t)
 	_ = env.connectAuthor(t)
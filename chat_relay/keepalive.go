@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The relay pings every websocket and expects a pong (or any message)
+// within the pong timeout. A peer that goes quiet, such as a half-open TCP
+// connection or an unreachable host author, hits the read deadline, which
+// ends its read loop and runs cleanupClient like any other disconnect.
+
+const (
+	defaultPingInterval = 25 * time.Second
+	defaultPongTimeout  = 60 * time.Second
+	pingWriteTimeout    = 5 * time.Second
+)
+
+type keepaliveConfig struct {
+	mu           sync.Mutex
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+}
+
+var relayKeepalive = &keepaliveConfig{
+	pingInterval: defaultPingInterval,
+	pongTimeout:  defaultPongTimeout,
+}
+
+// set changes the intervals for connections opened afterwards. The pong
+// timeout must leave room for at least one ping.
+func (k *keepaliveConfig) set(pingInterval, pongTimeout time.Duration) {
+	k.mu.Lock()
+	k.pingInterval = pingInterval
+	k.pongTimeout = pongTimeout
+	k.mu.Unlock()
+}
+
+func (k *keepaliveConfig) get() (pingInterval, pongTimeout time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.pingInterval, k.pongTimeout
+}
+
+// keepaliveConn pushes the read deadline forward whenever the peer shows
+// signs of life.
+type keepaliveConn struct {
+	conn        *websocket.Conn
+	pongTimeout time.Duration
+}
+
+func (k keepaliveConn) touch() {
+	_ = k.conn.SetReadDeadline(time.Now().Add(k.pongTimeout))
+}
+
+// startKeepalive arms the read deadline and pings conn until stop is
+// called. Call touch after each message read.
+func startKeepalive(conn *websocket.Conn) (keepaliveConn, func()) {
+	pingInterval, pongTimeout := relayKeepalive.get()
+	alive := keepaliveConn{conn: conn, pongTimeout: pongTimeout}
+	alive.touch()
+	conn.SetPongHandler(func(string) error {
+		alive.touch()
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// WriteControl may run alongside the client's WritePump.
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return alive, func() { close(done) }
+}
+
+// isKeepaliveTimeout tells a dead peer apart from an ordinary close.
+func isKeepaliveTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func logStaleConnection(client *Client, ip string) {
+	if client != nil && client.IsHostAuthor {
+		log.Printf("Keepalive: host author for %s stopped answering pings, closing", client.HostUUID)
+		return
+	}
+	log.Printf("Keepalive: closing stale connection from %s", ip)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"gochat/db"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func setKeepalive(t *testing.T, pingInterval, pongTimeout time.Duration) {
+	t.Helper()
+	relayKeepalive.set(pingInterval, pongTimeout)
+	t.Cleanup(func() { relayKeepalive.set(defaultPingInterval, defaultPongTimeout) })
+}
+
+func hostClientCount(t *testing.T, hostUUID string) (clients int, authorOnline bool) {
+	t.Helper()
+	host, ok := GetHost(hostUUID)
+	if !ok {
+		t.Fatalf("host %s not loaded", hostUUID)
+	}
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	return len(host.ClientsByConn), host.AuthorConn != nil
+}
+
+func waitForClientCount(t *testing.T, hostUUID string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(testReadTimeout)
+	for {
+		got, _ := hostClientCount(t, hostUUID)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients, have %d", want, got)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRelayIntegrationKeepaliveReapsSilentClients(t *testing.T) {
+	setKeepalive(t, 50*time.Millisecond, 300*time.Millisecond)
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	env.connectAuthor(t)
+
+	live := env.dialWS(t)
+	defer live.Close()
+	env.joinHost(t, live)
+	var pings atomic.Int32
+	live.SetPingHandler(func(data string) error {
+		pings.Add(1)
+		return live.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		_ = live.SetReadDeadline(time.Time{})
+		for {
+			if _, _, err := live.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// A peer that stops reading never answers pings, like a half-open
+	// connection.
+	silent := env.dialWS(t)
+	defer silent.Close()
+	env.joinHost(t, silent)
+
+	waitForClientCount(t, env.hostUUID, 2)
+	time.Sleep(400 * time.Millisecond)
+	clients, authorOnline := hostClientCount(t, env.hostUUID)
+	if clients != 2 || !authorOnline {
+		t.Fatalf("expected the author and the live client to stay, have %d clients (author online %v)", clients, authorOnline)
+	}
+	if pings.Load() == 0 {
+		t.Fatal("expected the relay to ping the live client")
+	}
+}
+
+func TestRelayIntegrationKeepaliveReapsSilentAuthor(t *testing.T) {
+	setKeepalive(t, 50*time.Millisecond, 300*time.Millisecond)
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.dialWS(t)
+	defer author.Close()
+	env.joinHostAsAuthor(t, author)
+
+	waitForClientCount(t, env.hostUUID, 0)
+	if _, authorOnline := hostClientCount(t, env.hostUUID); authorOnline {
+		t.Fatal("expected the silent author to be dropped")
+	}
+	var online int
+	if err := db.HostDB.QueryRow(`SELECT online FROM hosts WHERE uuid = ?`, env.hostUUID).Scan(&online); err != nil {
+		t.Fatalf("query host: %v", err)
+	}
+	if online != 0 {
+		t.Fatal("expected the host to be marked offline")
+	}
+}
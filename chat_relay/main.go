@@ -8,12 +8,14 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
 	ratelimit "github.com/JGLTechnologies/gin-rate-limit"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
@@ -56,13 +58,90 @@ func main() {
 	}
 
 	var err error
-	db.HostDB, err = db.InitSQLite(dbName)
+	db.HostDB, err = openRelayDatabase(dbName)
 	if err != nil {
 		log.Fatal("Error opening chat relay database:", err)
 	}
 	defer db.CloseDB(db.HostDB)
-	if err := ensureChatRelaySchema(); err != nil {
-		log.Fatal("Error ensuring chat relay schema:", err)
+
+	if redisURL := os.Getenv("CHAT_RELAY_CLUSTER_REDIS_URL"); redisURL != "" {
+		bus, err := newRedisBus(redisURL)
+		if err != nil {
+			log.Fatal("Error connecting to the cluster bus:", err)
+		}
+		nodeID := os.Getenv("CHAT_RELAY_NODE_ID")
+		if nodeID == "" {
+			nodeID = uuid.NewString()
+		}
+		relayCluster, err = startCluster(nodeID, bus)
+		if err != nil {
+			log.Fatal("Error joining the relay cluster:", err)
+		}
+		defer relayCluster.Close()
+		log.Printf("Relay cluster mode enabled as node %s", nodeID)
+	}
+
+	if raw := os.Getenv("CHAT_RELAY_HOST_REQUEST_TIMEOUT"); raw != "" {
+		timeout, err := time.ParseDuration(raw)
+		if err != nil || timeout <= 0 {
+			log.Fatalf("Invalid CHAT_RELAY_HOST_REQUEST_TIMEOUT %q: want a positive duration such as 15s", raw)
+		}
+		hostRequests.setTimeout(timeout)
+	}
+
+	pingInterval, pongTimeout := relayKeepalive.get()
+	if raw := os.Getenv("CHAT_RELAY_PING_INTERVAL"); raw != "" {
+		pingInterval, err = time.ParseDuration(raw)
+		if err != nil || pingInterval <= 0 {
+			log.Fatalf("Invalid CHAT_RELAY_PING_INTERVAL %q: want a positive duration such as 25s", raw)
+		}
+	}
+	if raw := os.Getenv("CHAT_RELAY_PONG_TIMEOUT"); raw != "" {
+		pongTimeout, err = time.ParseDuration(raw)
+		if err != nil || pongTimeout <= 0 {
+			log.Fatalf("Invalid CHAT_RELAY_PONG_TIMEOUT %q: want a positive duration such as 60s", raw)
+		}
+	}
+	if pongTimeout <= pingInterval {
+		log.Fatalf("CHAT_RELAY_PONG_TIMEOUT (%s) must be longer than CHAT_RELAY_PING_INTERVAL (%s)", pongTimeout, pingInterval)
+	}
+	relayKeepalive.set(pingInterval, pongTimeout)
+
+	// In cluster mode the three connection limits are per-cluster totals that
+	// each node enforces as its even share (see nodeQuota), so a small limit
+	// shrinks fast: 5 sessions per key on 6 nodes is 1 per node, and a user
+	// whose connections land on one node is refused at the second.
+	quota := hostQuotaDefaults.get()
+	for env, limit := range map[string]*int{
+		"CHAT_RELAY_HOST_MAX_CLIENTS":             &quota.MaxClients,
+		"CHAT_RELAY_HOST_MAX_SESSIONS_PER_KEY":    &quota.MaxSessionsPerKey,
+		"CHAT_RELAY_HOST_MAX_CHANNEL_SUBSCRIBERS": &quota.MaxChannelSubscribers,
+		"CHAT_RELAY_HOST_MAX_MESSAGES_PER_MINUTE": &quota.MaxMessagesPerMinute,
+	} {
+		raw := os.Getenv(env)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 0 {
+			log.Fatalf("Invalid %s %q: want a non-negative integer, 0 for no limit", env, raw)
+		}
+		*limit = value
+	}
+	hostQuotaDefaults.set(quota)
+
+	drainTimeout := defaultDrainTimeout
+	if raw := os.Getenv("CHAT_RELAY_DRAIN_TIMEOUT"); raw != "" {
+		timeout, err := time.ParseDuration(raw)
+		if err != nil || timeout <= 0 {
+			log.Fatalf("Invalid CHAT_RELAY_DRAIN_TIMEOUT %q: want a positive duration such as 10s", raw)
+		}
+		drainTimeout = timeout
+	}
+
+	if os.Getenv("CHAT_RELAY_STRICT_DELIVERY") == "true" {
+		strictChatDelivery = true
+		log.Println("Strict chat delivery enabled")
 	}
 
 	r := gin.Default()
@@ -90,8 +169,11 @@ func main() {
 	r.GET("/ws", HandleSocket)
 
 	r.GET("/api/host/:uuid", HandleGetHost)
+	r.PATCH("/api/host/:uuid", HandleUpdateHost)
+	r.DELETE("/api/host/:uuid", HandleDeregisterHost)
 	r.POST("/api/hosts_by_uuids", HandleGetHostsByUUIDs)
 	r.POST("/api/register_host", HandleRegisterHost)
+	r.POST("/api/rotate_host_key", HandleRotateHostKey)
 
 	r.GET("/client", func(c *gin.Context) {
 		c.File(filepath.Join(staticDir, "client", "index.html"))
@@ -122,6 +204,8 @@ func main() {
 	<-quit
 	log.Println("Shutting down chat relay...")
 
+	drainRelay(drainTimeout)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := server.Shutdown(ctx); err != nil {
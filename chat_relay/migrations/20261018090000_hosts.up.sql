@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS hosts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    signing_public_key TEXT NOT NULL DEFAULT '',
+    online INTEGER DEFAULT 0
+);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS host_signing_key_history;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS host_signing_key_history (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    host_uuid TEXT NOT NULL,
+    signing_public_key TEXT NOT NULL,
+    replaced_by_key TEXT NOT NULL,
+    rotation_signature TEXT NOT NULL,
+    rotated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (host_uuid) REFERENCES hosts(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_host_signing_key_history_host
+    ON host_signing_key_history(host_uuid, id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_host_signing_key_history_host_key
+    ON host_signing_key_history(host_uuid, signing_public_key);
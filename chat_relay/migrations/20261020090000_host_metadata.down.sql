@@ -0,0 +1,4 @@
+ALTER TABLE hosts DROP COLUMN updated_at;
+ALTER TABLE hosts DROP COLUMN software_version;
+ALTER TABLE hosts DROP COLUMN icon_url;
+ALTER TABLE hosts DROP COLUMN description;
@@ -0,0 +1,4 @@
+ALTER TABLE hosts ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE hosts ADD COLUMN icon_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE hosts ADD COLUMN software_version TEXT NOT NULL DEFAULT '';
+ALTER TABLE hosts ADD COLUMN updated_at TEXT;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS host_quotas (
+    host_uuid TEXT PRIMARY KEY,
+    max_clients INTEGER,
+    max_sessions_per_key INTEGER,
+    max_channel_subscribers INTEGER,
+    max_messages_per_minute INTEGER,
+    note TEXT NOT NULL DEFAULT '',
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (host_uuid) REFERENCES hosts(uuid) ON DELETE CASCADE
+);
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// handleReportMessage forwards a member's report on a message in one of their
+// channels. The host verifies the envelope, so the relay only checks that the
+// reporter can read the channel.
+func handleReportMessage(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[ReportMessageClient](wsMsg.Data)
+	if err != nil || data.Envelope == nil {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid report message data"}})
+		return
+	}
+	if !requireSpaceCapability(client, data.SpaceUUID, data.ChannelUUID, data.CapabilityToken, scopeReadHistory, "Unauthorized channel access") {
+		return
+	}
+
+	SendToAuthor(client, WSMessage{
+		Type: "report_message_request",
+		Data: ReportMessageRequest{
+			SpaceUUID:                 data.SpaceUUID,
+			ChannelUUID:               data.ChannelUUID,
+			Envelope:                  data.Envelope,
+			Excerpt:                   data.Excerpt,
+			Reason:                    data.Reason,
+			RequesterUserID:           client.UserID,
+			RequesterUserPublicKey:    client.PublicKey,
+			RequesterUserEncPublicKey: client.EncPublicKey,
+			ClientUUID:                client.ClientUUID,
+		},
+	})
+}
+
+func handleReportUser(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[ReportUserClient](wsMsg.Data)
+	if err != nil || data.UserPublicKey == "" {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid report user data"}})
+		return
+	}
+	if !requireSpaceCapability(client, data.SpaceUUID, "", data.CapabilityToken, scopeReadHistory, "Unauthorized space access") {
+		return
+	}
+
+	SendToAuthor(client, WSMessage{
+		Type: "report_user_request",
+		Data: ReportUserRequest{
+			SpaceUUID:                 data.SpaceUUID,
+			UserPublicKey:             data.UserPublicKey,
+			Reason:                    data.Reason,
+			RequesterUserID:           client.UserID,
+			RequesterUserPublicKey:    client.PublicKey,
+			RequesterUserEncPublicKey: client.EncPublicKey,
+			ClientUUID:                client.ClientUUID,
+		},
+	})
+}
+
+func handleReportRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[ReportResponse](wsMsg.Data)
+	if err != nil {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid report response data"}})
+		return
+	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
+
+	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
+		Type: "report_success",
+		Data: ReportSuccess{ReportID: data.ReportID, Kind: data.Kind, SpaceUUID: data.SpaceUUID},
+	})
+}
+
+// handleListReports needs the capability for removing members, as does
+// resolving a report: moderation is an admin action.
+func handleListReports(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[ListReportsClient](wsMsg.Data)
+	if err != nil {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid list reports data"}})
+		return
+	}
+	if !requireSpaceCapability(client, data.SpaceUUID, "", data.CapabilityToken, scopeRemoveSpaceUser, "Unauthorized space access") {
+		return
+	}
+
+	SendToAuthor(client, WSMessage{
+		Type: "list_reports_request",
+		Data: ListReportsRequest{
+			SpaceUUID:                 data.SpaceUUID,
+			Status:                    data.Status,
+			RequesterUserID:           client.UserID,
+			RequesterUserPublicKey:    client.PublicKey,
+			RequesterUserEncPublicKey: client.EncPublicKey,
+			ClientUUID:                client.ClientUUID,
+		},
+	})
+}
+
+func handleListReportsRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[ListReportsResponse](wsMsg.Data)
+	if err != nil {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid list reports response data"}})
+		return
+	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
+	reports := data.Reports
+	if reports == nil {
+		reports = []ModerationReport{}
+	}
+
+	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
+		Type: "list_reports_success",
+		Data: ListReportsSuccess{SpaceUUID: data.SpaceUUID, Reports: reports},
+	})
+}
+
+func handleResolveReport(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[ResolveReportClient](wsMsg.Data)
+	if err != nil || data.ReportID <= 0 || data.Action == "" {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid resolve report data"}})
+		return
+	}
+	if !requireSpaceCapability(client, data.SpaceUUID, "", data.CapabilityToken, scopeRemoveSpaceUser, "Unauthorized space access") {
+		return
+	}
+
+	SendToAuthor(client, WSMessage{
+		Type: "resolve_report_request",
+		Data: ResolveReportRequest{
+			SpaceUUID:                 data.SpaceUUID,
+			ReportID:                  data.ReportID,
+			Action:                    data.Action,
+			RequesterUserID:           client.UserID,
+			RequesterUserPublicKey:    client.PublicKey,
+			RequesterUserEncPublicKey: client.EncPublicKey,
+			ClientUUID:                client.ClientUUID,
+		},
+	})
+}
+
+// handleResolveReportRes tells the moderator the report is closed and, when
+// the reported message was deleted, tells its channel. Removals arrive
+// separately as remove_space_user_success.
+func handleResolveReportRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	if !client.IsHostAuthor {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Only the host can resolve reports"}})
+		return
+	}
+	data, err := decodeData[ResolveReportResponse](wsMsg.Data)
+	if err != nil {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid resolve report response data"}})
+		return
+	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
+
+	if data.DeletedMessageID != "" && data.Report.ChannelUUID != "" {
+		BroadcastToChannel(client.HostUUID, data.Report.ChannelUUID, WSMessage{
+			Type: "message_deleted",
+			Data: MessageDeleted{ChannelUUID: data.Report.ChannelUUID, MessageID: data.DeletedMessageID},
+		})
+	}
+	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
+		Type: "resolve_report_success",
+		Data: ResolveReportSuccess{Report: data.Report},
+	})
+}
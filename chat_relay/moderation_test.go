@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayIntegrationModerationReports(t *testing.T) {
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "ivan")
+
+	// Member tokens may report but not moderate.
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "list_reports",
+		Data: ListReportsClient{SpaceUUID: member.spaceUUID, CapabilityToken: member.token},
+	})
+	mustReadUnauthorizedError(t, member.conn)
+
+	envelope := map[string]interface{}{"message_id": "m-bad", "ciphertext": "x"}
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "report_message",
+		Data: ReportMessageClient{
+			SpaceUUID:       member.spaceUUID,
+			ChannelUUID:     member.channelUUID,
+			Envelope:        envelope,
+			Excerpt:         "spam link",
+			Reason:          "spam",
+			CapabilityToken: member.token,
+		},
+	})
+	requestMsg := author.mustNextType("report_message_request")
+	request, err := decodeData[ReportMessageRequest](requestMsg.Data)
+	if err != nil {
+		t.Fatalf("decode report_message_request: %v", err)
+	}
+	if request.RequesterUserPublicKey != member.auth.PublicKey || request.ClientUUID == "" || request.Excerpt != "spam link" || request.Envelope["message_id"] != "m-bad" {
+		t.Fatalf("unexpected report_message_request: %+v", request)
+	}
+	author.mustSend(WSMessage{
+		Type: "report_response",
+		Data: ReportResponse{ReportID: 7, Kind: "message", SpaceUUID: member.spaceUUID, ClientUUID: request.ClientUUID},
+	})
+	reportMsg := mustReadType(t, member.conn, "report_success", testReadTimeout)
+	if report, _ := decodeData[ReportSuccess](reportMsg.Data); report.ReportID != 7 {
+		t.Fatalf("unexpected report_success: %+v", report)
+	}
+
+	adminToken := env.mustIssueCapabilityToken(t, member.auth.PublicKey, member.spaceUUID, []string{scopeRemoveSpaceUser}, 5*time.Minute)
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "resolve_report",
+		Data: ResolveReportClient{SpaceUUID: member.spaceUUID, ReportID: 7, Action: "delete_message", CapabilityToken: adminToken},
+	})
+	resolveMsg := author.mustNextType("resolve_report_request")
+	resolve, err := decodeData[ResolveReportRequest](resolveMsg.Data)
+	if err != nil || resolve.ReportID != 7 || resolve.Action != "delete_message" || resolve.RequesterUserPublicKey != member.auth.PublicKey {
+		t.Fatalf("unexpected resolve_report_request: %v %+v", err, resolve)
+	}
+	author.mustSend(WSMessage{
+		Type: "resolve_report_response",
+		Data: ResolveReportResponse{
+			Report: ModerationReport{
+				ID:          7,
+				SpaceUUID:   member.spaceUUID,
+				ChannelUUID: member.channelUUID,
+				Kind:        "message",
+				MessageID:   "m-bad",
+				Status:      "resolved",
+				Action:      "delete_message",
+			},
+			DeletedMessageID: "m-bad",
+			ClientUUID:       resolve.ClientUUID,
+		},
+	})
+	deletedMsg := mustReadType(t, member.conn, "message_deleted", testReadTimeout)
+	if deleted, _ := decodeData[MessageDeleted](deletedMsg.Data); deleted.MessageID != "m-bad" || deleted.ChannelUUID != member.channelUUID {
+		t.Fatalf("unexpected message_deleted: %+v", deleted)
+	}
+	resolvedMsg := mustReadType(t, member.conn, "resolve_report_success", testReadTimeout)
+	if resolved, _ := decodeData[ResolveReportSuccess](resolvedMsg.Data); resolved.Report.Status != "resolved" {
+		t.Fatalf("unexpected resolve_report_success: %+v", resolved)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"gochat/db"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Per-host quotas keep one busy host from taking over the relay. Defaults
+// come from the environment; an operator can override them per host in the
+// host_quotas table, where a NULL column keeps the default and 0 lifts the
+// limit.
+//
+// In cluster mode each node only sees its own connections, so the
+// connection quotas are split evenly across the live nodes and every node
+// admits up to its share, rounded up. Message throughput is counted in the
+// cluster store, so the cluster shares one budget per minute.
+
+const (
+	quotaClients            = "clients"
+	quotaSessionsPerKey     = "sessions_per_key"
+	quotaChannelSubscribers = "channel_subscribers"
+	quotaMessagesPerMinute  = "messages_per_minute"
+
+	// hostQuotaRefresh is how often a loaded host rereads host_quotas, so
+	// operator changes apply without a restart.
+	hostQuotaRefresh = time.Minute
+	// quotaUsagePushInterval throttles the usage pushed to the author after
+	// a rejection.
+	quotaUsagePushInterval = 10 * time.Second
+)
+
+// HostQuota is a set of limits; 0 means unlimited. In cluster mode a node
+// enforces nodeQuota's share of the first three.
+type HostQuota struct {
+	MaxClients            int `json:"max_clients"`
+	MaxSessionsPerKey     int `json:"max_sessions_per_key"`
+	MaxChannelSubscribers int `json:"max_channel_subscribers"`
+	MaxMessagesPerMinute  int `json:"max_messages_per_minute"`
+}
+
+type hostQuotaDefaultsConfig struct {
+	mu    sync.Mutex
+	quota HostQuota
+}
+
+var hostQuotaDefaults = &hostQuotaDefaultsConfig{quota: HostQuota{
+	MaxClients:            1000,
+	MaxSessionsPerKey:     5,
+	MaxChannelSubscribers: 500,
+	MaxMessagesPerMinute:  3000,
+}}
+
+func (d *hostQuotaDefaultsConfig) set(quota HostQuota) {
+	d.mu.Lock()
+	d.quota = quota
+	d.mu.Unlock()
+}
+
+func (d *hostQuotaDefaultsConfig) get() HostQuota {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.quota
+}
+
+// hostQuotaState is the quota bookkeeping on a Host, guarded by host.mu.
+type hostQuotaState struct {
+	quota         HostQuota
+	loadedAt      time.Time
+	windowStart   time.Time
+	windowCount   int
+	rejections    map[string]int64
+	lastUsagePush time.Time
+}
+
+func loadHostQuota(hostUUID string) (HostQuota, error) {
+	quota := hostQuotaDefaults.get()
+	var maxClients, maxSessions, maxSubscribers, maxMessages sql.NullInt64
+	err := db.HostDB.QueryRow(
+		`SELECT max_clients, max_sessions_per_key, max_channel_subscribers, max_messages_per_minute FROM host_quotas WHERE host_uuid = ?`,
+		hostUUID,
+	).Scan(&maxClients, &maxSessions, &maxSubscribers, &maxMessages)
+	if err == sql.ErrNoRows {
+		return quota, nil
+	}
+	if err != nil {
+		return quota, err
+	}
+	override := func(limit *int, value sql.NullInt64) {
+		if value.Valid {
+			*limit = int(max(value.Int64, 0))
+		}
+	}
+	override(&quota.MaxClients, maxClients)
+	override(&quota.MaxSessionsPerKey, maxSessions)
+	override(&quota.MaxChannelSubscribers, maxSubscribers)
+	override(&quota.MaxMessagesPerMinute, maxMessages)
+	return quota, nil
+}
+
+// currentHostQuota returns the host's limits, rereading host_quotas when
+// they are older than hostQuotaRefresh.
+func currentHostQuota(host *Host) HostQuota {
+	host.mu.Lock()
+	quota := host.quota.quota
+	fresh := !host.quota.loadedAt.IsZero() && time.Since(host.quota.loadedAt) < hostQuotaRefresh
+	host.mu.Unlock()
+	if fresh {
+		return quota
+	}
+
+	quota, err := loadHostQuota(host.UUID)
+	if err != nil {
+		log.Printf("Database error loading quota for host %s: %v", host.UUID, err)
+	}
+	host.mu.Lock()
+	host.quota.quota = quota
+	host.quota.loadedAt = time.Now()
+	host.mu.Unlock()
+	return quota
+}
+
+// nodeQuota is this node's share of quota's connection limits. Nothing
+// spreads one key's sessions or one channel's subscribers evenly across the
+// nodes, so those two shares refuse connections well below the configured
+// total when the load balancer sends a user or a channel to one node. Small
+// per-key limits suffer most; operators running several nodes should set
+// them to the per-node limit they want times the node count, or to 0.
+func nodeQuota(quota HostQuota) HostQuota {
+	nodes := relayCluster.liveNodes()
+	quota.MaxClients = nodeShare(quota.MaxClients, nodes)
+	quota.MaxSessionsPerKey = nodeShare(quota.MaxSessionsPerKey, nodes)
+	quota.MaxChannelSubscribers = nodeShare(quota.MaxChannelSubscribers, nodes)
+	return quota
+}
+
+func nodeShare(limit, nodes int) int {
+	if limit == 0 || nodes <= 1 {
+		return limit
+	}
+	return (limit + nodes - 1) / nodes
+}
+
+// hostMessageQuotaKey names the cluster counter for the host's messages in
+// the minute now falls in.
+func hostMessageQuotaKey(hostUUID string, now time.Time) string {
+	return fmt.Sprintf("quota.messages.%s.%d", hostUUID, now.Unix()/60)
+}
+
+// rejectQuotaLocked counts a rejection and builds the error for the client.
+// host.mu must be held.
+func rejectQuotaLocked(host *Host, quota string, limit int, content string) *QuotaExceeded {
+	if host.quota.rejections == nil {
+		host.quota.rejections = make(map[string]int64)
+	}
+	host.quota.rejections[quota]++
+	return &QuotaExceeded{Content: content, Code: "quota_exceeded", Quota: quota, Limit: limit}
+}
+
+// admitClientLocked checks the client quota for a new connection. Host
+// candidates are let through while the host has no author, so a full host
+// can still get its author back. host.mu must be held.
+func admitClientLocked(host *Host, quota HostQuota, conn *websocket.Conn, isHostCandidate bool) *QuotaExceeded {
+	if quota.MaxClients == 0 || (isHostCandidate && host.AuthorConn == nil) {
+		return nil
+	}
+	clients := 0
+	for existing := range host.ClientsByConn {
+		if existing != conn && existing != host.AuthorConn {
+			clients++
+		}
+	}
+	if clients < quota.MaxClients {
+		return nil
+	}
+	return rejectQuotaLocked(host, quotaClients, quota.MaxClients, "This host has reached its connection limit on the relay")
+}
+
+// admitSessionLocked checks how many connections already use publicKey.
+// host.mu must be held.
+func admitSessionLocked(host *Host, quota HostQuota, client *Client, publicKey string) *QuotaExceeded {
+	if quota.MaxSessionsPerKey == 0 {
+		return nil
+	}
+	sessions := 0
+	for _, existing := range host.ClientsByConn {
+		if existing != client && existing.PublicKey == publicKey {
+			sessions++
+		}
+	}
+	if sessions < quota.MaxSessionsPerKey {
+		return nil
+	}
+	return rejectQuotaLocked(host, quotaSessionsPerKey, quota.MaxSessionsPerKey, "Too many sessions for this identity on this host")
+}
+
+// admitSubscriberLocked checks the channel subscriber quota. host.mu and
+// channel.mu must be held.
+func admitSubscriberLocked(host *Host, quota HostQuota, channel *Channel, conn *websocket.Conn) *QuotaExceeded {
+	if quota.MaxChannelSubscribers == 0 {
+		return nil
+	}
+	if _, subscribed := channel.Users[conn]; subscribed || len(channel.Users) < quota.MaxChannelSubscribers {
+		return nil
+	}
+	return rejectQuotaLocked(host, quotaChannelSubscribers, quota.MaxChannelSubscribers, "This channel is full")
+}
+
+// takeHostMessage counts a chat message against the host's per-minute
+// throughput. In cluster mode the count is shared; if the cluster store is
+// unreachable the node falls back to its share of the limit.
+func takeHostMessage(host *Host, now time.Time) *QuotaExceeded {
+	quota := currentHostQuota(host)
+	limit := quota.MaxMessagesPerMinute
+	if limit > 0 {
+		count, shared, err := relayCluster.increment(hostMessageQuotaKey(host.UUID, now), 2*time.Minute)
+		if err != nil {
+			log.Printf("cluster: counting messages for host %s: %v", host.UUID, err)
+			limit = nodeShare(limit, relayCluster.liveNodes())
+		} else if shared {
+			host.mu.Lock()
+			defer host.mu.Unlock()
+			host.quota.windowStart = now.Truncate(time.Minute)
+			host.quota.windowCount = int(min(count, int64(limit)))
+			if count > int64(limit) {
+				return rejectQuotaLocked(host, quotaMessagesPerMinute, limit, "This host's message limit was reached; try again shortly")
+			}
+			return nil
+		}
+	}
+
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	if now.Sub(host.quota.windowStart) >= time.Minute {
+		host.quota.windowStart = now
+		host.quota.windowCount = 0
+	}
+	if limit > 0 && host.quota.windowCount >= limit {
+		return rejectQuotaLocked(host, quotaMessagesPerMinute, limit, "This host's message limit was reached; try again shortly")
+	}
+	host.quota.windowCount++
+	return nil
+}
+
+func hostQuotaUsage(host *Host) HostQuotaUsage {
+	quota := currentHostQuota(host)
+	host.mu.Lock()
+	defer host.mu.Unlock()
+
+	usage := HostQuotaUsage{Limits: quota, Rejections: make(map[string]int64)}
+	sessionsByKey := make(map[string]int)
+	for conn, client := range host.ClientsByConn {
+		if conn != host.AuthorConn {
+			usage.Clients++
+		}
+		if client.PublicKey != "" {
+			sessionsByKey[client.PublicKey]++
+		}
+	}
+	for _, sessions := range sessionsByKey {
+		usage.BusiestKeySessions = max(usage.BusiestKeySessions, sessions)
+	}
+	for _, channel := range host.Channels {
+		channel.mu.Lock()
+		usage.BusiestChannelSubscribers = max(usage.BusiestChannelSubscribers, len(channel.Users))
+		channel.mu.Unlock()
+	}
+	if time.Since(host.quota.windowStart) < time.Minute {
+		usage.MessagesThisMinute = host.quota.windowCount
+	}
+	for quota, count := range host.quota.rejections {
+		usage.Rejections[quota] = count
+	}
+	return usage
+}
+
+// sendQuotaUsage sends the host's usage to its author when connected here.
+func sendQuotaUsage(host *Host) {
+	sendToLocalAuthor(host.UUID, WSMessage{Type: "quota_usage", Data: hostQuotaUsage(host)})
+}
+
+// noteQuotaRejection lets the author know a quota turned someone away, at
+// most every quotaUsagePushInterval.
+func noteQuotaRejection(host *Host) {
+	host.mu.Lock()
+	push := time.Since(host.quota.lastUsagePush) >= quotaUsagePushInterval
+	if push {
+		host.quota.lastUsagePush = time.Now()
+	}
+	host.mu.Unlock()
+	if push {
+		sendQuotaUsage(host)
+	}
+}
+
+func handleGetQuotaUsage(client *Client, conn *websocket.Conn) {
+	if !client.IsHostAuthor {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Only the host can read its quota usage"}})
+		return
+	}
+	host, exists := GetHost(client.HostUUID)
+	if !exists {
+		return
+	}
+	safeSend(client, conn, WSMessage{Type: "quota_usage", Data: hostQuotaUsage(host)})
+}
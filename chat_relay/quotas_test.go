@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"gochat/db"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+func setHostQuotaDefaults(t *testing.T, quota HostQuota) {
+	t.Helper()
+	prev := hostQuotaDefaults.get()
+	hostQuotaDefaults.set(quota)
+	t.Cleanup(func() { hostQuotaDefaults.set(prev) })
+}
+
+func mustDecodeQuotaExceeded(t *testing.T, msg WSMessage, quota string, limit int) {
+	t.Helper()
+	exceeded, err := decodeData[QuotaExceeded](msg.Data)
+	if err != nil {
+		t.Fatalf("decode quota error: %v", err)
+	}
+	if exceeded.Code != "quota_exceeded" || exceeded.Quota != quota || exceeded.Limit != limit || exceeded.Content == "" {
+		t.Fatalf("unexpected quota error: %+v", exceeded)
+	}
+}
+
+// sendAuthWithKey authenticates conn as priv's identity and returns the
+// relay's answer.
+func sendAuthWithKey(t *testing.T, env *relayIntegrationEnv, conn *websocket.Conn, challenge string, priv ed25519.PrivateKey) WSMessage {
+	t.Helper()
+	publicKey := base64.RawStdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+	encPublicKey := "enc-" + publicKey[:8]
+	mustWriteMessage(t, conn, WSMessage{
+		Type: "auth_pubkey",
+		Data: AuthPubKeyClient{
+			PublicKey:    publicKey,
+			EncPublicKey: encPublicKey,
+			Challenge:    challenge,
+			Signature:    base64.RawStdEncoding.EncodeToString(ed25519.Sign(priv, []byte(authMessage(env.hostUUID, challenge, encPublicKey)))),
+		},
+	})
+	msg, err := readOneMessage(conn, testReadTimeout)
+	if err != nil {
+		t.Fatalf("read auth answer: %v", err)
+	}
+	return msg
+}
+
+func TestRelayIntegrationClientAndSessionQuotas(t *testing.T) {
+	setHostQuotaDefaults(t, HostQuota{MaxClients: 3})
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	// The operator override caps sessions per key and leaves the client
+	// limit at the default.
+	if _, err := db.HostDB.Exec(`INSERT INTO host_quotas (host_uuid, max_sessions_per_key) VALUES (?, 1)`, env.hostUUID); err != nil {
+		t.Fatalf("insert override: %v", err)
+	}
+	author := env.connectAuthor(t)
+	author.mustNextType("quota_usage")
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	first := env.dialWS(t)
+	defer first.Close()
+	if msg := sendAuthWithKey(t, env, first, env.joinHost(t, first), priv); msg.Type != "auth_pubkey_success" {
+		t.Fatalf("expected the first session to authenticate, got %s", msg.Type)
+	}
+	second := env.dialWS(t)
+	defer second.Close()
+	msg := sendAuthWithKey(t, env, second, env.joinHost(t, second), priv)
+	if msg.Type != "join_error" {
+		t.Fatalf("expected a second session for the key to be refused, got %s", msg.Type)
+	}
+	mustDecodeQuotaExceeded(t, msg, quotaSessionsPerKey, 1)
+
+	third := env.dialWS(t)
+	defer third.Close()
+	env.joinHost(t, third)
+	fourth := env.dialWS(t)
+	defer fourth.Close()
+	mustWriteMessage(t, fourth, WSMessage{Type: "join_host", Data: JoinHost{UUID: env.hostUUID}})
+	mustDecodeQuotaExceeded(t, mustReadType(t, fourth, "join_error", testReadTimeout), quotaClients, 3)
+
+	// The first rejection pushed usage to the author; the second was
+	// throttled, so ask.
+	author.mustNextType("quota_usage")
+	author.mustSend(WSMessage{Type: "get_quota_usage"})
+	usage, err := decodeData[HostQuotaUsage](author.mustNextType("quota_usage").Data)
+	if err != nil {
+		t.Fatalf("decode quota_usage: %v", err)
+	}
+	if usage.Limits.MaxClients != 3 || usage.Limits.MaxSessionsPerKey != 1 || usage.Clients != 3 || usage.BusiestKeySessions != 1 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+	if usage.Rejections[quotaSessionsPerKey] != 1 || usage.Rejections[quotaClients] != 1 {
+		t.Fatalf("expected both rejections counted, got %v", usage.Rejections)
+	}
+}
+
+func TestRelayIntegrationChannelAndThroughputQuotas(t *testing.T) {
+	setHostQuotaDefaults(t, HostQuota{MaxChannelSubscribers: 1, MaxMessagesPerMinute: 1})
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "ada")
+
+	// A second member of the space cannot join the full channel.
+	other := env.dialWS(t)
+	defer other.Close()
+	auth := authenticateClient(t, env, other, env.joinHost(t, other), "bob")
+	token := env.mustIssueCapabilityToken(t, auth.PublicKey, member.spaceUUID, []string{scopeJoinChannel, scopeReadHistory}, 5*time.Minute)
+	mustWriteMessage(t, other, WSMessage{Type: "join_all_spaces", Data: JoinAllSpacesClient{
+		SpaceUUIDs:       []string{member.spaceUUID},
+		CapabilityTokens: map[string]string{member.spaceUUID: token},
+	}})
+	mustReadType(t, other, "join_all_spaces_success", testReadTimeout)
+	mustWriteMessage(t, other, WSMessage{Type: "join_channel", Data: JoinUUID{UUID: member.channelUUID, CapabilityToken: token}})
+	mustDecodeQuotaExceeded(t, mustReadType(t, other, "quota_exceeded", testReadTimeout), quotaChannelSubscribers, 1)
+
+	for i, messageID := range []string{"m-1", "m-2"} {
+		mustWriteMessage(t, member.conn, WSMessage{
+			Type: "chat",
+			Data: ChatData{
+				Envelope:        map[string]interface{}{"message_id": messageID, "ciphertext": "ok"},
+				CapabilityToken: member.token,
+			},
+		})
+		if i == 0 {
+			author.mustNextType("save_chat_message_request")
+		}
+	}
+	mustDecodeQuotaExceeded(t, mustReadType(t, member.conn, "quota_exceeded", testReadTimeout), quotaMessagesPerMinute, 1)
+
+	// The throughput rejection came too soon after the channel one to be
+	// pushed, so ask.
+	author.mustSend(WSMessage{Type: "get_quota_usage"})
+	usage, err := decodeData[HostQuotaUsage](author.mustNextType("quota_usage").Data)
+	if err != nil {
+		t.Fatalf("decode quota_usage: %v", err)
+	}
+	if usage.MessagesThisMinute != 1 || usage.BusiestChannelSubscribers != 1 ||
+		usage.Rejections[quotaChannelSubscribers] != 1 || usage.Rejections[quotaMessagesPerMinute] != 1 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestRelayIntegrationClusterSplitsConnectionQuotas(t *testing.T) {
+	setHostQuotaDefaults(t, HostQuota{MaxSessionsPerKey: 3})
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	remote := startTestCluster(t)
+	env.connectAuthor(t)
+
+	// Once the other node is heard from, this node admits half the
+	// sessions, rounded up.
+	remote.publish(clusterSubjectAll, clusterMessage{Kind: clusterState})
+	waitForRoute(t, func() bool { return relayCluster.liveNodes() == 2 })
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	for i := 0; i < 2; i++ {
+		conn := env.dialWS(t)
+		defer conn.Close()
+		if msg := sendAuthWithKey(t, env, conn, env.joinHost(t, conn), priv); msg.Type != "auth_pubkey_success" {
+			t.Fatalf("expected session %d to authenticate, got %s", i+1, msg.Type)
+		}
+	}
+	third := env.dialWS(t)
+	defer third.Close()
+	msg := sendAuthWithKey(t, env, third, env.joinHost(t, third), priv)
+	if msg.Type != "join_error" {
+		t.Fatalf("expected the session beyond this node's share to be refused, got %s", msg.Type)
+	}
+	mustDecodeQuotaExceeded(t, msg, quotaSessionsPerKey, 2)
+}
+
+func TestRelayIntegrationClusterSharesMessageQuota(t *testing.T) {
+	setHostQuotaDefaults(t, HostQuota{MaxMessagesPerMinute: 2})
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	server := miniredis.RunT(t)
+	bus, err := newRedisBus("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("connect redis bus: %v", err)
+	}
+	node, err := startCluster("node-a", bus)
+	if err != nil {
+		t.Fatalf("start cluster: %v", err)
+	}
+	relayCluster = node
+	t.Cleanup(func() {
+		relayCluster = nil
+		_ = node.Close()
+	})
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "ada")
+
+	// Keep the whole exchange inside one counting window.
+	if now := time.Now(); now.Second() >= 55 {
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+	}
+	// Another node has already passed one of the host's messages.
+	otherNode, err := newRedisBus("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("connect second redis bus: %v", err)
+	}
+	defer otherNode.Close()
+	if _, err := otherNode.Increment(clusterSubjectPrefix+hostMessageQuotaKey(env.hostUUID, time.Now()), 2*time.Minute); err != nil {
+		t.Fatalf("count remote message: %v", err)
+	}
+
+	for i, messageID := range []string{"m-1", "m-2"} {
+		mustWriteMessage(t, member.conn, WSMessage{
+			Type: "chat",
+			Data: ChatData{
+				Envelope:        map[string]interface{}{"message_id": messageID, "ciphertext": "ok"},
+				CapabilityToken: member.token,
+			},
+		})
+		if i == 0 {
+			author.mustNextType("save_chat_message_request")
+		}
+	}
+	mustDecodeQuotaExceeded(t, mustReadType(t, member.conn, "quota_exceeded", testReadTimeout), quotaMessagesPerMinute, 2)
+}
@@ -1,45 +1,61 @@
 package main
 
 import (
+	"database/sql"
+	"embed"
 	"fmt"
 	"gochat/db"
 )
 
-func ensureChatRelaySchema() error {
-	statements := []string{
-		`CREATE TABLE IF NOT EXISTS hosts (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			uuid TEXT NOT NULL UNIQUE,
-			name TEXT NOT NULL,
-			signing_public_key TEXT NOT NULL DEFAULT '',
-			online INTEGER DEFAULT 0
-		)`,
-	}
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
 
-	for _, stmt := range statements {
-		if _, err := db.HostDB.Exec(stmt); err != nil {
-			return fmt.Errorf("schema exec failed: %w", err)
-		}
+const migrationsPath = "migrations"
+
+// relaySchemaBaselineVersion is the migration that matches the schema the
+// relay bootstrapped in code before it used versioned migrations.
+const relaySchemaBaselineVersion = 20261018090000
+
+func openRelayDatabase(dbPath string) (*sql.DB, error) {
+	return db.InitDB(dbPath, migrationFiles, migrationsPath, adoptLegacyRelaySchema)
+}
+
+func adoptLegacyRelaySchema(conn *sql.DB) (uint, error) {
+	var hostsTables int
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'hosts'`).Scan(&hostsTables); err != nil {
+		return 0, fmt.Errorf("failed checking for hosts table: %w", err)
+	}
+	if hostsTables == 0 {
+		return 0, nil
 	}
-	if _, err := db.HostDB.Exec(`DROP TABLE IF EXISTS chat_identities`); err != nil {
+	if err := normalizeLegacyRelaySchema(conn); err != nil {
+		return 0, err
+	}
+	return relaySchemaBaselineVersion, nil
+}
+
+// normalizeLegacyRelaySchema is the pre-migrations bootstrap, kept so relay
+// DBs from any older release are brought to the baseline before adoption.
+func normalizeLegacyRelaySchema(conn *sql.DB) error {
+	if _, err := conn.Exec(`DROP TABLE IF EXISTS chat_identities`); err != nil {
 		return fmt.Errorf("failed to drop legacy chat_identities table: %w", err)
 	}
-	if err := migrateHostsTableWithoutAuthorID(); err != nil {
+	if err := migrateHostsTableWithoutAuthorID(conn); err != nil {
 		return err
 	}
 
-	if err := ensureRelayColumnExists("hosts", "online", `ALTER TABLE hosts ADD COLUMN online INTEGER DEFAULT 0`); err != nil {
+	if err := ensureRelayColumnExists(conn, "hosts", "online", `ALTER TABLE hosts ADD COLUMN online INTEGER DEFAULT 0`); err != nil {
 		return err
 	}
-	if err := ensureRelayColumnExists("hosts", "signing_public_key", `ALTER TABLE hosts ADD COLUMN signing_public_key TEXT NOT NULL DEFAULT ''`); err != nil {
+	if err := ensureRelayColumnExists(conn, "hosts", "signing_public_key", `ALTER TABLE hosts ADD COLUMN signing_public_key TEXT NOT NULL DEFAULT ''`); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func relayTableColumns(tableName string) (map[string]struct{}, error) {
-	rows, err := db.HostDB.Query("PRAGMA table_info(" + tableName + ")")
+func relayTableColumns(conn *sql.DB, tableName string) (map[string]struct{}, error) {
+	rows, err := conn.Query("PRAGMA table_info(" + tableName + ")")
 	if err != nil {
 		return nil, fmt.Errorf("table_info query failed for %s: %w", tableName, err)
 	}
@@ -64,8 +80,8 @@ func relayTableColumns(tableName string) (map[string]struct{}, error) {
 	return columns, nil
 }
 
-func migrateHostsTableWithoutAuthorID() error {
-	columns, err := relayTableColumns("hosts")
+func migrateHostsTableWithoutAuthorID(conn *sql.DB) error {
+	columns, err := relayTableColumns(conn, "hosts")
 	if err != nil {
 		return err
 	}
@@ -82,10 +98,10 @@ func migrateHostsTableWithoutAuthorID() error {
 		selectOnline = "COALESCE(online, 0) AS online"
 	}
 
-	if _, err := db.HostDB.Exec(`DROP TABLE IF EXISTS hosts_new`); err != nil {
+	if _, err := conn.Exec(`DROP TABLE IF EXISTS hosts_new`); err != nil {
 		return fmt.Errorf("failed dropping stale hosts_new table: %w", err)
 	}
-	if _, err := db.HostDB.Exec(`
+	if _, err := conn.Exec(`
 		CREATE TABLE IF NOT EXISTS hosts_new (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			uuid TEXT NOT NULL UNIQUE,
@@ -101,20 +117,20 @@ func migrateHostsTableWithoutAuthorID() error {
 		INSERT INTO hosts_new (id, uuid, name, signing_public_key, online)
 		SELECT id, uuid, name, %s, %s FROM hosts
 	`, selectSigning, selectOnline)
-	if _, err := db.HostDB.Exec(copyQuery); err != nil {
+	if _, err := conn.Exec(copyQuery); err != nil {
 		return fmt.Errorf("failed copying hosts data into hosts_new: %w", err)
 	}
-	if _, err := db.HostDB.Exec(`DROP TABLE hosts`); err != nil {
+	if _, err := conn.Exec(`DROP TABLE hosts`); err != nil {
 		return fmt.Errorf("failed dropping legacy hosts table: %w", err)
 	}
-	if _, err := db.HostDB.Exec(`ALTER TABLE hosts_new RENAME TO hosts`); err != nil {
+	if _, err := conn.Exec(`ALTER TABLE hosts_new RENAME TO hosts`); err != nil {
 		return fmt.Errorf("failed renaming hosts_new table: %w", err)
 	}
 	return nil
 }
 
-func ensureRelayColumnExists(tableName, columnName, alterStmt string) error {
-	rows, err := db.HostDB.Query("PRAGMA table_info(" + tableName + ")")
+func ensureRelayColumnExists(conn *sql.DB, tableName, columnName, alterStmt string) error {
+	rows, err := conn.Query("PRAGMA table_info(" + tableName + ")")
 	if err != nil {
 		return fmt.Errorf("table_info query failed for %s: %w", tableName, err)
 	}
@@ -138,7 +154,7 @@ func ensureRelayColumnExists(tableName, columnName, alterStmt string) error {
 		return fmt.Errorf("table_info row error for %s: %w", tableName, err)
 	}
 
-	if _, err := db.HostDB.Exec(alterStmt); err != nil {
+	if _, err := conn.Exec(alterStmt); err != nil {
 		return fmt.Errorf("alter table failed for %s.%s: %w", tableName, columnName, err)
 	}
 	return nil
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gochat/db"
+)
+
+func relayMigrationVersion(t *testing.T, conn *sql.DB) (int, bool) {
+	t.Helper()
+
+	var version int
+	var dirty bool
+	if err := conn.QueryRow(`SELECT version, dirty FROM schema_migrations`).Scan(&version, &dirty); err != nil {
+		t.Fatalf("read schema_migrations: %v", err)
+	}
+	return version, dirty
+}
+
+func latestRelayMigrationVersion(t *testing.T) int {
+	t.Helper()
+
+	entries, err := migrationFiles.ReadDir(migrationsPath)
+	if err != nil {
+		t.Fatalf("read embedded migrations: %v", err)
+	}
+	latest := 0
+	for _, entry := range entries {
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			t.Fatalf("migration %s has no numeric version", entry.Name())
+		}
+		if version > latest {
+			latest = version
+		}
+	}
+	return latest
+}
+
+func TestOpenRelayDatabaseFreshInstall(t *testing.T) {
+	conn, err := openRelayDatabase(filepath.Join(t.TempDir(), "fresh.sqlite"))
+	if err != nil {
+		t.Fatalf("open relay db: %v", err)
+	}
+	defer conn.Close()
+
+	latest := latestRelayMigrationVersion(t)
+	version, dirty := relayMigrationVersion(t, conn)
+	if version != latest || dirty {
+		t.Fatalf("expected clean version %d, got %d dirty=%v", latest, version, dirty)
+	}
+	columns, err := relayTableColumns(conn, "hosts")
+	if err != nil {
+		t.Fatalf("hosts columns: %v", err)
+	}
+	for _, name := range []string{"uuid", "name", "signing_public_key", "online"} {
+		if _, ok := columns[name]; !ok {
+			t.Fatalf("expected hosts.%s after migrations", name)
+		}
+	}
+}
+
+func TestOpenRelayDatabaseAdoptsLegacySchema(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "legacy.sqlite")
+	legacy, err := db.InitSQLite(dbPath)
+	if err != nil {
+		t.Fatalf("init sqlite: %v", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE hosts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			uuid TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			author_id TEXT NOT NULL UNIQUE
+		)`,
+		`CREATE TABLE chat_identities (id INTEGER PRIMARY KEY)`,
+		`INSERT INTO hosts (uuid, name, author_id) VALUES ('legacy-host', 'Legacy Host', 'author-1')`,
+	} {
+		if _, err := legacy.Exec(stmt); err != nil {
+			t.Fatalf("seed legacy schema: %v", err)
+		}
+	}
+	_ = legacy.Close()
+
+	conn, err := openRelayDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("open relay db: %v", err)
+	}
+	defer conn.Close()
+
+	// Adoption records the baseline; later migrations then apply on top.
+	latest := latestRelayMigrationVersion(t)
+	version, dirty := relayMigrationVersion(t, conn)
+	if version != latest || dirty {
+		t.Fatalf("expected version %d after adoption, got %d dirty=%v", latest, version, dirty)
+	}
+	columns, err := relayTableColumns(conn, "hosts")
+	if err != nil {
+		t.Fatalf("hosts columns: %v", err)
+	}
+	if _, ok := columns["author_id"]; ok {
+		t.Fatalf("expected legacy author_id column to be dropped")
+	}
+	if _, ok := columns["signing_public_key"]; !ok {
+		t.Fatalf("expected signing_public_key column after adoption")
+	}
+
+	var name string
+	if err := conn.QueryRow(`SELECT name FROM hosts WHERE uuid = 'legacy-host'`).Scan(&name); err != nil {
+		t.Fatalf("legacy host row lost: %v", err)
+	}
+	if name != "Legacy Host" {
+		t.Fatalf("unexpected legacy host name %q", name)
+	}
+	var identityTables int
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'chat_identities'`).Scan(&identityTables); err != nil {
+		t.Fatalf("check chat_identities: %v", err)
+	}
+	if identityTables != 0 {
+		t.Fatalf("expected legacy chat_identities table to be dropped")
+	}
+
+	// Reopening must not adopt again or re-run the baseline migration.
+	_ = conn.Close()
+	reopened, err := openRelayDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("reopen relay db: %v", err)
+	}
+	defer reopened.Close()
+	if version, _ := relayMigrationVersion(t, reopened); version != latest {
+		t.Fatalf("expected version %d after reopen, got %d", latest, version)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Each client's outbound messages go through SendQueue to its WritePump.
+// The queue is never closed: Done is the only thing that ends a client, and
+// only Client.close closes it, so a send can race a disconnect without
+// panicking. A full queue falls back on the message's priority.
+
+const clientSendQueueSize = 64
+
+// A host author carries every save, dashboard and moderation request for
+// its host, so host connections get a much deeper queue, and a critical
+// send to an author that finds it full waits up to authorSendTimeout for
+// room before giving up on the host.
+const (
+	authorSendQueueSize = 4096
+	authorSendTimeout   = 5 * time.Second
+)
+
+// closeSlowConsumer is the websocket close code for a client dropped
+// because it could not keep up with its queue.
+const closeSlowConsumer = 4008
+
+type messagePriority int
+
+const (
+	// priorityCritical messages cannot be lost without the client going
+	// out of sync, so a full queue disconnects the client instead.
+	priorityCritical messagePriority = iota
+	// priorityLow messages are dropped once the queue is full; the client
+	// recovers them later.
+	priorityLow
+	// priorityEphemeral messages are dropped early, keeping the last
+	// quarter of the queue for everything else.
+	priorityEphemeral
+)
+
+func sendPriority(msg WSMessage) messagePriority {
+	switch msg.Type {
+	case "joined_channel", "left_channel", "relay_health_check":
+		return priorityEphemeral
+	case "chat_saved":
+		return priorityLow
+	case "export_space_success":
+		// Clients ask for each chunk and ask again when one goes missing.
+		return priorityLow
+	case "chat":
+		// Strict delivery numbers every message, and clients refetch the
+		// gap a dropped one leaves.
+		if strictChatDelivery {
+			return priorityLow
+		}
+	}
+	return priorityCritical
+}
+
+// close ends the client: its WritePump stops and closes the socket. Safe to
+// call more than once.
+func (c *Client) close() {
+	c.closeOnce.Do(func() { close(c.Done) })
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+// disconnectSlow tells the client why and closes its socket, which ends the
+// read loop and runs cleanupClient. It runs apart from the sender, which
+// may hold host locks.
+func (c *Client) disconnectSlow() {
+	c.slowOnce.Do(func() {
+		log.Printf("Disconnecting slow consumer %s on host %s", c.ClientUUID, c.HostUUID)
+		go func() {
+			closeMsg := websocket.FormatCloseMessage(closeSlowConsumer, "slow_consumer")
+			_ = c.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+			_ = c.Conn.Close()
+		}()
+	})
+}
+
+// safeSend queues msg for client's WritePump. Nothing else writes to a
+// client socket, so a client without a queue gets nothing.
+func safeSend(client *Client, conn *websocket.Conn, msg WSMessage) {
+	if client == nil || client.SendQueue == nil || client.closed() {
+		return
+	}
+
+	priority := sendPriority(msg)
+	if priority == priorityEphemeral && len(client.SendQueue) >= cap(client.SendQueue)*3/4 {
+		return
+	}
+	client.unsent.Add(1)
+	select {
+	case client.SendQueue <- msg:
+		return
+	default:
+		client.unsent.Add(-1)
+	}
+	if priority == priorityCritical {
+		if client.IsHostAuthor && client.waitToSend(msg) {
+			return
+		}
+		client.disconnectSlow()
+	}
+}
+
+// waitToSend blocks until msg fits in the queue, the client closes or
+// authorSendTimeout passes, and reports whether msg was queued.
+func (c *Client) waitToSend(msg WSMessage) bool {
+	timer := time.NewTimer(authorSendTimeout)
+	defer timer.Stop()
+	c.unsent.Add(1)
+	select {
+	case c.SendQueue <- msg:
+		return true
+	case <-c.Done:
+	case <-timer.C:
+	}
+	c.unsent.Add(-1)
+	return false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newSocketPair returns the relay side and the peer side of a websocket.
+func newSocketPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	serverConns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(server.Close)
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = peer.Close() })
+	relaySide := <-serverConns
+	t.Cleanup(func() { _ = relaySide.Close() })
+	return relaySide, peer
+}
+
+func TestSafeSendOverflowPolicy(t *testing.T) {
+	relaySide, peer := newSocketPair(t)
+	// No WritePump: the queue only fills.
+	client := &Client{Conn: relaySide, ClientUUID: "slow", SendQueue: make(chan WSMessage, 4), Done: make(chan struct{})}
+
+	for i := 0; i < 3; i++ {
+		safeSend(client, relaySide, WSMessage{Type: "error"})
+	}
+	safeSend(client, relaySide, WSMessage{Type: "joined_channel"})
+	if len(client.SendQueue) != 3 {
+		t.Fatalf("expected an ephemeral message dropped at the high-water mark, queue has %d", len(client.SendQueue))
+	}
+	safeSend(client, relaySide, WSMessage{Type: "chat_saved"})
+	safeSend(client, relaySide, WSMessage{Type: "chat_saved"})
+	if len(client.SendQueue) != 4 {
+		t.Fatalf("expected one low-priority message queued and one dropped, queue has %d", len(client.SendQueue))
+	}
+	if got := client.unsent.Load(); got != 4 {
+		t.Fatalf("expected 4 unsent, have %d", got)
+	}
+
+	// A critical message that does not fit drops the client.
+	safeSend(client, relaySide, WSMessage{Type: "error"})
+	_, err := readOneMessage(peer, testReadTimeout)
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeSlowConsumer || closeErr.Text != "slow_consumer" {
+		t.Fatalf("expected a slow_consumer close frame, got %v", err)
+	}
+
+	// Sends after the client is gone, and closing twice, are harmless.
+	client.close()
+	client.close()
+	safeSend(client, relaySide, WSMessage{Type: "error"})
+}
+
+func TestSafeSendWaitsForRoomForHostAuthor(t *testing.T) {
+	relaySide, peer := newSocketPair(t)
+	author := &Client{Conn: relaySide, ClientUUID: "author", IsHostAuthor: true, SendQueue: make(chan WSMessage, 2), Done: make(chan struct{})}
+	safeSend(author, relaySide, WSMessage{Type: "save_chat_message_request"})
+	safeSend(author, relaySide, WSMessage{Type: "save_chat_message_request"})
+
+	// The full queue holds the next request back instead of dropping the
+	// host; it goes in once the writer catches up.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-author.SendQueue
+	}()
+	safeSend(author, relaySide, WSMessage{Type: "get_dash_data_request"})
+	if len(author.SendQueue) != 2 || author.unsent.Load() != 3 {
+		t.Fatalf("expected the request queued after waiting, queue has %d, unsent %d", len(author.SendQueue), author.unsent.Load())
+	}
+	if err := peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, _, err := peer.ReadMessage(); !errors.As(err, new(net.Error)) {
+		t.Fatalf("expected the author to stay connected, got %v", err)
+	}
+}
+
+func TestRelayIntegrationBroadcastDuringDisconnect(t *testing.T) {
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	env.connectAuthor(t)
+
+	const members = 8
+	peers := make([]*websocket.Conn, members)
+	for i := range peers {
+		peers[i] = env.dialWS(t)
+		env.joinHost(t, peers[i])
+	}
+	waitForClientCount(t, env.hostUUID, members+1)
+
+	// Put every member in one channel so a broadcast reaches all of them.
+	host, _ := GetHost(env.hostUUID)
+	host.mu.Lock()
+	channel := &Channel{Users: make(map[*websocket.Conn]int)}
+	var clients []*Client
+	for conn, client := range host.ClientsByConn {
+		if client.IsHostAuthor {
+			continue
+		}
+		channel.Users[conn] = 0
+		host.ChannelSubscriptions[conn] = "room"
+		clients = append(clients, client)
+	}
+	host.Channels["room"] = channel
+	host.mu.Unlock()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				broadcastToLocalChannel(env.hostUUID, "room", WSMessage{Type: "chat", Data: ChatPayload{Timestamp: time.Now()}})
+				for _, client := range clients {
+					safeSend(client, client.Conn, WSMessage{Type: "chat_saved"})
+				}
+			}
+		}()
+	}
+
+	for _, peer := range peers {
+		_ = peer.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForClientCount(t, env.hostUUID, 1)
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+
+	"github.com/gorilla/websocket"
+)
+
+// Version 2 envelopes use sender keys: a member wraps a per-channel chain key
+// for every recipient once (kind "sender_key"), and its later messages in the
+// channel (kind "message") carry only ciphertext and the epoch of the key
+// they were encrypted under. Version 3 only changes how the wrapped keys are
+// ordered for signing.
+const (
+	envelopeVersionSenderKey = 2
+	envelopeVersionOrdinal   = 3
+	envelopeKindSenderKey    = "sender_key"
+	envelopeKindMessage      = "message"
+)
+
+// senderKeyEpoch is the newest sender key a member distributed in a channel.
+// A stale key was distributed before someone left the space, so messages
+// under it are refused until the sender rotates. In strict delivery a new
+// distribution is Pending until the host stores it; messages under it are
+// forwarded behind it in the same channel order.
+type senderKeyEpoch struct {
+	Epoch int64
+	Stale bool
+
+	Pending          int64
+	PendingMessageID string
+}
+
+// senderKeyEnvelope reports the kind and epoch of a version 2 or 3 envelope.
+func senderKeyEnvelope(envelope map[string]interface{}) (kind string, epoch int64, ok bool) {
+	version, _ := envelope["v"].(float64)
+	if version != envelopeVersionSenderKey && version != envelopeVersionOrdinal {
+		return "", 0, false
+	}
+	kind, _ = envelope["kind"].(string)
+	rawEpoch, _ := envelope["epoch"].(float64)
+	if rawEpoch < 1 || rawEpoch > 1<<53 || rawEpoch != math.Trunc(rawEpoch) {
+		return kind, 0, true
+	}
+	return kind, int64(rawEpoch), true
+}
+
+// acceptSenderKeyEnvelope refuses messages whose sender key is unknown,
+// outdated or stale, and distributions that do not move the epoch forward.
+// It records nothing: a distribution only becomes the sender's key through
+// recordSenderKey once the relay has accepted the envelope. It returns the
+// epoch a distribution introduces, 0 for anything else. Version 1 envelopes
+// pass through.
+func acceptSenderKeyEnvelope(client *Client, conn *websocket.Conn, host *Host, channelUUID string, envelope map[string]interface{}) (int64, bool) {
+	kind, epoch, ok := senderKeyEnvelope(envelope)
+	if !ok {
+		return 0, true
+	}
+	if stringValue(envelope["sender_auth_public_key"]) != client.PublicKey || stringValue(envelope["channel_uuid"]) != channelUUID {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Sender key envelope does not match the session"}})
+		return 0, false
+	}
+
+	host.mu.Lock()
+	current := host.SenderKeys[channelUUID][client.PublicKey]
+	switch kind {
+	case envelopeKindSenderKey:
+		outdated := current != nil && (epoch <= current.Epoch || epoch <= current.Pending)
+		host.mu.Unlock()
+		if outdated {
+			safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Sender key epoch must increase"}})
+			return 0, false
+		}
+		return epoch, true
+	default:
+		usable := current != nil && ((!current.Stale && current.Epoch == epoch) || (current.Pending != 0 && current.Pending == epoch))
+		host.mu.Unlock()
+		if !usable {
+			safeSend(client, conn, WSMessage{
+				Type: "sender_key_required",
+				Data: SenderKeyRequired{ChannelUUID: channelUUID, MessageID: stringValue(envelope["message_id"])},
+			})
+		}
+		return 0, usable
+	}
+}
+
+// recordSenderKey makes an accepted distribution the sender's key in the
+// channel, or in strict delivery its pending key until settleSenderKey
+// hears back from the host.
+func recordSenderKey(host *Host, channelUUID, senderPublicKey string, epoch int64, messageID string, pending bool) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	if host.SenderKeys == nil {
+		host.SenderKeys = make(map[string]map[string]*senderKeyEpoch)
+	}
+	senders := host.SenderKeys[channelUUID]
+	if senders == nil {
+		senders = make(map[string]*senderKeyEpoch)
+		host.SenderKeys[channelUUID] = senders
+	}
+	current := senders[senderPublicKey]
+	if current == nil {
+		current = &senderKeyEpoch{}
+		senders[senderPublicKey] = current
+	}
+	if pending {
+		current.Pending, current.PendingMessageID = epoch, messageID
+		return
+	}
+	*current = senderKeyEpoch{Epoch: epoch}
+}
+
+// settleSenderKey resolves the pending distribution the host answered for:
+// a stored one becomes the sender's key, a refused one is forgotten so
+// nothing more is sent under a key members never received.
+func settleSenderKey(host *Host, channelUUID, messageID string, stored bool) {
+	if channelUUID == "" || messageID == "" {
+		return
+	}
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	for _, state := range host.SenderKeys[channelUUID] {
+		if state.PendingMessageID != messageID {
+			continue
+		}
+		if stored {
+			state.Epoch, state.Stale = state.Pending, false
+		}
+		state.Pending, state.PendingMessageID = 0, ""
+		return
+	}
+}
+
+// markSenderKeysStaleLocked forces every sender in the space's channels to
+// rotate before posting again, so members who left cannot read on.
+func markSenderKeysStaleLocked(host *Host, spaceUUID string) {
+	for channelUUID, channelSpace := range host.ChannelToSpace {
+		if channelSpace != spaceUUID {
+			continue
+		}
+		for _, state := range host.SenderKeys[channelUUID] {
+			state.Stale = true
+			state.Pending, state.PendingMessageID = 0, ""
+		}
+	}
+}
+
+func stringValue(value interface{}) string {
+	text, _ := value.(string)
+	return text
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestValidateSenderKeyEnvelopes(t *testing.T) {
+	distribution := map[string]interface{}{
+		"v": float64(2), "kind": "sender_key", "epoch": float64(5),
+		"wrapped_keys": []interface{}{map[string]interface{}{"recipient_auth_public_key": "a"}},
+	}
+	if err := validateEnvelopeForRelay(distribution); err != nil {
+		t.Fatalf("expected a valid distribution, got %v", err)
+	}
+	message := map[string]interface{}{"v": float64(2), "kind": "message", "epoch": float64(5), "content_iv": "iv", "ciphertext": "ct"}
+	if err := validateEnvelopeForRelay(message); err != nil {
+		t.Fatalf("expected a valid message, got %v", err)
+	}
+
+	invalid := []map[string]interface{}{
+		{"v": float64(2), "kind": "message", "epoch": float64(0), "content_iv": "iv", "ciphertext": "ct"},
+		{"v": float64(2), "kind": "message", "epoch": float64(1.5), "content_iv": "iv", "ciphertext": "ct"},
+		{"v": float64(2), "kind": "message", "epoch": float64(1), "content_iv": "iv", "ciphertext": "ct", "wrapped_keys": []interface{}{}},
+		{"v": float64(2), "kind": "sender_key", "epoch": float64(1), "wrapped_keys": []interface{}{}},
+		{"v": float64(2), "kind": "other", "epoch": float64(1)},
+	}
+	for i, envelope := range invalid {
+		if err := validateEnvelopeForRelay(envelope); err == nil {
+			t.Fatalf("case %d: expected %v to be rejected", i, envelope)
+		}
+	}
+}
+
+func TestRelayIntegrationSenderKeysRotateAfterMemberLeaves(t *testing.T) {
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+
+	member := joinChatChannel(t, env, author, "frank")
+	client, auth, spaceUUID, channelUUID, token := member.conn, member.auth, member.spaceUUID, member.channelUUID, member.token
+
+	envelope := func(kind string, epoch int64) map[string]interface{} {
+		return senderKeyTestEnvelope(auth.PublicKey, channelUUID, kind, epoch)
+	}
+	send := func(env map[string]interface{}) {
+		mustWriteMessage(t, client, WSMessage{Type: "chat", Data: ChatData{Envelope: env, CapabilityToken: token}})
+	}
+
+	// A message needs a distributed sender key first.
+	send(envelope(envelopeKindMessage, 1))
+	mustReadType(t, client, "sender_key_required", testReadTimeout)
+
+	send(envelope(envelopeKindSenderKey, 1))
+	mustReadType(t, client, "chat", testReadTimeout)
+	author.mustNextType("save_chat_message_request")
+	send(envelope(envelopeKindMessage, 1))
+	mustReadType(t, client, "chat", testReadTimeout)
+	author.mustNextType("save_chat_message_request")
+
+	// Once a member leaves, the old epoch is refused until the sender rotates.
+	author.mustSend(WSMessage{Type: "leave_space_success", Data: LeaveSpaceResponse{SpaceUUID: spaceUUID, UserID: 99, ClientUUID: uuid.NewString()}})
+	mustReadType(t, client, "leave_space_update", testReadTimeout)
+	send(envelope(envelopeKindMessage, 1))
+	required := mustReadType(t, client, "sender_key_required", testReadTimeout)
+	if data, _ := decodeData[SenderKeyRequired](required.Data); data.ChannelUUID != channelUUID {
+		t.Fatalf("unexpected sender_key_required: %+v", data)
+	}
+
+	send(envelope(envelopeKindSenderKey, 1))
+	mustReadType(t, client, "error", testReadTimeout)
+	send(envelope(envelopeKindSenderKey, 2))
+	mustReadType(t, client, "chat", testReadTimeout)
+	send(envelope(envelopeKindMessage, 2))
+	mustReadType(t, client, "chat", testReadTimeout)
+}
+
+func TestRelayIntegrationRejectedDistributionDoesNotBecomeTheSenderKey(t *testing.T) {
+	setHostQuotaDefaults(t, HostQuota{MaxMessagesPerMinute: 1})
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "judy")
+	send := func(envelope map[string]interface{}) {
+		mustWriteMessage(t, member.conn, WSMessage{Type: "chat", Data: ChatData{Envelope: envelope, CapabilityToken: member.token}})
+	}
+
+	send(senderKeyTestEnvelope(member.auth.PublicKey, member.channelUUID, envelopeKindSenderKey, 1))
+	mustReadType(t, member.conn, "chat", testReadTimeout)
+	author.mustNextType("save_chat_message_request")
+
+	// The quota refuses the rotation, so members never see epoch 2 and
+	// messages under it must not go out.
+	send(senderKeyTestEnvelope(member.auth.PublicKey, member.channelUUID, envelopeKindSenderKey, 2))
+	mustDecodeQuotaExceeded(t, mustReadType(t, member.conn, "quota_exceeded", testReadTimeout), quotaMessagesPerMinute, 1)
+	send(senderKeyTestEnvelope(member.auth.PublicKey, member.channelUUID, envelopeKindMessage, 2))
+	mustReadType(t, member.conn, "sender_key_required", testReadTimeout)
+}
+
+func TestRelayIntegrationStrictDeliveryKeepsDistributionPendingUntilStored(t *testing.T) {
+	strictChatDelivery = true
+	t.Cleanup(func() { strictChatDelivery = false })
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "kim")
+	send := func(envelope map[string]interface{}) *SaveChatMessageRequest {
+		t.Helper()
+		mustWriteMessage(t, member.conn, WSMessage{Type: "chat", Data: ChatData{Envelope: envelope, CapabilityToken: member.token}})
+		save, err := decodeData[SaveChatMessageRequest](author.mustNextType("save_chat_message_request").Data)
+		if err != nil {
+			t.Fatalf("decode save_chat_message_request: %v", err)
+		}
+		return &save
+	}
+	answer := func(save *SaveChatMessageRequest, failure string) {
+		t.Helper()
+		response := SaveChatMessageResponse{
+			MessageID:   stringValue(save.Envelope["message_id"]),
+			ChannelUUID: save.ChannelUUID,
+			Error:       failure,
+			ClientUUID:  save.ClientUUID,
+		}
+		if failure == "" {
+			response.Envelope = save.Envelope
+		}
+		author.mustSend(WSMessage{Type: "save_chat_message_response", Data: response})
+	}
+
+	// Messages under a pending distribution follow it to the host, but
+	// once the host refuses the distribution its epoch is gone.
+	refused := send(senderKeyTestEnvelope(member.auth.PublicKey, member.channelUUID, envelopeKindSenderKey, 1))
+	send(senderKeyTestEnvelope(member.auth.PublicKey, member.channelUUID, envelopeKindMessage, 1))
+	answer(refused, "storage unavailable")
+	mustReadType(t, member.conn, "chat_save_failed", testReadTimeout)
+	mustWriteMessage(t, member.conn, WSMessage{Type: "chat", Data: ChatData{
+		Envelope:        senderKeyTestEnvelope(member.auth.PublicKey, member.channelUUID, envelopeKindMessage, 1),
+		CapabilityToken: member.token,
+	}})
+	mustReadType(t, member.conn, "sender_key_required", testReadTimeout)
+
+	stored := send(senderKeyTestEnvelope(member.auth.PublicKey, member.channelUUID, envelopeKindSenderKey, 2))
+	answer(stored, "")
+	mustReadType(t, member.conn, "chat_saved", testReadTimeout)
+	send(senderKeyTestEnvelope(member.auth.PublicKey, member.channelUUID, envelopeKindMessage, 2))
+}
+
+// senderKeyTestEnvelope is a version 2 envelope from senderPublicKey with
+// just the fields the relay looks at.
+func senderKeyTestEnvelope(senderPublicKey, channelUUID, kind string, epoch int64) map[string]interface{} {
+	out := map[string]interface{}{
+		"v": 2, "kind": kind, "epoch": epoch,
+		"message_id":             uuid.NewString(),
+		"channel_uuid":           channelUUID,
+		"sender_auth_public_key": senderPublicKey,
+	}
+	if kind == envelopeKindSenderKey {
+		out["wrapped_keys"] = []interface{}{map[string]interface{}{"recipient_auth_public_key": senderPublicKey}}
+	} else {
+		out["content_iv"] = "iv"
+		out["ciphertext"] = "ct"
+	}
+	return out
+}
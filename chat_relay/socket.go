@@ -49,6 +49,13 @@ func HandleSocket(c *gin.Context) {
 	}
 	conn.SetReadLimit(256 * 1024)
 	defer conn.Close()
+	if !liveSockets.add(conn) {
+		rejectDraining(conn)
+		return
+	}
+	defer liveSockets.remove(conn)
+	alive, stopKeepalive := startKeepalive(conn)
+	defer stopKeepalive()
 
 	clientIP := c.ClientIP()
 	var client *Client
@@ -56,8 +63,12 @@ func HandleSocket(c *gin.Context) {
 	for {
 		_, msgBytes, err := conn.ReadMessage()
 		if err != nil {
+			if isKeepaliveTimeout(err) {
+				logStaleConnection(client, clientIP)
+			}
 			break
 		}
+		alive.touch()
 
 		var wsMsg WSMessage
 		if err := json.Unmarshal(msgBytes, &wsMsg); err != nil {
@@ -66,6 +77,10 @@ func HandleSocket(c *gin.Context) {
 		}
 
 		if wsMsg.Type == "join_host" {
+			if liveSockets.isDraining() {
+				conn.WriteJSON(WSMessage{Type: "join_error", Data: ChatError{Content: "Relay is shutting down"}})
+				continue
+			}
 			data, err := decodeData[JoinHost](wsMsg.Data)
 			if err != nil {
 				conn.WriteJSON(WSMessage{Type: "join_error", Data: ChatError{Content: "Invalid host uuid"}})
@@ -88,7 +103,13 @@ func HandleSocket(c *gin.Context) {
 					continue
 				}
 			}
-			client = registerClient(host, conn, clientIP, isHostCandidate)
+			registered, exceeded := registerClient(host, conn, clientIP, isHostCandidate)
+			if exceeded != nil {
+				conn.WriteJSON(WSMessage{Type: "join_error", Data: exceeded})
+				noteQuotaRejection(host)
+				continue
+			}
+			client = registered
 			continue
 		}
 
@@ -113,31 +134,32 @@ func cleanupClient(client *Client) {
 		UnregisterAuthenticatedIP(client.IP)
 	}
 
-	host, exists := GetHost(client.HostUUID)
-	if !exists {
-		return
-	}
-
-	host.mu.Lock()
-	shouldMarkOffline := false
-	delete(host.ClientsByConn, client.Conn)
-	delete(host.ClientConnsByUUID, client.ClientUUID)
-	delete(host.ClientsByUserID, client.UserID)
-	if client.IsHostAuthor && host.AuthorConn == client.Conn {
-		host.AuthorConn = nil
-		shouldMarkOffline = true
-	}
-	if client.PublicKey != "" {
-		delete(host.ClientsByPublicKey, client.PublicKey)
-	}
-	host.mu.Unlock()
-	if shouldMarkOffline {
-		HandleUpdateHostOffline(host.UUID)
+	// A deregistered host is already gone from Hosts, but the client's own
+	// state still needs releasing.
+	if host, exists := GetHost(client.HostUUID); exists {
+		host.mu.Lock()
+		shouldMarkOffline := false
+		delete(host.ClientsByConn, client.Conn)
+		delete(host.ClientConnsByUUID, client.ClientUUID)
+		delete(host.ClientsByUserID, client.UserID)
+		if client.IsHostAuthor && host.AuthorConn == client.Conn {
+			host.AuthorConn = nil
+			shouldMarkOffline = true
+		}
+		if client.PublicKey != "" {
+			delete(host.ClientsByPublicKey, client.PublicKey)
+		}
+		host.mu.Unlock()
+		if shouldMarkOffline {
+			HandleUpdateHostOffline(host.UUID)
+			relayCluster.withdrawAuthor(host.UUID)
+			hostRequests.failHost(host.UUID, "The host disconnected before answering")
+		}
 	}
+	relayCluster.withdrawClient(client.ClientUUID)
 	clearChatMessageLimiter(client.ClientUUID)
 
-	close(client.SendQueue)
-	close(client.Done)
+	client.close()
 }
 
 func GetHost(uuid string) (*Host, bool) {
@@ -147,41 +169,65 @@ func GetHost(uuid string) (*Host, bool) {
 	return host, ok
 }
 
-func safeSend(client *Client, conn *websocket.Conn, msg WSMessage) {
-	if client != nil && client.SendQueue != nil {
-		select {
-		case client.SendQueue <- msg:
-		default:
-			log.Printf("safeSend: send queue full for client")
-			close(client.SendQueue)
-		}
-	} else {
-		_ = conn.WriteJSON(msg)
+// SendToClient delivers msg to the client's connection, on another relay node
+// if it is not connected here.
+func SendToClient(hostUUID, clientUUID string, msg WSMessage) {
+	if sendToLocalClient(hostUUID, clientUUID, msg) || relayCluster.forwardToClient(hostUUID, clientUUID, msg) {
+		return
+	}
+	if _, exists := GetHost(hostUUID); !exists {
+		log.Printf("SendToClient: host %s not found\n", hostUUID)
 	}
 }
 
-func SendToClient(hostUUID, clientUUID string, msg WSMessage) {
+func sendToLocalClient(hostUUID, clientUUID string, msg WSMessage) bool {
 	host, exists := GetHost(hostUUID)
 	if !exists {
-		log.Printf("SendToClient: host %s not found\n", hostUUID)
-		return
+		return false
 	}
 
 	host.mu.Lock()
 	conn, ok := host.ClientConnsByUUID[clientUUID]
 	if !ok {
 		host.mu.Unlock()
-		return
+		return false
 	}
 
 	client, ok := host.ClientsByConn[conn]
 	if !ok {
 		host.mu.Unlock()
-		return
+		return false
 	}
 	host.mu.Unlock()
 
 	safeSend(client, conn, msg)
+	return true
+}
+
+// SendToUser delivers msg to a connection of the user, looked up by identity
+// here first and then on the other relay nodes.
+func SendToUser(hostUUID string, userID int, userPublicKey string, msg WSMessage) {
+	if sendToLocalUser(hostUUID, userID, userPublicKey, msg) {
+		return
+	}
+	relayCluster.forwardToUser(hostUUID, userID, userPublicKey, msg)
+}
+
+func sendToLocalUser(hostUUID string, userID int, userPublicKey string, msg WSMessage) bool {
+	host, exists := GetHost(hostUUID)
+	if !exists {
+		return false
+	}
+
+	host.mu.Lock()
+	target, ok := findHostClientByIdentity(host, userID, userPublicKey)
+	host.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	safeSend(target, target.Conn, msg)
+	return true
 }
 
 func SendToAuthor(client *Client, msg WSMessage) {
@@ -191,25 +237,45 @@ func SendToAuthor(client *Client, msg WSMessage) {
 		return
 	}
 
+	newHostRequest(host, client.ClientUUID, &msg)
+	if sendToLocalAuthor(host.UUID, msg) || relayCluster.forwardToAuthor(host.UUID, client.ClientUUID, msg) {
+		return
+	}
+	hostRequests.forget(msg.RequestID)
+	SendToClient(client.HostUUID, client.ClientUUID, WSMessage{Type: "author_error", Data: ChatError{Content: "Failed to connect to the host"}})
+}
+
+func sendToLocalAuthor(hostUUID string, msg WSMessage) bool {
+	host, exists := GetHost(hostUUID)
+	if !exists {
+		return false
+	}
+
 	host.mu.Lock()
 	hostConn := host.AuthorConn
 	if hostConn == nil {
 		host.mu.Unlock()
-		SendToClient(client.HostUUID, client.ClientUUID, WSMessage{Type: "author_error", Data: ChatError{Content: "Failed to connect to the host"}})
-		return
+		return false
 	}
 	authorClient := host.ClientsByConn[hostConn]
 	if authorClient == nil || !authorClient.IsHostAuthor {
 		host.mu.Unlock()
-		SendToClient(client.HostUUID, client.ClientUUID, WSMessage{Type: "author_error", Data: ChatError{Content: "Failed to connect to the host"}})
-		return
+		return false
 	}
 	host.mu.Unlock()
 
 	safeSend(authorClient, hostConn, msg)
+	return true
 }
 
+// BroadcastToChannel delivers msg to the channel's members on every relay
+// node.
 func BroadcastToChannel(hostUUID, channelUUID string, msg WSMessage) {
+	broadcastToLocalChannel(hostUUID, channelUUID, msg)
+	relayCluster.forwardBroadcast(clusterBroadcastChannel, hostUUID, channelUUID, msg)
+}
+
+func broadcastToLocalChannel(hostUUID, channelUUID string, msg WSMessage) {
 	host, exists := GetHost(hostUUID)
 	if !exists {
 		return
@@ -224,12 +290,21 @@ func BroadcastToChannel(hostUUID, channelUUID string, msg WSMessage) {
 	defer channel.mu.Unlock()
 
 	for conn := range channel.Users {
-		client := host.ClientsByConn[conn]
-		safeSend(client, conn, msg)
+		// A member whose cleanup is under way has no client left to
+		// queue for; writing to its socket directly would race its pump.
+		if client := host.ClientsByConn[conn]; client != nil {
+			safeSend(client, conn, msg)
+		}
 	}
 }
 
+// BroadcastToSpace delivers msg to the space's members on every relay node.
 func BroadcastToSpace(hostUUID, spaceUUID string, msg WSMessage) {
+	broadcastToLocalSpace(hostUUID, spaceUUID, msg)
+	relayCluster.forwardBroadcast(clusterBroadcastSpace, hostUUID, spaceUUID, msg)
+}
+
+func broadcastToLocalSpace(hostUUID, spaceUUID string, msg WSMessage) {
 	host, exists := GetHost(hostUUID)
 	if !exists {
 		return
@@ -243,8 +318,11 @@ func BroadcastToSpace(hostUUID, spaceUUID string, msg WSMessage) {
 	space.mu.Lock()
 	defer space.mu.Unlock()
 	for conn := range space.Users {
-		client := host.ClientsByConn[conn]
-		safeSend(client, conn, msg)
+		// A member whose cleanup is under way has no client left to
+		// queue for; writing to its socket directly would race its pump.
+		if client := host.ClientsByConn[conn]; client != nil {
+			safeSend(client, conn, msg)
+		}
 	}
 }
 
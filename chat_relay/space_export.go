@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// handleExportSpace asks the host for a signed archive of a space. Only the
+// space author holds the delete_space scope, and the host checks authorship
+// again. The archive comes back in export_space_response chunks, which the
+// client pulls one request at a time with the export ID from the first.
+func handleExportSpace(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[ExportSpaceClient](wsMsg.Data)
+	if err != nil || data.SpaceUUID == "" || data.Chunk < 0 || (data.ExportID == "" && data.Chunk != 0) {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid export space data"}})
+		return
+	}
+	if !requireSpaceCapability(client, data.SpaceUUID, "", data.CapabilityToken, scopeDeleteSpace, "Unauthorized space access") {
+		return
+	}
+
+	SendToAuthor(client, WSMessage{
+		Type: "export_space_request",
+		Data: ExportSpaceRequest{
+			SpaceUUID:                 data.SpaceUUID,
+			ExportID:                  data.ExportID,
+			Chunk:                     data.Chunk,
+			RequesterUserID:           client.UserID,
+			RequesterUserPublicKey:    client.PublicKey,
+			RequesterUserEncPublicKey: client.EncPublicKey,
+			ClientUUID:                client.ClientUUID,
+		},
+	})
+}
+
+func handleExportSpaceRes(client *Client, conn *websocket.Conn, wsMsg *WSMessage) {
+	data, err := decodeData[ExportSpaceResponse](wsMsg.Data)
+	if err != nil || data.Chunks <= 0 || data.Chunk < 0 || data.Chunk >= data.Chunks {
+		safeSend(client, conn, WSMessage{Type: "error", Data: ChatError{Content: "Invalid export space response data"}})
+		return
+	}
+	data.ClientUUID = responseClientUUID(client, wsMsg, data.ClientUUID)
+
+	SendToClient(client.HostUUID, data.ClientUUID, WSMessage{
+		Type: "export_space_success",
+		Data: ExportSpaceSuccess{SpaceUUID: data.SpaceUUID, ExportID: data.ExportID, Chunk: data.Chunk, Chunks: data.Chunks, Data: data.Data},
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayIntegrationExportSpace(t *testing.T) {
+	env := newRelayIntegrationEnvWithSigningKey(t, true)
+	author := env.connectAuthor(t)
+	member := joinChatChannel(t, env, author, "ivan")
+
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "export_space",
+		Data: ExportSpaceClient{SpaceUUID: member.spaceUUID, CapabilityToken: member.token},
+	})
+	mustReadUnauthorizedError(t, member.conn)
+
+	ownerToken := env.mustIssueCapabilityToken(t, member.auth.PublicKey, member.spaceUUID, []string{scopeDeleteSpace}, 5*time.Minute)
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "export_space",
+		Data: ExportSpaceClient{SpaceUUID: member.spaceUUID, CapabilityToken: ownerToken},
+	})
+	requestMsg := author.mustNextType("export_space_request")
+	request, err := decodeData[ExportSpaceRequest](requestMsg.Data)
+	if err != nil || request.SpaceUUID != member.spaceUUID || request.RequesterUserPublicKey != member.auth.PublicKey || request.ClientUUID == "" {
+		t.Fatalf("unexpected export_space_request: %v %+v", err, request)
+	}
+
+	// The client pulls each chunk after the first with the export ID; every
+	// pull is a request of its own and its chunk reaches the client that
+	// asked.
+	for chunk, data := range []string{"H4sIAAAA", "AAAA=="} {
+		author.mustSend(WSMessage{
+			Type:      "export_space_response",
+			RequestID: requestMsg.RequestID,
+			Data: ExportSpaceResponse{
+				SpaceUUID:  member.spaceUUID,
+				ExportID:   "export-1",
+				Chunk:      chunk,
+				Chunks:     2,
+				Data:       data,
+				ClientUUID: request.ClientUUID,
+			},
+		})
+		successMsg := mustReadType(t, member.conn, "export_space_success", testReadTimeout)
+		success, err := decodeData[ExportSpaceSuccess](successMsg.Data)
+		if err != nil || success.Chunk != chunk || success.Chunks != 2 || success.Data != data || success.SpaceUUID != member.spaceUUID || success.ExportID != "export-1" {
+			t.Fatalf("unexpected export_space_success %d: %v %+v", chunk, err, success)
+		}
+		if chunk == 1 {
+			break
+		}
+
+		mustWriteMessage(t, member.conn, WSMessage{
+			Type: "export_space",
+			Data: ExportSpaceClient{SpaceUUID: member.spaceUUID, ExportID: "export-1", Chunk: chunk + 1, CapabilityToken: ownerToken},
+		})
+		previousRequestID := requestMsg.RequestID
+		requestMsg = author.mustNextType("export_space_request")
+		request, err = decodeData[ExportSpaceRequest](requestMsg.Data)
+		if err != nil || request.ExportID != "export-1" || request.Chunk != chunk+1 || requestMsg.RequestID == previousRequestID {
+			t.Fatalf("unexpected chunk request: %v %+v", err, request)
+		}
+	}
+
+	// Only an export the host named can be continued.
+	mustWriteMessage(t, member.conn, WSMessage{
+		Type: "export_space",
+		Data: ExportSpaceClient{SpaceUUID: member.spaceUUID, Chunk: 1, CapabilityToken: ownerToken},
+	})
+	errMsg := mustReadType(t, member.conn, "error", testReadTimeout)
+	if chatErr, err := decodeData[ChatError](errMsg.Data); err != nil || chatErr.Content != "Invalid export space data" {
+		t.Fatalf("expected a chunk without an export ID to be refused, got %v %+v", err, chatErr)
+	}
+
+	// Chunks are pulled again when lost, so a burst of them is dropped
+	// rather than disconnecting the client as a slow consumer.
+	if sendPriority(WSMessage{Type: "export_space_success"}) != priorityLow {
+		t.Fatal("expected export chunks to be low priority")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,7 +22,20 @@ type Host struct {
 	Spaces               map[string]*Space
 	ChannelSubscriptions map[*websocket.Conn]string
 	SpaceSubscriptions   map[*websocket.Conn][]string
-	mu                   sync.Mutex
+	// RevokedDevices is the host's deny list, user public key -> device IDs.
+	// The host replaces it wholesale with every device_deny_list it pushes.
+	RevokedDevices map[string]map[string]struct{}
+	// KeyedIdentities are the user public keys that must sign in with a
+	// device key.
+	KeyedIdentities map[string]struct{}
+	// SenderKeys tracks the newest sender key each member distributed per
+	// channel, channel UUID -> sender auth public key.
+	SenderKeys map[string]map[string]*senderKeyEpoch
+	// AuthorRequestIDs records whether the current author, here or on
+	// another relay node, echoes request_id.
+	AuthorRequestIDs bool
+	quota            hostQuotaState
+	mu               sync.Mutex
 }
 
 type Channel struct {
@@ -53,6 +67,11 @@ type Client struct {
 	IsAuthenticated   bool
 	SendQueue         chan WSMessage
 	Done              chan struct{}
+	// unsent counts messages queued or still being written, so a drain
+	// can tell when the connection has flushed.
+	unsent    atomic.Int64
+	closeOnce sync.Once
+	slowOnce  sync.Once
 }
 
 func (c *Client) WritePump() {
@@ -60,12 +79,10 @@ func (c *Client) WritePump() {
 
 	for {
 		select {
-		case msg, ok := <-c.SendQueue:
-			if !ok {
-				return
-			}
-
-			if err := c.Conn.WriteJSON(msg); err != nil {
+		case msg := <-c.SendQueue:
+			err := c.Conn.WriteJSON(msg)
+			c.unsent.Add(-1)
+			if err != nil {
 				log.Println("WritePump error:", err)
 				return
 			}
@@ -78,6 +95,18 @@ func (c *Client) WritePump() {
 type WSMessage struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
+	// RequestID ties a host-bound request to the host's answers; see
+	// host_requests.go.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// RequestFailure is sent to a client as request_timeout when its host did
+// not answer in time, or as host_error when the host answered with an error
+// or went away before answering.
+type RequestFailure struct {
+	RequestID   string `json:"request_id"`
+	RequestType string `json:"request_type"`
+	Content     string `json:"error"`
 }
 
 type JoinHost struct {
@@ -98,6 +127,16 @@ type ChatData struct {
 type ChatPayload struct {
 	Envelope  map[string]interface{} `json:"envelope"`
 	Timestamp time.Time              `json:"timestamp"`
+	// Seq is the host's per-channel sequence number, only known in strict
+	// delivery.
+	Seq int64 `json:"seq,omitempty"`
+}
+
+// SenderKeyRequired asks a sender to distribute a fresh sender key for the
+// channel and send the message again.
+type SenderKeyRequired struct {
+	ChannelUUID string `json:"channel_uuid"`
+	MessageID   string `json:"message_id"`
 }
 
 type ChatError struct {
@@ -128,6 +167,52 @@ type UpdateUsernameResponse struct {
 	ClientUUID       string `json:"client_uuid"`
 }
 
+// IdentityMigrateClient asks to move the identity holding OldPublicKey onto
+// the keys this session signed in with. Signature is the old key's signature
+// over identityMigrationMessage.
+type IdentityMigrateClient struct {
+	OldPublicKey string `json:"old_public_key"`
+	IssuedAt     int64  `json:"issued_at"`
+	Signature    string `json:"signature"`
+}
+
+type IdentityMigrateRequest struct {
+	OldPublicKey    string `json:"old_public_key"`
+	NewPublicKey    string `json:"new_public_key"`
+	NewEncPublicKey string `json:"new_enc_public_key"`
+	IssuedAt        int64  `json:"issued_at"`
+	Signature       string `json:"signature"`
+	ClientUUID      string `json:"client_uuid"`
+}
+
+type IdentityMigrateResponse struct {
+	UserID          int      `json:"user_id"`
+	Username        string   `json:"username"`
+	OldPublicKey    string   `json:"old_public_key"`
+	NewPublicKey    string   `json:"new_public_key"`
+	NewEncPublicKey string   `json:"new_enc_public_key"`
+	SpaceUUIDs      []string `json:"space_uuids"`
+	ClientUUID      string   `json:"client_uuid"`
+}
+
+type IdentityMigrateSuccess struct {
+	UserID          int    `json:"user_id"`
+	Username        string `json:"username"`
+	OldPublicKey    string `json:"old_public_key"`
+	NewPublicKey    string `json:"new_public_key"`
+	NewEncPublicKey string `json:"new_enc_public_key"`
+}
+
+// IdentityKeyChanged tells space members that a contact now uses new keys.
+type IdentityKeyChanged struct {
+	SpaceUUID       string `json:"space_uuid"`
+	UserID          int    `json:"user_id"`
+	Username        string `json:"username"`
+	OldPublicKey    string `json:"old_public_key"`
+	NewPublicKey    string `json:"new_public_key"`
+	NewEncPublicKey string `json:"new_enc_public_key"`
+}
+
 type UpdateUsernameSuccess struct {
 	UserID           int    `json:"user_id"`
 	UserPublicKey    string `json:"user_public_key,omitempty"`
@@ -193,6 +278,10 @@ type GetDashDataRequest struct {
 	UserEncPublicKey string `json:"user_enc_public_key,omitempty"`
 	Username         string `json:"username"`
 	ClientUUID       string `json:"client_uuid"`
+	DeviceID         string `json:"device_id,omitempty"`
+	DeviceName       string `json:"device_name,omitempty"`
+	// RequestID tags the answer to one entry of a batched reissue.
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type GetDashDataResponse struct {
@@ -218,6 +307,70 @@ type ActiveDevice struct {
 	IsCurrent  bool   `json:"is_current"`
 }
 
+// RegisteredDevice is a device from the host's registry as shown to its
+// owner; Online and IsCurrent are filled in by the relay.
+type RegisteredDevice struct {
+	DeviceID     string `json:"device_id"`
+	DeviceName   string `json:"device_name"`
+	EncPublicKey string `json:"enc_public_key,omitempty"`
+	FirstSeen    string `json:"first_seen"`
+	LastSeen     string `json:"last_seen"`
+	RevokedAt    string `json:"revoked_at,omitempty"`
+	Online       bool   `json:"online"`
+	IsCurrent    bool   `json:"is_current"`
+}
+
+type ListDevicesRequest struct {
+	UserID           int    `json:"user_id"`
+	UserPublicKey    string `json:"user_public_key,omitempty"`
+	UserEncPublicKey string `json:"user_enc_public_key,omitempty"`
+	Username         string `json:"username"`
+	ClientUUID       string `json:"client_uuid"`
+}
+
+type ListDevicesResponse struct {
+	Devices    []RegisteredDevice `json:"devices"`
+	ClientUUID string             `json:"client_uuid"`
+}
+
+type ListDevicesSuccess struct {
+	Devices []RegisteredDevice `json:"devices"`
+}
+
+type RevokeDeviceClient struct {
+	DeviceID string `json:"device_id"`
+}
+
+type RevokeDeviceRequest struct {
+	UserID           int    `json:"user_id"`
+	UserPublicKey    string `json:"user_public_key,omitempty"`
+	UserEncPublicKey string `json:"user_enc_public_key,omitempty"`
+	Username         string `json:"username"`
+	DeviceID         string `json:"device_id"`
+	ClientUUID       string `json:"client_uuid"`
+}
+
+type RevokeDeviceResponse struct {
+	DeviceID   string `json:"device_id"`
+	ClientUUID string `json:"client_uuid"`
+}
+
+type RevokeDeviceSuccess struct {
+	DeviceID string `json:"device_id"`
+}
+
+type RevokedDevice struct {
+	UserPublicKey string `json:"user_public_key"`
+	DeviceID      string `json:"device_id"`
+}
+
+type DeviceDenyList struct {
+	Devices []RevokedDevice `json:"devices"`
+	// KeyedIdentities have registered a device key; their sessions must
+	// present one.
+	KeyedIdentities []string `json:"keyed_identities"`
+}
+
 type CreateSpaceClient struct {
 	Name string `json:"name"`
 }
@@ -479,10 +632,43 @@ type SaveChatMessageRequest struct {
 	Username         string                 `json:"username,omitempty"`
 	ChannelUUID      string                 `json:"channel_uuid"`
 	Envelope         map[string]interface{} `json:"envelope"`
+	ClientUUID       string                 `json:"client_uuid,omitempty"`
+	// Strict is set when the relay waits for the save before broadcasting.
+	Strict bool `json:"strict,omitempty"`
+}
+
+type SaveChatMessageResponse struct {
+	MessageID   string `json:"message_id"`
+	ChannelUUID string `json:"channel_uuid"`
+	ID          int    `json:"id,omitempty"`
+	Timestamp   string `json:"timestamp,omitempty"`
+	Seq         int64  `json:"seq,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Envelope is returned for strict saves so the relay can broadcast it.
+	Envelope   map[string]interface{} `json:"envelope,omitempty"`
+	ClientUUID string                 `json:"client_uuid"`
+}
+
+// ChatSaved tells a sender the host stored its message.
+type ChatSaved struct {
+	MessageID   string `json:"message_id"`
+	ChannelUUID string `json:"channel_uuid"`
+	ID          int    `json:"id"`
+	Timestamp   string `json:"timestamp"`
+	Seq         int64  `json:"seq,omitempty"`
+}
+
+// ChatSaveFailed tells a sender the host did not store its message.
+type ChatSaveFailed struct {
+	MessageID   string `json:"message_id"`
+	ChannelUUID string `json:"channel_uuid"`
+	Error       string `json:"error"`
 }
 
 type GetMessagesClient struct {
 	BeforeUnixTime  string `json:"before_unix_time"`
+	FromSeq         int64  `json:"from_seq,omitempty"`
+	ToSeq           int64  `json:"to_seq,omitempty"`
 	CapabilityToken string `json:"capability_token,omitempty"`
 }
 
@@ -490,6 +676,10 @@ type GetMessagesRequest struct {
 	ChannelUUID    string `json:"channel_uuid"`
 	ClientUUID     string `json:"client_uuid"`
 	BeforeUnixTime string `json:"before_unix_time"`
+	// FromSeq and ToSeq request an exact sequence range instead of a page
+	// before BeforeUnixTime. ToSeq 0 means no upper bound.
+	FromSeq int64 `json:"from_seq,omitempty"`
+	ToSeq   int64 `json:"to_seq,omitempty"`
 }
 
 type GetMessagesMessage struct {
@@ -501,29 +691,260 @@ type GetMessagesMessage struct {
 	UserPublicKey    string                 `json:"user_public_key,omitempty"`
 	UserEncPublicKey string                 `json:"user_enc_public_key,omitempty"`
 	Timestamp        string                 `json:"timestamp"`
+	Seq              int64                  `json:"seq,omitempty"`
 }
 
 type GetMessagesResponse struct {
-	Messages        []GetMessagesMessage `json:"messages"`
-	HasMoreMessages bool                 `json:"has_more_messages"`
-	ChannelUUID     string               `json:"channel_uuid"`
-	ClientUUID      string               `json:"client_uuid"`
+	Messages []GetMessagesMessage `json:"messages"`
+	// SenderKeys are the sender key envelopes the sender-key messages in
+	// this page were encrypted under.
+	SenderKeys      []map[string]interface{} `json:"sender_keys,omitempty"`
+	HasMoreMessages bool                     `json:"has_more_messages"`
+	// FromSeq echoes a range request so clients can tell it from paging.
+	FromSeq     int64  `json:"from_seq,omitempty"`
+	ChannelUUID string `json:"channel_uuid"`
+	ClientUUID  string `json:"client_uuid"`
 }
 
 type GetMessagesSuccess struct {
-	Messages        []GetMessagesMessage `json:"messages"`
-	HasMoreMessages bool                 `json:"has_more_messages"`
-	ChannelUUID     string               `json:"channel_uuid"`
+	Messages        []GetMessagesMessage     `json:"messages"`
+	SenderKeys      []map[string]interface{} `json:"sender_keys,omitempty"`
+	HasMoreMessages bool                     `json:"has_more_messages"`
+	FromSeq         int64                    `json:"from_seq,omitempty"`
+	ChannelUUID     string                   `json:"channel_uuid"`
+}
+
+// ModerationReport is a host's report on a message or member; the relay only
+// passes it through.
+type ModerationReport struct {
+	ID                int    `json:"id"`
+	SpaceUUID         string `json:"space_uuid"`
+	ChannelUUID       string `json:"channel_uuid,omitempty"`
+	Kind              string `json:"kind"`
+	ReporterUserID    int    `json:"reporter_user_id"`
+	ReporterPublicKey string `json:"reporter_public_key,omitempty"`
+	TargetPublicKey   string `json:"target_public_key"`
+	MessageID         string `json:"message_id,omitempty"`
+	Envelope          string `json:"envelope,omitempty"`
+	Excerpt           string `json:"excerpt,omitempty"`
+	Reason            string `json:"reason,omitempty"`
+	Status            string `json:"status"`
+	Action            string `json:"action,omitempty"`
+	ResolvedBy        int    `json:"resolved_by,omitempty"`
+	CreatedAt         string `json:"created_at"`
+	ResolvedAt        string `json:"resolved_at,omitempty"`
+}
+
+type ReportMessageClient struct {
+	SpaceUUID       string                 `json:"space_uuid"`
+	ChannelUUID     string                 `json:"channel_uuid"`
+	Envelope        map[string]interface{} `json:"envelope"`
+	Excerpt         string                 `json:"excerpt,omitempty"`
+	Reason          string                 `json:"reason,omitempty"`
+	CapabilityToken string                 `json:"capability_token,omitempty"`
+}
+
+type ReportMessageRequest struct {
+	SpaceUUID                 string                 `json:"space_uuid"`
+	ChannelUUID               string                 `json:"channel_uuid"`
+	Envelope                  map[string]interface{} `json:"envelope"`
+	Excerpt                   string                 `json:"excerpt,omitempty"`
+	Reason                    string                 `json:"reason,omitempty"`
+	RequesterUserID           int                    `json:"requester_user_id"`
+	RequesterUserPublicKey    string                 `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string                 `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string                 `json:"client_uuid"`
+}
+
+type ReportUserClient struct {
+	SpaceUUID       string `json:"space_uuid"`
+	UserPublicKey   string `json:"user_public_key"`
+	Reason          string `json:"reason,omitempty"`
+	CapabilityToken string `json:"capability_token,omitempty"`
+}
+
+type ReportUserRequest struct {
+	SpaceUUID                 string `json:"space_uuid"`
+	UserPublicKey             string `json:"user_public_key"`
+	Reason                    string `json:"reason,omitempty"`
+	RequesterUserID           int    `json:"requester_user_id"`
+	RequesterUserPublicKey    string `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string `json:"client_uuid"`
+}
+
+type ReportResponse struct {
+	ReportID   int    `json:"report_id"`
+	Kind       string `json:"kind"`
+	SpaceUUID  string `json:"space_uuid"`
+	ClientUUID string `json:"client_uuid"`
+}
+
+type ReportSuccess struct {
+	ReportID  int    `json:"report_id"`
+	Kind      string `json:"kind"`
+	SpaceUUID string `json:"space_uuid"`
+}
+
+type ListReportsClient struct {
+	SpaceUUID       string `json:"space_uuid"`
+	Status          string `json:"status,omitempty"`
+	CapabilityToken string `json:"capability_token,omitempty"`
+}
+
+type ListReportsRequest struct {
+	SpaceUUID                 string `json:"space_uuid"`
+	Status                    string `json:"status,omitempty"`
+	RequesterUserID           int    `json:"requester_user_id"`
+	RequesterUserPublicKey    string `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string `json:"client_uuid"`
+}
+
+type ListReportsResponse struct {
+	SpaceUUID  string             `json:"space_uuid"`
+	Reports    []ModerationReport `json:"reports"`
+	ClientUUID string             `json:"client_uuid"`
+}
+
+type ListReportsSuccess struct {
+	SpaceUUID string             `json:"space_uuid"`
+	Reports   []ModerationReport `json:"reports"`
+}
+
+type ResolveReportClient struct {
+	SpaceUUID       string `json:"space_uuid"`
+	ReportID        int    `json:"report_id"`
+	Action          string `json:"action"`
+	CapabilityToken string `json:"capability_token,omitempty"`
+}
+
+type ResolveReportRequest struct {
+	SpaceUUID                 string `json:"space_uuid"`
+	ReportID                  int    `json:"report_id"`
+	Action                    string `json:"action"`
+	RequesterUserID           int    `json:"requester_user_id"`
+	RequesterUserPublicKey    string `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string `json:"client_uuid"`
+}
+
+type ResolveReportResponse struct {
+	Report           ModerationReport `json:"report"`
+	DeletedMessageID string           `json:"deleted_message_id,omitempty"`
+	ClientUUID       string           `json:"client_uuid"`
+}
+
+type ResolveReportSuccess struct {
+	Report ModerationReport `json:"report"`
+}
+
+// AuditEntry mirrors the host's audit log entry. Clients can check Hash and
+// Signature against the host signing key themselves.
+type AuditEntry struct {
+	ID               int               `json:"id"`
+	SpaceUUID        string            `json:"space_uuid"`
+	ActorUserID      int               `json:"actor_user_id,omitempty"`
+	ActorPublicKey   string            `json:"actor_public_key,omitempty"`
+	Action           string            `json:"action"`
+	Details          map[string]string `json:"details,omitempty"`
+	CreatedAt        string            `json:"created_at"`
+	PrevHash         string            `json:"prev_hash"`
+	Hash             string            `json:"hash"`
+	SigningPublicKey string            `json:"signing_public_key"`
+	Signature        string            `json:"signature"`
+}
+
+type GetAuditLogClient struct {
+	SpaceUUID       string `json:"space_uuid"`
+	BeforeID        int    `json:"before_id,omitempty"`
+	CapabilityToken string `json:"capability_token,omitempty"`
+}
+
+type GetAuditLogRequest struct {
+	SpaceUUID                 string `json:"space_uuid"`
+	BeforeID                  int    `json:"before_id,omitempty"`
+	RequesterUserID           int    `json:"requester_user_id"`
+	RequesterUserPublicKey    string `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string `json:"client_uuid"`
+}
+
+type GetAuditLogResponse struct {
+	SpaceUUID  string       `json:"space_uuid"`
+	Entries    []AuditEntry `json:"entries"`
+	HasMore    bool         `json:"has_more"`
+	ClientUUID string       `json:"client_uuid"`
+}
+
+type GetAuditLogSuccess struct {
+	SpaceUUID string       `json:"space_uuid"`
+	Entries   []AuditEntry `json:"entries"`
+	HasMore   bool         `json:"has_more"`
+}
+
+// ExportSpaceClient asks for a new space export, or with ExportID for the
+// next chunk of one the host has already built.
+type ExportSpaceClient struct {
+	SpaceUUID       string `json:"space_uuid"`
+	ExportID        string `json:"export_id,omitempty"`
+	Chunk           int    `json:"chunk,omitempty"`
+	CapabilityToken string `json:"capability_token,omitempty"`
+}
+
+type ExportSpaceRequest struct {
+	SpaceUUID                 string `json:"space_uuid"`
+	ExportID                  string `json:"export_id,omitempty"`
+	Chunk                     int    `json:"chunk,omitempty"`
+	RequesterUserID           int    `json:"requester_user_id"`
+	RequesterUserPublicKey    string `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string `json:"client_uuid"`
+}
+
+// ExportSpaceResponse is one chunk of a space archive; the client joins
+// Data from chunk 0 to Chunks-1.
+type ExportSpaceResponse struct {
+	SpaceUUID  string `json:"space_uuid"`
+	ExportID   string `json:"export_id"`
+	Chunk      int    `json:"chunk"`
+	Chunks     int    `json:"chunks"`
+	Data       string `json:"data"`
+	ClientUUID string `json:"client_uuid"`
+}
+
+type ExportSpaceSuccess struct {
+	SpaceUUID string `json:"space_uuid"`
+	ExportID  string `json:"export_id"`
+	Chunk     int    `json:"chunk"`
+	Chunks    int    `json:"chunks"`
+	Data      string `json:"data"`
+}
+
+// MessageDeleted tells a channel a moderator removed one of its messages.
+type MessageDeleted struct {
+	ChannelUUID string `json:"channel_uuid"`
+	MessageID   string `json:"message_id"`
 }
 
 type ClientHost struct {
 	ID               int    `json:"id"`
 	UUID             string `json:"uuid"`
 	Name             string `json:"name"`
+	Description      string `json:"description"`
+	IconURL          string `json:"icon_url"`
+	SoftwareVersion  string `json:"software_version"`
 	SigningPublicKey string `json:"signing_public_key,omitempty"`
 	Online           bool   `json:"online"`
 }
 
+type UpdateHostRequest struct {
+	Name            *string `json:"name"`
+	Description     *string `json:"description"`
+	IconURL         *string `json:"icon_url"`
+	SoftwareVersion *string `json:"software_version"`
+}
+
 type UUIDListRequest struct {
 	UUIDs []string `json:"uuids"`
 }
@@ -536,6 +957,12 @@ type AuthPubKeyClient struct {
 	Username     string `json:"username"`
 	Challenge    string `json:"challenge"`
 	Signature    string `json:"signature"`
+	// DevicePublicKey is the browser's own signing key. DeviceCertificate
+	// is the identity's signature over it and DeviceSignature the device
+	// key's signature over the challenge.
+	DevicePublicKey   string `json:"device_public_key,omitempty"`
+	DeviceCertificate string `json:"device_certificate,omitempty"`
+	DeviceSignature   string `json:"device_signature,omitempty"`
 }
 
 type AuthChallenge struct {
@@ -546,9 +973,32 @@ type HostAuthChallenge struct {
 	Challenge string `json:"challenge"`
 }
 
+// RotateHostKeyRequest replaces a host's signing key. Signature is made with
+// the current (old) key over hostKeyRotationMessage; NewKeySignature proves
+// the host holds the new private key.
+type RotateHostKeyRequest struct {
+	UUID                string `json:"uuid"`
+	OldSigningPublicKey string `json:"old_signing_public_key"`
+	NewSigningPublicKey string `json:"new_signing_public_key"`
+	IssuedAt            int64  `json:"issued_at"`
+	Signature           string `json:"signature"`
+	NewKeySignature     string `json:"new_key_signature"`
+}
+
+type ReissueCapabilitiesRequest struct {
+	Clients []GetDashDataRequest `json:"clients"`
+}
+
+type HostKeyRotated struct {
+	SigningPublicKey string `json:"signing_public_key"`
+}
+
 type HostAuthClient struct {
 	Challenge string `json:"challenge"`
 	Signature string `json:"signature"`
+	// RequestIDs is set by hosts that echo request_id on every answer.
+	// Requests to older hosts are still routed but never time out.
+	RequestIDs bool `json:"request_ids,omitempty"`
 }
 
 type RelayHealthCheck struct {
@@ -559,6 +1009,33 @@ type RelayHealthCheckAck struct {
 	Nonce string `json:"nonce"`
 }
 
+// QuotaExceeded is sent when a host quota turns a client away: as the data
+// of join_error while joining, and as quota_exceeded afterwards.
+type QuotaExceeded struct {
+	Content string `json:"error"`
+	Code    string `json:"code"`
+	Quota   string `json:"quota"`
+	Limit   int    `json:"limit"`
+}
+
+// HostQuotaUsage is what the relay reports to a host author about its
+// quotas on this relay node.
+type HostQuotaUsage struct {
+	Limits                    HostQuota        `json:"limits"`
+	Clients                   int              `json:"clients"`
+	BusiestKeySessions        int              `json:"busiest_key_sessions"`
+	BusiestChannelSubscribers int              `json:"busiest_channel_subscribers"`
+	MessagesThisMinute        int              `json:"messages_this_minute"`
+	Rejections                map[string]int64 `json:"rejections"`
+}
+
+// RelayShutdown tells a client the relay is going away and when to
+// reconnect.
+type RelayShutdown struct {
+	Reason           string `json:"reason"`
+	ReconnectAfterMs int64  `json:"reconnect_after_ms"`
+}
+
 type AuthPubKeySuccess struct {
 	UserID       int    `json:"user_id"`
 	Username     string `json:"username"`
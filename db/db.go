@@ -6,8 +6,10 @@ import (
 	"embed"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
 	"github.com/golang-migrate/migrate/v4/database/sqlite"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	sqlite3 "modernc.org/sqlite"
@@ -22,14 +24,22 @@ func init() {
 var ChatDB *sql.DB
 var HostDB *sql.DB
 
-func InitDB(databaseName string, migrations embed.FS, migrationPath string) (*sql.DB, error) {
+// AdoptFunc brings a database that predates versioned migrations to the shape
+// of a known migration version and returns that version. Returning 0 means
+// there is nothing to adopt and every migration runs from the start.
+type AdoptFunc func(db *sql.DB) (uint, error)
+
+// InitDB opens databaseName and applies the embedded migrations. adopt may be
+// nil; it is only consulted when the database has no migration history yet.
+func InitDB(databaseName string, migrations embed.FS, migrationPath string, adopt AdoptFunc) (*sql.DB, error) {
 	db, err := InitSQLite(databaseName)
 	if err != nil {
 		return nil, err
 	}
 
-	err = runMigrations(db, migrations, migrationPath)
+	err = Migrate(db, migrations, migrationPath, adopt)
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("migration error: %v", err)
 	}
 
@@ -39,7 +49,14 @@ func InitDB(databaseName string, migrations embed.FS, migrationPath string) (*sq
 // InitSQLite opens a sqlite database with foreign keys enabled.
 // Callers can bootstrap schema directly in code without migration files.
 func InitSQLite(databaseName string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", databaseName)
+	// PRAGMAs only apply to the connection that runs them, so also set them in
+	// the DSN for every connection the pool opens. busy_timeout makes concurrent
+	// writers wait for the lock instead of failing with SQLITE_BUSY.
+	separator := "?"
+	if strings.Contains(databaseName, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite3", databaseName+separator+"_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, err
 	}
@@ -68,22 +85,43 @@ func CloseDB(databaseInstance *sql.DB) {
 	}
 }
 
-func runMigrations(db *sql.DB, migrations embed.FS, migrationPath string) error {
+// Migrate applies the embedded migrations to an already open database.
+func Migrate(db *sql.DB, migrations embed.FS, migrationPath string, adopt AdoptFunc) error {
 	driver, err := sqlite.WithInstance(db, &sqlite.Config{})
 	if err != nil {
 		return fmt.Errorf("sqlite driver error: %w", err)
 	}
+	return applyMigrations(db, driver, "sqlite3", migrations, migrationPath, adopt)
+}
 
+func applyMigrations(db *sql.DB, driver database.Driver, driverName string, migrations embed.FS, migrationPath string, adopt AdoptFunc) error {
 	d, err := iofs.New(migrations, migrationPath)
 	if err != nil {
 		return fmt.Errorf("iofs source error: %w", err)
 	}
 
-	m, err := migrate.NewWithInstance("iofs", d, "sqlite3", driver)
+	m, err := migrate.NewWithInstance("iofs", d, driverName, driver)
 	if err != nil {
 		return fmt.Errorf("migrate instance error: %w", err)
 	}
 
+	if adopt != nil {
+		if _, _, err := m.Version(); err == migrate.ErrNilVersion {
+			version, err := adopt(db)
+			if err != nil {
+				return fmt.Errorf("adopt existing schema: %w", err)
+			}
+			if version > 0 {
+				if err := m.Force(int(version)); err != nil {
+					return fmt.Errorf("record adopted version %d: %w", version, err)
+				}
+				log.Printf("Adopted existing schema at migration version %d", version)
+			}
+		} else if err != nil {
+			return fmt.Errorf("read migration version: %w", err)
+		}
+	}
+
 	err = m.Up()
 	if err != nil && err != migrate.ErrNoChange {
 		return fmt.Errorf("migration up error: %w", err)
@@ -0,0 +1,36 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/lib/pq"
+)
+
+// InitPostgres opens the PostgreSQL database at dsn and applies the embedded
+// migrations. Several processes may run this against the same database; the
+// migrate driver serializes them with an advisory lock.
+func InitPostgres(dsn string, migrations embed.FS, migrationPath string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect to postgres: %w", err)
+	}
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("postgres driver error: %w", err)
+	}
+	if err := applyMigrations(db, driver, "postgres", migrations, migrationPath, nil); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migration error: %v", err)
+	}
+
+	return db, nil
+}
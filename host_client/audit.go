@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	auditActionCreateSpace       = "create_space"
+	auditActionDeleteSpace       = "delete_space"
+	auditActionCreateChannel     = "create_channel"
+	auditActionDeleteChannel     = "delete_channel"
+	auditActionChannelAllowVoice = "channel_allow_voice"
+	auditActionInviteUser        = "invite_user"
+	auditActionRemoveSpaceUser   = "remove_space_user"
+	auditActionLeaveSpace        = "leave_space"
+	auditActionResolveReport     = "resolve_report"
+	auditActionExportSpace       = "export_space"
+	auditActionImportSpace       = "import_space"
+
+	auditSignaturePrefix = "parch-audit-v1:"
+	auditPageSize        = 50
+	auditAppendAttempts  = 5
+)
+
+// auditMu serialises appends from this process. The UNIQUE (space_uuid,
+// prev_hash) constraint still catches a second host process sharing the DB.
+var auditMu sync.Mutex
+
+// auditHashInput is what an entry's hash covers. Field order is fixed by the
+// struct and details marshal with sorted keys, so the encoding is stable.
+type auditHashInput struct {
+	Version          int               `json:"v"`
+	SpaceUUID        string            `json:"space_uuid"`
+	PrevHash         string            `json:"prev_hash"`
+	ActorUserID      int               `json:"actor_user_id"`
+	ActorPublicKey   string            `json:"actor_public_key"`
+	Action           string            `json:"action"`
+	Details          map[string]string `json:"details"`
+	CreatedAt        string            `json:"created_at"`
+	SigningPublicKey string            `json:"signing_public_key"`
+}
+
+func auditEntryHash(entry AuditEntry) (string, error) {
+	details := entry.Details
+	if details == nil {
+		details = map[string]string{}
+	}
+	encoded, err := encodeCanonicalJSON(auditHashInput{
+		Version:          1,
+		SpaceUUID:        entry.SpaceUUID,
+		PrevHash:         entry.PrevHash,
+		ActorUserID:      entry.ActorUserID,
+		ActorPublicKey:   entry.ActorPublicKey,
+		Action:           entry.Action,
+		Details:          details,
+		CreatedAt:        entry.CreatedAt,
+		SigningPublicKey: entry.SigningPublicKey,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// sealAuditEntry fills in the hash and the host's signature over it. The
+// signing public key is stored with the entry so rotating the host key does
+// not break verification of older entries.
+func sealAuditEntry(entry *AuditEntry, signingKey ed25519.PrivateKey) error {
+	entry.SigningPublicKey = base64.RawStdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey))
+	hash, err := auditEntryHash(*entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	entry.Signature = base64.RawStdEncoding.EncodeToString(ed25519.Sign(signingKey, []byte(auditSignaturePrefix+hash)))
+	return nil
+}
+
+func verifyAuditEntry(entry AuditEntry) error {
+	hash, err := auditEntryHash(entry)
+	if err != nil {
+		return err
+	}
+	if hash != entry.Hash {
+		return fmt.Errorf("entry %d: hash mismatch", entry.ID)
+	}
+	publicKey, err := base64.RawStdEncoding.DecodeString(entry.SigningPublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("entry %d: invalid signing public key", entry.ID)
+	}
+	signature, err := base64.RawStdEncoding.DecodeString(entry.Signature)
+	if err != nil {
+		return fmt.Errorf("entry %d: invalid signature encoding", entry.ID)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), []byte(auditSignaturePrefix+hash), signature) {
+		return fmt.Errorf("entry %d: bad signature", entry.ID)
+	}
+	return nil
+}
+
+// verifyAuditChain checks entries oldest first: each must verify on its own
+// and point at the hash of the one before it. The first entry of a space has
+// an empty prev_hash.
+func verifyAuditChain(entries []AuditEntry) error {
+	prevHash := ""
+	for _, entry := range entries {
+		if entry.PrevHash != prevHash {
+			return fmt.Errorf("entry %d: chain broken (prev_hash does not match previous entry)", entry.ID)
+		}
+		if err := verifyAuditEntry(entry); err != nil {
+			return err
+		}
+		prevHash = entry.Hash
+	}
+	return nil
+}
+
+// loadAuditChain returns every entry of the space, oldest first.
+func loadAuditChain(spaceUUID string) ([]AuditEntry, error) {
+	var chain []AuditEntry
+	beforeID := 0
+	for {
+		page, err := hostStore.AuditEntries(spaceUUID, beforeID, 500)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, page...)
+		if len(page) < 500 {
+			break
+		}
+		beforeID = page[len(page)-1].ID
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// appendAudit seals and stores an entry at the head of the space's chain,
+// retrying when another writer got there first.
+func appendAudit(entry AuditEntry) error {
+	signingKey, err := currentSigningPrivateKey()
+	if err != nil {
+		return err
+	}
+	if entry.Details == nil {
+		entry.Details = map[string]string{}
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		prevHash, err := hostStore.LastAuditHash(entry.SpaceUUID)
+		if err != nil {
+			return err
+		}
+		entry.PrevHash = prevHash
+		entry.CreatedAt = storeTimestamp()
+		if err := sealAuditEntry(&entry, signingKey); err != nil {
+			return err
+		}
+		if _, err := hostStore.AppendAuditEntry(entry); err != nil {
+			if errors.Is(err, errStoreConflict) {
+				continue
+			}
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("audit chain for space %s kept moving", entry.SpaceUUID)
+}
+
+// recordAudit logs an admin action. The action has already happened, so a
+// failure here is logged rather than reported to the requester.
+func recordAudit(spaceUUID string, actor DashDataUser, action string, details map[string]string) {
+	err := appendAudit(AuditEntry{
+		SpaceUUID:      spaceUUID,
+		ActorUserID:    actor.ID,
+		ActorPublicKey: actor.PublicKey,
+		Action:         action,
+		Details:        details,
+	})
+	if err != nil {
+		log.Printf("Error writing audit entry %s for space %s: %v", action, spaceUUID, err)
+	}
+}
+
+func handleGetAuditLog(conn *relayConn, wsMsg *WSMessage) {
+	data, err := decodeData[GetAuditLogRequest](wsMsg.Data)
+	if err != nil {
+		log.Println("error decoding get_audit_log_request:", err)
+		return
+	}
+
+	requester, err := resolveHostUserIdentityStrict(data.RequesterUserID, data.RequesterUserPublicKey, data.RequesterUserEncPublicKey)
+	if err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Failed to resolve requester identity", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if err := ensureSpaceAuthor(data.SpaceUUID, requester.ID); err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Not authorized to view this space's audit log", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	entries, err := hostStore.AuditEntries(data.SpaceUUID, data.BeforeID, auditPageSize+1)
+	if err != nil {
+		log.Println("Error listing audit entries:", err)
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Database failed to load audit log", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	hasMore := len(entries) > auditPageSize
+	if hasMore {
+		entries = entries[:auditPageSize]
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+
+	sendToConn(conn, WSMessage{
+		Type: "get_audit_log_response",
+		Data: GetAuditLogResponse{
+			SpaceUUID:  data.SpaceUUID,
+			Entries:    entries,
+			HasMore:    hasMore,
+			ClientUUID: data.ClientUUID,
+		},
+	})
+}
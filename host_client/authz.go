@@ -3,7 +3,6 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"gochat/db"
 )
 
 func ensureSpaceAuthor(spaceUUID string, requesterID int) error {
@@ -14,15 +13,14 @@ func ensureSpaceAuthor(spaceUUID string, requesterID int) error {
 		return fmt.Errorf("invalid requester id")
 	}
 
-	var authorID int
-	err := db.ChatDB.QueryRow(`SELECT author_id FROM spaces WHERE uuid = ?`, spaceUUID).Scan(&authorID)
+	space, err := hostStore.Space(spaceUUID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return fmt.Errorf("space not found")
 		}
 		return fmt.Errorf("failed to load space author: %w", err)
 	}
-	if authorID != requesterID {
+	if space.AuthorID != requesterID {
 		return fmt.Errorf("forbidden")
 	}
 	return nil
@@ -32,18 +30,42 @@ func loadChannelAuthz(channelUUID string) (spaceUUID string, authorID int, err e
 	if channelUUID == "" {
 		return "", 0, fmt.Errorf("missing channel uuid")
 	}
-	err = db.ChatDB.QueryRow(
-		`SELECT c.space_uuid, s.author_id
-		   FROM channels c
-		   JOIN spaces s ON s.uuid = c.space_uuid
-		  WHERE c.uuid = ?`,
-		channelUUID,
-	).Scan(&spaceUUID, &authorID)
+	channel, err := hostStore.Channel(channelUUID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return "", 0, fmt.Errorf("channel not found")
 		}
 		return "", 0, err
 	}
-	return spaceUUID, authorID, nil
+	space, err := hostStore.Space(channel.SpaceUUID)
+	if err != nil {
+		return "", 0, err
+	}
+	return space.UUID, space.AuthorID, nil
+}
+
+// ensureSpaceMember accepts the space author and users who have joined the
+// space; a pending invite is not enough.
+func ensureSpaceMember(spaceUUID string, userID int) error {
+	if spaceUUID == "" {
+		return fmt.Errorf("missing space uuid")
+	}
+	space, err := hostStore.Space(spaceUUID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("space not found")
+		}
+		return fmt.Errorf("failed to load space: %w", err)
+	}
+	if space.AuthorID == userID {
+		return nil
+	}
+	joined, err := hostStore.Membership(spaceUUID, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == sql.ErrNoRows || joined != 1 {
+		return fmt.Errorf("forbidden")
+	}
+	return nil
 }
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gochat/db"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	backupTimestampLayout = "20060102_150405.000"
+	backupPlainSuffix     = ".db.gz"
+	backupEncryptedSuffix = ".db.gz.enc"
+
+	// Matches the browser's identity backup KDF parameters.
+	backupKDFIterations = 210000
+	backupChunkSize     = 64 * 1024
+)
+
+// Encrypted backups are a gzip stream sealed in fixed-size AES-GCM chunks:
+//
+//	magic(8) | iterations(u32) | salt(16) | nonce prefix(8) | chunks...
+//	chunk = length(u32) | ciphertext
+//
+// Each chunk nonce is prefix||counter and its AAD marks the final chunk, so
+// reordering, truncation and appended data all fail authentication.
+var backupMagic = []byte("PRCHBAK1")
+
+type backupOptions struct {
+	Dir        string
+	Keep       int
+	Passphrase string
+}
+
+// backupOptionsFromEnv resolves HOST_BACKUP_* into backup options and the
+// scheduler interval (zero when scheduled backups are disabled).
+func backupOptionsFromEnv() (backupOptions, time.Duration, error) {
+	opts := backupOptions{Dir: strings.TrimSpace(backupDir), Passphrase: backupPassphrase}
+	if opts.Dir == "" {
+		dir, err := getAppSupportPathFor("backups")
+		if err != nil {
+			return opts, 0, err
+		}
+		opts.Dir = dir
+	}
+
+	keep, err := strconv.Atoi(strings.TrimSpace(backupKeep))
+	if err != nil || keep < 0 {
+		return opts, 0, fmt.Errorf("invalid HOST_BACKUP_KEEP %q", backupKeep)
+	}
+	opts.Keep = keep
+
+	var interval time.Duration
+	if raw := strings.TrimSpace(backupInterval); raw != "" {
+		interval, err = time.ParseDuration(raw)
+		if err != nil || interval < time.Minute {
+			return opts, 0, fmt.Errorf("invalid HOST_BACKUP_INTERVAL %q (minimum 1m)", backupInterval)
+		}
+	}
+	return opts, interval, nil
+}
+
+// createHostBackup writes a consistent snapshot of conn into opts.Dir and
+// rotates old backups. It is safe to call while the host is serving traffic.
+func createHostBackup(conn *sql.DB, dbPath string, opts backupOptions) (string, error) {
+	if strings.TrimSpace(opts.Dir) == "" {
+		return "", fmt.Errorf("missing backup directory")
+	}
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	prefix := backupPrefix(dbPath)
+	ts := time.Now().UTC().Format(backupTimestampLayout)
+	snapshotPath := filepath.Join(opts.Dir, fmt.Sprintf(".%s%s.snapshot", prefix, ts))
+	defer os.Remove(snapshotPath)
+
+	// VACUUM INTO produces a transactionally consistent copy without blocking
+	// writers for longer than a normal read transaction.
+	if _, err := conn.Exec(`VACUUM INTO ?`, snapshotPath); err != nil {
+		return "", fmt.Errorf("failed to snapshot host DB: %w", err)
+	}
+
+	suffix := backupPlainSuffix
+	if opts.Passphrase != "" {
+		suffix = backupEncryptedSuffix
+	}
+	finalPath := filepath.Join(opts.Dir, prefix+ts+suffix)
+	partialPath := finalPath + ".partial"
+	if err := writeBackupFile(snapshotPath, partialPath, opts.Passphrase); err != nil {
+		os.Remove(partialPath)
+		return "", err
+	}
+	if err := os.Rename(partialPath, finalPath); err != nil {
+		os.Remove(partialPath)
+		return "", fmt.Errorf("failed to finalize backup: %w", err)
+	}
+
+	if opts.Keep > 0 {
+		if err := rotateHostBackups(opts.Dir, prefix, opts.Keep); err != nil {
+			log.Printf("Backup rotation failed: %v", err)
+		}
+	}
+	return finalPath, nil
+}
+
+func backupPrefix(dbPath string) string {
+	return strings.TrimSuffix(filepath.Base(dbPath), filepath.Ext(dbPath)) + "-"
+}
+
+func writeBackupFile(snapshotPath, outPath string, passphrase string) error {
+	in, err := os.Open(snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var sink io.WriteCloser = nopWriteCloser{out}
+	if passphrase != "" {
+		sink, err = newBackupEncryptWriter(out, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	gz := gzip.NewWriter(sink)
+	if _, err := io.Copy(gz, in); err != nil {
+		return fmt.Errorf("failed to compress backup: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := sink.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// rotateHostBackups keeps the newest keep backups. Names embed a sortable UTC
+// timestamp, so lexical order is chronological order.
+func rotateHostBackups(dir, prefix string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isHostBackupName(entry.Name(), prefix) {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		log.Printf("Removed old backup %s", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// isHostBackupName reports whether name is a backup createHostBackup wrote for
+// prefix. The timestamp has to follow the prefix directly, so host-test.db's
+// backups are not mistaken for host.db's.
+func isHostBackupName(name, prefix string) bool {
+	rest, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return false
+	}
+	ts, ok := strings.CutSuffix(rest, backupEncryptedSuffix)
+	if !ok {
+		if ts, ok = strings.CutSuffix(rest, backupPlainSuffix); !ok {
+			return false
+		}
+	}
+	_, err := time.Parse(backupTimestampLayout, ts)
+	return err == nil
+}
+
+// restoreHostBackup unpacks backupPath next to dbPath, verifies it, and only
+// then swaps it in. The replaced DB is kept as <db>.pre-restore.<ts>.
+func restoreHostBackup(backupPath, dbPath, passphrase string) (string, error) {
+	ts := time.Now().UTC().Format(backupTimestampLayout)
+	stagedPath := fmt.Sprintf("%s.restore.%s", dbPath, ts)
+	if err := extractBackupFile(backupPath, stagedPath, passphrase); err != nil {
+		os.Remove(stagedPath)
+		return "", err
+	}
+	if err := verifyRestoredHostDB(stagedPath); err != nil {
+		os.Remove(stagedPath)
+		return "", err
+	}
+
+	previousPath := ""
+	if _, err := os.Stat(dbPath); err == nil {
+		previousPath = fmt.Sprintf("%s.pre-restore.%s", dbPath, ts)
+		if err := os.Rename(dbPath, previousPath); err != nil {
+			os.Remove(stagedPath)
+			return "", fmt.Errorf("failed to move current DB aside: %w", err)
+		}
+		_ = renameIfExists(dbPath+"-wal", previousPath+"-wal")
+		_ = renameIfExists(dbPath+"-shm", previousPath+"-shm")
+	}
+	if err := os.Rename(stagedPath, dbPath); err != nil {
+		if previousPath != "" {
+			_ = os.Rename(previousPath, dbPath)
+		}
+		return "", fmt.Errorf("failed to swap in restored DB: %w", err)
+	}
+	return previousPath, nil
+}
+
+func extractBackupFile(backupPath, outPath, passphrase string) error {
+	in, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	br := bufio.NewReader(in)
+	head, err := br.Peek(len(backupMagic))
+	if err != nil {
+		return fmt.Errorf("backup file is too short")
+	}
+
+	var src io.Reader = br
+	if bytes.Equal(head, backupMagic) {
+		if passphrase == "" {
+			return fmt.Errorf("backup is encrypted; a passphrase is required")
+		}
+		src, err = newBackupDecryptReader(br, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return fmt.Errorf("backup is not a valid archive: %w", err)
+	}
+	defer gz.Close()
+
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, gz); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to extract backup: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func verifyRestoredHostDB(path string) error {
+	conn, err := db.InitSQLite(path)
+	if err != nil {
+		return fmt.Errorf("restored DB cannot be opened: %w", err)
+	}
+	defer conn.Close()
+
+	var integrity string
+	if err := conn.QueryRow(`PRAGMA integrity_check`).Scan(&integrity); err != nil {
+		return fmt.Errorf("restored DB integrity check failed: %w", err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("restored DB integrity check failed: %s", integrity)
+	}
+
+	// hasIncompatibleHostSchema tolerates missing tables because startup can
+	// create them; a backup without the core tables is not a host DB at all.
+	for _, tableName := range []string{"chat_users", "spaces", "channels", "messages", "space_users"} {
+		exists, _, err := tableColumns(conn, tableName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("restored DB is missing table %s", tableName)
+		}
+	}
+	incompatible, reason, err := hasIncompatibleHostSchema(conn)
+	if err != nil {
+		return err
+	}
+	if incompatible {
+		return fmt.Errorf("restored DB has an incompatible schema: %s", reason)
+	}
+	return nil
+}
+
+// startBackupScheduler snapshots the live DB every interval until ctx ends.
+func startBackupScheduler(ctx context.Context, dbPath string, interval time.Duration, opts backupOptions) {
+	if interval <= 0 {
+		return
+	}
+	log.Printf("Scheduled backups every %s into %s (keeping %d)", interval, opts.Dir, opts.Keep)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				path, err := createHostBackup(db.ChatDB, dbPath, opts)
+				if err != nil {
+					log.Printf("Scheduled backup failed: %v", err)
+					continue
+				}
+				log.Printf("Scheduled backup written: %s", path)
+			}
+		}
+	}()
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func deriveBackupKey(passphrase string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New)
+}
+
+type backupEncryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newBackupEncryptWriter(w io.Writer, passphrase string) (*backupEncryptWriter, error) {
+	salt, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := randomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newBackupAEAD(deriveBackupKey(passphrase, salt, backupKDFIterations))
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(backupMagic)+4+len(salt)+len(prefix))
+	header = append(header, backupMagic...)
+	header = binary.BigEndian.AppendUint32(header, backupKDFIterations)
+	header = append(header, salt...)
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &backupEncryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, backupChunkSize)}, nil
+}
+
+func (e *backupEncryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+		// Keep a full chunk buffered so Close can always seal a final chunk.
+		if len(e.buf) == cap(e.buf) && len(p) > 0 {
+			if err := e.sealChunk(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (e *backupEncryptWriter) Close() error {
+	return e.sealChunk(true)
+}
+
+func (e *backupEncryptWriter) sealChunk(final bool) error {
+	sealed := e.aead.Seal(nil, backupChunkNonce(e.prefix, e.counter), e.buf, backupChunkAAD(final))
+	e.counter++
+	e.buf = e.buf[:0]
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := e.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+type backupDecryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	done    bool
+}
+
+func newBackupDecryptReader(r io.Reader, passphrase string) (*backupDecryptReader, error) {
+	header := make([]byte, len(backupMagic)+4+16+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("encrypted backup header is truncated")
+	}
+	rest := header[len(backupMagic):]
+	iterations := int(binary.BigEndian.Uint32(rest[:4]))
+	if iterations < 1 || iterations > 10_000_000 {
+		return nil, fmt.Errorf("encrypted backup has invalid KDF parameters")
+	}
+	salt := rest[4:20]
+	prefix := append([]byte(nil), rest[20:28]...)
+
+	aead, err := newBackupAEAD(deriveBackupKey(passphrase, salt, iterations))
+	if err != nil {
+		return nil, err
+	}
+	return &backupDecryptReader{r: r, aead: aead, prefix: prefix}, nil
+}
+
+func (d *backupDecryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.openChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *backupDecryptReader) openChunk() error {
+	var length [4]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		return fmt.Errorf("encrypted backup is truncated")
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size < uint32(d.aead.Overhead()) || size > backupChunkSize+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("encrypted backup chunk has invalid size")
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("encrypted backup is truncated")
+	}
+
+	nonce := backupChunkNonce(d.prefix, d.counter)
+	d.counter++
+	if plain, err := d.aead.Open(nil, nonce, sealed, backupChunkAAD(false)); err == nil {
+		d.plain = plain
+		return nil
+	}
+	plain, err := d.aead.Open(nil, nonce, sealed, backupChunkAAD(true))
+	if err != nil {
+		return errors.New("failed to decrypt backup (wrong passphrase or corrupted file)")
+	}
+	if _, err := d.r.Read(make([]byte, 1)); err != io.EOF {
+		return fmt.Errorf("encrypted backup has trailing data")
+	}
+	d.plain = plain
+	d.done = true
+	return nil
+}
+
+func newBackupAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func backupChunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	return binary.BigEndian.AppendUint32(nonce, counter)
+}
+
+func backupChunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gochat/db"
+)
+
+// seededHostDB opens a host DB holding one user, so a restore can be checked
+// for content and not just for opening.
+func seededHostDB(t *testing.T, dir string) (*sql.DB, string) {
+	t.Helper()
+	dbPath := filepath.Join(dir, "host.db")
+	conn, err := openHostDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("open host DB: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := newSQLiteHostStore(conn).UpsertUser("pub-alice", "enc-alice", "alice"); err != nil {
+		t.Fatalf("seed user: %v", err)
+	}
+	return conn, dbPath
+}
+
+func restoredUserCount(t *testing.T, dbPath string) int {
+	t.Helper()
+	conn, err := db.InitSQLite(dbPath)
+	if err != nil {
+		t.Fatalf("open restored DB: %v", err)
+	}
+	defer conn.Close()
+	var count int
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM chat_users WHERE public_key = 'pub-alice'`).Scan(&count); err != nil {
+		t.Fatalf("read restored DB: %v", err)
+	}
+	return count
+}
+
+func TestHostBackupRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		passphrase string
+		suffix     string
+	}{
+		{"plain", "", backupPlainSuffix},
+		{"encrypted", "correct horse", backupEncryptedSuffix},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			conn, dbPath := seededHostDB(t, dir)
+			path, err := createHostBackup(conn, dbPath, backupOptions{Dir: filepath.Join(dir, "backups"), Passphrase: tc.passphrase})
+			if err != nil {
+				t.Fatalf("create backup: %v", err)
+			}
+			if !strings.HasSuffix(path, tc.suffix) || !isHostBackupName(filepath.Base(path), "host-") {
+				t.Fatalf("unexpected backup name %s", path)
+			}
+
+			target := filepath.Join(t.TempDir(), "host.db")
+			previous, err := restoreHostBackup(path, target, tc.passphrase)
+			if err != nil || previous != "" {
+				t.Fatalf("restore into an empty directory: %q, %v", previous, err)
+			}
+			if got := restoredUserCount(t, target); got != 1 {
+				t.Fatalf("expected the seeded user restored, got %d", got)
+			}
+			// Restoring over a DB keeps the one it replaces.
+			previous, err = restoreHostBackup(path, target, tc.passphrase)
+			if err != nil {
+				t.Fatalf("restore over an existing DB: %v", err)
+			}
+			if _, err := os.Stat(previous); err != nil {
+				t.Fatalf("expected the replaced DB kept at %q: %v", previous, err)
+			}
+		})
+	}
+}
+
+func TestHostBackupRejectsWrongPassphraseAndDamage(t *testing.T) {
+	dir := t.TempDir()
+	conn, dbPath := seededHostDB(t, dir)
+	path, err := createHostBackup(conn, dbPath, backupOptions{Dir: filepath.Join(dir, "backups"), Passphrase: "correct horse"})
+	if err != nil {
+		t.Fatalf("create backup: %v", err)
+	}
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read backup: %v", err)
+	}
+	headerSize := len(backupMagic) + 4 + 16 + 8
+
+	flipped := append([]byte(nil), original...)
+	flipped[headerSize+4+10] ^= 0xff
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		wantErr    string
+	}{
+		{"wrong passphrase", original, "wrong horse", "wrong passphrase"},
+		{"no passphrase", original, "", "passphrase is required"},
+		{"tampered chunk", flipped, "correct horse", "corrupted"},
+		{"truncated chunk", original[:len(original)-5], "correct horse", "truncated"},
+		{"header only", original[:headerSize], "correct horse", "truncated"},
+		{"trailing data", append(append([]byte(nil), original...), 0), "correct horse", "trailing data"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			damaged := filepath.Join(t.TempDir(), "host-damaged"+backupEncryptedSuffix)
+			if err := os.WriteFile(damaged, tc.data, 0600); err != nil {
+				t.Fatalf("write backup: %v", err)
+			}
+			target := filepath.Join(t.TempDir(), "host.db")
+			if err := os.WriteFile(target, []byte("live"), 0600); err != nil {
+				t.Fatalf("write live DB: %v", err)
+			}
+			_, err := restoreHostBackup(damaged, target, tc.passphrase)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected %q, got %v", tc.wantErr, err)
+			}
+			// The live DB is untouched and nothing is left staged next to it.
+			if live, _ := os.ReadFile(target); string(live) != "live" {
+				t.Fatalf("expected the live DB untouched, got %q", live)
+			}
+			if entries, _ := os.ReadDir(filepath.Dir(target)); len(entries) != 1 {
+				t.Fatalf("expected only the live DB left, got %d files", len(entries))
+			}
+		})
+	}
+}
+
+// Dropping or reordering whole chunks of a multi-chunk stream fails too: only
+// the last chunk is sealed as final, and nonces follow the chunk order.
+func TestBackupStreamDetectsMissingAndReorderedChunks(t *testing.T) {
+	plain := make([]byte, 2*backupChunkSize+100)
+	if _, err := rand.Read(plain); err != nil {
+		t.Fatalf("random data: %v", err)
+	}
+	var sealed bytes.Buffer
+	enc, err := newBackupEncryptWriter(&sealed, "correct horse")
+	if err != nil {
+		t.Fatalf("encrypt writer: %v", err)
+	}
+	if _, err := enc.Write(plain); err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	data := sealed.Bytes()
+	headerSize := len(backupMagic) + 4 + 16 + 8
+	header := data[:headerSize]
+	var chunks [][]byte
+	for rest := data[headerSize:]; len(rest) > 0; {
+		size := 4 + int(binary.BigEndian.Uint32(rest[:4]))
+		chunks = append(chunks, rest[:size])
+		rest = rest[size:]
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, parts...), nil)
+	}
+	decrypt := func(data []byte) ([]byte, error) {
+		dec, err := newBackupDecryptReader(bytes.NewReader(data), "correct horse")
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(dec)
+	}
+
+	if got, err := decrypt(join(chunks...)); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("expected the intact stream to decrypt, got %d bytes, %v", len(got), err)
+	}
+	if _, err := decrypt(join(chunks[0], chunks[1])); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Fatalf("expected a missing final chunk to be truncated, got %v", err)
+	}
+	if _, err := decrypt(join(chunks[1], chunks[0], chunks[2])); err == nil {
+		t.Fatal("expected reordered chunks to fail")
+	}
+}
+
+func TestRotateHostBackupsOnlyCountsThisDatabase(t *testing.T) {
+	dir := t.TempDir()
+	stamp := func(minutes int) string {
+		return time.Date(2025, 10, 19, 12, minutes, 0, 0, time.UTC).Format(backupTimestampLayout)
+	}
+	names := []string{
+		"host-" + stamp(1) + backupPlainSuffix,
+		"host-" + stamp(2) + backupEncryptedSuffix,
+		"host-" + stamp(3) + backupPlainSuffix,
+		"host-" + stamp(4) + backupPlainSuffix,
+		// host-test.db shares the "host-" prefix but is another database.
+		"host-test-" + stamp(0) + backupPlainSuffix,
+		"host-test-" + stamp(5) + backupPlainSuffix,
+		"host-" + stamp(6) + backupPlainSuffix + ".partial",
+		"host-notes" + backupPlainSuffix,
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	if err := rotateHostBackups(dir, "host-", 2); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, entry.Name())
+	}
+	sort.Strings(kept)
+	want := []string{names[2], names[3], names[6], names[7], names[4], names[5]}
+	sort.Strings(want)
+	if strings.Join(kept, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected files after rotation:\n%s\nwant:\n%s", strings.Join(kept, "\n"), strings.Join(want, "\n"))
+	}
+
+	// createHostBackup rotates with the same rule.
+	conn, dbPath := seededHostDB(t, t.TempDir())
+	path, err := createHostBackup(conn, dbPath, backupOptions{Dir: dir, Keep: 1})
+	if err != nil {
+		t.Fatalf("create backup: %v", err)
+	}
+	for _, name := range []string{names[2], names[3]} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s rotated out, got %v", name, err)
+		}
+	}
+	for _, name := range []string{filepath.Base(path), names[4], names[5]} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("expected %s kept: %v", name, err)
+		}
+	}
+}
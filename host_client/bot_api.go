@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxBotMessageBytes = 16 * 1024
+
+// botAPIAdminTokenFile holds the token management requests must carry when
+// HOST_BOT_API_ADMIN_TOKEN is not set. It is created on first start.
+const botAPIAdminTokenFile = "bot_api_admin_token"
+
+type createBotRequest struct {
+	Name string `json:"name"`
+}
+
+type createBotResponse struct {
+	Bot   botIdentity `json:"bot"`
+	Token string      `json:"token"`
+}
+
+type botSpaceRequest struct {
+	SpaceUUID string `json:"space_uuid"`
+}
+
+type postBotMessageRequest struct {
+	ChannelUUID string `json:"channel_uuid"`
+	Text        string `json:"text"`
+}
+
+// startBotAPI serves the local bot API until ctx is cancelled. It is only
+// started when HOST_BOT_API_ADDR is set, and every request must come from a
+// loopback address. Loopback is not enough on a shared machine, so managing
+// bots also takes the admin token, and posting takes a bot's own token.
+func startBotAPI(ctx context.Context, addr string) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return
+	}
+	adminToken, err := loadBotAPIAdminToken()
+	if err != nil {
+		log.Printf("Bot API disabled: %v", err)
+		return
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           newBotAPIHandler(adminToken),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		log.Printf("Bot API listening on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Bot API error: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+		closeAllBotSessions()
+	}()
+}
+
+func newBotAPIHandler(adminToken string) http.Handler {
+	admin := func(next http.HandlerFunc) http.HandlerFunc {
+		return requireAdminToken(adminToken, next)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/bots", admin(handleListBots))
+	mux.HandleFunc("POST /api/bots", admin(handleCreateBot))
+	mux.HandleFunc("DELETE /api/bots/{id}", admin(handleDeleteBot))
+	mux.HandleFunc("POST /api/bots/{id}/spaces", admin(handleAddBotToSpace))
+	mux.HandleFunc("DELETE /api/bots/{id}/spaces/{space_uuid}", admin(handleRemoveBotFromSpace))
+	mux.HandleFunc("POST /api/messages", handlePostBotMessage)
+	mux.HandleFunc("GET /api/metrics", admin(handleRequestMetrics))
+	mux.HandleFunc("GET /api/relay_quota", admin(handleRelayQuota))
+	return requireLoopback(mux)
+}
+
+// loadBotAPIAdminToken returns HOST_BOT_API_ADMIN_TOKEN, or the token kept in
+// the host config directory, creating it the first time.
+func loadBotAPIAdminToken() (string, error) {
+	if token := strings.TrimSpace(botAPIAdminToken); token != "" {
+		return token, nil
+	}
+	path, err := getAppSupportPathFor(botAPIAdminTokenFile)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	tokenBytes, err := randomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.Printf("Bot API admin token written to %s", path)
+	return token, nil
+}
+
+func requireAdminToken(adminToken string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			writeBotAPIError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func requireLoopback(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !ip.IsLoopback() {
+			writeBotAPIError(w, http.StatusForbidden, "bot API is only available from localhost")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleRequestMetrics(w http.ResponseWriter, r *http.Request) {
+	writeBotAPIJSON(w, http.StatusOK, hostRequestMetrics.snapshot())
+}
+
+func handleListBots(w http.ResponseWriter, r *http.Request) {
+	bots, err := listBots()
+	if err != nil {
+		log.Println("Error listing bots:", err)
+		writeBotAPIError(w, http.StatusInternalServerError, "failed to list bots")
+		return
+	}
+	writeBotAPIJSON(w, http.StatusOK, bots)
+}
+
+func handleCreateBot(w http.ResponseWriter, r *http.Request) {
+	var req createBotRequest
+	if !decodeBotAPIRequest(w, r, &req) {
+		return
+	}
+	bot, token, err := createBot(req.Name)
+	if err != nil {
+		writeBotAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeBotAPIJSON(w, http.StatusCreated, createBotResponse{Bot: bot, Token: token})
+}
+
+func handleDeleteBot(w http.ResponseWriter, r *http.Request) {
+	botID, ok := parseBotID(w, r)
+	if !ok {
+		return
+	}
+	if err := deleteBot(botID); err != nil {
+		writeBotStoreError(w, err)
+		return
+	}
+	closeBotSession(botID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleAddBotToSpace(w http.ResponseWriter, r *http.Request) {
+	botID, ok := parseBotID(w, r)
+	if !ok {
+		return
+	}
+	var req botSpaceRequest
+	if !decodeBotAPIRequest(w, r, &req) {
+		return
+	}
+	spaceUUID := strings.TrimSpace(req.SpaceUUID)
+	if spaceUUID == "" {
+		writeBotAPIError(w, http.StatusBadRequest, "space_uuid is required")
+		return
+	}
+	if err := addBotToSpace(botID, spaceUUID); err != nil {
+		writeBotStoreError(w, err)
+		return
+	}
+	bot, err := lookupBotByID(botID)
+	if err != nil {
+		writeBotStoreError(w, err)
+		return
+	}
+	writeBotAPIJSON(w, http.StatusOK, bot)
+}
+
+func handleRemoveBotFromSpace(w http.ResponseWriter, r *http.Request) {
+	botID, ok := parseBotID(w, r)
+	if !ok {
+		return
+	}
+	if err := removeBotFromSpace(botID, r.PathValue("space_uuid")); err != nil {
+		writeBotStoreError(w, err)
+		return
+	}
+	// Capabilities cached by a live session still cover the old space.
+	closeBotSession(botID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handlePostBotMessage(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	bot, err := lookupBotByToken(token)
+	if err != nil {
+		writeBotAPIError(w, http.StatusUnauthorized, "invalid bot token")
+		return
+	}
+
+	var req postBotMessageRequest
+	if !decodeBotAPIRequest(w, r, &req) {
+		return
+	}
+	req.ChannelUUID = strings.TrimSpace(req.ChannelUUID)
+	if req.ChannelUUID == "" {
+		writeBotAPIError(w, http.StatusBadRequest, "channel_uuid is required")
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		writeBotAPIError(w, http.StatusBadRequest, "text is required")
+		return
+	}
+	if len(req.Text) > maxBotMessageBytes {
+		writeBotAPIError(w, http.StatusRequestEntityTooLarge, "text is too long")
+		return
+	}
+
+	messageID, err := postBotMessage(bot, req.ChannelUUID, req.Text)
+	if err != nil {
+		if errors.Is(err, errBotNotMember) {
+			writeBotAPIError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		log.Printf("bot %d: post message failed: %v", bot.ID, err)
+		writeBotAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeBotAPIJSON(w, http.StatusCreated, map[string]string{"message_id": messageID})
+}
+
+func parseBotID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	botID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || botID <= 0 {
+		writeBotAPIError(w, http.StatusBadRequest, "invalid bot id")
+		return 0, false
+	}
+	return botID, true
+}
+
+func decodeBotAPIRequest(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		writeBotAPIError(w, http.StatusBadRequest, "invalid request body")
+		return false
+	}
+	return true
+}
+
+func writeBotStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errBotNotFound), errors.Is(err, errSpaceNotFound), errors.Is(err, errBotNotMember):
+		writeBotAPIError(w, http.StatusNotFound, err.Error())
+	default:
+		log.Println("Bot API error:", err)
+		writeBotAPIError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func writeBotAPIError(w http.ResponseWriter, status int, message string) {
+	writeBotAPIJSON(w, status, map[string]string{"error": message})
+}
+
+func writeBotAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Bot API encode error:", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBotAPIManagementNeedsAdminToken(t *testing.T) {
+	conn, err := openHostDatabase(filepath.Join(t.TempDir(), "host.db"))
+	if err != nil {
+		t.Fatalf("open sqlite store: %v", err)
+	}
+	store := newSQLiteHostStore(conn)
+	t.Cleanup(func() { _ = store.Close() })
+	previousStore := hostStore
+	t.Cleanup(func() { hostStore = previousStore })
+	hostStore = store
+
+	_, botToken, err := createBot("ci-bot")
+	if err != nil {
+		t.Fatalf("create bot: %v", err)
+	}
+	handler := newBotAPIHandler("admin-secret")
+	serve := func(method, path, remoteAddr, token, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	const local = "127.0.0.1:40000"
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		remoteAddr string
+		token      string
+		body       string
+		want       int
+	}{
+		{"no token", http.MethodGet, "/api/bots", local, "", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/api/bots", local, "admin-guess", "", http.StatusUnauthorized},
+		{"bot token", http.MethodPost, "/api/bots", local, botToken, `{"name":"second"}`, http.StatusUnauthorized},
+		{"bot token deleting", http.MethodDelete, "/api/bots/1", local, botToken, "", http.StatusUnauthorized},
+		{"bot token on metrics", http.MethodGet, "/api/metrics", local, botToken, "", http.StatusUnauthorized},
+		{"admin token from another machine", http.MethodGet, "/api/bots", "192.0.2.7:40000", "admin-secret", "", http.StatusForbidden},
+		{"admin token", http.MethodGet, "/api/bots", local, "admin-secret", "", http.StatusOK},
+		{"admin creates a bot", http.MethodPost, "/api/bots", local, "admin-secret", `{"name":"second"}`, http.StatusCreated},
+		{"admin reads metrics", http.MethodGet, "/api/metrics", local, "admin-secret", "", http.StatusOK},
+		// Posting is authorised by the bot's own token, not the admin's.
+		{"admin token posting", http.MethodPost, "/api/messages", local, "admin-secret", `{"channel_uuid":"c","text":"hi"}`, http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		if got := serve(tc.method, tc.path, tc.remoteAddr, tc.token, tc.body); got != tc.want {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestLoadBotAPIAdminTokenIsGeneratedOnce(t *testing.T) {
+	previousDir, previousToken := hostConfigDir, botAPIAdminToken
+	hostConfigDir = t.TempDir()
+	botAPIAdminToken = ""
+	t.Cleanup(func() { hostConfigDir, botAPIAdminToken = previousDir, previousToken })
+
+	first, err := loadBotAPIAdminToken()
+	if err != nil || len(first) < 32 {
+		t.Fatalf("generate token: %q, %v", first, err)
+	}
+	info, err := os.Stat(filepath.Join(hostConfigDir, botAPIAdminTokenFile))
+	if err != nil {
+		t.Fatalf("stat token file: %v", err)
+	}
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm&0077 != 0 {
+		t.Fatalf("expected the token file private, got %v", perm)
+	}
+	if again, err := loadBotAPIAdminToken(); err != nil || again != first {
+		t.Fatalf("expected the stored token reused, got %q, %v", again, err)
+	}
+
+	botAPIAdminToken = "from-env"
+	if token, err := loadBotAPIAdminToken(); err != nil || token != "from-env" {
+		t.Fatalf("expected HOST_BOT_API_ADMIN_TOKEN to win, got %q, %v", token, err)
+	}
+}
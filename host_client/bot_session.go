@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	botResponseTimeout = 10 * time.Second
+	// Refresh capabilities a little before expiry so a send never races the
+	// relay's own expiry check.
+	botCapabilityRefreshSkew = 30 * time.Second
+)
+
+// botSession is a bot's own client-role connection to the relay. The relay
+// treats it exactly like a browser: pubkey auth, capability-gated channel
+// join, then chat envelopes.
+type botSession struct {
+	botID int
+
+	mu            sync.Mutex
+	conn          *websocket.Conn
+	incoming      chan WSMessage
+	closed        chan struct{}
+	capabilities  map[string]SpaceCapability
+	joinedChannel string
+}
+
+var (
+	botSessionsMu sync.Mutex
+	botSessions   = map[int]*botSession{}
+)
+
+func getBotSession(botID int) *botSession {
+	botSessionsMu.Lock()
+	defer botSessionsMu.Unlock()
+	session, ok := botSessions[botID]
+	if !ok {
+		session = &botSession{botID: botID}
+		botSessions[botID] = session
+	}
+	return session
+}
+
+func closeBotSession(botID int) {
+	botSessionsMu.Lock()
+	session, ok := botSessions[botID]
+	delete(botSessions, botID)
+	botSessionsMu.Unlock()
+	if !ok {
+		return
+	}
+	session.mu.Lock()
+	session.resetLocked()
+	session.mu.Unlock()
+}
+
+func closeAllBotSessions() {
+	botSessionsMu.Lock()
+	ids := make([]int, 0, len(botSessions))
+	for id := range botSessions {
+		ids = append(ids, id)
+	}
+	botSessionsMu.Unlock()
+	for _, id := range ids {
+		closeBotSession(id)
+	}
+}
+
+// postBotMessage encrypts plaintext to the channel's current members and
+// sends it through the relay. It returns the envelope message ID once the
+// host has confirmed it stored the message.
+func postBotMessage(bot botIdentity, channelUUID string, plaintext string) (string, error) {
+	spaceUUID, recipients, err := botChannelRecipients(bot, channelUUID)
+	if err != nil {
+		return "", err
+	}
+	sender, err := bot.envelopeSender()
+	if err != nil {
+		return "", err
+	}
+	envelope, err := encryptEnvelope(sender, spaceUUID, channelUUID, plaintext, recipients)
+	if err != nil {
+		return "", err
+	}
+
+	session := getBotSession(bot.ID)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if err := session.sendLocked(bot, spaceUUID, channelUUID, envelope); err != nil {
+		// Drop the connection so the next post starts from a clean handshake.
+		session.resetLocked()
+		return "", err
+	}
+	return envelope.MessageID, nil
+}
+
+func (s *botSession) sendLocked(bot botIdentity, spaceUUID, channelUUID string, envelope chatEnvelope) error {
+	if s.conn == nil {
+		if err := s.connectLocked(bot); err != nil {
+			return err
+		}
+	}
+
+	capability, ok := s.capabilities[spaceUUID]
+	if !ok || time.Until(time.Unix(capability.ExpiresAt, 0)) < botCapabilityRefreshSkew {
+		if err := s.refreshSpacesLocked(); err != nil {
+			return err
+		}
+		capability, ok = s.capabilities[spaceUUID]
+		if !ok {
+			return errBotNotMember
+		}
+	}
+
+	if s.joinedChannel != channelUUID {
+		s.drainLocked()
+		if err := s.writeLocked(WSMessage{
+			Type: "join_channel",
+			Data: JoinChannelClient{UUID: channelUUID, CapabilityToken: capability.Token},
+		}); err != nil {
+			return err
+		}
+		if _, err := s.awaitLocked(func(msg WSMessage) bool { return msg.Type == "joined_channel" }); err != nil {
+			return fmt.Errorf("join channel: %w", err)
+		}
+		s.joinedChannel = channelUUID
+	}
+
+	s.drainLocked()
+	if err := s.writeLocked(WSMessage{
+		Type: "chat",
+		Data: ChatClient{Envelope: envelope, CapabilityToken: capability.Token},
+	}); err != nil {
+		return err
+	}
+	ack, err := s.awaitLocked(func(msg WSMessage) bool {
+		if msg.Type != "chat_saved" && msg.Type != "chat_save_failed" {
+			return false
+		}
+		res, err := decodeData[SaveChatMessageResponse](msg.Data)
+		return err == nil && res.MessageID == envelope.MessageID
+	})
+	if err != nil {
+		return fmt.Errorf("send chat: %w", err)
+	}
+	if ack.Type == "chat_save_failed" {
+		res, _ := decodeData[SaveChatMessageResponse](ack.Data)
+		return fmt.Errorf("send chat: %s", res.Error)
+	}
+	return nil
+}
+
+func (s *botSession) connectLocked(bot botIdentity) error {
+	signingKey, err := parseSigningPrivateKey(bot.signingPrivateKey)
+	if err != nil {
+		return err
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsRelayURL.String(), nil)
+	if err != nil {
+		return fmt.Errorf("connect to relay: %w", err)
+	}
+	s.conn = conn
+	s.incoming = make(chan WSMessage, 64)
+	s.closed = make(chan struct{})
+	s.capabilities = nil
+	s.joinedChannel = ""
+	go s.readPump(conn, s.incoming, s.closed)
+
+	if err := s.writeLocked(WSMessage{
+		Type: "join_host",
+		Data: JoinHostPayload{UUID: currentHostUUID},
+	}); err != nil {
+		return err
+	}
+	msg, err := s.awaitLocked(func(msg WSMessage) bool { return msg.Type == "auth_challenge" })
+	if err != nil {
+		return fmt.Errorf("join host: %w", err)
+	}
+	challenge, err := decodeData[AuthChallenge](msg.Data)
+	if err != nil || strings.TrimSpace(challenge.Challenge) == "" {
+		return fmt.Errorf("invalid auth challenge from relay")
+	}
+
+	message := chatAuthMessage(currentHostUUID, challenge.Challenge, bot.EncPublicKey)
+	if err := s.writeLocked(WSMessage{
+		Type: "auth_pubkey",
+		Data: AuthPubKeyClient{
+			PublicKey:    bot.PublicKey,
+			EncPublicKey: bot.EncPublicKey,
+			DeviceID:     fmt.Sprintf("host-bot-%d", bot.ID),
+			DeviceName:   "Host bot",
+			Username:     bot.Name,
+			Challenge:    challenge.Challenge,
+			Signature:    base64.RawStdEncoding.EncodeToString(ed25519.Sign(signingKey, []byte(message))),
+		},
+	}); err != nil {
+		return err
+	}
+	if _, err := s.awaitLocked(func(msg WSMessage) bool { return msg.Type == "auth_pubkey_success" }); err != nil {
+		return fmt.Errorf("authenticate bot: %w", err)
+	}
+	return nil
+}
+
+// refreshSpacesLocked fetches fresh capabilities and (re)subscribes the bot to
+// every space it belongs to. The dash data round trip is also what teaches the
+// relay the channel-to-space mapping for those spaces.
+func (s *botSession) refreshSpacesLocked() error {
+	s.drainLocked()
+	if err := s.writeLocked(WSMessage{Type: "get_dash_data", Data: ""}); err != nil {
+		return err
+	}
+	msg, err := s.awaitLocked(func(msg WSMessage) bool { return msg.Type == "dash_data_payload" })
+	if err != nil {
+		return fmt.Errorf("load dash data: %w", err)
+	}
+	payload, err := decodeData[DashDataPayload](msg.Data)
+	if err != nil {
+		return fmt.Errorf("invalid dash data payload")
+	}
+
+	s.capabilities = make(map[string]SpaceCapability, len(payload.Capabilities))
+	spaceUUIDs := make([]string, 0, len(payload.Capabilities))
+	tokens := make(map[string]string, len(payload.Capabilities))
+	for _, capability := range payload.Capabilities {
+		s.capabilities[capability.SpaceUUID] = capability
+		spaceUUIDs = append(spaceUUIDs, capability.SpaceUUID)
+		tokens[capability.SpaceUUID] = capability.Token
+	}
+	if len(spaceUUIDs) == 0 {
+		return nil
+	}
+
+	if err := s.writeLocked(WSMessage{
+		Type: "join_all_spaces",
+		Data: JoinAllSpacesClient{SpaceUUIDs: spaceUUIDs, CapabilityTokens: tokens},
+	}); err != nil {
+		return err
+	}
+	if _, err := s.awaitLocked(func(msg WSMessage) bool { return msg.Type == "join_all_spaces_success" }); err != nil {
+		return fmt.Errorf("join spaces: %w", err)
+	}
+	return nil
+}
+
+func (s *botSession) readPump(conn *websocket.Conn, incoming chan<- WSMessage, closed chan<- struct{}) {
+	defer close(closed)
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		select {
+		case incoming <- msg:
+		default:
+			// Nobody is waiting on chat traffic from other members; shed it
+			// rather than stall the socket.
+		}
+	}
+}
+
+func (s *botSession) writeLocked(msg WSMessage) error {
+	if s.conn == nil {
+		return fmt.Errorf("bot session is not connected")
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(botResponseTimeout))
+	return s.conn.WriteJSON(msg)
+}
+
+// awaitLocked waits for the first message accepted by match. Relay error
+// frames abort the wait and surface their content.
+func (s *botSession) awaitLocked(match func(WSMessage) bool) (WSMessage, error) {
+	timer := time.NewTimer(botResponseTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-s.incoming:
+			switch msg.Type {
+			case "error", "author_error", "authentication-error", "join_error":
+				data, _ := decodeData[ChatError](msg.Data)
+				content := strings.TrimSpace(data.Content)
+				if content == "" {
+					content = msg.Type
+				}
+				return WSMessage{}, fmt.Errorf("relay: %s", content)
+			}
+			if match(msg) {
+				return msg, nil
+			}
+		case <-s.closed:
+			return WSMessage{}, fmt.Errorf("relay connection closed")
+		case <-timer.C:
+			return WSMessage{}, fmt.Errorf("timed out waiting for relay")
+		}
+	}
+}
+
+func (s *botSession) drainLocked() {
+	for {
+		select {
+		case <-s.incoming:
+		default:
+			return
+		}
+	}
+}
+
+func (s *botSession) resetLocked() {
+	if s.conn != nil {
+		if err := s.conn.Close(); err != nil {
+			log.Printf("bot %d: close relay connection: %v", s.botID, err)
+		}
+	}
+	s.conn = nil
+	s.capabilities = nil
+	s.joinedChannel = ""
+}
+
+func chatAuthMessage(hostUUID, challenge, encPublicKey string) string {
+	return fmt.Sprintf("parch-chat-auth:%s:%s:%s", hostUUID, challenge, encPublicKey)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errBotNotFound   = errors.New("bot not found")
+	errSpaceNotFound = errors.New("space not found")
+	errBotNotMember  = errors.New("bot is not a member of this space")
+)
+
+// Bots are ordinary chat_users rows whose private keys are held by the host,
+// so they show up as space members and receive wrapped keys like any user.
+type botIdentity struct {
+	ID                int      `json:"id"`
+	UserID            int      `json:"user_id"`
+	Name              string   `json:"name"`
+	PublicKey         string   `json:"public_key"`
+	EncPublicKey      string   `json:"enc_public_key"`
+	SpaceUUIDs        []string `json:"space_uuids"`
+	CreatedAt         string   `json:"created_at"`
+	signingPrivateKey string
+	encPrivateKey     string
+}
+
+func (b botIdentity) envelopeSender() (envelopeSender, error) {
+	signingKey, err := parseSigningPrivateKey(b.signingPrivateKey)
+	if err != nil {
+		return envelopeSender{}, err
+	}
+	encryptionKey, err := parseEncPrivateKey(b.encPrivateKey)
+	if err != nil {
+		return envelopeSender{}, err
+	}
+	return envelopeSender{
+		AuthPublicKey: b.PublicKey,
+		EncPublicKey:  b.EncPublicKey,
+		SigningKey:    signingKey,
+		EncryptionKey: encryptionKey,
+	}, nil
+}
+
+func hashBotToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createBot generates a fresh identity and returns the bot together with its
+// API token. Only the token hash is stored, so the token cannot be shown again.
+func createBot(name string) (botIdentity, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return botIdentity{}, "", fmt.Errorf("bot name is required")
+	}
+	if len(name) > 40 {
+		return botIdentity{}, "", fmt.Errorf("bot name is too long")
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return botIdentity{}, "", err
+	}
+	encPublicKey, encPrivateKey, err := generateEncryptionKeyPair()
+	if err != nil {
+		return botIdentity{}, "", err
+	}
+	tokenBytes, err := randomBytes(32)
+	if err != nil {
+		return botIdentity{}, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	user, err := upsertHostUserByPublicKey(base64.RawStdEncoding.EncodeToString(pub), encPublicKey, name)
+	if err != nil {
+		return botIdentity{}, "", fmt.Errorf("failed to create bot user: %w", err)
+	}
+
+	botID, err := hostStore.CreateBot(
+		user.ID,
+		name,
+		base64.RawStdEncoding.EncodeToString(priv),
+		encPrivateKey,
+		hashBotToken(token),
+	)
+	if err != nil {
+		_ = hostStore.DeleteUser(user.ID)
+		return botIdentity{}, "", fmt.Errorf("failed to store bot: %w", err)
+	}
+
+	bot, err := lookupBotByID(botID)
+	if err != nil {
+		return botIdentity{}, "", err
+	}
+	return bot, token, nil
+}
+
+func lookupBotByID(botID int) (botIdentity, error) {
+	bot, err := hostStore.BotByID(botID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return botIdentity{}, errBotNotFound
+	}
+	if err != nil {
+		return botIdentity{}, err
+	}
+	bot.SpaceUUIDs, err = botSpaceUUIDs(bot.UserID)
+	return bot, err
+}
+
+func lookupBotByToken(token string) (botIdentity, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return botIdentity{}, errBotNotFound
+	}
+	bot, err := hostStore.BotByTokenHash(hashBotToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return botIdentity{}, errBotNotFound
+	}
+	if err != nil {
+		return botIdentity{}, err
+	}
+	bot.SpaceUUIDs, err = botSpaceUUIDs(bot.UserID)
+	return bot, err
+}
+
+func listBots() ([]botIdentity, error) {
+	bots, err := hostStore.ListBots()
+	if err != nil {
+		return nil, err
+	}
+	for i := range bots {
+		bots[i].SpaceUUIDs, err = botSpaceUUIDs(bots[i].UserID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bots, nil
+}
+
+func botSpaceUUIDs(userID int) ([]string, error) {
+	return hostStore.JoinedSpaceUUIDs(userID)
+}
+
+func deleteBot(botID int) error {
+	bot, err := lookupBotByID(botID)
+	if err != nil {
+		return err
+	}
+	return hostStore.DeleteBot(bot.ID, bot.UserID)
+}
+
+func addBotToSpace(botID int, spaceUUID string) error {
+	bot, err := lookupBotByID(botID)
+	if err != nil {
+		return err
+	}
+	_, err = hostStore.Space(spaceUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errSpaceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return hostStore.AddMember(spaceUUID, bot.UserID)
+}
+
+func removeBotFromSpace(botID int, spaceUUID string) error {
+	bot, err := lookupBotByID(botID)
+	if err != nil {
+		return err
+	}
+	err = hostStore.RemoveMember(spaceUUID, bot.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errBotNotMember
+	}
+	return err
+}
+
+// botChannelRecipients resolves the channel's space and its current members.
+// The bot must itself be a joined member of that space.
+func botChannelRecipients(bot botIdentity, channelUUID string) (string, []DashDataUser, error) {
+	channel, err := hostStore.Channel(channelUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, fmt.Errorf("channel not found")
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	space, err := hostStore.Space(channel.SpaceUUID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	isMember := false
+	for _, spaceUUID := range bot.SpaceUUIDs {
+		if spaceUUID == space.UUID {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		return "", nil, errBotNotMember
+	}
+
+	AppendspaceChannelsAndUsers(&space)
+	return space.UUID, space.Users, nil
+}
@@ -40,10 +40,11 @@ var adminScopes = []string{
 }
 
 func currentSigningPrivateKey() (ed25519.PrivateKey, error) {
-	if runtimeHostConfig == nil {
+	cfg := runtimeHostConfig.Load()
+	if cfg == nil {
 		return nil, fmt.Errorf("host config not initialized")
 	}
-	raw := strings.TrimSpace(runtimeHostConfig.SigningPrivateKey)
+	raw := strings.TrimSpace(cfg.SigningPrivateKey)
 	if raw == "" {
 		return nil, fmt.Errorf("missing host signing private key")
 	}
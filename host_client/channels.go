@@ -1,14 +1,15 @@
 package main
 
 import (
-	"gochat/db"
+	"database/sql"
+	"errors"
 	"log"
+	"strconv"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 )
 
-func handleCreateChannel(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleCreateChannel(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[CreateChannelRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding create_channel_request:", err)
@@ -43,14 +44,13 @@ func handleCreateChannel(conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
-	var channel DashDataChannel
-
-	query := `INSERT INTO channels (uuid, name, space_uuid) VALUES (?, ?, ?) RETURNING *`
-	err = db.ChatDB.QueryRow(query, channelUUID, data.Name, data.SpaceUUID).Scan(&channel.ID, &channel.UUID, &channel.Name, &channel.SpaceUUID, &channel.AllowVoice)
-
+	channel, err := hostStore.CreateChannel(DashDataChannel{
+		UUID:      channelUUID.String(),
+		Name:      data.Name,
+		SpaceUUID: data.SpaceUUID,
+	})
 	if err != nil {
-		// Check if the error message contains "UNIQUE constraint failed"
-		if err.Error() == "UNIQUE constraint failed: channels.uuid" {
+		if errors.Is(err, errStoreConflict) {
 			sendToConn(conn, WSMessage{
 				Type: "error",
 				Data: ChatError{
@@ -71,6 +71,10 @@ func handleCreateChannel(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
+	recordAudit(data.SpaceUUID, requester, auditActionCreateChannel, map[string]string{
+		"channel_uuid": channel.UUID,
+		"name":         channel.Name,
+	})
 
 	sendToConn(conn, WSMessage{
 		Type: "create_channel_response",
@@ -82,7 +86,7 @@ func handleCreateChannel(conn *websocket.Conn, wsMsg *WSMessage) {
 	})
 }
 
-func handleDeleteChannel(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleDeleteChannel(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[DeleteChannelRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding delete_channel_request:", err)
@@ -106,9 +110,7 @@ func handleDeleteChannel(conn *websocket.Conn, wsMsg *WSMessage) {
 	}
 
 	// Get channel info before deleting.
-	var channelID int
-	var spaceUUID string
-	err = db.ChatDB.QueryRow(`SELECT id, space_uuid FROM channels WHERE uuid = ?`, data.UUID).Scan(&channelID, &spaceUUID)
+	channel, err := hostStore.Channel(data.UUID)
 	if err != nil {
 		sendToConn(conn, WSMessage{
 			Type: "error",
@@ -119,7 +121,7 @@ func handleDeleteChannel(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
-	if err := ensureSpaceAuthor(spaceUUID, requester.ID); err != nil {
+	if err := ensureSpaceAuthor(channel.SpaceUUID, requester.ID); err != nil {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -131,8 +133,8 @@ func handleDeleteChannel(conn *websocket.Conn, wsMsg *WSMessage) {
 	}
 
 	// Delete the channel
-	res, err := db.ChatDB.Exec(`DELETE FROM channels WHERE uuid = ?`, data.UUID)
-	if err != nil {
+	err = hostStore.DeleteChannel(data.UUID)
+	if err != nil && err != sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -143,7 +145,7 @@ func handleDeleteChannel(conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
-	if rows, _ := res.RowsAffected(); rows == 0 {
+	if err == sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -153,28 +155,30 @@ func handleDeleteChannel(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
+	recordAudit(channel.SpaceUUID, requester, auditActionDeleteChannel, map[string]string{
+		"channel_uuid": channel.UUID,
+		"name":         channel.Name,
+	})
 
 	sendToConn(conn, WSMessage{
 		Type: "delete_channel_response",
 		Data: DeleteChannelResponse{
-			ID:         channelID,
+			ID:         channel.ID,
 			UUID:       data.UUID,
-			SpaceUUID:  spaceUUID,
+			SpaceUUID:  channel.SpaceUUID,
 			ClientUUID: data.ClientUUID,
 		},
 	})
 }
 
-func handleChannelAllowVoice(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleChannelAllowVoice(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[ChannelAllowVoiceRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding channel_allow_voice_request:", err)
 		return
 	}
 
-	query := `UPDATE channels SET allow_voice = ? WHERE uuid = ?`
-	res, err := db.ChatDB.Exec(query, data.Allow, data.UUID)
-	if err != nil {
+	if err := hostStore.SetChannelAllowVoice(data.UUID, data.Allow); err != nil {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -185,14 +189,11 @@ func handleChannelAllowVoice(conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
-	if rows, _ := res.RowsAffected(); rows == 0 {
-		sendToConn(conn, WSMessage{
-			Type: "error",
-			Data: ChatError{
-				Content:    "Database error updating channel allow voice",
-				ClientUUID: data.ClientUUID,
-			},
+	// The request carries no requester, so the entry has no actor.
+	if spaceUUID, _, err := loadChannelAuthz(data.UUID); err == nil {
+		recordAudit(spaceUUID, DashDataUser{}, auditActionChannelAllowVoice, map[string]string{
+			"channel_uuid": data.UUID,
+			"allow":        strconv.Itoa(data.Allow),
 		})
-		return
 	}
 }
@@ -0,0 +1,985 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gochat/db"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errUsage = errors.New("usage")
+
+var errPostgresBackup = errors.New("backup and restore only cover the SQLite store; use pg_dump and pg_restore for PostgreSQL")
+
+func cliName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func printUsage(w io.Writer) {
+	name := cliName()
+	fmt.Fprintf(w, `Usage: %[1]s [global flags] <command> [arguments]
+
+Commands:
+  init [--non-interactive] [--name <name>]    Register this host with the relay and write its config
+  run                                         Connect to the relay and serve this host (default)
+  spaces list [--user <pubkey>]               List all spaces, or the spaces a user belongs to
+  spaces export <space-uuid> <file>           Write a signed archive of a space and its history
+  spaces import --signing-key <key> <file>    Recreate an archived space on this host
+  channels create <space-uuid> <name>         Create a channel (--voice, and --as <author-pubkey> or --force)
+  members list <space-uuid>                   List the members of a space
+  members remove <space-uuid> <pubkey>        Remove a member (--ban, and --as <author-pubkey> or --force)
+  users show <pubkey>                         Show a host user and their spaces
+  audit verify <space-uuid>                   Check the hash chain and signatures of a space's audit log
+  config show                                 Print the host configuration (private key redacted)
+  rotate-key [--discard-pending]              Replace the host signing key and tell the relay
+  relay show                                  Show this host's listing on the relay
+  relay update [--name|--description|--icon-url <value>]
+                                              Update the relay listing and reported version
+  relay deregister --yes                      Remove this host from the relay
+  backup [--dir <dir>] [--keep <n>]           Write a compressed snapshot of the host database
+  restore <backup-file>                       Replace the host database with a verified backup
+
+Global flags (each also has an environment variable):
+  --config-dir <dir>         HOST_CONFIG_DIR           config, DB and backup directory
+  --db-file <path>           HOST_CHAT_DB_FILE         host database path
+  --database-url <url>       HOST_DATABASE_URL         PostgreSQL URL; replaces the SQLite file
+  --relay-url <url>          CHAT_RELAY_URL            relay base URL, e.g. https://chat.example.com
+  --name <name>              HOST_NAME                 host name for first-time provisioning
+  --signing-key-file <path>  HOST_SIGNING_KEY_FILE     pre-provisioned signing key (or HOST_SIGNING_PRIVATE_KEY)
+
+run without a config registers the host non-interactively when a name is
+given, and only prompts when stdin is a terminal.
+
+backup and restore read the passphrase from --passphrase-file or
+HOST_BACKUP_PASSPHRASE. Stop the running host before restoring. They only
+cover the SQLite file; back up a PostgreSQL store with pg_dump.
+
+spaces import checks the archive's signature against the old host's signing
+public key, given with --signing-key, and every envelope in it against its
+sender. The space keeps its UUID, so members rejoin it once this host is
+online.
+
+Admin commands edit the host database directly. Connected browsers pick up
+the change on their next dashboard refresh.
+`, name)
+}
+
+// runCLI dispatches os.Args[1:]. No arguments keeps the historical behaviour
+// of prompting for a name on first launch and then running the host.
+func runCLI(args []string) error {
+	args, err := parseGlobalFlags(args)
+	if err == nil {
+		err = runCommand(args)
+	}
+
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr)
+		printUsage(os.Stderr)
+	}
+	return err
+}
+
+// parseGlobalFlags applies the flags that may precede the command, e.g.
+// `host --config-dir /etc/parch run`. They override the matching env vars.
+func parseGlobalFlags(args []string) ([]string, error) {
+	fs := flag.NewFlagSet(cliName(), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&hostConfigDir, "config-dir", hostConfigDir, "directory for the host config, DB and backups")
+	fs.StringVar(&hostDBFile, "db-file", hostDBFile, "host database path")
+	fs.StringVar(&hostDatabaseURL, "database-url", hostDatabaseURL, "PostgreSQL URL to use instead of the SQLite file")
+	fs.StringVar(&relayURLSetting, "relay-url", relayURLSetting, "relay base URL")
+	fs.StringVar(&hostNameSetting, "name", hostNameSetting, "host name used when provisioning")
+	fs.StringVar(&hostSigningKeyFile, "signing-key-file", hostSigningKeyFile, "pre-provisioned host signing private key")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return []string{"help"}, nil
+		}
+		return nil, fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if relayURLSetting != "" {
+		if err := setRelayURL(relayURLSetting); err != nil {
+			return nil, fmt.Errorf("%w: %v", errUsage, err)
+		}
+	}
+	return fs.Args(), nil
+}
+
+func runCommand(args []string) error {
+	if len(args) == 0 {
+		return runHostCommand()
+	}
+
+	command, rest := args[0], args[1:]
+	var err error
+	switch command {
+	case "init":
+		err = cliInit(rest)
+	case "run":
+		err = runHostCommand()
+	case "spaces":
+		err = runSubcommand(command, rest, map[string]func([]string) error{
+			"list":   cliSpacesList,
+			"export": cliSpacesExport,
+			"import": cliSpacesImport,
+		})
+	case "channels":
+		err = runSubcommand(command, rest, map[string]func([]string) error{
+			"create": cliChannelsCreate,
+		})
+	case "members":
+		err = runSubcommand(command, rest, map[string]func([]string) error{
+			"list":   cliMembersList,
+			"remove": cliMembersRemove,
+		})
+	case "users":
+		err = runSubcommand(command, rest, map[string]func([]string) error{
+			"show": cliUsersShow,
+		})
+	case "audit":
+		err = runSubcommand(command, rest, map[string]func([]string) error{
+			"verify": cliAuditVerify,
+		})
+	case "config":
+		err = runSubcommand(command, rest, map[string]func([]string) error{
+			"show": cliConfigShow,
+		})
+	case "rotate-key":
+		err = cliRotateKey(rest)
+	case "relay":
+		err = runSubcommand(command, rest, map[string]func([]string) error{
+			"show":       cliRelayShow,
+			"update":     cliRelayUpdate,
+			"deregister": cliRelayDeregister,
+		})
+	case "backup":
+		err = cliBackup(rest)
+	case "restore":
+		err = cliRestore(rest)
+	case "help", "-h", "--help":
+		printUsage(os.Stdout)
+		return nil
+	default:
+		err = fmt.Errorf("%w: unknown command %q", errUsage, command)
+	}
+	return err
+}
+
+func runSubcommand(command string, args []string, handlers map[string]func([]string) error) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: %s needs a subcommand", errUsage, command)
+	}
+	handler, ok := handlers[args[0]]
+	if !ok {
+		return fmt.Errorf("%w: unknown subcommand %q for %s", errUsage, args[0], command)
+	}
+	return handler(args[1:])
+}
+
+// parseCommandFlags lets flags appear before or after positional arguments.
+func parseCommandFlags(fs *flag.FlagSet, args []string, wantPositional int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", errUsage, fs.Name(), err)
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) != wantPositional {
+		return nil, fmt.Errorf("%w: %s expects %d argument(s)", errUsage, fs.Name(), wantPositional)
+	}
+	return positional, nil
+}
+
+func runHostCommand() error {
+	pingInterval, pongTimeout, err := relayKeepaliveSettings()
+	if err != nil {
+		return err
+	}
+	cfg, err := LoadOrInitHostConfigCLI()
+	if err != nil {
+		return fmt.Errorf("failed to load host config: %w", err)
+	}
+
+	fmt.Println("========================================")
+	fmt.Println("Parch Host CLI")
+	fmt.Println("========================================")
+	fmt.Printf("Host Name: %s\n", cfg.Name)
+	fmt.Printf("Host UUID: %s\n", cfg.UUID)
+	fmt.Println("========================================")
+	fmt.Println("Press Ctrl+C to shutdown")
+	fmt.Println()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Handle shutdown signals
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigChan
+		fmt.Println("\nShutdown signal received...")
+		cancel()
+	}()
+
+	runMainLogic(ctx, cfg, pingInterval, pongTimeout)
+	return nil
+}
+
+// openHostDatabaseForAdmin opens the configured host DB without registering
+// with the relay. Unlike startup it refuses to archive an incompatible DB;
+// admin commands must never move data out of the way.
+func openHostDatabaseForAdmin() (*HostConfig, func(), error) {
+	cfg, err := loadExistingConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("no usable host config (run the host once first): %w", err)
+	}
+	currentHostUUID = cfg.UUID
+	runtimeHostConfig.Store(cfg)
+
+	if usingPostgresStore() {
+		store, err := openPostgresHostStore(hostDatabaseURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		hostStore = store
+		if err := ensureOfficialSpace(); err != nil {
+			store.Close()
+			return nil, nil, err
+		}
+		return cfg, func() { _ = store.Close() }, nil
+	}
+
+	if _, err := os.Stat(cfg.DBFile); err != nil {
+		return nil, nil, fmt.Errorf("host database not found at %s: %w", cfg.DBFile, err)
+	}
+	conn, err := db.InitSQLite(cfg.DBFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open host database: %w", err)
+	}
+	incompatible, reason, err := hasIncompatibleHostSchema(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if incompatible {
+		conn.Close()
+		return nil, nil, fmt.Errorf("host database has an incompatible schema: %s", reason)
+	}
+
+	if err := migrateHostDatabase(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	db.ChatDB = conn
+	hostStore = newSQLiteHostStore(conn)
+	if err := ensureOfficialSpace(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return cfg, func() { _ = conn.Close() }, nil
+}
+
+// resolveAdminActor enforces the same author check as the websocket handlers
+// when --as is given. --force is the operator override for spaces whose
+// author has lost their keys; it returns no actor.
+func resolveAdminActor(spaceUUID, asPublicKey string, force bool) (DashDataUser, error) {
+	asPublicKey = strings.TrimSpace(asPublicKey)
+	if asPublicKey == "" {
+		if !force {
+			return DashDataUser{}, fmt.Errorf("%w: pass --as <author-pubkey> or --force", errUsage)
+		}
+		return DashDataUser{}, spaceExists(spaceUUID)
+	}
+	actor, err := lookupHostUserByPublicKey(asPublicKey)
+	if err != nil {
+		return DashDataUser{}, fmt.Errorf("unknown --as user: %w", err)
+	}
+	if err := ensureSpaceAuthor(spaceUUID, actor.ID); err != nil {
+		return DashDataUser{}, fmt.Errorf("not allowed: %w", err)
+	}
+	return actor, nil
+}
+
+// cliAuditDetails marks audit entries written by admin commands.
+func cliAuditDetails(force bool, details map[string]string) map[string]string {
+	details["via"] = "cli"
+	if force {
+		details["forced"] = "true"
+	}
+	return details
+}
+
+func spaceExists(spaceUUID string) error {
+	_, err := hostStore.Space(spaceUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("space not found")
+	}
+	return err
+}
+
+func cliSpacesList(args []string) error {
+	fs := flag.NewFlagSet("spaces list", flag.ContinueOnError)
+	userKey := fs.String("user", "", "only list spaces this public key belongs to")
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	_, closeDB, err := openHostDatabaseForAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	var spaces []DashDataSpace
+	if strings.TrimSpace(*userKey) != "" {
+		user, err := lookupHostUserByPublicKey(*userKey)
+		if err != nil {
+			return fmt.Errorf("user not found: %w", err)
+		}
+		spaces, err = GetUserSpaces(user.ID)
+		if err != nil {
+			return err
+		}
+	} else {
+		spaces, err = hostStore.ListSpaces()
+		if err != nil {
+			return err
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "UUID\tNAME\tAUTHOR\tCHANNELS\tMEMBERS")
+	for i := range spaces {
+		AppendspaceChannelsAndUsers(&spaces[i])
+		author := "-"
+		if user, err := lookupHostUserByID(spaces[i].AuthorID); err == nil {
+			author = user.Username
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", spaces[i].UUID, spaces[i].Name, author, len(spaces[i].Channels), len(spaces[i].Users))
+	}
+	return tw.Flush()
+}
+
+func cliSpacesExport(args []string) error {
+	fs := flag.NewFlagSet("spaces export", flag.ContinueOnError)
+	positional, err := parseCommandFlags(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	spaceUUID, path := positional[0], positional[1]
+
+	_, closeDB, err := openHostDatabaseForAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	archive, err := buildSpaceArchive(spaceUUID)
+	if err != nil {
+		return err
+	}
+	if err := writeSpaceArchiveFile(path, archive); err != nil {
+		return err
+	}
+	recordAudit(spaceUUID, DashDataUser{}, auditActionExportSpace, cliAuditDetails(false, spaceArchiveAuditDetails(archive)))
+	fmt.Printf("Exported space %s (%d channels, %d messages, %d users) to %s\n",
+		spaceUUID, len(archive.Channels), archive.messageCount(), len(archive.Users), path)
+	return nil
+}
+
+func cliSpacesImport(args []string) error {
+	fs := flag.NewFlagSet("spaces import", flag.ContinueOnError)
+	signingKey := fs.String("signing-key", "", "old host signing public key the archive must be signed with (required)")
+	positional, err := parseCommandFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	archive, err := readSpaceArchiveFile(positional[0])
+	if err != nil {
+		return err
+	}
+	// The archive signature alone only proves the file is intact; anyone
+	// can sign an archive with a key of their own.
+	key := strings.TrimSpace(*signingKey)
+	if key == "" {
+		return fmt.Errorf("--signing-key is required: this archive claims to come from host %s and is signed by %s; compare that with `config show` on the old host",
+			archive.SourceHostUUID, archive.SigningPublicKey)
+	}
+	if key != archive.SigningPublicKey {
+		return fmt.Errorf("archive was signed by %s, not the expected key", archive.SigningPublicKey)
+	}
+
+	_, closeDB, err := openHostDatabaseForAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	if err := importSpaceArchive(archive); err != nil {
+		return err
+	}
+	recordAudit(archive.Space.UUID, DashDataUser{}, auditActionImportSpace, cliAuditDetails(false, spaceArchiveAuditDetails(archive)))
+	fmt.Printf("Imported space %s (%s) from host %s: %d channels, %d messages\n  signed by: %s\n",
+		archive.Space.UUID, archive.Space.Name, archive.SourceHostUUID, len(archive.Channels), archive.messageCount(), archive.SigningPublicKey)
+	return nil
+}
+
+func cliChannelsCreate(args []string) error {
+	fs := flag.NewFlagSet("channels create", flag.ContinueOnError)
+	voice := fs.Bool("voice", false, "allow voice in the channel")
+	asKey := fs.String("as", "", "act as this space author public key")
+	force := fs.Bool("force", false, "skip the author check (host operator override)")
+	positional, err := parseCommandFlags(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	spaceUUID, name := positional[0], strings.TrimSpace(positional[1])
+	if name == "" {
+		return fmt.Errorf("%w: channel name cannot be empty", errUsage)
+	}
+
+	_, closeDB, err := openHostDatabaseForAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	actor, err := resolveAdminActor(spaceUUID, *asKey, *force)
+	if err != nil {
+		return err
+	}
+
+	allowVoice := 0
+	if *voice {
+		allowVoice = 1
+	}
+	channel, err := hostStore.CreateChannel(DashDataChannel{
+		UUID:       uuid.NewString(),
+		Name:       name,
+		SpaceUUID:  spaceUUID,
+		AllowVoice: allowVoice,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create channel: %w", err)
+	}
+	recordAudit(spaceUUID, actor, auditActionCreateChannel, cliAuditDetails(*force, map[string]string{
+		"channel_uuid": channel.UUID,
+		"name":         channel.Name,
+	}))
+	fmt.Printf("Created channel %q (%s) in space %s\n", channel.Name, channel.UUID, channel.SpaceUUID)
+	return nil
+}
+
+func cliMembersList(args []string) error {
+	fs := flag.NewFlagSet("members list", flag.ContinueOnError)
+	positional, err := parseCommandFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	spaceUUID := positional[0]
+
+	_, closeDB, err := openHostDatabaseForAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	space, err := hostStore.Space(spaceUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("space not found")
+	}
+	if err != nil {
+		return err
+	}
+	AppendspaceChannelsAndUsers(&space)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSERNAME\tROLE\tPUBLIC KEY")
+	for _, user := range space.Users {
+		role := "member"
+		if user.ID == space.AuthorID {
+			role = "author"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", user.ID, user.Username, role, user.PublicKey)
+	}
+	return tw.Flush()
+}
+
+func cliMembersRemove(args []string) error {
+	fs := flag.NewFlagSet("members remove", flag.ContinueOnError)
+	ban := fs.Bool("ban", false, "also keep the key out of the space")
+	asKey := fs.String("as", "", "act as this space author public key")
+	force := fs.Bool("force", false, "skip the author check (host operator override)")
+	positional, err := parseCommandFlags(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	spaceUUID, publicKey := positional[0], strings.TrimSpace(positional[1])
+	if publicKey == "" {
+		return fmt.Errorf("%w: public key cannot be empty", errUsage)
+	}
+
+	_, closeDB, err := openHostDatabaseForAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	actor, err := resolveAdminActor(spaceUUID, *asKey, *force)
+	if err != nil {
+		return err
+	}
+	space, err := hostStore.Space(spaceUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("space not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load space: %w", err)
+	}
+	// A key that has never connected to this host can still be banned, as
+	// with a moderation report.
+	target, lookupErr := lookupHostUserByPublicKey(publicKey)
+	if lookupErr != nil && !*ban {
+		return fmt.Errorf("user not found: %w", lookupErr)
+	}
+	if lookupErr == nil && space.AuthorID == target.ID {
+		return fmt.Errorf("cannot remove the space author")
+	}
+
+	details := map[string]string{"user_public_key": publicKey}
+	if *ban {
+		// The ban goes first so the key stays out even if removal fails.
+		if err := hostStore.BanKey(spaceUUID, publicKey, actor.ID); err != nil && !errors.Is(err, errStoreConflict) {
+			return fmt.Errorf("failed to ban key: %w", err)
+		}
+		details["banned"] = "true"
+	}
+	if lookupErr == nil {
+		err = hostStore.RemoveMember(spaceUUID, target.ID)
+		if errors.Is(err, sql.ErrNoRows) && !*ban {
+			return fmt.Errorf("%s is not a member of %s", target.Username, spaceUUID)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to remove member: %w", err)
+		}
+	}
+	recordAudit(spaceUUID, actor, auditActionRemoveSpaceUser, cliAuditDetails(*force, details))
+	if *ban {
+		fmt.Printf("Banned %s from space %s\n", publicKey, spaceUUID)
+		return nil
+	}
+	fmt.Printf("Removed %s from space %s\n", target.Username, spaceUUID)
+	return nil
+}
+
+func cliAuditVerify(args []string) error {
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	positional, err := parseCommandFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	spaceUUID := positional[0]
+
+	_, closeDB, err := openHostDatabaseForAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	chain, err := loadAuditChain(spaceUUID)
+	if err != nil {
+		return err
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("no audit entries for space %s", spaceUUID)
+	}
+	if err := verifyAuditChain(chain); err != nil {
+		return fmt.Errorf("audit log of %s failed verification: %w", spaceUUID, err)
+	}
+	fmt.Printf("Verified %d audit entries for space %s\n  head: %s\n", len(chain), spaceUUID, chain[len(chain)-1].Hash)
+	return nil
+}
+
+func cliUsersShow(args []string) error {
+	fs := flag.NewFlagSet("users show", flag.ContinueOnError)
+	positional, err := parseCommandFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	_, closeDB, err := openHostDatabaseForAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	user, err := lookupHostUserByPublicKey(positional[0])
+	if err != nil {
+		return fmt.Errorf("user not found: %w", err)
+	}
+	spaces, err := GetUserSpaces(user.ID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("ID:             %d\n", user.ID)
+	fmt.Printf("Username:       %s\n", user.Username)
+	fmt.Printf("Public key:     %s\n", user.PublicKey)
+	fmt.Printf("Enc public key: %s\n", user.EncPublicKey)
+	fmt.Println("Spaces:")
+	if len(spaces) == 0 {
+		fmt.Println("  (none)")
+	}
+	for _, space := range spaces {
+		role := "member"
+		if space.AuthorID == user.ID {
+			role = "author"
+		}
+		fmt.Printf("  %s  %s (%s)\n", space.UUID, space.Name, role)
+	}
+	return nil
+}
+
+func cliConfigShow(args []string) error {
+	fs := flag.NewFlagSet("config show", flag.ContinueOnError)
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	cfg, err := loadExistingConfig()
+	if err != nil {
+		return fmt.Errorf("no usable host config: %w", err)
+	}
+	configPath, err := getAppSupportPathFor(configFileName)
+	if err != nil {
+		return err
+	}
+
+	redacted := *cfg
+	if redacted.SigningPrivateKey != "" {
+		redacted.SigningPrivateKey = "(redacted)"
+	}
+	if redacted.PendingSigningPrivateKey != "" {
+		redacted.PendingSigningPrivateKey = "(redacted)"
+	}
+	out, err := json.MarshalIndent(struct {
+		ConfigPath string `json:"config_path"`
+		RelayURL   string `json:"relay_url"`
+		*HostConfig
+	}{
+		ConfigPath: configPath,
+		RelayURL:   relayBaseURL.String(),
+		HostConfig: &redacted,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func readPassphraseFile(path string) (string, error) {
+	if path == "" {
+		return backupPassphrase, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase file: %w", err)
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file %s is empty", path)
+	}
+	return passphrase, nil
+}
+
+func cliBackup(args []string) error {
+	opts, _, err := backupOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dir := fs.String("dir", opts.Dir, "backup directory")
+	keep := fs.Int("keep", opts.Keep, "number of backups to keep (0 keeps all)")
+	passphraseFile := fs.String("passphrase-file", "", "file containing the encryption passphrase")
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *keep < 0 {
+		return fmt.Errorf("%w: --keep cannot be negative", errUsage)
+	}
+	if usingPostgresStore() {
+		return errPostgresBackup
+	}
+	opts.Dir = *dir
+	opts.Keep = *keep
+	if opts.Passphrase, err = readPassphraseFile(*passphraseFile); err != nil {
+		return err
+	}
+
+	cfg, closeDB, err := openHostDatabaseForAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	path, err := createHostBackup(db.ChatDB, cfg.DBFile, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
+
+func cliRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	passphraseFile := fs.String("passphrase-file", "", "file containing the encryption passphrase")
+	positional, err := parseCommandFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if usingPostgresStore() {
+		return errPostgresBackup
+	}
+	passphrase, err := readPassphraseFile(*passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadExistingConfig()
+	if err != nil {
+		return fmt.Errorf("no usable host config (run the host once first): %w", err)
+	}
+	previous, err := restoreHostBackup(positional[0], cfg.DBFile, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s from %s\n", cfg.DBFile, positional[0])
+	if previous != "" {
+		fmt.Printf("Previous database kept at %s\n", previous)
+	}
+	return nil
+}
+
+func cliRotateKey(args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	discardPending := fs.Bool("discard-pending", false, "drop an unconfirmed pending key instead of retrying it")
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	cfg, err := loadExistingConfig()
+	if err != nil {
+		return fmt.Errorf("no usable host config (run the host once first): %w", err)
+	}
+	if *discardPending {
+		if cfg.PendingSigningPublicKey == "" {
+			fmt.Println("No pending signing key")
+			return nil
+		}
+		cfg.PendingSigningPublicKey = ""
+		cfg.PendingSigningPrivateKey = ""
+		if err := saveConfig(cfg); err != nil {
+			return err
+		}
+		fmt.Println("Discarded pending signing key")
+		return nil
+	}
+
+	previous := cfg.SigningPublicKey
+	if err := rotateHostSigningKey(cfg); err != nil {
+		return err
+	}
+	fmt.Printf("Rotated host signing key\n  old: %s\n  new: %s\n", previous, cfg.SigningPublicKey)
+	return nil
+}
+
+func cliRelayShow(args []string) error {
+	fs := flag.NewFlagSet("relay show", flag.ContinueOnError)
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	cfg, err := loadExistingConfig()
+	if err != nil {
+		return fmt.Errorf("no usable host config (run the host once first): %w", err)
+	}
+	info, err := fetchRelayHostInfo(cfg.UUID)
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func cliRelayUpdate(args []string) error {
+	fs := flag.NewFlagSet("relay update", flag.ContinueOnError)
+	name := fs.String("name", "", "new host name")
+	description := fs.String("description", "", "host description shown to users")
+	iconURL := fs.String("icon-url", "", "https URL of the host icon (empty string clears it)")
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	// Only send the fields that were given; the software version always is.
+	version := hostSoftwareVersion
+	req := UpdateHostRequest{SoftwareVersion: &version}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			req.Name = name
+		case "description":
+			req.Description = description
+		case "icon-url":
+			req.IconURL = iconURL
+		}
+	})
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		return fmt.Errorf("%w: --name cannot be empty", errUsage)
+	}
+
+	cfg, err := loadExistingConfig()
+	if err != nil {
+		return fmt.Errorf("no usable host config (run the host once first): %w", err)
+	}
+	info, err := updateHostOnRelay(cfg, req)
+	if err != nil {
+		return err
+	}
+	// Registration on startup sends the configured name, so keep it in sync.
+	if cfg.Name != info.Name {
+		cfg.Name = info.Name
+		if err := saveConfig(cfg); err != nil {
+			return fmt.Errorf("relay updated the host but saving the config failed: %w", err)
+		}
+	}
+	fmt.Printf("Updated %s (%s)\n", info.Name, info.UUID)
+	return nil
+}
+
+func cliRelayDeregister(args []string) error {
+	fs := flag.NewFlagSet("relay deregister", flag.ContinueOnError)
+	confirm := fs.Bool("yes", false, "confirm deregistration")
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	cfg, err := loadExistingConfig()
+	if err != nil {
+		return fmt.Errorf("no usable host config (run the host once first): %w", err)
+	}
+	if !*confirm {
+		return fmt.Errorf("%w: deregistering %s removes it from the relay for good; pass --yes to confirm", errUsage, cfg.UUID)
+	}
+	if err := deregisterHostFromRelay(cfg); err != nil {
+		return err
+	}
+
+	// Keep the old config (and its keys) aside so the next run starts fresh
+	// instead of silently registering the same UUID again.
+	configPath, err := getAppSupportPathFor(configFileName)
+	if err != nil {
+		return err
+	}
+	archived := fmt.Sprintf("%s.deregistered.%s", configPath, time.Now().UTC().Format("20060102_150405"))
+	if err := os.Rename(configPath, archived); err != nil {
+		return fmt.Errorf("relay deregistered the host but archiving the config failed: %w", err)
+	}
+	fmt.Printf("Deregistered %s; previous config kept at %s\n", cfg.UUID, archived)
+	fmt.Println("The host database was left in place.")
+	return nil
+}
+
+func cliInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	nonInteractive := fs.Bool("non-interactive", false, "never prompt; print the result as JSON")
+	name := fs.String("name", hostNameSetting, "host name")
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	// An existing config is reported as-is so provisioning scripts can rerun.
+	cfg, err := loadExistingConfig()
+	created := false
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("existing host config is unusable: %w", err)
+	}
+	if err != nil {
+		hostName := strings.TrimSpace(*name)
+		if hostName == "" {
+			if *nonInteractive || !stdinIsTerminal() {
+				return fmt.Errorf("%w: init needs --name or HOST_NAME", errUsage)
+			}
+			hostName = promptInput("Enter a name for this host: ")
+			if hostName == "" {
+				return fmt.Errorf("host name cannot be empty")
+			}
+		}
+		if cfg, err = provisionHostConfig(hostName); err != nil {
+			return err
+		}
+		created = true
+	}
+
+	configPath, err := getAppSupportPathFor(configFileName)
+	if err != nil {
+		return err
+	}
+	if !*nonInteractive {
+		if created {
+			fmt.Printf("Registered host %s (%s)\n", cfg.Name, cfg.UUID)
+		} else {
+			fmt.Printf("Host %s (%s) is already initialized\n", cfg.Name, cfg.UUID)
+		}
+		fmt.Printf("Signing public key: %s\nConfig: %s\n", cfg.SigningPublicKey, configPath)
+		return nil
+	}
+
+	out, err := json.MarshalIndent(struct {
+		UUID             string `json:"uuid"`
+		Name             string `json:"name"`
+		SigningPublicKey string `json:"signing_public_key"`
+		ConfigPath       string `json:"config_path"`
+		DBFile           string `json:"db_file"`
+		RelayURL         string `json:"relay_url"`
+		Created          bool   `json:"created"`
+	}{
+		UUID:             cfg.UUID,
+		Name:             cfg.Name,
+		SigningPublicKey: cfg.SigningPublicKey,
+		ConfigPath:       configPath,
+		DBFile:           cfg.DBFile,
+		RelayURL:         relayBaseURL.String(),
+		Created:          created,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
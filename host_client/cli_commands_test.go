@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gochat/db"
+)
+
+// useAdminHost points the admin commands at a fresh config directory holding
+// a host config and a DB with one space, its author and a member. It returns
+// a function that reopens the DB so a test can check what a command wrote.
+func useAdminHost(t *testing.T) func() HostStore {
+	t.Helper()
+	previousDir, previousDBFile, previousURL := hostConfigDir, hostDBFile, hostDatabaseURL
+	previousStore, previousChatDB, previousUUID := hostStore, db.ChatDB, currentHostUUID
+	previousConfig := runtimeHostConfig.Load()
+	t.Cleanup(func() {
+		hostConfigDir, hostDBFile, hostDatabaseURL = previousDir, previousDBFile, previousURL
+		hostStore, db.ChatDB, currentHostUUID = previousStore, previousChatDB, previousUUID
+		runtimeHostConfig.Store(previousConfig)
+	})
+	hostConfigDir, hostDBFile, hostDatabaseURL = t.TempDir(), "", ""
+
+	if err := os.WriteFile(filepath.Join(hostConfigDir, configFileName), []byte(`{"uuid":"host-1","name":"Host"}`), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	dbPath := filepath.Join(hostConfigDir, dbName)
+	conn, err := openHostDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("open host DB: %v", err)
+	}
+	store := newSQLiteHostStore(conn)
+	author, _ := store.UpsertUser("pub-author", "enc-author", "Author")
+	member, _ := store.UpsertUser("pub-member", "enc-member", "Member")
+	if _, err := store.UpsertUser("pub-outsider", "enc-outsider", "Outsider"); err != nil {
+		t.Fatalf("seed users: %v", err)
+	}
+	if _, err := store.CreateSpace("space-1", "Space One", author.ID); err != nil {
+		t.Fatalf("create space: %v", err)
+	}
+	if err := store.AddMember("space-1", member.ID); err != nil {
+		t.Fatalf("add member: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close host DB: %v", err)
+	}
+
+	return func() HostStore {
+		t.Helper()
+		conn, err := openHostDatabase(dbPath)
+		if err != nil {
+			t.Fatalf("reopen host DB: %v", err)
+		}
+		store := newSQLiteHostStore(conn)
+		t.Cleanup(func() { _ = store.Close() })
+		hostStore = store
+		return store
+	}
+}
+
+func TestAdminCommandArgumentValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"unknown command", []string{"channel"}},
+		{"missing subcommand", []string{"members"}},
+		{"unknown subcommand", []string{"channels", "rename"}},
+		{"channels create without a name", []string{"channels", "create", "space-1"}},
+		{"channels create with a blank name", []string{"channels", "create", "space-1", "  ", "--force"}},
+		{"channels create with an extra argument", []string{"channels", "create", "space-1", "general", "extra"}},
+		{"channels create with an unknown flag", []string{"channels", "create", "space-1", "general", "--video"}},
+		{"members list without a space", []string{"members", "list"}},
+		{"members remove without a key", []string{"members", "remove", "space-1"}},
+		{"members remove with a blank key", []string{"members", "remove", "space-1", " ", "--force"}},
+		{"members remove with a valued --ban", []string{"members", "remove", "space-1", "pub-member", "--ban=maybe"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// All of these fail before the host DB is opened.
+			if err := runCommand(tc.args); !errors.Is(err, errUsage) {
+				t.Fatalf("expected a usage error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAdminCommandsRefuseUnauthorisedChanges(t *testing.T) {
+	reopen := useAdminHost(t)
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"no --as or --force", []string{"channels", "create", "space-1", "general"}, "--as <author-pubkey> or --force"},
+		{"--as a member", []string{"channels", "create", "space-1", "general", "--as", "pub-member"}, "not allowed"},
+		{"--as an unknown key", []string{"members", "remove", "space-1", "pub-member", "--as", "pub-nobody"}, "unknown --as user"},
+		{"unknown space", []string{"channels", "create", "space-9", "general", "--force"}, "space not found"},
+		{"removing the author", []string{"members", "remove", "space-1", "pub-author", "--force"}, "cannot remove the space author"},
+		{"banning the author", []string{"members", "remove", "--ban", "space-1", "pub-author", "--force"}, "cannot remove the space author"},
+		{"removing a non-member", []string{"members", "remove", "space-1", "pub-outsider", "--force"}, "not a member"},
+		{"removing an unknown key", []string{"members", "remove", "space-1", "pub-nobody", "--force"}, "user not found"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := runCommand(tc.args)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	store := reopen()
+	if channels, err := store.SpaceChannels("space-1"); err != nil || len(channels) != 0 {
+		t.Fatalf("expected no channels created, got %+v, %v", channels, err)
+	}
+	member, _ := store.UserByPublicKey("pub-member")
+	if _, err := store.Membership("space-1", member.ID); err != nil {
+		t.Fatalf("expected the member kept: %v", err)
+	}
+	if banned, _ := store.IsKeyBanned("space-1", "pub-author"); banned {
+		t.Fatal("expected the author not banned")
+	}
+	if chain, err := loadAuditChain("space-1"); err != nil || len(chain) != 0 {
+		t.Fatalf("expected no audit entries for refused commands, got %d, %v", len(chain), err)
+	}
+}
+
+func TestAdminCommandStoreEffects(t *testing.T) {
+	reopen := useAdminHost(t)
+	run := func(args ...string) {
+		t.Helper()
+		if err := runCommand(args); err != nil {
+			t.Fatalf("%s: %v", strings.Join(args, " "), err)
+		}
+	}
+
+	run("channels", "create", "space-1", " general ", "--as", "pub-author")
+	run("channels", "create", "--voice", "space-1", "lounge", "--force")
+	run("members", "remove", "space-1", "pub-member", "--as", "pub-author")
+	run("members", "remove", "space-1", "pub-outsider", "--ban", "--force")
+	// A key that never reached this host can be banned ahead of time, and
+	// banning twice is not an error.
+	run("members", "remove", "space-1", "pub-stranger", "--ban", "--force")
+	run("members", "remove", "space-1", "pub-stranger", "--ban", "--force")
+
+	store := reopen()
+	channels, err := store.SpaceChannels("space-1")
+	if err != nil || len(channels) != 2 {
+		t.Fatalf("expected two channels, got %+v, %v", channels, err)
+	}
+	voice := map[string]int{}
+	for _, channel := range channels {
+		voice[channel.Name] = channel.AllowVoice
+	}
+	if len(voice) != 2 || voice["general"] != 0 || voice["lounge"] != 1 {
+		t.Fatalf("unexpected channels %+v", channels)
+	}
+
+	member, _ := store.UserByPublicKey("pub-member")
+	if _, err := store.Membership("space-1", member.ID); err == nil {
+		t.Fatal("expected the member removed")
+	}
+	for key, want := range map[string]bool{"pub-member": false, "pub-outsider": true, "pub-stranger": true} {
+		if banned, err := store.IsKeyBanned("space-1", key); err != nil || banned != want {
+			t.Fatalf("%s: expected banned=%v, got %v, %v", key, want, banned, err)
+		}
+	}
+
+	chain, err := loadAuditChain("space-1")
+	if err != nil {
+		t.Fatalf("load audit chain: %v", err)
+	}
+	if err := verifyAuditChain(chain); err != nil {
+		t.Fatalf("verify audit chain: %v", err)
+	}
+	var actions []string
+	for _, entry := range chain {
+		actions = append(actions, entry.Action+":"+entry.Details["via"]+":"+entry.Details["forced"]+":"+entry.Details["banned"])
+	}
+	want := []string{
+		"create_channel:cli::",
+		"create_channel:cli:true:",
+		"remove_space_user:cli::",
+		"remove_space_user:cli:true:true",
+		"remove_space_user:cli:true:true",
+		"remove_space_user:cli:true:true",
+	}
+	if strings.Join(actions, " ") != strings.Join(want, " ") {
+		t.Fatalf("unexpected audit entries:\n%s\nwant:\n%s", strings.Join(actions, "\n"), strings.Join(want, "\n"))
+	}
+	if chain[0].ActorPublicKey != "pub-author" || chain[1].ActorPublicKey != "" {
+		t.Fatalf("expected --as recorded as the actor and --force as none, got %q and %q", chain[0].ActorPublicKey, chain[1].ActorPublicKey)
+	}
+}
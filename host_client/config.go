@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"net/url"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // dev
@@ -24,6 +28,45 @@ var relayWSScheme = envOrDefault("CHAT_RELAY_WS_SCHEME", "wss")
 var relayBaseURL = url.URL{Scheme: relayScheme, Host: relayHost, Path: ""}
 var wsRelayURL = url.URL{Scheme: relayWSScheme, Host: relayHost, Path: "/ws"}
 
+// Full relay URL, e.g. https://chat.example.com. Overrides the three
+// CHAT_RELAY_* settings above when set.
+var relayURLSetting = envOrDefault("CHAT_RELAY_URL", "")
+
+// Headless provisioning; each has a matching global flag. HOST_NAME and the
+// signing key are only used when no host config exists yet.
+var hostConfigDir = envOrDefault("HOST_CONFIG_DIR", "")
+var hostDBFile = envOrDefault("HOST_CHAT_DB_FILE", "")
+var hostNameSetting = envOrDefault("HOST_NAME", "")
+var hostSigningKeyFile = envOrDefault("HOST_SIGNING_KEY_FILE", "")
+var hostSigningPrivateKey = envOrDefault("HOST_SIGNING_PRIVATE_KEY", "")
+
+// PostgreSQL connection URL, e.g. postgres://parch@db/parch?sslmode=disable.
+// When set the host stores everything there instead of the SQLite file.
+var hostDatabaseURL = envOrDefault("HOST_DATABASE_URL", "")
+
+func setRelayURL(raw string) error {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || parsed.Host == "" {
+		return fmt.Errorf("invalid relay URL %q", raw)
+	}
+	var wsScheme string
+	switch parsed.Scheme {
+	case "https":
+		wsScheme = "wss"
+	case "http":
+		wsScheme = "ws"
+	default:
+		return fmt.Errorf("relay URL %q must use http or https", raw)
+	}
+
+	relayHost = parsed.Host
+	relayScheme = parsed.Scheme
+	relayWSScheme = wsScheme
+	relayBaseURL = url.URL{Scheme: relayScheme, Host: relayHost, Path: ""}
+	wsRelayURL = url.URL{Scheme: relayWSScheme, Host: relayHost, Path: "/ws"}
+	return nil
+}
+
 // Use a dedicated v2 host DB file so legacy chat DB data cannot conflict with
 // the decentralized host schema bootstrap.
 var dbName = "host_chat_v2.db"
@@ -38,8 +81,43 @@ var officialSpaceName = envOrDefault("OFFICIAL_SPACE_NAME", "Parch Community")
 
 var officialSpaceChannels = []string{"general", "feedback", "announcements"}
 
+// Local bot API listen address, e.g. 127.0.0.1:8787. Disabled when empty.
+var botAPIAddr = envOrDefault("HOST_BOT_API_ADDR", "")
+
+// Token for the bot API's management endpoints. When empty, one is generated
+// into bot_api_admin_token in the host config directory.
+var botAPIAdminToken = envOrDefault("HOST_BOT_API_ADMIN_TOKEN", "")
+
+// Scheduled backups, e.g. HOST_BACKUP_INTERVAL=6h. Disabled when empty.
+// HOST_BACKUP_DIR defaults to a backups folder next to the host config.
+var backupInterval = envOrDefault("HOST_BACKUP_INTERVAL", "")
+var backupDir = envOrDefault("HOST_BACKUP_DIR", "")
+var backupKeep = envOrDefault("HOST_BACKUP_KEEP", "7")
+var backupPassphrase = envOrDefault("HOST_BACKUP_PASSPHRASE", "")
+
+// Relay requests run on a bounded worker pool; see relay_dispatch.go.
+const defaultRequestWorkers = 8
+const defaultMaxPendingRequests = 512
+
+var requestWorkers = envOrDefault("HOST_REQUEST_WORKERS", "")
+var maxPendingRequests = envOrDefault("HOST_MAX_PENDING_REQUESTS", "")
+
+// The request metrics are logged on this interval; "0" turns that off.
+const defaultRequestMetricsInterval = 5 * time.Minute
+
+var requestMetricsInterval = envOrDefault("HOST_REQUEST_METRICS_INTERVAL", "")
+
+// Keepalive toward the relay; see relay_dispatch.go.
+const defaultRelayPingInterval = 25 * time.Second
+const defaultRelayPongTimeout = 60 * time.Second
+
+var relayPingInterval = envOrDefault("HOST_RELAY_PING_INTERVAL", "")
+var relayPongTimeout = envOrDefault("HOST_RELAY_PONG_TIMEOUT", "")
+
 var currentHostUUID string
-var runtimeHostConfig *HostConfig
+
+// runtimeHostConfig is swapped by key rotation while request workers read it.
+var runtimeHostConfig atomic.Pointer[HostConfig]
 
 func isOfficialHostInstance() bool {
 	if officialHostUUID == "" {
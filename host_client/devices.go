@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+)
+
+// keyedDevicePrefix marks device IDs the relay derived from a device key
+// the identity certified.
+const keyedDevicePrefix = "key-"
+
+func handleListDevices(conn *relayConn, wsMsg *WSMessage) {
+	data, err := decodeData[ListDevicesRequest](wsMsg.Data)
+	if err != nil {
+		log.Println("error decoding list_devices_request:", err)
+		return
+	}
+
+	user, err := resolveHostUserIdentity(data.UserID, data.UserPublicKey, data.UserEncPublicKey, data.Username)
+	if err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Failed to resolve user identity", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	devices, err := hostStore.UserDevices(user.ID)
+	if err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Database failed to list devices", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	sendToConn(conn, WSMessage{
+		Type: "list_devices_response",
+		Data: ListDevicesResponse{Devices: devices, ClientUUID: data.ClientUUID},
+	})
+}
+
+func handleRevokeDevice(conn *relayConn, wsMsg *WSMessage) {
+	data, err := decodeData[RevokeDeviceRequest](wsMsg.Data)
+	if err != nil {
+		log.Println("error decoding revoke_device_request:", err)
+		return
+	}
+	deviceID := strings.TrimSpace(data.DeviceID)
+	if deviceID == "" {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Missing device id", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	user, err := resolveHostUserIdentity(data.UserID, data.UserPublicKey, data.UserEncPublicKey, data.Username)
+	if err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Failed to resolve user identity", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	err = hostStore.RevokeDevice(user.ID, deviceID)
+	if err != nil && err != sql.ErrNoRows {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Database failed to revoke device", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if err == sql.ErrNoRows {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Device not found or already revoked", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	sendToConn(conn, WSMessage{
+		Type: "revoke_device_response",
+		Data: RevokeDeviceResponse{DeviceID: deviceID, ClientUUID: data.ClientUUID},
+	})
+	sendDeviceDenyList(conn)
+}
+
+// sendDeviceDenyList pushes every revoked device to the relay, which refuses
+// them at sign-in and drops their live sessions, along with the identities
+// that must sign in with a device key. The full list is sent each time so a
+// relay that restarted catches up on the next host_auth_success.
+func sendDeviceDenyList(conn *relayConn) {
+	revoked, err := hostStore.RevokedDevices()
+	if err != nil {
+		log.Println("Error loading revoked devices:", err)
+		return
+	}
+	keyed, err := hostStore.KeyedDeviceIdentities()
+	if err != nil {
+		log.Println("Error loading keyed device identities:", err)
+		return
+	}
+	sendToConn(conn, WSMessage{
+		Type: "device_deny_list",
+		Data: DeviceDenyList{Devices: revoked, KeyedIdentities: keyed},
+	})
+}
+
+// isKeyedDeviceID reports whether the relay derived deviceID from a device
+// key the identity certified. The relay never passes the prefix through
+// from unkeyed sessions.
+func isKeyedDeviceID(deviceID string) bool {
+	return strings.HasPrefix(deviceID, keyedDevicePrefix)
+}
+
+// hasKeyedDevice reports whether userID has already registered a device key.
+func hasKeyedDevice(userID int) (bool, error) {
+	devices, err := hostStore.UserDevices(userID)
+	if err != nil {
+		return false, err
+	}
+	for _, device := range devices {
+		if isKeyedDeviceID(device.DeviceID) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Mirrors web_client/frontend/js/lib/e2ee.js. Any change to field order,
+// key derivation labels or encodings here must be made there as well.
+const (
+	envelopeVersion   = 1
+	envelopeAlgorithm = "p256-hkdf-aesgcm+ed25519"
+
+	// Version 2 envelopes use per-channel sender keys. A "sender_key"
+	// envelope wraps the sender's chain key for every member; "message"
+	// envelopes carry only ciphertext and the epoch of that chain key.
+	envelopeVersionSenderKey = 2
+	envelopeKindSenderKey    = "sender_key"
+	envelopeKindMessage      = "message"
+
+	// Version 3 is version 2 with its wrapped keys sorted by code unit
+	// instead of localeCompare, which depends on the signer's locale, and
+	// sent in that order.
+	envelopeVersionOrdinal = 3
+)
+
+// wrappedKeyOrder is how a canonical envelope orders its wrapped keys.
+type wrappedKeyOrder int
+
+const (
+	// wrappedKeysLocale is the en-US localeCompare order version 1 and 2
+	// browsers sign.
+	wrappedKeysLocale wrappedKeyOrder = iota
+	// wrappedKeysAsSent keeps the transmitted order, which is what a
+	// version 1 or 2 signer in another locale sorted them into.
+	wrappedKeysAsSent
+	// wrappedKeysOrdinal is the version 3 order.
+	wrappedKeysOrdinal
+)
+
+func isSenderKeyVersion(version int) bool {
+	return version == envelopeVersionSenderKey || version == envelopeVersionOrdinal
+}
+
+// signedWrappedKeyOrders lists the orders a signature over an envelope of
+// version may have been made with, most likely first.
+func signedWrappedKeyOrders(version int) []wrappedKeyOrder {
+	if version == envelopeVersionOrdinal {
+		return []wrappedKeyOrder{wrappedKeysOrdinal}
+	}
+	return []wrappedKeyOrder{wrappedKeysLocale, wrappedKeysAsSent}
+}
+
+func orderWrappedKeys(keys []envelopeWrappedKey, order wrappedKeyOrder) []envelopeWrappedKey {
+	ordered := make([]envelopeWrappedKey, len(keys))
+	copy(ordered, keys)
+	switch order {
+	case wrappedKeysLocale:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return compareLikeLocale(ordered[i].RecipientAuthPublicKey, ordered[j].RecipientAuthPublicKey) < 0
+		})
+	case wrappedKeysOrdinal:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].RecipientAuthPublicKey < ordered[j].RecipientAuthPublicKey
+		})
+	}
+	return ordered
+}
+
+type chatEnvelope struct {
+	Version             int                  `json:"v"`
+	Alg                 string               `json:"alg"`
+	MessageID           string               `json:"message_id"`
+	SenderTimestamp     string               `json:"sender_timestamp"`
+	SpaceUUID           string               `json:"space_uuid"`
+	ChannelUUID         string               `json:"channel_uuid"`
+	SenderAuthPublicKey string               `json:"sender_auth_public_key"`
+	SenderEncPublicKey  string               `json:"sender_enc_public_key"`
+	ContentIV           string               `json:"content_iv"`
+	Ciphertext          string               `json:"ciphertext"`
+	WrappedKeys         []envelopeWrappedKey `json:"wrapped_keys"`
+	Signature           string               `json:"sig,omitempty"`
+}
+
+type envelopeWrappedKey struct {
+	RecipientAuthPublicKey string `json:"recipient_auth_public_key"`
+	IV                     string `json:"iv"`
+	Ciphertext             string `json:"ciphertext"`
+}
+
+// envelopeSender holds the private key material needed to encrypt and sign
+// an envelope on behalf of a host-managed identity.
+type envelopeSender struct {
+	AuthPublicKey string
+	EncPublicKey  string
+	SigningKey    ed25519.PrivateKey
+	EncryptionKey *ecdh.PrivateKey
+}
+
+func encryptEnvelope(sender envelopeSender, spaceUUID, channelUUID, plaintext string, recipients []DashDataUser) (chatEnvelope, error) {
+	if sender.AuthPublicKey == "" || sender.EncPublicKey == "" || sender.SigningKey == nil || sender.EncryptionKey == nil {
+		return chatEnvelope{}, fmt.Errorf("missing sender identity keys")
+	}
+	if spaceUUID == "" || channelUUID == "" {
+		return chatEnvelope{}, fmt.Errorf("missing space/channel context")
+	}
+
+	unique := make([]DashDataUser, 0, len(recipients)+1)
+	seen := make(map[string]struct{}, len(recipients)+1)
+	for _, recipient := range recipients {
+		if recipient.PublicKey == "" || recipient.EncPublicKey == "" {
+			continue
+		}
+		if _, ok := seen[recipient.PublicKey]; ok {
+			continue
+		}
+		seen[recipient.PublicKey] = struct{}{}
+		unique = append(unique, recipient)
+	}
+	if _, ok := seen[sender.AuthPublicKey]; !ok {
+		unique = append(unique, DashDataUser{PublicKey: sender.AuthPublicKey, EncPublicKey: sender.EncPublicKey})
+	}
+
+	messageKey, err := randomBytes(32)
+	if err != nil {
+		return chatEnvelope{}, err
+	}
+	contentIV, contentCipher, err := aesGCMSeal(messageKey, []byte(plaintext))
+	if err != nil {
+		return chatEnvelope{}, err
+	}
+	messageID, err := randomBytes(16)
+	if err != nil {
+		return chatEnvelope{}, err
+	}
+
+	envelope := chatEnvelope{
+		Version:             envelopeVersion,
+		Alg:                 envelopeAlgorithm,
+		MessageID:           base64.RawStdEncoding.EncodeToString(messageID),
+		SenderTimestamp:     time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		SpaceUUID:           spaceUUID,
+		ChannelUUID:         channelUUID,
+		SenderAuthPublicKey: sender.AuthPublicKey,
+		SenderEncPublicKey:  sender.EncPublicKey,
+		ContentIV:           base64.RawStdEncoding.EncodeToString(contentIV),
+		Ciphertext:          base64.RawStdEncoding.EncodeToString(contentCipher),
+		WrappedKeys:         make([]envelopeWrappedKey, 0, len(unique)),
+	}
+
+	for _, recipient := range unique {
+		recipientKey, err := parseEncPublicKey(recipient.EncPublicKey)
+		if err != nil {
+			return chatEnvelope{}, fmt.Errorf("recipient %s: %w", recipient.PublicKey, err)
+		}
+		wrapKey, err := deriveWrapKey(sender.EncryptionKey, recipientKey, envelope)
+		if err != nil {
+			return chatEnvelope{}, err
+		}
+		wrapIV, wrapped, err := aesGCMSeal(wrapKey, messageKey)
+		if err != nil {
+			return chatEnvelope{}, err
+		}
+		envelope.WrappedKeys = append(envelope.WrappedKeys, envelopeWrappedKey{
+			RecipientAuthPublicKey: recipient.PublicKey,
+			IV:                     base64.RawStdEncoding.EncodeToString(wrapIV),
+			Ciphertext:             base64.RawStdEncoding.EncodeToString(wrapped),
+		})
+	}
+
+	// Sending the keys in the order they are signed in lets verifiers whose
+	// localeCompare differs fall back to the transmitted order.
+	envelope.WrappedKeys = orderWrappedKeys(envelope.WrappedKeys, wrappedKeysLocale)
+	canonical, err := canonicalEnvelopeForSignature(envelope, wrappedKeysLocale)
+	if err != nil {
+		return chatEnvelope{}, err
+	}
+	envelope.Signature = base64.RawStdEncoding.EncodeToString(ed25519.Sign(sender.SigningKey, canonical))
+	return envelope, nil
+}
+
+// canonicalEnvelopeForSignature reproduces the browser's
+// JSON.stringify(canonicalEnvelopeForSignature(envelope)) byte for byte, with
+// the wrapped keys in order.
+func canonicalEnvelopeForSignature(envelope chatEnvelope, order wrappedKeyOrder) ([]byte, error) {
+	canonical := envelope
+	canonical.WrappedKeys = orderWrappedKeys(envelope.WrappedKeys, order)
+	canonical.Signature = ""
+	return encodeCanonicalJSON(canonical)
+}
+
+// senderKeyCanonical holds the signed fields every sender-key envelope shares,
+// in the order the browser writes them.
+type senderKeyCanonical struct {
+	Version             int    `json:"v"`
+	Alg                 string `json:"alg"`
+	Kind                string `json:"kind"`
+	MessageID           string `json:"message_id"`
+	SenderTimestamp     string `json:"sender_timestamp"`
+	SpaceUUID           string `json:"space_uuid"`
+	ChannelUUID         string `json:"channel_uuid"`
+	SenderAuthPublicKey string `json:"sender_auth_public_key"`
+	SenderEncPublicKey  string `json:"sender_enc_public_key"`
+	Epoch               int64  `json:"epoch"`
+}
+
+type senderKeyDistributionCanonical struct {
+	senderKeyCanonical
+	WrappedKeys []envelopeWrappedKey `json:"wrapped_keys"`
+}
+
+type senderKeyMessageCanonical struct {
+	senderKeyCanonical
+	ContentIV  string `json:"content_iv"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// receivedEnvelope is an envelope of either version as sent by a client.
+type receivedEnvelope struct {
+	chatEnvelope
+	Kind  string `json:"kind"`
+	Epoch int64  `json:"epoch"`
+}
+
+// canonicalSenderKeyEnvelopeForSignature is the sender-key counterpart of
+// canonicalEnvelopeForSignature. Distributions sign their wrapped keys and
+// messages sign their ciphertext.
+func canonicalSenderKeyEnvelopeForSignature(envelope receivedEnvelope, order wrappedKeyOrder) ([]byte, error) {
+	shared := senderKeyCanonical{
+		Version:             envelope.Version,
+		Alg:                 envelope.Alg,
+		Kind:                envelope.Kind,
+		MessageID:           envelope.MessageID,
+		SenderTimestamp:     envelope.SenderTimestamp,
+		SpaceUUID:           envelope.SpaceUUID,
+		ChannelUUID:         envelope.ChannelUUID,
+		SenderAuthPublicKey: envelope.SenderAuthPublicKey,
+		SenderEncPublicKey:  envelope.SenderEncPublicKey,
+		Epoch:               envelope.Epoch,
+	}
+	if envelope.Kind == envelopeKindSenderKey {
+		wrapped := orderWrappedKeys(envelope.WrappedKeys, order)
+		return encodeCanonicalJSON(senderKeyDistributionCanonical{senderKeyCanonical: shared, WrappedKeys: wrapped})
+	}
+	return encodeCanonicalJSON(senderKeyMessageCanonical{
+		senderKeyCanonical: shared,
+		ContentIV:          envelope.ContentIV,
+		Ciphertext:         envelope.Ciphertext,
+	})
+}
+
+// encodeCanonicalJSON encodes v the way JSON.stringify does for the plain
+// string and number fields envelopes contain.
+func encodeCanonicalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// verifyEnvelope checks a client envelope before the host stores it: the
+// version and algorithm must be known, it must be addressed to the channel
+// it was sent in, and the sender's Ed25519 signature must cover it. Version 1
+// and 2 signatures are tried against the en-US order first and then the
+// order the wrapped keys were sent in.
+func verifyEnvelope(envelopeJSON []byte, spaceUUID, channelUUID string) error {
+	var envelope receivedEnvelope
+	if err := json.Unmarshal(envelopeJSON, &envelope); err != nil {
+		return fmt.Errorf("malformed envelope")
+	}
+	if envelope.Version != envelopeVersion && !isSenderKeyVersion(envelope.Version) {
+		return fmt.Errorf("unsupported envelope version")
+	}
+	if envelope.Alg != envelopeAlgorithm {
+		return fmt.Errorf("unsupported envelope algorithm")
+	}
+	if envelope.SpaceUUID != spaceUUID || envelope.ChannelUUID != channelUUID {
+		return fmt.Errorf("envelope is not addressed to this channel")
+	}
+
+	senderKey, err := base64.RawStdEncoding.DecodeString(envelope.SenderAuthPublicKey)
+	if err != nil || len(senderKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid sender public key")
+	}
+	signature, err := base64.RawStdEncoding.DecodeString(envelope.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid envelope signature")
+	}
+	for _, order := range signedWrappedKeyOrders(envelope.Version) {
+		var canonical []byte
+		if isSenderKeyVersion(envelope.Version) {
+			canonical, err = canonicalSenderKeyEnvelopeForSignature(envelope, order)
+		} else {
+			canonical, err = canonicalEnvelopeForSignature(envelope.chatEnvelope, order)
+		}
+		if err != nil {
+			return fmt.Errorf("malformed envelope")
+		}
+		if ed25519.Verify(ed25519.PublicKey(senderKey), canonical, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid envelope signature")
+}
+
+// compareLikeLocale orders base64 key strings the way the browser's
+// String.prototype.localeCompare does: letters compare case-insensitively
+// after digits and punctuation, and only an all-else-equal tie falls back to
+// lowercase-before-uppercase.
+func compareLikeLocale(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		pa, pb := collationPrimary(a[i]), collationPrimary(b[i])
+		if pa != pb {
+			if pa < pb {
+				return -1
+			}
+			return 1
+		}
+	}
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	for i := 0; i < len(a); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		if a[i] >= 'a' && a[i] <= 'z' {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func collationPrimary(c byte) int {
+	switch {
+	case c == '_':
+		return 1
+	case c == '-':
+		return 2
+	case c == '/':
+		return 3
+	case c == '+':
+		return 4
+	case c == '=':
+		return 5
+	case c >= '0' && c <= '9':
+		return 10 + int(c-'0')
+	case c >= 'a' && c <= 'z':
+		return 20 + int(c-'a')
+	case c >= 'A' && c <= 'Z':
+		return 20 + int(c-'A')
+	default:
+		return 100 + int(c)
+	}
+}
+
+func deriveWrapKey(priv *ecdh.PrivateKey, pub *ecdh.PublicKey, envelope chatEnvelope) ([]byte, error) {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("ecdh failed: %w", err)
+	}
+	salt := []byte("parch-e2ee-wrap-salt:" + envelope.SpaceUUID + ":" + envelope.ChannelUUID)
+	info := []byte("parch-e2ee-wrap-info:" + envelope.SenderAuthPublicKey)
+	return hkdfSHA256(shared, salt, info), nil
+}
+
+// hkdfSHA256 returns a single 32-byte HKDF-SHA256 output block, which is all
+// an AES-256 wrap key needs.
+func hkdfSHA256(secret, salt, info []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func aesGCMSeal(key, plaintext []byte) (iv []byte, ciphertext []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	iv, err = randomBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, nil, err
+	}
+	return iv, gcm.Seal(nil, iv, plaintext, nil), nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// generateEncryptionKeyPair returns a P-256 ECDH keypair encoded the way the
+// browser exports it: SPKI public key and PKCS8 private key, raw base64.
+func generateEncryptionKeyPair() (publicKey string, privateKey string, err error) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(priv.PublicKey())
+	if err != nil {
+		return "", "", err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(spki), base64.RawStdEncoding.EncodeToString(pkcs8), nil
+}
+
+func parseEncPublicKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption public key encoding")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption public key: %w", err)
+	}
+	switch key := parsed.(type) {
+	case *ecdh.PublicKey:
+		return key, nil
+	case interface {
+		ECDH() (*ecdh.PublicKey, error)
+	}:
+		return key.ECDH()
+	default:
+		return nil, fmt.Errorf("unsupported encryption public key type")
+	}
+}
+
+func parseEncPrivateKey(encoded string) (*ecdh.PrivateKey, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption private key encoding")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption private key: %w", err)
+	}
+	switch key := parsed.(type) {
+	case *ecdh.PrivateKey:
+		return key, nil
+	case interface {
+		ECDH() (*ecdh.PrivateKey, error)
+	}:
+		return key.ECDH()
+	default:
+		return nil, fmt.Errorf("unsupported encryption private key type")
+	}
+}
+
+func parseSigningPrivateKey(encoded string) (ed25519.PrivateKey, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing private key encoding")
+	}
+	if len(raw) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid signing private key size")
+	}
+	return ed25519.PrivateKey(raw), nil
+}
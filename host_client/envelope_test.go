@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// The fixtures below were produced by web_client/frontend/js/lib/e2ee.js
+// (and, for the bot envelope, by encryptEnvelope) and checked against the
+// other side, so a change that breaks compatibility fails here first.
+const (
+	testEnvelopeSpaceUUID   = "7c0d3f4e-1b2a-4c5d-8e6f-0a1b2c3d4e5f"
+	testEnvelopeChannelUUID = "2f9e8d7c-6b5a-4e3d-9c2b-1a0f9e8d7c6b"
+
+	// The bot the browser fixtures are addressed to, which also sent the
+	// bot fixture.
+	testBotAuthPublicKey = "VYRVcosVZNrbnoV1SgRxeJnLPIFvoCLTpPuBK8sAYzw"
+	testBotEncPrivateKey = "MIGHAgEAMBMGByqGSM49AgEGCCqGSM49AwEHBG0wawIBAQQg766PDHokXjrlgAeViu+LNKDdmPr88gF6olcVGXrK2qihRANCAARKrru8tJi4zwx57kEKjeeclY1MBA4B05KYEL9U0uXeGquV/MphHcCXI1tQXxGPnEOCVHXnakwkdyBXlcus5H2q"
+
+	// encryptMessageForSpace to the bot and one more member. The members'
+	// keys sort differently by code unit than by localeCompare.
+	testBrowserEnvelopeV1 = `{"v":1,"alg":"p256-hkdf-aesgcm+ed25519","message_id":"XDBkNtrWsqNFBAI3TYR59A","sender_timestamp":"2026-10-19T00:32:04.051Z","space_uuid":"7c0d3f4e-1b2a-4c5d-8e6f-0a1b2c3d4e5f","channel_uuid":"2f9e8d7c-6b5a-4e3d-9c2b-1a0f9e8d7c6b","sender_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","sender_enc_public_key":"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAELajPrOOo9mUT3H7FhB35Z7P2ZgUshz3V6d75aulQKuPV0UWn1cOQnM0aFXcsPbLS0k2oHUcBNCa1i44NzA/tgg","content_iv":"ze/VrQgNucafPB4I","ciphertext":"0cu2vZc/n69hjGS/u21W6pt4qkiVpfr48karJNX1dh9VzjjgFNw","wrapped_keys":[{"recipient_auth_public_key":"VYRVcosVZNrbnoV1SgRxeJnLPIFvoCLTpPuBK8sAYzw","iv":"XzuK+E0Wbgddne4M","ciphertext":"7g7bFdHGacHviZoNBEOLW+KzVO26K1T41iUrxLUktb0RA1TJPcYU2Eo3v415oAd2"},{"recipient_auth_public_key":"mKepTIgLUquz5Ea/MZ4UWQeodiZQflJemJOpFqYBkNM","iv":"+WrH2xH68oM/szzQ","ciphertext":"IPSVJKurljqXoaB9eiWLS9vM0tofZufsYlg+u6sh8nLa8f15IcbzgOy/KMv0c8TH"},{"recipient_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","iv":"7GtJPrXo0OXGgd9b","ciphertext":"GGkvd7rozXlY+uj/EvzX1dnBMs9R31IXhl/+RNCpzwTbCu/gGYG1fTG8IxwdiTFv"}],"sig":"OCuqHEdtuK8kxzBVul+HPy+iWgVmfkNOningu3BvrwejcIYgut0CYVtoaubt/CvoqcGIivONTRqpmd4oLIZrDg"}`
+
+	// createSenderKeyDistribution to the same members, and a message
+	// encryptWithSenderKey sent under that key.
+	testBrowserSenderKeyV2 = `{"v":2,"alg":"p256-hkdf-aesgcm+ed25519","kind":"sender_key","message_id":"3ZeR/D2XXG4myww5ejEzEA","sender_timestamp":"2026-10-19T00:32:04.097Z","space_uuid":"7c0d3f4e-1b2a-4c5d-8e6f-0a1b2c3d4e5f","channel_uuid":"2f9e8d7c-6b5a-4e3d-9c2b-1a0f9e8d7c6b","sender_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","sender_enc_public_key":"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAELajPrOOo9mUT3H7FhB35Z7P2ZgUshz3V6d75aulQKuPV0UWn1cOQnM0aFXcsPbLS0k2oHUcBNCa1i44NzA/tgg","epoch":1792369924097,"wrapped_keys":[{"recipient_auth_public_key":"VYRVcosVZNrbnoV1SgRxeJnLPIFvoCLTpPuBK8sAYzw","iv":"bRoyS75JscBwRpeK","ciphertext":"GFuiRj38bnyO663UQGHjBVc412WaDlyjW+qK5wQ613GQ9UqNhyMDSRf348h9pS+P"},{"recipient_auth_public_key":"mKepTIgLUquz5Ea/MZ4UWQeodiZQflJemJOpFqYBkNM","iv":"SqoNTKmdxPv3KPcM","ciphertext":"xyFi8/wEii3wHCCoxYMTSkzJEFQgXHgB4rTVrKKAUhONmsM6XDd2MfNwHDf5XwnJ"},{"recipient_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","iv":"OhBRgR7DYP6R7hm7","ciphertext":"mS0684/DGhlgI/ZMPWOToDIaZGgE7Csp8HIS2TIF2+yyGXmcvrRedDrGORM7Uk1P"}],"sig":"krOokkSyRYkf67knAxkD+z06YNGtvYgFf+OiAlFgPSjB69yWOkAO7BShwTMg00Wrp+Stv9HNo4i/5WAFXBp/DQ"}`
+	testBrowserMessageV2   = `{"v":2,"alg":"p256-hkdf-aesgcm+ed25519","kind":"message","message_id":"lljswLE+1plys34NfJWjUw","sender_timestamp":"2026-10-19T00:32:04.106Z","space_uuid":"7c0d3f4e-1b2a-4c5d-8e6f-0a1b2c3d4e5f","channel_uuid":"2f9e8d7c-6b5a-4e3d-9c2b-1a0f9e8d7c6b","sender_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","sender_enc_public_key":"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAELajPrOOo9mUT3H7FhB35Z7P2ZgUshz3V6d75aulQKuPV0UWn1cOQnM0aFXcsPbLS0k2oHUcBNCa1i44NzA/tgg","epoch":1792369924097,"content_iv":"iWO/PYo2B1HyfnGF","ciphertext":"639pAiPQcBXtAxcQksqfLcjFeAAzbnrl26Dl4tivIBc","sig":"OgvQWMpZthQfb0Zfv7xAcKf+wBgQUoTfk84ci9M55qt9RPMsc4IDQQTm/j+stdKN4UaF+X6YdmbiVwzRps+QBA"}`
+
+	// The same from the version 3 client, to the bot and a member whose key
+	// sorts before the bot's by localeCompare but after it by code unit.
+	testBrowserSenderKeyV3 = `{"v":3,"alg":"p256-hkdf-aesgcm+ed25519","kind":"sender_key","message_id":"nKvYM95EDSCHFKxOIjv+FA","sender_timestamp":"2026-10-19T00:46:21.685Z","space_uuid":"7c0d3f4e-1b2a-4c5d-8e6f-0a1b2c3d4e5f","channel_uuid":"2f9e8d7c-6b5a-4e3d-9c2b-1a0f9e8d7c6b","sender_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","sender_enc_public_key":"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAELajPrOOo9mUT3H7FhB35Z7P2ZgUshz3V6d75aulQKuPV0UWn1cOQnM0aFXcsPbLS0k2oHUcBNCa1i44NzA/tgg","epoch":1792370781683,"wrapped_keys":[{"recipient_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","iv":"HeG28f+zDen2QxZO","ciphertext":"iO6JFH1P86WI5QWNhHqdDDOAbKKT5YRLwxOPy45MwP/ma+awwyL8dBVGY8Djb2jU"},{"recipient_auth_public_key":"VYRVcosVZNrbnoV1SgRxeJnLPIFvoCLTpPuBK8sAYzw","iv":"sm5TiljmVqGoQEZx","ciphertext":"0U3GeRE3BSvsvNYk8+Oqw1aUY+fVxtdbjTcW2DJvwcZizvv9h74Dx3+wPzSwC1bv"},{"recipient_auth_public_key":"k0O5uDfv8MrCXyNNyE8/mFpiMQPjfkUHl7a1AvjEa4Q","iv":"lJC8VQZ1DsAjlp+T","ciphertext":"AfeaXyF1CLVl3/uJPcwZMQMZMkoaii3J8VPdTJQsNzHB6DFXLMP/nZk68K6GUbpX"}],"sig":"NHYuD3t3V0138jxJAn+fBPu4RettDzuOeiLgmkhZL/sN2yilXoR06qOVv4EYM014YapQ6oPjp6yY0tT2DN7rCg"}`
+	testBrowserMessageV3   = `{"v":3,"alg":"p256-hkdf-aesgcm+ed25519","kind":"message","message_id":"FrMxrIbrvYdGoDkcV8B1Ug","sender_timestamp":"2026-10-19T00:46:21.704Z","space_uuid":"7c0d3f4e-1b2a-4c5d-8e6f-0a1b2c3d4e5f","channel_uuid":"2f9e8d7c-6b5a-4e3d-9c2b-1a0f9e8d7c6b","sender_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","sender_enc_public_key":"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAELajPrOOo9mUT3H7FhB35Z7P2ZgUshz3V6d75aulQKuPV0UWn1cOQnM0aFXcsPbLS0k2oHUcBNCa1i44NzA/tgg","epoch":1792370781683,"content_iv":"/bpS9xPe7yjHGSD2","ciphertext":"TAPajAJW/OUz0FSz/SSSEpxsK+a5yTVuSiTSgTYrcme37jIMTU7jIw","sig":"3XjsnFdiUk9AncjYIygDtyj7u75/sG3Uzf3WyV3U72MLLItMdTMqisegH1LXaNpFvWXeOzUdUVTQum1Vegi9Bw"}`
+
+	// encryptMessageForSpace from a browser whose localeCompare orders the
+	// keys the other way round from en-US. It signs and sends them in that
+	// order.
+	testBrowserEnvelopeOtherLocale = `{"v":1,"alg":"p256-hkdf-aesgcm+ed25519","message_id":"/fbytzeToNiwIqduP8X+hg","sender_timestamp":"2026-10-19T00:46:21.719Z","space_uuid":"7c0d3f4e-1b2a-4c5d-8e6f-0a1b2c3d4e5f","channel_uuid":"2f9e8d7c-6b5a-4e3d-9c2b-1a0f9e8d7c6b","sender_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","sender_enc_public_key":"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAELajPrOOo9mUT3H7FhB35Z7P2ZgUshz3V6d75aulQKuPV0UWn1cOQnM0aFXcsPbLS0k2oHUcBNCa1i44NzA/tgg","content_iv":"hoDuloVpY4CEuyFN","ciphertext":"S+DuwQOGOcyX3KRJXI6xZrPfZqswjunMaNqbFWFhxxrnN1apPwXohcg","wrapped_keys":[{"recipient_auth_public_key":"k0O5uDfv8MrCXyNNyE8/mFpiMQPjfkUHl7a1AvjEa4Q","iv":"atKSJscBo1mkYXzi","ciphertext":"ED2jRhi8Gr2hmLTPB6j3OxfRr48fwg5uDGKRZsBZxZHrP+ICF/yOHJQb7eHv8wre"},{"recipient_auth_public_key":"VYRVcosVZNrbnoV1SgRxeJnLPIFvoCLTpPuBK8sAYzw","iv":"MgO/3DKKcMzg93vr","ciphertext":"9q3GHv+6+seppMhpdvTeNmF07oTa864KZWMxXQbVN6EraJKh7y4GBSv6oXkCpWVf"},{"recipient_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","iv":"Z9W2yztgx8m6m8Jg","ciphertext":"jRgGfcebgHXMR3wTFy8nQzKzejymBRGDx2MD3+P9dpGnAmwWlu1sy/eA2yhoKisi"}],"sig":"GvcYj6XCD7pQMNOuB55M23kwHhH+i0r4YArl6uEu1t6Hy876miKSuTBQOj0mdXITOUbnVZHGhTeMRI8c1OVPBQ"}`
+
+	// encryptEnvelope from the bot to the browser member and one more
+	// member. e2ee.js decrypts it as "hello from a bot", and its
+	// canonicalEnvelopeForSignature returns testBotEnvelopeBrowserCanonical.
+	testBotEnvelopeV1               = `{"v":1,"alg":"p256-hkdf-aesgcm+ed25519","message_id":"Pytb/7EipWJjTKcZjhF8MA","sender_timestamp":"2026-10-19T00:32:36.095Z","space_uuid":"7c0d3f4e-1b2a-4c5d-8e6f-0a1b2c3d4e5f","channel_uuid":"2f9e8d7c-6b5a-4e3d-9c2b-1a0f9e8d7c6b","sender_auth_public_key":"VYRVcosVZNrbnoV1SgRxeJnLPIFvoCLTpPuBK8sAYzw","sender_enc_public_key":"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAESq67vLSYuM8Mee5BCo3nnJWNTAQOAdOSmBC/VNLl3hqrlfzKYR3AlyNbUF8Rj5xDglR152pMJHcgV5XLrOR9qg","content_iv":"TfKD1SWF/cDzDA+x","ciphertext":"lDlHIQqePZ+TArDQKEN9z0tSxdX2EygQDjnTA/l9ttE","wrapped_keys":[{"recipient_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","iv":"1PL9L+oHuWIqpNTV","ciphertext":"WvmWjmnSE8lPxq8aPbVbR6skw0rpqaMqO0FCJzsKdZhEDZveLZJuByfX/B8ty9gL"},{"recipient_auth_public_key":"mKepTIgLUquz5Ea/MZ4UWQeodiZQflJemJOpFqYBkNM","iv":"i08kGNQ6p/xFRwol","ciphertext":"oSyAOWeT5rxKncuM3AtO25068Ic7WWKcecvM6tdEmxNdVDuAJDHWP8kP0m7styBD"},{"recipient_auth_public_key":"VYRVcosVZNrbnoV1SgRxeJnLPIFvoCLTpPuBK8sAYzw","iv":"1nVoKzgO84g8ztg7","ciphertext":"YgMRupzBmtHPgxqGCBqMwbkSlTYf3vvV15psINDmXLTNFOjz5F04uR1n7bbfOyrv"}],"sig":"tMwd0AV3NpZynYBV68MY0rbzNfAFNbobNmLvSwcRGmUf/wROdN99VUqiKNdvPOr+ZGbgliDhle13M/quooGpDw"}`
+	testBotEnvelopeBrowserCanonical = `{"v":1,"alg":"p256-hkdf-aesgcm+ed25519","message_id":"Pytb/7EipWJjTKcZjhF8MA","sender_timestamp":"2026-10-19T00:32:36.095Z","space_uuid":"7c0d3f4e-1b2a-4c5d-8e6f-0a1b2c3d4e5f","channel_uuid":"2f9e8d7c-6b5a-4e3d-9c2b-1a0f9e8d7c6b","sender_auth_public_key":"VYRVcosVZNrbnoV1SgRxeJnLPIFvoCLTpPuBK8sAYzw","sender_enc_public_key":"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAESq67vLSYuM8Mee5BCo3nnJWNTAQOAdOSmBC/VNLl3hqrlfzKYR3AlyNbUF8Rj5xDglR152pMJHcgV5XLrOR9qg","content_iv":"TfKD1SWF/cDzDA+x","ciphertext":"lDlHIQqePZ+TArDQKEN9z0tSxdX2EygQDjnTA/l9ttE","wrapped_keys":[{"recipient_auth_public_key":"4yksUnBaKZVYqDXpYdM5VMrpmypunHFPy90dPP/h9bA","iv":"1PL9L+oHuWIqpNTV","ciphertext":"WvmWjmnSE8lPxq8aPbVbR6skw0rpqaMqO0FCJzsKdZhEDZveLZJuByfX/B8ty9gL"},{"recipient_auth_public_key":"mKepTIgLUquz5Ea/MZ4UWQeodiZQflJemJOpFqYBkNM","iv":"i08kGNQ6p/xFRwol","ciphertext":"oSyAOWeT5rxKncuM3AtO25068Ic7WWKcecvM6tdEmxNdVDuAJDHWP8kP0m7styBD"},{"recipient_auth_public_key":"VYRVcosVZNrbnoV1SgRxeJnLPIFvoCLTpPuBK8sAYzw","iv":"1nVoKzgO84g8ztg7","ciphertext":"YgMRupzBmtHPgxqGCBqMwbkSlTYf3vvV15psINDmXLTNFOjz5F04uR1n7bbfOyrv"}]}`
+)
+
+func TestHKDFSHA256MatchesRFC5869(t *testing.T) {
+	sequence := func(from, to int) []byte {
+		out := make([]byte, 0, to-from+1)
+		for b := from; b <= to; b++ {
+			out = append(out, byte(b))
+		}
+		return out
+	}
+	// RFC 5869 appendix A, test cases 1-3. hkdfSHA256 returns one block, so
+	// only the first 32 bytes of each OKM apply.
+	cases := []struct {
+		name            string
+		ikm, salt, info []byte
+		okm             string
+	}{
+		{"case 1", bytes.Repeat([]byte{0x0b}, 22), sequence(0x00, 0x0c), sequence(0xf0, 0xf9), "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf"},
+		{"case 2", sequence(0x00, 0x4f), sequence(0x60, 0xaf), sequence(0xb0, 0xff), "b11e398dc80327a1c8e7f78c596a49344f012eda2d4efad8a050cc4c19afa97c"},
+		{"case 3", bytes.Repeat([]byte{0x0b}, 22), nil, nil, "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d"},
+	}
+	for _, tc := range cases {
+		if got := hex.EncodeToString(hkdfSHA256(tc.ikm, tc.salt, tc.info)); got != tc.okm {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.okm)
+		}
+	}
+}
+
+func TestCompareLikeLocaleMatchesBrowserSort(t *testing.T) {
+	// The order ["..."].sort((a, b) => a.localeCompare(b)) gives in en-US.
+	want := []string{"_x", "-x", "/x", "+x", "0Z", "4yksUnBa", "9z", "ab", "abc", "aBc", "ABC", "abc/9", "Abc/9", "mkep_Igl", "mkep-Igl", "mKep+Igl", "mKepTIgL", "VYRVcosV", "zz", "Zz"}
+	got := []string{"zz", "Abc/9", "mKepTIgL", "ABC", "+x", "VYRVcosV", "abc", "_x", "mkep-Igl", "9z", "aBc", "4yksUnBa", "/x", "Zz", "ab", "mKep+Igl", "-x", "abc/9", "0Z", "mkep_Igl"}
+	sort.SliceStable(got, func(i, j int) bool { return compareLikeLocale(got[i], got[j]) < 0 })
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sorted order differs at %d:\n got %q\nwant %q", i, got, want)
+		}
+	}
+	if compareLikeLocale("same", "same") != 0 {
+		t.Fatal("expected equal strings to compare equal")
+	}
+}
+
+func TestCanonicalEnvelopeMatchesBrowser(t *testing.T) {
+	var envelope chatEnvelope
+	if err := json.Unmarshal([]byte(testBotEnvelopeV1), &envelope); err != nil {
+		t.Fatalf("decode bot envelope: %v", err)
+	}
+	canonical, err := canonicalEnvelopeForSignature(envelope, wrappedKeysLocale)
+	if err != nil {
+		t.Fatalf("canonical envelope: %v", err)
+	}
+	if string(canonical) != testBotEnvelopeBrowserCanonical {
+		t.Fatalf("canonical form differs from the browser's:\n got %s\nwant %s", canonical, testBotEnvelopeBrowserCanonical)
+	}
+	if err := verifyEnvelope([]byte(testBotEnvelopeV1), testEnvelopeSpaceUUID, testEnvelopeChannelUUID); err != nil {
+		t.Fatalf("verify bot envelope: %v", err)
+	}
+}
+
+func TestBrowserEnvelopesVerifyAndDecrypt(t *testing.T) {
+	for name, raw := range map[string]string{
+		"v1":            testBrowserEnvelopeV1,
+		"sender key v2": testBrowserSenderKeyV2,
+		"message v2":    testBrowserMessageV2,
+		"sender key v3": testBrowserSenderKeyV3,
+		"message v3":    testBrowserMessageV3,
+		"other locale":  testBrowserEnvelopeOtherLocale,
+	} {
+		if err := verifyEnvelope([]byte(raw), testEnvelopeSpaceUUID, testEnvelopeChannelUUID); err != nil {
+			t.Errorf("verify %s envelope: %v", name, err)
+		}
+	}
+
+	messageKey := openWrappedKeyForBot(t, testBrowserEnvelopeV1)
+	if got := openEnvelopeContent(t, messageKey, testBrowserEnvelopeV1); got != "hello from the browser" {
+		t.Fatalf("v1 plaintext = %q", got)
+	}
+
+	chainKey := openWrappedKeyForBot(t, testBrowserSenderKeyV2)
+	if got := openEnvelopeContent(t, senderMessageKeyForTest(t, chainKey, testBrowserMessageV2), testBrowserMessageV2); got != "sender key hello" {
+		t.Fatalf("sender key plaintext = %q", got)
+	}
+
+	chainKey = openWrappedKeyForBot(t, testBrowserSenderKeyV3)
+	if got := openEnvelopeContent(t, senderMessageKeyForTest(t, chainKey, testBrowserMessageV3), testBrowserMessageV3); got != "ordinal sender key hello" {
+		t.Fatalf("v3 sender key plaintext = %q", got)
+	}
+
+	messageKey = openWrappedKeyForBot(t, testBrowserEnvelopeOtherLocale)
+	if got := openEnvelopeContent(t, messageKey, testBrowserEnvelopeOtherLocale); got != "hello from another locale" {
+		t.Fatalf("other locale plaintext = %q", got)
+	}
+}
+
+func TestSenderKeyV3SignsWrappedKeysInCodeUnitOrder(t *testing.T) {
+	var envelope receivedEnvelope
+	if err := json.Unmarshal([]byte(testBrowserSenderKeyV3), &envelope); err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+	keys := make([]string, len(envelope.WrappedKeys))
+	for i, wrapped := range envelope.WrappedKeys {
+		keys[i] = wrapped.RecipientAuthPublicKey
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Fatalf("expected version 3 wrapped keys to be sent in code unit order, got %q", keys)
+	}
+	localeSorted := orderWrappedKeys(envelope.WrappedKeys, wrappedKeysLocale)
+	if localeSorted[1].RecipientAuthPublicKey == keys[1] {
+		t.Fatal("fixture should order its keys differently under localeCompare")
+	}
+
+	// Version 3 sorts before checking, so the order keys arrive in does not
+	// matter.
+	envelope.WrappedKeys[1], envelope.WrappedKeys[2] = envelope.WrappedKeys[2], envelope.WrappedKeys[1]
+	shuffled, _ := json.Marshal(envelope)
+	if err := verifyEnvelope(shuffled, testEnvelopeSpaceUUID, testEnvelopeChannelUUID); err != nil {
+		t.Fatalf("verify shuffled version 3 envelope: %v", err)
+	}
+}
+
+func TestEncryptEnvelopeSendsWrappedKeysInSignedOrder(t *testing.T) {
+	sender := newTestEnvelopeSender(t)
+	var recipients []DashDataUser
+	for i := 0; i < 8; i++ {
+		recipient := newTestEnvelopeSender(t)
+		recipients = append(recipients, DashDataUser{PublicKey: recipient.AuthPublicKey, EncPublicKey: recipient.EncPublicKey})
+	}
+	envelope, err := encryptEnvelope(sender, testEnvelopeSpaceUUID, testEnvelopeChannelUUID, "hello", recipients)
+	if err != nil {
+		t.Fatalf("encrypt envelope: %v", err)
+	}
+	sent := envelope.WrappedKeys
+	signed := orderWrappedKeys(sent, wrappedKeysLocale)
+	for i := range sent {
+		if sent[i].RecipientAuthPublicKey != signed[i].RecipientAuthPublicKey {
+			t.Fatalf("wrapped key %d is sent out of signed order", i)
+		}
+	}
+	raw, _ := json.Marshal(envelope)
+	if err := verifyEnvelope(raw, testEnvelopeSpaceUUID, testEnvelopeChannelUUID); err != nil {
+		t.Fatalf("verify envelope: %v", err)
+	}
+}
+
+func TestVerifyEnvelopeRejections(t *testing.T) {
+	edit := func(raw string, change func(map[string]interface{})) []byte {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+			t.Fatalf("decode fixture: %v", err)
+		}
+		change(fields)
+		out, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("encode fixture: %v", err)
+		}
+		return out
+	}
+	otherKey := "k0O5uDfv8MrCXyNNyE8/mFpiMQPjfkUHl7a1AvjEa4Q"
+
+	cases := []struct {
+		name     string
+		envelope []byte
+		channel  string
+		want     string
+	}{
+		{"not json", []byte("{"), testEnvelopeChannelUUID, "malformed envelope"},
+		{"wrong field type", edit(testBrowserMessageV3, func(f map[string]interface{}) { f["wrapped_keys"] = "none" }), testEnvelopeChannelUUID, "malformed envelope"},
+		{"unknown version", edit(testBrowserMessageV3, func(f map[string]interface{}) { f["v"] = 4 }), testEnvelopeChannelUUID, "unsupported envelope version"},
+		{"missing version", edit(testBrowserEnvelopeV1, func(f map[string]interface{}) { delete(f, "v") }), testEnvelopeChannelUUID, "unsupported envelope version"},
+		{"unknown algorithm", edit(testBrowserMessageV3, func(f map[string]interface{}) { f["alg"] = "x25519" }), testEnvelopeChannelUUID, "unsupported envelope algorithm"},
+		{"other channel", []byte(testBrowserMessageV3), "other-channel", "envelope is not addressed to this channel"},
+		{"other space", edit(testBrowserMessageV3, func(f map[string]interface{}) { f["space_uuid"] = "other-space" }), testEnvelopeChannelUUID, "envelope is not addressed to this channel"},
+		{"bad sender key", edit(testBrowserMessageV3, func(f map[string]interface{}) { f["sender_auth_public_key"] = "not base64!" }), testEnvelopeChannelUUID, "invalid sender public key"},
+		{"short sender key", edit(testBrowserMessageV3, func(f map[string]interface{}) { f["sender_auth_public_key"] = "AAAA" }), testEnvelopeChannelUUID, "invalid sender public key"},
+		{"missing signature", edit(testBrowserMessageV3, func(f map[string]interface{}) { delete(f, "sig") }), testEnvelopeChannelUUID, "invalid envelope signature"},
+		{"other signer", edit(testBrowserMessageV3, func(f map[string]interface{}) { f["sender_auth_public_key"] = otherKey }), testEnvelopeChannelUUID, "invalid envelope signature"},
+		{"edited ciphertext", edit(testBrowserMessageV3, func(f map[string]interface{}) { f["ciphertext"] = "AAAA" + f["ciphertext"].(string)[4:] }), testEnvelopeChannelUUID, "invalid envelope signature"},
+		{"edited epoch", edit(testBrowserMessageV3, func(f map[string]interface{}) { f["epoch"] = f["epoch"].(float64) + 1 }), testEnvelopeChannelUUID, "invalid envelope signature"},
+		{"dropped wrapped key", edit(testBrowserSenderKeyV3, func(f map[string]interface{}) {
+			f["wrapped_keys"] = f["wrapped_keys"].([]interface{})[1:]
+		}), testEnvelopeChannelUUID, "invalid envelope signature"},
+		{"edited v1 content", edit(testBrowserEnvelopeV1, func(f map[string]interface{}) { f["content_iv"] = "AAAAAAAAAAAAAAAA" }), testEnvelopeChannelUUID, "invalid envelope signature"},
+	}
+	for _, tc := range cases {
+		err := verifyEnvelope(tc.envelope, testEnvelopeSpaceUUID, tc.channel)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%s: expected %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+// senderMessageKeyForTest mirrors deriveSenderMessageKey in e2ee.js.
+func senderMessageKeyForTest(t *testing.T, chainKey []byte, raw string) []byte {
+	t.Helper()
+	var message receivedEnvelope
+	if err := json.Unmarshal([]byte(raw), &message); err != nil {
+		t.Fatalf("decode message envelope: %v", err)
+	}
+	return hkdfSHA256(chainKey,
+		[]byte("parch-e2ee-sender-salt:"+message.MessageID),
+		[]byte("parch-e2ee-sender-info:"+message.SpaceUUID+":"+message.ChannelUUID+":"+message.SenderAuthPublicKey+":"+strconv.FormatInt(message.Epoch, 10)))
+}
+
+// openWrappedKeyForBot unwraps the key an envelope wrapped for the test bot.
+func openWrappedKeyForBot(t *testing.T, raw string) []byte {
+	t.Helper()
+	var envelope chatEnvelope
+	if err := json.Unmarshal([]byte(raw), &envelope); err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+	botKey, err := parseEncPrivateKey(testBotEncPrivateKey)
+	if err != nil {
+		t.Fatalf("parse bot key: %v", err)
+	}
+	senderKey, err := parseEncPublicKey(envelope.SenderEncPublicKey)
+	if err != nil {
+		t.Fatalf("parse sender key: %v", err)
+	}
+	wrapKey, err := deriveWrapKey(botKey, senderKey, envelope)
+	if err != nil {
+		t.Fatalf("derive wrap key: %v", err)
+	}
+	for _, wrapped := range envelope.WrappedKeys {
+		if wrapped.RecipientAuthPublicKey == testBotAuthPublicKey {
+			return aesGCMOpenForTest(t, wrapKey, wrapped.IV, wrapped.Ciphertext)
+		}
+	}
+	t.Fatal("envelope has no key wrapped for the bot")
+	return nil
+}
+
+func openEnvelopeContent(t *testing.T, key []byte, raw string) string {
+	t.Helper()
+	var envelope chatEnvelope
+	if err := json.Unmarshal([]byte(raw), &envelope); err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+	return string(aesGCMOpenForTest(t, key, envelope.ContentIV, envelope.Ciphertext))
+}
+
+func aesGCMOpenForTest(t *testing.T, key []byte, iv, ciphertext string) []byte {
+	t.Helper()
+	nonce, err := base64.RawStdEncoding.DecodeString(iv)
+	if err != nil {
+		t.Fatalf("decode iv: %v", err)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		t.Fatalf("decode ciphertext: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("aes: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("gcm: %v", err)
+	}
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return plaintext
+}
+
+func newTestEnvelopeSender(t *testing.T) envelopeSender {
+	t.Helper()
+	publicKey, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate signing key: %v", err)
+	}
+	encPublicKey, encPrivateKey, err := generateEncryptionKeyPair()
+	if err != nil {
+		t.Fatalf("generate encryption key: %v", err)
+	}
+	encryptionKey, err := parseEncPrivateKey(encPrivateKey)
+	if err != nil {
+		t.Fatalf("parse encryption key: %v", err)
+	}
+	return envelopeSender{
+		AuthPublicKey: base64.RawStdEncoding.EncodeToString(publicKey),
+		EncPublicKey:  encPublicKey,
+		SigningKey:    signingKey,
+		EncryptionKey: encryptionKey,
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 )
 
@@ -20,16 +21,24 @@ type HostConfig struct {
 	DBFile            string `json:"db_file"`
 	SigningPublicKey  string `json:"signing_public_key,omitempty"`
 	SigningPrivateKey string `json:"signing_private_key,omitempty"`
+
+	// Set while a key rotation has been started but not yet confirmed by
+	// the relay, so an interrupted rotation can be resumed.
+	PendingSigningPublicKey  string `json:"pending_signing_public_key,omitempty"`
+	PendingSigningPrivateKey string `json:"pending_signing_private_key,omitempty"`
 }
 
 func getAppSupportPathFor(filename string) (string, error) {
-	configDir, err := os.UserConfigDir()
-	if err != nil {
-		return "", fmt.Errorf("unable to get user config directory: %w", err)
-	}
-
-	appDir := filepath.Join(configDir, "ParchHost")
-	if err := os.MkdirAll(appDir, 0755); err != nil {
+	appDir := hostConfigDir
+	if appDir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("unable to get user config directory: %w", err)
+		}
+		appDir = filepath.Join(configDir, "ParchHost")
+	}
+	// The directory holds the host signing key, the DB and its backups.
+	if err := os.MkdirAll(appDir, 0700); err != nil {
 		return "", fmt.Errorf("unable to create config directory: %w", err)
 	}
 
@@ -48,6 +57,7 @@ func loadExistingConfig() (*HostConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	restrictConfigPermissions(configPath)
 
 	var cfg HostConfig
 	if err := json.Unmarshal(data, &cfg); err != nil {
@@ -62,7 +72,7 @@ func loadExistingConfig() (*HostConfig, error) {
 	}
 
 	// Update DB path to current location
-	dbPath, err := getAppSupportPathFor(dbName)
+	dbPath, err := hostDBPath()
 	if err != nil {
 		return nil, err
 	}
@@ -71,6 +81,33 @@ func loadExistingConfig() (*HostConfig, error) {
 	return &cfg, nil
 }
 
+// restrictConfigPermissions makes the config, which holds the host signing
+// key, readable by its owner only. Configs written by older releases were
+// left group and world readable.
+func restrictConfigPermissions(configPath string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	info, err := os.Stat(configPath)
+	if err != nil || info.Mode().Perm()&0077 == 0 {
+		return
+	}
+	if err := os.Chmod(configPath, 0600); err != nil {
+		log.Printf("Warning: %s holds the host signing key but is readable by other users (mode %04o) and could not be restricted: %v", configPath, info.Mode().Perm(), err)
+		return
+	}
+	log.Printf("Restricted %s to mode 0600; it holds the host signing key", configPath)
+}
+
+// hostDBPath is HOST_CHAT_DB_FILE / --db-file when set, otherwise the default DB
+// next to the host config.
+func hostDBPath() (string, error) {
+	if hostDBFile != "" {
+		return filepath.Abs(hostDBFile)
+	}
+	return getAppSupportPathFor(dbName)
+}
+
 func saveConfig(cfg *HostConfig) error {
 	configPath, err := getAppSupportPathFor(configFileName)
 	if err != nil {
@@ -82,7 +119,29 @@ func saveConfig(cfg *HostConfig) error {
 		return err
 	}
 
-	return os.WriteFile(configPath, data, 0644)
+	// Write-then-rename so a crash can never leave a truncated config and
+	// lose the host's signing key.
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), "."+configFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), configPath)
 }
 
 func generateHostSigningKeyPair() (publicKey string, privateKey string, err error) {
@@ -93,6 +152,30 @@ func generateHostSigningKeyPair() (publicKey string, privateKey string, err erro
 	return base64.RawStdEncoding.EncodeToString(pub), base64.RawStdEncoding.EncodeToString(priv), nil
 }
 
+// provisionedSigningKeys returns the signing keypair supplied through
+// HOST_SIGNING_PRIVATE_KEY or HOST_SIGNING_KEY_FILE, if any. The private key
+// uses the same base64 encoding as the host config.
+func provisionedSigningKeys() (publicKey string, privateKey string, err error) {
+	privateKey = strings.TrimSpace(hostSigningPrivateKey)
+	if hostSigningKeyFile != "" {
+		data, err := os.ReadFile(hostSigningKeyFile)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read signing key file: %w", err)
+		}
+		privateKey = strings.TrimSpace(string(data))
+	}
+	if privateKey == "" {
+		return "", "", nil
+	}
+
+	key, err := parseSigningPrivateKey(privateKey)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid provisioned signing key: %w", err)
+	}
+	publicKey = base64.RawStdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	return publicKey, privateKey, nil
+}
+
 func ensureHostSigningKeys(cfg *HostConfig) error {
 	if cfg == nil {
 		return fmt.Errorf("missing host config")
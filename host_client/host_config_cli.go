@@ -3,11 +3,19 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
+	"strings"
 )
 
 func LoadOrInitHostConfigCLI() (*HostConfig, error) {
 	// Try loading existing config first
 	if cfg, err := loadExistingConfig(); err == nil {
+		if publicKey, _, err := provisionedSigningKeys(); err == nil && publicKey != "" && publicKey != cfg.SigningPublicKey {
+			log.Println("Warning: ignoring the provisioned signing key; the existing host config has its own (use rotate-key to change it)")
+		}
+		if err := resumePendingKeyRotation(cfg); err != nil {
+			log.Printf("Warning: %v", err)
+		}
 		if err := ensureHostRegisteredWithRelay(cfg); err != nil {
 			log.Printf("Warning: failed to sync host registration with relay: %v", err)
 		}
@@ -15,41 +23,61 @@ func LoadOrInitHostConfigCLI() (*HostConfig, error) {
 		return cfg, nil
 	}
 
-	dbPath, err := getAppSupportPathFor(dbName)
+	name := strings.TrimSpace(hostNameSetting)
+	if name == "" {
+		// Under systemd or in a container nobody can answer the prompt.
+		if !stdinIsTerminal() {
+			return nil, fmt.Errorf("no host config found; set HOST_NAME (or --name) or run `init --non-interactive` first")
+		}
+		fmt.Println("No existing host configuration found.")
+		name = promptInput("Enter a name for this host: ")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("host name cannot be empty")
+	}
+
+	fmt.Println("Registering with relay server...")
+	return provisionHostConfig(name)
+}
+
+// provisionHostConfig registers a new host with the relay and saves its
+// config. A pre-provisioned signing key is used when one is configured.
+func provisionHostConfig(name string) (*HostConfig, error) {
+	dbPath, err := hostDBPath()
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve DB path: %w", err)
 	}
 
-	// No valid config: prompt for host name
-	fmt.Println("No existing host configuration found.")
-	name := promptInput("Enter a name for this host: ")
-	if name == "" {
-		return nil, fmt.Errorf("host name cannot be empty")
+	cfg := &HostConfig{Name: name, DBFile: dbPath}
+	cfg.SigningPublicKey, cfg.SigningPrivateKey, err = provisionedSigningKeys()
+	if err != nil {
+		return nil, err
 	}
-	tmpCfg := &HostConfig{Name: name}
-	if err := ensureHostSigningKeys(tmpCfg); err != nil {
+	if err := ensureHostSigningKeys(cfg); err != nil {
 		return nil, fmt.Errorf("failed to initialize host signing keys: %w", err)
 	}
 
-	// Register with relay
-	fmt.Println("Registering with relay server...")
-	uuid, err := registerHostWithRelay("", name, tmpCfg.SigningPublicKey)
+	cfg.UUID, err = registerHostWithRelay("", name, cfg.SigningPublicKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to register host with relay: %w", err)
 	}
 
-	cfg := &HostConfig{
-		UUID:              uuid,
-		Name:              name,
-		DBFile:            dbPath,
-		SigningPublicKey:  tmpCfg.SigningPublicKey,
-		SigningPrivateKey: tmpCfg.SigningPrivateKey,
-	}
-
-	// Save config
+	// Without the saved config the registered UUID and key are lost.
 	if err := saveConfig(cfg); err != nil {
-		fmt.Printf("Warning: failed to save config: %v\n", err)
+		return nil, fmt.Errorf("host %s registered but saving the config failed: %w", cfg.UUID, err)
 	}
-
 	return cfg, nil
 }
+
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// systemd and most container runtimes attach stdin to /dev/null, which is
+	// a character device too.
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(info, null) {
+		return false
+	}
+	return true
+}
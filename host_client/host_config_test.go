@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLoadExistingConfigRestrictsPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on windows")
+	}
+	previousDir := hostConfigDir
+	hostConfigDir = t.TempDir()
+	t.Cleanup(func() { hostConfigDir = previousDir })
+
+	configPath := filepath.Join(hostConfigDir, configFileName)
+	data := []byte(`{"uuid":"host-1","name":"Host","signing_public_key":"pub","signing_private_key":"priv"}`)
+	if err := os.WriteFile(configPath, data, 0644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	// WriteFile is subject to the umask; make sure the file starts open.
+	if err := os.Chmod(configPath, 0644); err != nil {
+		t.Fatalf("chmod config: %v", err)
+	}
+
+	cfg, err := loadExistingConfig()
+	if err != nil || cfg.UUID != "host-1" {
+		t.Fatalf("load config: %v %+v", err, cfg)
+	}
+	info, err := os.Stat(configPath)
+	if err != nil {
+		t.Fatalf("stat config: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("expected mode 0600 after load, got %04o", mode)
+	}
+}
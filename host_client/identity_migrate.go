@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Migration statements are only accepted close to when they were signed so a
+// captured one cannot be replayed later.
+const identityMigrationMaxSkew = 5 * time.Minute
+
+func identityMigrationMessage(hostUUID, oldPublicKey, newPublicKey, newEncPublicKey string, issuedAt int64) string {
+	return fmt.Sprintf("parch-identity-migrate:%s:%s:%s:%s:%d", hostUUID, oldPublicKey, newPublicKey, newEncPublicKey, issuedAt)
+}
+
+func verifyIdentityMigration(data IdentityMigrateRequest, hostUUID string, now time.Time) error {
+	if data.OldPublicKey == "" || data.NewPublicKey == "" || data.NewEncPublicKey == "" {
+		return fmt.Errorf("missing identity keys")
+	}
+	if data.OldPublicKey == data.NewPublicKey {
+		return fmt.Errorf("new key must differ from the current key")
+	}
+	oldKey, err := base64.RawStdEncoding.DecodeString(data.OldPublicKey)
+	if err != nil || len(oldKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid old public key")
+	}
+	newKey, err := base64.RawStdEncoding.DecodeString(data.NewPublicKey)
+	if err != nil || len(newKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid new public key")
+	}
+	if _, err := parseEncPublicKey(data.NewEncPublicKey); err != nil {
+		return err
+	}
+
+	issuedAt := time.Unix(data.IssuedAt, 0)
+	if data.IssuedAt <= 0 || issuedAt.Before(now.Add(-identityMigrationMaxSkew)) || issuedAt.After(now.Add(identityMigrationMaxSkew)) {
+		return fmt.Errorf("migration statement is expired or not yet valid")
+	}
+
+	message := []byte(identityMigrationMessage(hostUUID, data.OldPublicKey, data.NewPublicKey, data.NewEncPublicKey, data.IssuedAt))
+	signature, err := base64.RawStdEncoding.DecodeString(data.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize || !ed25519.Verify(ed25519.PublicKey(oldKey), message, signature) {
+		return fmt.Errorf("invalid migration signature")
+	}
+	return nil
+}
+
+func handleIdentityMigrate(conn *relayConn, wsMsg *WSMessage) {
+	data, err := decodeData[IdentityMigrateRequest](wsMsg.Data)
+	if err != nil {
+		log.Println("error decoding identity_migrate_request:", err)
+		return
+	}
+	data.OldPublicKey = strings.TrimSpace(data.OldPublicKey)
+	data.NewPublicKey = strings.TrimSpace(data.NewPublicKey)
+	data.NewEncPublicKey = strings.TrimSpace(data.NewEncPublicKey)
+
+	if err := verifyIdentityMigration(data, currentHostUUID, time.Now().UTC()); err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Identity migration rejected: " + err.Error(), ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	user, err := hostStore.MigrateUserKey(data.OldPublicKey, data.NewPublicKey, data.NewEncPublicKey)
+	if err != nil {
+		content := "Database error migrating identity"
+		switch {
+		case err == sql.ErrNoRows:
+			content = "Identity migration failed: old identity not found on this host"
+		case errors.Is(err, errStoreConflict):
+			content = "Identity migration failed: the new key is already in use on this host"
+		default:
+			log.Println("Error migrating identity:", err)
+		}
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: content, ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	spaces, err := hostStore.UserSpaces(user.ID)
+	if err != nil {
+		log.Println("Error loading spaces after identity migration:", err)
+	}
+	spaceUUIDs := make([]string, 0, len(spaces))
+	for _, space := range spaces {
+		spaceUUIDs = append(spaceUUIDs, space.UUID)
+	}
+
+	sendToConn(conn, WSMessage{
+		Type: "identity_migrate_response",
+		Data: IdentityMigrateResponse{
+			UserID:          user.ID,
+			Username:        user.Username,
+			OldPublicKey:    data.OldPublicKey,
+			NewPublicKey:    user.PublicKey,
+			NewEncPublicKey: user.EncPublicKey,
+			SpaceUUIDs:      spaceUUIDs,
+			ClientUUID:      data.ClientUUID,
+		},
+	})
+}
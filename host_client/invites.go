@@ -3,13 +3,9 @@ package main
 import (
 	"database/sql"
 	"log"
-
-	"gochat/db"
-
-	"github.com/gorilla/websocket"
 )
 
-func handleAcceptInvite(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleAcceptInvite(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[AcceptInviteRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding create_space_request:", err)
@@ -29,9 +25,7 @@ func handleAcceptInvite(conn *websocket.Conn, wsMsg *WSMessage) {
 	}
 
 	// Get space user
-	var spaceUUID string
-	query := `UPDATE space_users SET joined = 1 WHERE id = ? AND user_id = ? AND joined = 0 RETURNING space_uuid` // Checking by user_id also ensures they are authorized
-	err = db.ChatDB.QueryRow(query, data.SpaceUserID, user.ID).Scan(&spaceUUID)
+	spaceUUID, err := hostStore.AcceptInvite(data.SpaceUserID, user.ID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			sendToConn(conn, WSMessage{
@@ -53,9 +47,7 @@ func handleAcceptInvite(conn *websocket.Conn, wsMsg *WSMessage) {
 		}
 	}
 
-	var space DashDataSpace
-	query = `SELECT * FROM spaces WHERE uuid = ?`
-	err = db.ChatDB.QueryRow(query, spaceUUID).Scan(&space.ID, &space.UUID, &space.Name, &space.AuthorID)
+	space, err := hostStore.Space(spaceUUID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			sendToConn(conn, WSMessage{
@@ -107,7 +99,7 @@ func handleAcceptInvite(conn *websocket.Conn, wsMsg *WSMessage) {
 	})
 }
 
-func handleDeclineInvite(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleDeclineInvite(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[DeclineInviteRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding create_space_request:", err)
@@ -126,8 +118,8 @@ func handleDeclineInvite(conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
-	res, err := db.ChatDB.Exec(`DELETE FROM space_users WHERE id = ? AND user_id = ?`, data.SpaceUserID, user.ID) // Checking by user_id also ensures they are authorized
-	if err != nil {
+	err = hostStore.DeclineInvite(data.SpaceUserID, user.ID) // Checking by user_id also ensures they are authorized
+	if err != nil && err != sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -138,7 +130,7 @@ func handleDeclineInvite(conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
-	if rows, _ := res.RowsAffected(); rows == 0 {
+	if err == sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Set when the relay switched this host to a new key; the next successful
+// host_auth asks the relay to refresh every connected member's capabilities.
+var reissueCapabilitiesAfterAuth bool
+
+func hostKeyRotationMessage(hostUUID, oldSigningPublicKey, newSigningPublicKey string, issuedAt int64) string {
+	return fmt.Sprintf("parch-host-rotate-key:%s:%s:%s:%d", hostUUID, oldSigningPublicKey, newSigningPublicKey, issuedAt)
+}
+
+// rotateHostSigningKey replaces the host signing key. The new keypair is saved
+// as pending before the relay is contacted, so a crash or network failure at
+// any point leaves enough state to finish the rotation by running it again.
+func rotateHostSigningKey(cfg *HostConfig) error {
+	if strings.TrimSpace(cfg.PendingSigningPublicKey) == "" || strings.TrimSpace(cfg.PendingSigningPrivateKey) == "" {
+		publicKey, privateKey, err := generateHostSigningKeyPair()
+		if err != nil {
+			return fmt.Errorf("failed to generate host signing keypair: %w", err)
+		}
+		cfg.PendingSigningPublicKey = publicKey
+		cfg.PendingSigningPrivateKey = privateKey
+		if err := saveConfig(cfg); err != nil {
+			return fmt.Errorf("failed to save pending signing key: %w", err)
+		}
+	}
+	return resumePendingKeyRotation(cfg)
+}
+
+// resumePendingKeyRotation submits a saved pending rotation and, once the
+// relay confirms it, promotes the pending key in the config.
+func resumePendingKeyRotation(cfg *HostConfig) error {
+	if strings.TrimSpace(cfg.PendingSigningPublicKey) == "" {
+		return nil
+	}
+	if err := submitHostKeyRotation(cfg); err != nil {
+		return fmt.Errorf("relay rejected key rotation (the new key stays pending; rerun rotate-key to retry): %w", err)
+	}
+
+	cfg.SigningPublicKey = cfg.PendingSigningPublicKey
+	cfg.SigningPrivateKey = cfg.PendingSigningPrivateKey
+	cfg.PendingSigningPublicKey = ""
+	cfg.PendingSigningPrivateKey = ""
+	if err := saveConfig(cfg); err != nil {
+		return fmt.Errorf("relay accepted the new key but saving the config failed: %w", err)
+	}
+	return nil
+}
+
+func submitHostKeyRotation(cfg *HostConfig) error {
+	oldKey, err := parseSigningPrivateKey(cfg.SigningPrivateKey)
+	if err != nil {
+		return err
+	}
+	newKey, err := parseSigningPrivateKey(cfg.PendingSigningPrivateKey)
+	if err != nil {
+		return err
+	}
+
+	issuedAt := time.Now().UTC().Unix()
+	message := []byte(hostKeyRotationMessage(cfg.UUID, cfg.SigningPublicKey, cfg.PendingSigningPublicKey, issuedAt))
+	payload, err := json.Marshal(RotateHostKeyRequest{
+		UUID:                cfg.UUID,
+		OldSigningPublicKey: cfg.SigningPublicKey,
+		NewSigningPublicKey: cfg.PendingSigningPublicKey,
+		IssuedAt:            issuedAt,
+		Signature:           base64.RawStdEncoding.EncodeToString(ed25519.Sign(oldKey, message)),
+		NewKeySignature:     base64.RawStdEncoding.EncodeToString(ed25519.Sign(newKey, message)),
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(relayBaseURL.String()+"/api/rotate_host_key", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var result struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		if result.Error != "" {
+			return fmt.Errorf("relay returned status %d: %s", resp.StatusCode, result.Error)
+		}
+		return fmt.Errorf("relay returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handleHostKeyRotated reloads the signing key after the relay accepted a
+// rotation. The rotate-key command may still be waiting for the relay's reply,
+// so the new key can be either current or pending in the saved config.
+func handleHostKeyRotated(wsMsg *WSMessage) {
+	data, err := decodeData[HostKeyRotated](wsMsg.Data)
+	if err != nil || strings.TrimSpace(data.SigningPublicKey) == "" {
+		log.Println("Invalid host_key_rotated payload")
+		return
+	}
+	if current := runtimeHostConfig.Load(); current != nil && current.SigningPublicKey == data.SigningPublicKey {
+		return
+	}
+
+	cfg, err := loadExistingConfig()
+	if err != nil {
+		log.Printf("Failed to reload host config after key rotation: %v", err)
+		return
+	}
+	switch data.SigningPublicKey {
+	case cfg.SigningPublicKey:
+	case cfg.PendingSigningPublicKey:
+		cfg.SigningPublicKey = cfg.PendingSigningPublicKey
+		cfg.SigningPrivateKey = cfg.PendingSigningPrivateKey
+		cfg.PendingSigningPublicKey = ""
+		cfg.PendingSigningPrivateKey = ""
+	default:
+		log.Printf("Relay rotated this host to signing key %s, which is not in the local config", data.SigningPublicKey)
+		return
+	}
+
+	runtimeHostConfig.Store(cfg)
+	reissueCapabilitiesAfterAuth = true
+	// Bot sessions hold capabilities signed by the retired key.
+	closeAllBotSessions()
+	log.Println("Host signing key rotated")
+}
+
+// handleReissueCapabilitiesRequest answers each member in the batch as if it
+// had asked for dashboard data itself, tagged with that entry's request ID.
+func handleReissueCapabilitiesRequest(conn *relayConn, wsMsg *WSMessage) {
+	data, err := decodeData[ReissueCapabilitiesRequest](wsMsg.Data)
+	if err != nil {
+		log.Println("error decoding reissue_capabilities_request:", err)
+		return
+	}
+	for _, request := range data.Clients {
+		handleGetDashData(conn.forRequest(request.RequestID), &WSMessage{Type: "get_dash_data_request", Data: request})
+	}
+}
@@ -2,33 +2,46 @@ package main
 
 import (
 	"context"
-	"gochat/db"
 	"log"
+	"strings"
+	"time"
 )
 
-func runMainLogic(ctx context.Context, cfg *HostConfig) {
+func runMainLogic(ctx context.Context, cfg *HostConfig, pingInterval, pongTimeout time.Duration) {
 	var err error
 	currentHostUUID = cfg.UUID
-	runtimeHostConfig = cfg
+	runtimeHostConfig.Store(cfg)
 
-	if err := prepareHostDatabase(cfg.DBFile); err != nil {
-		log.Println("Error preparing host database:", err)
-		return
-	}
-
-	db.ChatDB, err = db.InitSQLite(cfg.DBFile)
+	hostStore, err = openHostStore(cfg)
 	if err != nil {
-		log.Println("Error opening database:", err)
+		log.Println(err)
 		return
 	}
-	defer db.CloseDB(db.ChatDB)
-	if err := ensureHostClientSchema(); err != nil {
-		log.Println("Error ensuring host schema:", err)
+	defer hostStore.Close()
+	if err := ensureOfficialSpace(); err != nil {
+		log.Println("Error seeding official space:", err)
 		return
 	}
 
+	startBotAPI(ctx, botAPIAddr)
+	if interval, err := requestMetricsLogInterval(); err != nil {
+		log.Println("Request metrics log disabled:", err)
+	} else {
+		startRequestMetricsLog(ctx, interval)
+	}
+
+	if usingPostgresStore() {
+		if strings.TrimSpace(backupInterval) != "" {
+			log.Println("HOST_BACKUP_INTERVAL ignored: back up the PostgreSQL store with pg_dump")
+		}
+	} else if opts, interval, err := backupOptionsFromEnv(); err != nil {
+		log.Println("Scheduled backups disabled:", err)
+	} else {
+		startBackupScheduler(ctx, cfg.DBFile, interval, opts)
+	}
+
 	go func() {
-		err := SocketClient(ctx, cfg.UUID)
+		err := SocketClient(ctx, cfg.UUID, pingInterval, pongTimeout)
 		if err != nil {
 			log.Println("SocketClient error:", err)
 		}
@@ -2,69 +2,192 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"gochat/db"
 	"log"
+	"math"
 	"strings"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 const maxPersistedEnvelopeBytes = 128 * 1024
 
-func handleSaveChatMessage(wsMsg *WSMessage) {
+// handleSaveChatMessage stores a message the relay has already broadcast and
+// tells the sender whether it was saved.
+func handleSaveChatMessage(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[SaveChatMessageRequest](wsMsg.Data)
 	if err != nil {
-		log.Println("error decoding invite_user_request:", err)
+		log.Println("error decoding save_chat_message_request:", err)
 		return
 	}
 
 	msgTimestamp := time.Now().UTC()
+	messageID := strings.TrimSpace(stringField(data.Envelope, "message_id"))
+	senderAuthPublicKey := strings.TrimSpace(stringField(data.Envelope, "sender_auth_public_key"))
+	reply := chatSaveReply{conn: conn, messageID: messageID, channelUUID: data.ChannelUUID, clientUUID: data.ClientUUID}
+	if data.Strict {
+		reply.envelope = data.Envelope
+	}
 
 	user, err := resolveHostUserIdentity(data.UserID, data.UserPublicKey, data.UserEncPublicKey, data.Username)
 	if err != nil {
 		log.Println("Error resolving message user identity:", err)
+		reply.failed("Failed to resolve user identity")
 		return
 	}
-	messageID := strings.TrimSpace(stringField(data.Envelope, "message_id"))
-	senderAuthPublicKey := strings.TrimSpace(stringField(data.Envelope, "sender_auth_public_key"))
 	if messageID == "" || senderAuthPublicKey == "" {
-		log.Println("Rejecting message without replay-protection fields")
+		reply.rejected("missing replay-protection fields")
 		return
 	}
 	if user.PublicKey != "" && senderAuthPublicKey != user.PublicKey {
-		log.Println("Rejecting message with mismatched sender auth key")
+		reply.rejected("sender key does not match the signed-in user")
 		return
 	}
 
-	query := `INSERT INTO messages (channel_uuid, content, user_id, message_id, sender_auth_public_key, timestamp) VALUES (?, ?, ?, ?, ?, ?)`
 	envelopeJSON, err := json.Marshal(data.Envelope)
 	if err != nil {
 		log.Println("Error marshalling encrypted message envelope:", err)
+		reply.rejected("malformed envelope")
 		return
 	}
 	if len(envelopeJSON) > maxPersistedEnvelopeBytes {
-		log.Printf("Rejecting oversized encrypted envelope: %d bytes", len(envelopeJSON))
+		reply.rejected(fmt.Sprintf("envelope is too large (%d bytes)", len(envelopeJSON)))
 		return
 	}
 
-	_, err = db.ChatDB.Exec(
-		query,
-		data.ChannelUUID,
-		string(envelopeJSON),
-		user.ID,
-		messageID,
-		senderAuthPublicKey,
-		msgTimestamp.Format(time.RFC3339),
-	)
+	spaceUUID, _, err := loadChannelAuthz(data.ChannelUUID)
 	if err != nil {
-		if strings.Contains(strings.ToLower(err.Error()), "unique") {
-			log.Printf("Duplicate message replay ignored for channel %s message_id=%s", data.ChannelUUID, messageID)
+		reply.rejected(err.Error())
+		return
+	}
+	if err := verifyEnvelope(envelopeJSON, spaceUUID, data.ChannelUUID); err != nil {
+		reply.rejected(err.Error())
+		return
+	}
+
+	timestamp := msgTimestamp.Format(time.RFC3339)
+	if kind, epoch, ok := senderKeyEnvelopeInfo(data.Envelope); ok {
+		if epoch <= 0 || (kind != envelopeKindSenderKey && kind != envelopeKindMessage) {
+			reply.rejected("malformed sender key envelope")
+			return
+		}
+		if kind == envelopeKindSenderKey {
+			id, err := hostStore.SaveSenderKey(StoredSenderKey{
+				ChannelUUID:         data.ChannelUUID,
+				SenderAuthPublicKey: senderAuthPublicKey,
+				Epoch:               epoch,
+				Content:             string(envelopeJSON),
+			})
+			reply.result(SaveChatMessageResponse{ID: id, Timestamp: timestamp}, err)
 			return
 		}
-		fmt.Println("Error: Database failed to insert message")
 	}
+
+	saved, err := hostStore.SaveMessage(StoredMessage{
+		ChannelUUID:         data.ChannelUUID,
+		Content:             string(envelopeJSON),
+		UserID:              user.ID,
+		MessageID:           messageID,
+		SenderAuthPublicKey: senderAuthPublicKey,
+		Timestamp:           timestamp,
+	})
+	reply.result(SaveChatMessageResponse{ID: saved.ID, Timestamp: timestamp, Seq: saved.Seq}, err)
+}
+
+// chatSaveReply answers one save_chat_message_request. The relay turns it
+// into chat_saved or chat_save_failed for the sending client. In strict
+// delivery the relay has held the message back, so a successful reply carries
+// the envelope for it to broadcast.
+type chatSaveReply struct {
+	conn        *relayConn
+	messageID   string
+	channelUUID string
+	clientUUID  string
+	envelope    map[string]interface{}
+}
+
+func (r chatSaveReply) result(saved SaveChatMessageResponse, err error) {
+	switch {
+	case errors.Is(err, errStoreConflict):
+		log.Printf("Duplicate message replay ignored for channel %s message_id=%s", r.channelUUID, r.messageID)
+		r.failed("Duplicate message")
+	case err != nil:
+		log.Println("Error: Database failed to insert message:", err)
+		r.failed("Database failed to save message")
+	default:
+		saved.Envelope = r.envelope
+		r.send(saved)
+	}
+}
+
+// rejected reports a message the host refused to store.
+func (r chatSaveReply) rejected(reason string) {
+	log.Println("Rejecting chat message:", reason)
+	r.failed("Message rejected: " + reason)
+}
+
+func (r chatSaveReply) failed(reason string) {
+	r.send(SaveChatMessageResponse{Error: reason})
+}
+
+func (r chatSaveReply) send(res SaveChatMessageResponse) {
+	res.MessageID = r.messageID
+	res.ChannelUUID = r.channelUUID
+	res.ClientUUID = r.clientUUID
+	sendToConn(r.conn, WSMessage{Type: "save_chat_message_response", Data: res})
+}
+
+// senderKeyEnvelopeInfo reports the kind and epoch of a version 2 or 3
+// (sender key) envelope. The epoch is 0 when missing or not a positive integer.
+func senderKeyEnvelopeInfo(envelope map[string]interface{}) (kind string, epoch int64, ok bool) {
+	version, _ := envelope["v"].(float64)
+	if version != float64(int(version)) || !isSenderKeyVersion(int(version)) {
+		return "", 0, false
+	}
+	kind = stringField(envelope, "kind")
+	rawEpoch, _ := envelope["epoch"].(float64)
+	if rawEpoch < 1 || rawEpoch > 1<<53 || rawEpoch != math.Trunc(rawEpoch) {
+		return kind, 0, true
+	}
+	return kind, int64(rawEpoch), true
+}
+
+// senderKeysForMessages loads the sender keys the sender-key messages on a
+// history page were encrypted under, so the page can be read on its own.
+func senderKeysForMessages(channelUUID string, messages []GetMessagesMessage) []map[string]interface{} {
+	var refs []SenderKeyRef
+	seen := make(map[SenderKeyRef]struct{})
+	for _, msg := range messages {
+		kind, epoch, ok := senderKeyEnvelopeInfo(msg.Envelope)
+		if !ok || kind != envelopeKindMessage || epoch <= 0 {
+			continue
+		}
+		ref := SenderKeyRef{SenderAuthPublicKey: stringField(msg.Envelope, "sender_auth_public_key"), Epoch: epoch}
+		if _, dup := seen[ref]; dup {
+			continue
+		}
+		seen[ref] = struct{}{}
+		refs = append(refs, ref)
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	stored, err := hostStore.SenderKeys(channelUUID, refs)
+	if err != nil {
+		log.Println("Error loading sender keys:", err)
+		return nil
+	}
+	keys := make([]map[string]interface{}, 0, len(stored))
+	for _, key := range stored {
+		var envelope map[string]interface{}
+		if err := json.Unmarshal([]byte(key.Content), &envelope); err != nil {
+			log.Println("Error unmarshalling sender key envelope:", err)
+			continue
+		}
+		keys = append(keys, envelope)
+	}
+	return keys
 }
 
 func stringField(values map[string]interface{}, key string) string {
@@ -82,7 +205,7 @@ func stringField(values map[string]interface{}, key string) string {
 	return text
 }
 
-func handleGetMessages(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleGetMessages(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[GetMessagesRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding get_messages_request:", err)
@@ -91,13 +214,19 @@ func handleGetMessages(conn *websocket.Conn, wsMsg *WSMessage) {
 
 	const messageRequestSize = 50
 
-	rows, err := db.ChatDB.Query(`
-		SELECT id, channel_uuid, content, user_id, timestamp
-		FROM messages
-		WHERE channel_uuid = ? AND timestamp < ?
-		ORDER BY timestamp DESC
-		LIMIT ?
-	`, data.ChannelUUID, data.BeforeUnixTime, messageRequestSize+1) // Get one extra to check if there are more
+	// A sequence range is answered oldest first; a page before a time comes
+	// back newest first and is reversed below.
+	inRange := data.FromSeq > 0
+	var stored []StoredMessage
+	if inRange {
+		toSeq := data.ToSeq
+		if toSeq <= 0 {
+			toSeq = math.MaxInt64
+		}
+		stored, err = hostStore.MessagesInRange(data.ChannelUUID, data.FromSeq, toSeq, messageRequestSize+1)
+	} else {
+		stored, err = hostStore.MessagesBefore(data.ChannelUUID, data.BeforeUnixTime, messageRequestSize+1) // Get one extra to check if there are more
+	}
 	if err != nil {
 		sendToConn(conn, WSMessage{
 			Type: "error",
@@ -108,22 +237,21 @@ func handleGetMessages(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
-	defer rows.Close()
 
 	var messages []GetMessagesMessage
 
 	userIDSet := make(map[int]struct{})
 
-	for rows.Next() {
-		var msg GetMessagesMessage
-		var envelopeRaw string
-		err = rows.Scan(&msg.ID, &msg.ChannelUUID, &envelopeRaw, &msg.UserID, &msg.Timestamp)
-		if err != nil {
-			log.Println("Error scanning message:", err)
-			continue
+	for _, row := range stored {
+		msg := GetMessagesMessage{
+			ID:          row.ID,
+			ChannelUUID: row.ChannelUUID,
+			UserID:      row.UserID,
+			Timestamp:   row.Timestamp,
+			Seq:         row.Seq,
 		}
-		if envelopeRaw != "" {
-			if err := json.Unmarshal([]byte(envelopeRaw), &msg.Envelope); err != nil {
+		if row.Content != "" {
+			if err := json.Unmarshal([]byte(row.Content), &msg.Envelope); err != nil {
 				log.Println("Error unmarshalling encrypted message envelope:", err)
 				continue
 			}
@@ -132,10 +260,6 @@ func handleGetMessages(conn *websocket.Conn, wsMsg *WSMessage) {
 		messages = append(messages, msg)
 	}
 
-	if err = rows.Err(); err != nil {
-		log.Println("Row iteration error:", err)
-	}
-
 	if len(messages) > 0 {
 		// Deduplicate user_ids
 		var userIDs []int
@@ -178,8 +302,10 @@ func handleGetMessages(conn *websocket.Conn, wsMsg *WSMessage) {
 	}
 
 	// Reverse so messages are sent oldest → newest
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+	if !inRange {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
 	}
 
 	// Send response
@@ -187,7 +313,9 @@ func handleGetMessages(conn *websocket.Conn, wsMsg *WSMessage) {
 		Type: "get_messages_response",
 		Data: GetMessagesResponse{
 			Messages:        messages,
+			SenderKeys:      senderKeysForMessages(data.ChannelUUID, messages),
 			HasMoreMessages: hasMoreMessages,
+			FromSeq:         data.FromSeq,
 			ChannelUUID:     data.ChannelUUID,
 			ClientUUID:      data.ClientUUID,
 		},
@@ -0,0 +1,52 @@
+CREATE TABLE IF NOT EXISTS chat_users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    public_key TEXT NOT NULL UNIQUE,
+    enc_public_key TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS spaces (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    author_id INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS channels (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    space_uuid TEXT NOT NULL,
+    allow_voice INTEGER DEFAULT 0,
+    FOREIGN KEY (space_uuid) REFERENCES spaces(uuid) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    channel_uuid TEXT NOT NULL,
+    content TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    message_id TEXT NOT NULL DEFAULT '',
+    sender_auth_public_key TEXT NOT NULL DEFAULT '',
+    timestamp TEXT,
+    FOREIGN KEY (channel_uuid) REFERENCES channels(uuid) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS space_users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    space_uuid TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    joined INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (space_uuid) REFERENCES spaces(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_channels_space_uuid ON channels(space_uuid);
+CREATE INDEX IF NOT EXISTS idx_messages_channel_time ON messages(channel_uuid, timestamp);
+CREATE INDEX IF NOT EXISTS idx_chat_users_public_key ON chat_users(public_key);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_space_users_unique_space_user
+    ON space_users(space_uuid, user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_channel_sender_msgid
+    ON messages(channel_uuid, sender_auth_public_key, message_id)
+    WHERE message_id <> '' AND sender_auth_public_key <> '';
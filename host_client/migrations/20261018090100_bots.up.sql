@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS bots (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    signing_private_key TEXT NOT NULL,
+    enc_private_key TEXT NOT NULL,
+    api_token_hash TEXT NOT NULL UNIQUE,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES chat_users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS user_devices (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    device_id TEXT NOT NULL,
+    device_name TEXT NOT NULL,
+    enc_public_key TEXT NOT NULL DEFAULT '',
+    first_seen TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TEXT,
+    FOREIGN KEY (user_id) REFERENCES chat_users(id) ON DELETE CASCADE,
+    UNIQUE (user_id, device_id)
+);
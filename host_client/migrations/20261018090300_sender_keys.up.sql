@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS sender_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    channel_uuid TEXT NOT NULL,
+    sender_auth_public_key TEXT NOT NULL,
+    epoch INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (channel_uuid) REFERENCES channels(uuid) ON DELETE CASCADE,
+    UNIQUE (channel_uuid, sender_auth_public_key, epoch)
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS space_bans;
+DROP INDEX IF EXISTS idx_moderation_reports_space_status;
+DROP TABLE IF EXISTS moderation_reports;
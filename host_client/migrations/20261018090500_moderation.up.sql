@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS moderation_reports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    space_uuid TEXT NOT NULL,
+    channel_uuid TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL,
+    reporter_user_id INTEGER NOT NULL,
+    target_public_key TEXT NOT NULL,
+    message_id TEXT NOT NULL DEFAULT '',
+    envelope TEXT NOT NULL DEFAULT '',
+    excerpt TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'open',
+    action TEXT NOT NULL DEFAULT '',
+    resolved_by INTEGER,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TEXT,
+    FOREIGN KEY (space_uuid) REFERENCES spaces(uuid) ON DELETE CASCADE,
+    FOREIGN KEY (reporter_user_id) REFERENCES chat_users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_moderation_reports_space_status ON moderation_reports (space_uuid, status);
+
+CREATE TABLE IF NOT EXISTS space_bans (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    space_uuid TEXT NOT NULL,
+    public_key TEXT NOT NULL,
+    banned_by INTEGER NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (space_uuid) REFERENCES spaces(uuid) ON DELETE CASCADE,
+    UNIQUE (space_uuid, public_key)
+);
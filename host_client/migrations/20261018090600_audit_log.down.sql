@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS audit_log_no_delete;
+DROP TRIGGER IF EXISTS audit_log_no_update;
+DROP INDEX IF EXISTS idx_audit_log_space_id;
+DROP TABLE IF EXISTS audit_log;
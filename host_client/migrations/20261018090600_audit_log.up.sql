@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    space_uuid TEXT NOT NULL,
+    actor_user_id INTEGER NOT NULL DEFAULT 0,
+    actor_public_key TEXT NOT NULL DEFAULT '',
+    action TEXT NOT NULL,
+    details TEXT NOT NULL DEFAULT '{}',
+    created_at TEXT NOT NULL,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    signing_public_key TEXT NOT NULL,
+    signature TEXT NOT NULL,
+    UNIQUE (space_uuid, prev_hash)
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_space_id ON audit_log (space_uuid, id);
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS bots;
+DROP TABLE IF EXISTS space_users;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS channels;
+DROP TABLE IF EXISTS spaces;
+DROP TABLE IF EXISTS chat_users;
@@ -0,0 +1,60 @@
+-- PostgreSQL baseline for the host store. Mirrors the SQLite migrations in
+-- ../migrations; timestamps stay TEXT so both backends return the same values.
+CREATE TABLE IF NOT EXISTS chat_users (
+    id SERIAL PRIMARY KEY,
+    public_key TEXT NOT NULL UNIQUE,
+    enc_public_key TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+    updated_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+
+CREATE TABLE IF NOT EXISTS spaces (
+    id SERIAL PRIMARY KEY,
+    uuid TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    author_id INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS channels (
+    id SERIAL PRIMARY KEY,
+    uuid TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    space_uuid TEXT NOT NULL REFERENCES spaces(uuid) ON DELETE CASCADE,
+    allow_voice INTEGER DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id SERIAL PRIMARY KEY,
+    channel_uuid TEXT NOT NULL REFERENCES channels(uuid) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    message_id TEXT NOT NULL DEFAULT '',
+    sender_auth_public_key TEXT NOT NULL DEFAULT '',
+    timestamp TEXT
+);
+
+CREATE TABLE IF NOT EXISTS space_users (
+    id SERIAL PRIMARY KEY,
+    space_uuid TEXT NOT NULL REFERENCES spaces(uuid) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL,
+    joined INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS bots (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL UNIQUE REFERENCES chat_users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    signing_private_key TEXT NOT NULL,
+    enc_private_key TEXT NOT NULL,
+    api_token_hash TEXT NOT NULL UNIQUE,
+    created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+
+CREATE INDEX IF NOT EXISTS idx_channels_space_uuid ON channels(space_uuid);
+CREATE INDEX IF NOT EXISTS idx_messages_channel_time ON messages(channel_uuid, timestamp);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_space_users_unique_space_user
+    ON space_users(space_uuid, user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_channel_sender_msgid
+    ON messages(channel_uuid, sender_auth_public_key, message_id)
+    WHERE message_id <> '' AND sender_auth_public_key <> '';
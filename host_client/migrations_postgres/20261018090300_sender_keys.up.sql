@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS sender_keys (
+    id SERIAL PRIMARY KEY,
+    channel_uuid TEXT NOT NULL REFERENCES channels(uuid) ON DELETE CASCADE,
+    sender_auth_public_key TEXT NOT NULL,
+    epoch BIGINT NOT NULL,
+    content TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+    UNIQUE (channel_uuid, sender_auth_public_key, epoch)
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_messages_channel_seq;
+ALTER TABLE messages DROP COLUMN seq;
+ALTER TABLE channels DROP COLUMN last_seq;
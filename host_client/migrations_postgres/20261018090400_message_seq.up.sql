@@ -0,0 +1,15 @@
+ALTER TABLE channels ADD COLUMN last_seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN seq BIGINT NOT NULL DEFAULT 0;
+
+UPDATE messages SET seq = numbered.seq
+  FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY channel_uuid ORDER BY timestamp, id) AS seq
+      FROM messages
+  ) AS numbered
+ WHERE numbered.id = messages.id;
+
+UPDATE channels SET last_seq = (
+    SELECT COALESCE(MAX(seq), 0) FROM messages WHERE messages.channel_uuid = channels.uuid
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_channel_seq ON messages(channel_uuid, seq);
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS moderation_reports (
+    id SERIAL PRIMARY KEY,
+    space_uuid TEXT NOT NULL REFERENCES spaces(uuid) ON DELETE CASCADE,
+    channel_uuid TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL,
+    reporter_user_id INTEGER NOT NULL REFERENCES chat_users(id) ON DELETE CASCADE,
+    target_public_key TEXT NOT NULL,
+    message_id TEXT NOT NULL DEFAULT '',
+    envelope TEXT NOT NULL DEFAULT '',
+    excerpt TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'open',
+    action TEXT NOT NULL DEFAULT '',
+    resolved_by INTEGER,
+    created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+    resolved_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_moderation_reports_space_status ON moderation_reports (space_uuid, status);
+
+CREATE TABLE IF NOT EXISTS space_bans (
+    id SERIAL PRIMARY KEY,
+    space_uuid TEXT NOT NULL REFERENCES spaces(uuid) ON DELETE CASCADE,
+    public_key TEXT NOT NULL,
+    banned_by INTEGER NOT NULL,
+    created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+    UNIQUE (space_uuid, public_key)
+);
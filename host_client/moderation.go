@@ -0,0 +1,418 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	reportKindMessage = "message"
+	reportKindUser    = "user"
+
+	reportStatusOpen     = "open"
+	reportStatusResolved = "resolved"
+
+	reportActionDismiss       = "dismiss"
+	reportActionDeleteMessage = "delete_message"
+	reportActionRemoveUser    = "remove_user"
+	reportActionBanUser       = "ban_user"
+
+	maxReportReasonLength  = 500
+	maxReportExcerptLength = 2000
+	maxListedReports       = 100
+)
+
+// isKeyBannedFromSpace fails closed: a ban that cannot be checked is treated
+// as a ban.
+func isKeyBannedFromSpace(spaceUUID, publicKey string) bool {
+	banned, err := hostStore.IsKeyBanned(spaceUUID, publicKey)
+	if err != nil {
+		log.Println("Error checking space ban:", err)
+		return true
+	}
+	return banned
+}
+
+func validateReportText(reason, excerpt string) string {
+	if utf8.RuneCountInString(reason) > maxReportReasonLength {
+		return "Report reason is too long"
+	}
+	if utf8.RuneCountInString(excerpt) > maxReportExcerptLength {
+		return "Report excerpt is too long"
+	}
+	return ""
+}
+
+// handleReportMessage files a report against a message. The reporter hands
+// over the envelope they received; its signature proves who sent it, so the
+// host never needs to read the message. Any plaintext is what the reporter
+// chose to disclose.
+func handleReportMessage(conn *relayConn, wsMsg *WSMessage) {
+	data, err := decodeData[ReportMessageRequest](wsMsg.Data)
+	if err != nil {
+		log.Println("error decoding report_message_request:", err)
+		return
+	}
+
+	requester, err := resolveHostUserIdentityStrict(data.RequesterUserID, data.RequesterUserPublicKey, data.RequesterUserEncPublicKey)
+	if err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Failed to resolve requester identity", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if err := ensureSpaceMember(data.SpaceUUID, requester.ID); err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Not authorized to report in this space", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	reason := strings.TrimSpace(data.Reason)
+	excerpt := strings.TrimSpace(data.Excerpt)
+	if msg := validateReportText(reason, excerpt); msg != "" {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: msg, ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	channelSpaceUUID, _, err := loadChannelAuthz(data.ChannelUUID)
+	if err != nil || channelSpaceUUID != data.SpaceUUID {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Reported channel not found in this space", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if kind, _, ok := senderKeyEnvelopeInfo(data.Envelope); ok && kind != envelopeKindMessage {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Only chat messages can be reported", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	envelopeJSON, err := json.Marshal(data.Envelope)
+	if err != nil || len(envelopeJSON) > maxPersistedEnvelopeBytes {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Reported message is malformed", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if err := verifyEnvelope(envelopeJSON, data.SpaceUUID, data.ChannelUUID); err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Reported message rejected: " + err.Error(), ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	report, err := hostStore.CreateReport(ModerationReport{
+		SpaceUUID:       data.SpaceUUID,
+		ChannelUUID:     data.ChannelUUID,
+		Kind:            reportKindMessage,
+		ReporterUserID:  requester.ID,
+		TargetPublicKey: stringField(data.Envelope, "sender_auth_public_key"),
+		MessageID:       stringField(data.Envelope, "message_id"),
+		Envelope:        string(envelopeJSON),
+		Excerpt:         excerpt,
+		Reason:          reason,
+	})
+	if err != nil {
+		log.Println("Error saving message report:", err)
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Database failed to save report", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	sendToConn(conn, WSMessage{
+		Type: "report_response",
+		Data: ReportResponse{ReportID: report.ID, Kind: report.Kind, SpaceUUID: report.SpaceUUID, ClientUUID: data.ClientUUID},
+	})
+}
+
+func handleReportUser(conn *relayConn, wsMsg *WSMessage) {
+	data, err := decodeData[ReportUserRequest](wsMsg.Data)
+	if err != nil {
+		log.Println("error decoding report_user_request:", err)
+		return
+	}
+
+	requester, err := resolveHostUserIdentityStrict(data.RequesterUserID, data.RequesterUserPublicKey, data.RequesterUserEncPublicKey)
+	if err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Failed to resolve requester identity", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if err := ensureSpaceMember(data.SpaceUUID, requester.ID); err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Not authorized to report in this space", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	reason := strings.TrimSpace(data.Reason)
+	if msg := validateReportText(reason, ""); msg != "" {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: msg, ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	target, err := lookupHostUserByPublicKey(data.UserPublicKey)
+	if err == nil && target.ID == requester.ID {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Cannot report yourself", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if err != nil || ensureSpaceMember(data.SpaceUUID, target.ID) != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Reported user is not a member of this space", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	report, err := hostStore.CreateReport(ModerationReport{
+		SpaceUUID:       data.SpaceUUID,
+		Kind:            reportKindUser,
+		ReporterUserID:  requester.ID,
+		TargetPublicKey: target.PublicKey,
+		Reason:          reason,
+	})
+	if err != nil {
+		log.Println("Error saving user report:", err)
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Database failed to save report", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	sendToConn(conn, WSMessage{
+		Type: "report_response",
+		Data: ReportResponse{ReportID: report.ID, Kind: report.Kind, SpaceUUID: report.SpaceUUID, ClientUUID: data.ClientUUID},
+	})
+}
+
+// handleListReports shows the space author the moderation queue, open
+// reports by default.
+func handleListReports(conn *relayConn, wsMsg *WSMessage) {
+	data, err := decodeData[ListReportsRequest](wsMsg.Data)
+	if err != nil {
+		log.Println("error decoding list_reports_request:", err)
+		return
+	}
+
+	requester, err := resolveHostUserIdentityStrict(data.RequesterUserID, data.RequesterUserPublicKey, data.RequesterUserEncPublicKey)
+	if err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Failed to resolve requester identity", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if err := ensureSpaceAuthor(data.SpaceUUID, requester.ID); err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Not authorized to moderate this space", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	status := data.Status
+	switch status {
+	case "":
+		status = reportStatusOpen
+	case "all":
+		status = ""
+	case reportStatusOpen, reportStatusResolved:
+	default:
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Unknown report status", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	reports, err := hostStore.SpaceReports(data.SpaceUUID, status, maxListedReports)
+	if err != nil {
+		log.Println("Error listing reports:", err)
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Database failed to list reports", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	sendToConn(conn, WSMessage{
+		Type: "list_reports_response",
+		Data: ListReportsResponse{SpaceUUID: data.SpaceUUID, Reports: reports, ClientUUID: data.ClientUUID},
+	})
+}
+
+// handleResolveReport applies the author's decision and closes the report.
+// Removing or banning a member goes through removeSpaceUser, so the relay
+// drops the member's sessions exactly as for a manual removal.
+func handleResolveReport(conn *relayConn, wsMsg *WSMessage) {
+	data, err := decodeData[ResolveReportRequest](wsMsg.Data)
+	if err != nil {
+		log.Println("error decoding resolve_report_request:", err)
+		return
+	}
+
+	requester, err := resolveHostUserIdentityStrict(data.RequesterUserID, data.RequesterUserPublicKey, data.RequesterUserEncPublicKey)
+	if err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Failed to resolve requester identity", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	report, err := hostStore.Report(data.ReportID)
+	if err != nil || report.SpaceUUID != data.SpaceUUID {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Report not found", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if err := ensureSpaceAuthor(report.SpaceUUID, requester.ID); err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Not authorized to moderate this space", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if report.Status != reportStatusOpen {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Report is already resolved", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	removal := RemoveSpaceUserRequest{
+		SpaceUUID:                 report.SpaceUUID,
+		UserPublicKey:             report.TargetPublicKey,
+		RequesterUserID:           requester.ID,
+		RequesterUserPublicKey:    requester.PublicKey,
+		RequesterUserEncPublicKey: requester.EncPublicKey,
+		ClientUUID:                data.ClientUUID,
+	}
+	var deletedMessageID string
+	switch data.Action {
+	case reportActionDismiss:
+	case reportActionDeleteMessage:
+		if report.Kind != reportKindMessage {
+			sendToConn(conn, WSMessage{
+				Type: "error",
+				Data: ChatError{Content: "Only message reports can delete a message", ClientUUID: data.ClientUUID},
+			})
+			return
+		}
+		// A message another report already removed counts as deleted.
+		err := hostStore.DeleteMessage(report.ChannelUUID, report.TargetPublicKey, report.MessageID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Println("Error deleting reported message:", err)
+			sendToConn(conn, WSMessage{
+				Type: "error",
+				Data: ChatError{Content: "Database failed to delete message", ClientUUID: data.ClientUUID},
+			})
+			return
+		}
+		deletedMessageID = report.MessageID
+	case reportActionRemoveUser:
+		if !removeSpaceUser(conn, removal) {
+			return
+		}
+	case reportActionBanUser:
+		if !banReportedKey(conn, report, requester.ID, removal) {
+			return
+		}
+	default:
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Unknown moderation action", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	if err := hostStore.ResolveReport(report.ID, data.Action, requester.ID); err != nil {
+		msg := "Database failed to resolve report"
+		if err == sql.ErrNoRows {
+			msg = "Report is already resolved"
+		}
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: msg, ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if resolved, err := hostStore.Report(report.ID); err == nil {
+		report = resolved
+	}
+	recordAudit(report.SpaceUUID, requester, auditActionResolveReport, map[string]string{
+		"report_id":         strconv.Itoa(report.ID),
+		"action":            data.Action,
+		"target_public_key": report.TargetPublicKey,
+	})
+
+	sendToConn(conn, WSMessage{
+		Type: "resolve_report_response",
+		Data: ResolveReportResponse{Report: report, DeletedMessageID: deletedMessageID, ClientUUID: data.ClientUUID},
+	})
+}
+
+// banReportedKey bans the reported key from the space and removes its user if
+// they are still a member or invited. The ban is recorded first, so the key
+// stays out even if it has never connected to this host.
+func banReportedKey(conn *relayConn, report ModerationReport, requesterID int, removal RemoveSpaceUserRequest) bool {
+	space, err := hostStore.Space(report.SpaceUUID)
+	if err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Failed to load space author", ClientUUID: removal.ClientUUID},
+		})
+		return false
+	}
+	target, lookupErr := lookupHostUserByPublicKey(report.TargetPublicKey)
+	if lookupErr == nil && target.ID == space.AuthorID {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Cannot ban the space author", ClientUUID: removal.ClientUUID},
+		})
+		return false
+	}
+
+	if err := hostStore.BanKey(report.SpaceUUID, report.TargetPublicKey, requesterID); err != nil && !errors.Is(err, errStoreConflict) {
+		log.Println("Error banning key:", err)
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Database failed to ban user", ClientUUID: removal.ClientUUID},
+		})
+		return false
+	}
+	if lookupErr != nil {
+		return true
+	}
+	if _, err := hostStore.Membership(report.SpaceUUID, target.ID); err == sql.ErrNoRows {
+		return true
+	}
+	return removeSpaceUser(conn, removal)
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	relayWriteTimeout  = 10 * time.Second
+	relaySendQueueSize = 256
+
+	// Chat saves for one channel always land on the same lane, so they are
+	// persisted in the order the relay forwarded them.
+	chatSaveLanes = 4
+)
+
+// relayConn owns all writes to the relay socket. Handlers on any worker queue
+// messages with sendToConn; a single writer goroutine puts them on the wire.
+type relayConn struct {
+	ws        *websocket.Conn
+	send      chan WSMessage
+	done      chan struct{}
+	closeOnce *sync.Once
+	// requestID is set on the view of the connection a handler gets, so
+	// everything it sends answers the relay's request.
+	requestID string
+	// reconnectAfter is the relay's hint from relay_shutdown, read by the
+	// reconnect loop once the socket closes.
+	reconnectAfter time.Duration
+}
+
+func newRelayConn(ws *websocket.Conn) *relayConn {
+	conn := &relayConn{
+		ws:        ws,
+		send:      make(chan WSMessage, relaySendQueueSize),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	go conn.writePump()
+	return conn
+}
+
+// forRequest returns a view of the connection whose sends carry requestID.
+func (c *relayConn) forRequest(requestID string) *relayConn {
+	if requestID == "" {
+		return c
+	}
+	view := *c
+	view.requestID = requestID
+	return &view
+}
+
+func (c *relayConn) writePump() {
+	for {
+		select {
+		case msg := <-c.send:
+			_ = c.ws.SetWriteDeadline(time.Now().Add(relayWriteTimeout))
+			if err := c.ws.WriteJSON(msg); err != nil {
+				log.Printf("Relay write failed: %v", err)
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// keepalive pings the relay until the connection closes. The read loop calls
+// touch after every message; a relay that sends nothing, not even a pong,
+// for pongTimeout trips the read deadline and the host reconnects.
+func (c *relayConn) keepalive(pingInterval, pongTimeout time.Duration) {
+	c.touch(pongTimeout)
+	c.ws.SetPongHandler(func(string) error {
+		c.touch(pongTimeout)
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(relayWriteTimeout)); err != nil {
+					log.Printf("Relay ping failed: %v", err)
+					c.close()
+					return
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+func (c *relayConn) touch(pongTimeout time.Duration) {
+	_ = c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
+}
+
+// close stops the writer and closes the socket, which also ends the read loop.
+func (c *relayConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.ws.Close()
+	})
+}
+
+// sendToConn queues msg for the writer. It blocks while the send queue is
+// full, which in turn slows the workers producing responses.
+func sendToConn(conn *relayConn, msg WSMessage) {
+	if msg.RequestID == "" {
+		msg.RequestID = conn.requestID
+	}
+	select {
+	case conn.send <- msg:
+	case <-conn.done:
+		hostRequestMetrics.dropped.Add(1)
+		log.Printf("SendToClient: relay connection closed, dropping %s", msg.Type)
+	}
+}
+
+type relayRequestHandler func(conn *relayConn, wsMsg *WSMessage)
+
+var relayRequestHandlers = map[string]relayRequestHandler{
+	"update_username_request":      handleUpdateUsername,
+	"get_dash_data_request":        handleGetDashData,
+	"create_space_request":         handleCreateSpace,
+	"delete_space_request":         handleDeleteSpace,
+	"create_channel_request":       handleCreateChannel,
+	"delete_channel_request":       handleDeleteChannel,
+	"invite_user_request":          handleInviteUser,
+	"accept_invite_request":        handleAcceptInvite,
+	"decline_invite_request":       handleDeclineInvite,
+	"leave_space_request":          handleLeaveSpace,
+	"remove_space_user_request":    handleRemoveSpaceUser,
+	"get_messages_request":         handleGetMessages,
+	"channel_allow_voice_request":  handleChannelAllowVoice,
+	"reissue_capabilities_request": handleReissueCapabilitiesRequest,
+	"list_devices_request":         handleListDevices,
+	"revoke_device_request":        handleRevokeDevice,
+	"identity_migrate_request":     handleIdentityMigrate,
+	"save_chat_message_request":    handleSaveChatMessage,
+	"report_message_request":       handleReportMessage,
+	"report_user_request":          handleReportUser,
+	"list_reports_request":         handleListReports,
+	"resolve_report_request":       handleResolveReport,
+	"get_audit_log_request":        handleGetAuditLog,
+	"export_space_request":         handleExportSpace,
+}
+
+type relayJob struct {
+	msg     WSMessage
+	handler relayRequestHandler
+}
+
+// requestDispatcher runs relay requests on a bounded worker pool. General
+// requests share one queue; chat saves are sharded by channel onto lanes that
+// each have a single worker. Admission is capped by maxPending across both.
+type requestDispatcher struct {
+	conn       *relayConn
+	general    chan relayJob
+	lanes      []chan relayJob
+	maxPending int64
+	wg         sync.WaitGroup
+}
+
+func newRequestDispatcher(conn *relayConn, workers, maxPending int) *requestDispatcher {
+	d := &requestDispatcher{
+		conn:       conn,
+		general:    make(chan relayJob, maxPending),
+		lanes:      make([]chan relayJob, chatSaveLanes),
+		maxPending: int64(maxPending),
+	}
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work(d.general)
+	}
+	for i := range d.lanes {
+		d.lanes[i] = make(chan relayJob, maxPending)
+		d.wg.Add(1)
+		go d.work(d.lanes[i])
+	}
+	return d
+}
+
+// submit queues a relay request and reports whether its type is handled by
+// the pool. Requests beyond the pending limit are refused, not queued.
+func (d *requestDispatcher) submit(wsMsg WSMessage) bool {
+	handler, ok := relayRequestHandlers[wsMsg.Type]
+	if !ok {
+		return false
+	}
+	if !hostRequestMetrics.admit(d.maxPending) {
+		d.rejectBusy(wsMsg)
+		return true
+	}
+
+	job := relayJob{msg: wsMsg, handler: handler}
+	if wsMsg.Type == "save_chat_message_request" {
+		d.lanes[chatSaveLane(wsMsg, len(d.lanes))] <- job
+	} else {
+		d.general <- job
+	}
+	return true
+}
+
+// stop waits for every queued request to finish. Chat saves still reach the
+// database after a disconnect; their replies are dropped.
+func (d *requestDispatcher) stop() {
+	close(d.general)
+	for _, lane := range d.lanes {
+		close(lane)
+	}
+	d.wg.Wait()
+}
+
+func (d *requestDispatcher) work(jobs <-chan relayJob) {
+	defer d.wg.Done()
+	for job := range jobs {
+		d.run(job)
+	}
+}
+
+func (d *requestDispatcher) run(job relayJob) {
+	started := time.Now()
+	conn := d.conn.forRequest(job.msg.RequestID)
+	defer func() {
+		if r := recover(); r != nil {
+			hostRequestMetrics.panics.Add(1)
+			log.Printf("Panic handling %s: %v", job.msg.Type, r)
+			// Answer the request so the client is not left waiting for
+			// the relay's timeout.
+			if job.msg.RequestID != "" {
+				sendToConn(conn, WSMessage{Type: "error", Data: ChatError{Content: "Host failed to handle the request"}})
+			}
+		}
+		hostRequestMetrics.finish(time.Since(started))
+	}()
+	job.handler(conn, &job.msg)
+}
+
+func (d *requestDispatcher) rejectBusy(wsMsg WSMessage) {
+	fields, _ := wsMsg.Data.(map[string]interface{})
+	hostRequestMetrics.logRejection(wsMsg.Type)
+	if wsMsg.Type == "save_chat_message_request" {
+		// The relay has already broadcast the message; a failed save reply
+		// becomes chat_save_failed, so the sender knows to send it again.
+		envelope, _ := fields["envelope"].(map[string]interface{})
+		chatSaveReply{
+			conn:        d.conn.forRequest(wsMsg.RequestID),
+			messageID:   stringField(envelope, "message_id"),
+			channelUUID: stringField(fields, "channel_uuid"),
+			clientUUID:  stringField(fields, "client_uuid"),
+		}.failed("Host is busy, please try again")
+		return
+	}
+	if clientUUID := stringField(fields, "client_uuid"); clientUUID != "" || wsMsg.RequestID != "" {
+		sendToConn(d.conn.forRequest(wsMsg.RequestID), WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Host is busy, please try again", ClientUUID: clientUUID},
+		})
+	}
+}
+
+func chatSaveLane(wsMsg WSMessage, lanes int) int {
+	fields, _ := wsMsg.Data.(map[string]interface{})
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(stringField(fields, "channel_uuid")))
+	return int(hash.Sum32() % uint32(lanes))
+}
+
+// requestMetrics is logged every HOST_REQUEST_METRICS_INTERVAL and reported
+// by the local API at GET /api/metrics when that is enabled.
+type requestMetrics struct {
+	pending     atomic.Int64
+	peakPending atomic.Int64
+	processed   atomic.Int64
+	rejected    atomic.Int64
+	panics      atomic.Int64
+	dropped     atomic.Int64
+	busyNanos   atomic.Int64
+
+	rejectLogMu sync.Mutex
+	lastLogged  time.Time
+}
+
+type requestMetricsSnapshot struct {
+	Pending         int64   `json:"pending"`
+	PeakPending     int64   `json:"peak_pending"`
+	MaxPending      int     `json:"max_pending"`
+	Workers         int     `json:"workers"`
+	Processed       int64   `json:"processed"`
+	Rejected        int64   `json:"rejected"`
+	Panics          int64   `json:"panics"`
+	DroppedReplies  int64   `json:"dropped_replies"`
+	AvgHandleMillis float64 `json:"avg_handle_ms"`
+}
+
+var hostRequestMetrics requestMetrics
+
+func (m *requestMetrics) admit(limit int64) bool {
+	pending := m.pending.Add(1)
+	if pending > limit {
+		m.pending.Add(-1)
+		m.rejected.Add(1)
+		return false
+	}
+	for {
+		peak := m.peakPending.Load()
+		if pending <= peak || m.peakPending.CompareAndSwap(peak, pending) {
+			return true
+		}
+	}
+}
+
+func (m *requestMetrics) finish(elapsed time.Duration) {
+	m.pending.Add(-1)
+	m.processed.Add(1)
+	m.busyNanos.Add(int64(elapsed))
+}
+
+// logRejection logs at most every 10 seconds so an overload does not also
+// flood the log.
+func (m *requestMetrics) logRejection(requestType string) {
+	m.rejectLogMu.Lock()
+	defer m.rejectLogMu.Unlock()
+	if time.Since(m.lastLogged) < 10*time.Second {
+		return
+	}
+	m.lastLogged = time.Now()
+	log.Printf("Host busy: refused %s (%d pending, %d refused so far)", requestType, m.pending.Load(), m.rejected.Load())
+}
+
+func (m *requestMetrics) snapshot() requestMetricsSnapshot {
+	workers, maxPending := requestPoolSettings()
+	snapshot := requestMetricsSnapshot{
+		Pending:        m.pending.Load(),
+		PeakPending:    m.peakPending.Load(),
+		MaxPending:     maxPending,
+		Workers:        workers,
+		Processed:      m.processed.Load(),
+		Rejected:       m.rejected.Load(),
+		Panics:         m.panics.Load(),
+		DroppedReplies: m.dropped.Load(),
+	}
+	if snapshot.Processed > 0 {
+		snapshot.AvgHandleMillis = float64(m.busyNanos.Load()) / float64(snapshot.Processed) / float64(time.Millisecond)
+	}
+	return snapshot
+}
+
+// requestMetricsLogInterval reads HOST_REQUEST_METRICS_INTERVAL. Zero
+// disables the log.
+func requestMetricsLogInterval() (time.Duration, error) {
+	raw := strings.TrimSpace(requestMetricsInterval)
+	if raw == "" {
+		return defaultRequestMetricsInterval, nil
+	}
+	if raw == "0" || raw == "off" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(raw)
+	if err != nil || interval < time.Second {
+		return 0, fmt.Errorf("invalid HOST_REQUEST_METRICS_INTERVAL %q: want a duration of at least 1s, or 0 to disable", raw)
+	}
+	return interval, nil
+}
+
+// startRequestMetricsLog logs the request metrics every interval until ctx
+// ends, skipping intervals in which no request came in.
+func startRequestMetricsLog(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var last requestMetricsSnapshot
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				snapshot := hostRequestMetrics.snapshot()
+				if snapshot.Processed == last.Processed && snapshot.Rejected == last.Rejected && snapshot.Pending == 0 {
+					continue
+				}
+				last = snapshot
+				log.Printf("Relay requests: %d pending (peak %d of %d), %d processed, %d refused, %d panicked, %d replies dropped, avg %.1fms",
+					snapshot.Pending, snapshot.PeakPending, snapshot.MaxPending, snapshot.Processed, snapshot.Rejected,
+					snapshot.Panics, snapshot.DroppedReplies, snapshot.AvgHandleMillis)
+			}
+		}
+	}()
+}
+
+// relayKeepaliveSettings reads HOST_RELAY_PING_INTERVAL and
+// HOST_RELAY_PONG_TIMEOUT. Unset values take the defaults; a value that is
+// set but unusable is an error rather than a silent default. The pong timeout
+// must leave room for a ping.
+func relayKeepaliveSettings() (pingInterval, pongTimeout time.Duration, err error) {
+	pingInterval = defaultRelayPingInterval
+	if raw := strings.TrimSpace(relayPingInterval); raw != "" {
+		pingInterval, err = time.ParseDuration(raw)
+		if err != nil || pingInterval <= 0 {
+			return 0, 0, fmt.Errorf("invalid HOST_RELAY_PING_INTERVAL %q: want a positive duration", raw)
+		}
+	}
+	raw := strings.TrimSpace(relayPongTimeout)
+	if raw == "" {
+		return pingInterval, max(defaultRelayPongTimeout, 2*pingInterval), nil
+	}
+	pongTimeout, err = time.ParseDuration(raw)
+	if err != nil || pongTimeout <= pingInterval {
+		return 0, 0, fmt.Errorf("invalid HOST_RELAY_PONG_TIMEOUT %q: want a duration longer than the %s ping interval", raw, pingInterval)
+	}
+	return pingInterval, pongTimeout, nil
+}
+
+// requestPoolSettings reads HOST_REQUEST_WORKERS and HOST_MAX_PENDING_REQUESTS,
+// falling back to the defaults for missing or invalid values.
+func requestPoolSettings() (workers, maxPending int) {
+	workers, err := strconv.Atoi(requestWorkers)
+	if err != nil || workers < 1 {
+		workers = defaultRequestWorkers
+	}
+	maxPending, err = strconv.Atoi(maxPendingRequests)
+	if err != nil || maxPending < 1 {
+		maxPending = defaultMaxPendingRequests
+	}
+	return workers, maxPending
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const dispatchTestTimeout = 5 * time.Second
+
+// newQueueOnlyRelayConn is a relayConn without a socket or writer, so tests
+// can read what handlers send straight off the queue.
+func newQueueOnlyRelayConn(queue int) *relayConn {
+	return &relayConn{
+		send:      make(chan WSMessage, queue),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+}
+
+// withRelayHandler swaps the handler for a request type for one test.
+func withRelayHandler(t *testing.T, requestType string, handler relayRequestHandler) {
+	t.Helper()
+	previous, existed := relayRequestHandlers[requestType]
+	relayRequestHandlers[requestType] = handler
+	t.Cleanup(func() {
+		if existed {
+			relayRequestHandlers[requestType] = previous
+		} else {
+			delete(relayRequestHandlers, requestType)
+		}
+	})
+}
+
+func TestRequestDispatcherKeepsChatSaveOrderPerChannel(t *testing.T) {
+	var mu sync.Mutex
+	saved := make(map[string][]int)
+	withRelayHandler(t, "save_chat_message_request", func(conn *relayConn, wsMsg *WSMessage) {
+		fields, _ := wsMsg.Data.(map[string]interface{})
+		seq, _ := strconv.Atoi(stringField(fields, "message_id"))
+		// Uneven handling times would reorder saves if a channel ever ran
+		// on more than one worker.
+		time.Sleep(time.Duration(seq%3) * 100 * time.Microsecond)
+		mu.Lock()
+		channel := stringField(fields, "channel_uuid")
+		saved[channel] = append(saved[channel], seq)
+		mu.Unlock()
+	})
+
+	dispatcher := newRequestDispatcher(newQueueOnlyRelayConn(1), 4, 1000)
+	channels := []string{"channel-a", "channel-b", "channel-c", "channel-d", "channel-e"}
+	const perChannel = 60
+	for seq := 0; seq < perChannel; seq++ {
+		for _, channel := range channels {
+			if !dispatcher.submit(WSMessage{Type: "save_chat_message_request", Data: map[string]interface{}{
+				"channel_uuid": channel,
+				"message_id":   strconv.Itoa(seq),
+			}}) {
+				t.Fatal("chat saves should be handled by the pool")
+			}
+		}
+	}
+	dispatcher.stop()
+
+	for _, channel := range channels {
+		got := saved[channel]
+		if len(got) != perChannel {
+			t.Fatalf("%s: expected %d saves, got %d", channel, perChannel, len(got))
+		}
+		for i, seq := range got {
+			if seq != i {
+				t.Fatalf("%s: saves ran out of order: %v", channel, got)
+			}
+		}
+	}
+}
+
+func TestRequestDispatcherRefusesRequestsBeyondPendingLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	withRelayHandler(t, "dispatch_test_request", func(conn *relayConn, wsMsg *WSMessage) {
+		started <- struct{}{}
+		<-release
+		sendToConn(conn, WSMessage{Type: "dispatch_test_response"})
+	})
+
+	conn := newQueueOnlyRelayConn(8)
+	dispatcher := newRequestDispatcher(conn, 2, 2)
+	rejectedBefore := hostRequestMetrics.rejected.Load()
+	for i := 0; i < 2; i++ {
+		dispatcher.submit(WSMessage{Type: "dispatch_test_request", RequestID: "req-" + strconv.Itoa(i)})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(dispatchTestTimeout):
+			t.Fatal("timed out waiting for the admitted requests to start")
+		}
+	}
+
+	dispatcher.submit(WSMessage{
+		Type:      "dispatch_test_request",
+		RequestID: "req-overflow",
+		Data:      map[string]interface{}{"client_uuid": "client-1"},
+	})
+	select {
+	case msg := <-conn.send:
+		data, _ := msg.Data.(ChatError)
+		if msg.Type != "error" || msg.RequestID != "req-overflow" || data.ClientUUID != "client-1" || !strings.Contains(data.Content, "busy") {
+			t.Fatalf("expected a busy error for the refused request, got %+v", msg)
+		}
+	case <-time.After(dispatchTestTimeout):
+		t.Fatal("timed out waiting for the busy error")
+	}
+
+	// A shed chat save is answered as a failed save, which the relay passes
+	// on to the sender as chat_save_failed.
+	dispatcher.submit(WSMessage{
+		Type:      "save_chat_message_request",
+		RequestID: "req-save",
+		Data: map[string]interface{}{
+			"channel_uuid": "channel-1",
+			"client_uuid":  "client-1",
+			"envelope":     map[string]interface{}{"message_id": "msg-1"},
+		},
+	})
+	select {
+	case msg := <-conn.send:
+		data, _ := msg.Data.(SaveChatMessageResponse)
+		if msg.Type != "save_chat_message_response" || msg.RequestID != "req-save" || data.MessageID != "msg-1" ||
+			data.ChannelUUID != "channel-1" || data.ClientUUID != "client-1" || !strings.Contains(data.Error, "busy") {
+			t.Fatalf("expected a failed save reply for the refused save, got %+v", msg)
+		}
+	case <-time.After(dispatchTestTimeout):
+		t.Fatal("timed out waiting for the failed save reply")
+	}
+	if got := hostRequestMetrics.rejected.Load() - rejectedBefore; got != 2 {
+		t.Fatalf("expected 2 refused requests, got %d", got)
+	}
+
+	close(release)
+	dispatcher.stop()
+	replies := map[string]bool{}
+	for len(conn.send) > 0 {
+		msg := <-conn.send
+		replies[msg.RequestID] = msg.Type == "dispatch_test_response"
+	}
+	if !replies["req-0"] || !replies["req-1"] || len(replies) != 2 {
+		t.Fatalf("expected replies to both admitted requests only, got %v", replies)
+	}
+}
+
+func TestRequestDispatcherStopWaitsForRunningRequests(t *testing.T) {
+	release := make(chan struct{})
+	var finished atomic.Int32
+	withRelayHandler(t, "dispatch_test_request", func(conn *relayConn, wsMsg *WSMessage) {
+		<-release
+		finished.Add(1)
+	})
+	withRelayHandler(t, "dispatch_test_panic_request", func(conn *relayConn, wsMsg *WSMessage) {
+		panic("handler failed")
+	})
+
+	conn := newQueueOnlyRelayConn(8)
+	dispatcher := newRequestDispatcher(conn, 2, 64)
+	const submitted = 10
+	for i := 0; i < submitted; i++ {
+		dispatcher.submit(WSMessage{Type: "dispatch_test_request"})
+	}
+	dispatcher.submit(WSMessage{Type: "dispatch_test_panic_request", RequestID: "req-panic"})
+
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stop returned while requests were still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(dispatchTestTimeout):
+		t.Fatal("timed out waiting for stop")
+	}
+	if got := finished.Load(); got != submitted {
+		t.Fatalf("expected all %d queued requests to finish before stop returned, got %d", submitted, got)
+	}
+	select {
+	case msg := <-conn.send:
+		if msg.Type != "error" || msg.RequestID != "req-panic" {
+			t.Fatalf("expected an error reply to the panicked request, got %+v", msg)
+		}
+	default:
+		t.Fatal("expected the panicked request to be answered")
+	}
+}
+
+func TestRelayConnWritesConcurrentSendsInOrder(t *testing.T) {
+	received := make(chan WSMessage, 1024)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			var msg WSMessage
+			if err := ws.ReadJSON(&msg); err != nil {
+				return
+			}
+			received <- msg
+		}
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn := newRelayConn(ws)
+	defer conn.close()
+
+	const senders, perSender = 8, 50
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(sender int) {
+			defer wg.Done()
+			view := conn.forRequest("sender-" + strconv.Itoa(sender))
+			for i := 0; i < perSender; i++ {
+				sendToConn(view, WSMessage{Type: strconv.Itoa(i)})
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	next := make(map[string]int)
+	for n := 0; n < senders*perSender; n++ {
+		select {
+		case msg := <-received:
+			if msg.Type != strconv.Itoa(next[msg.RequestID]) {
+				t.Fatalf("%s: expected message %d, got %s", msg.RequestID, next[msg.RequestID], msg.Type)
+			}
+			next[msg.RequestID]++
+		case <-time.After(dispatchTestTimeout):
+			t.Fatalf("timed out after %d of %d messages", n, senders*perSender)
+		}
+	}
+
+	// Once the connection is closed sends are dropped instead of blocking.
+	conn.close()
+	droppedBefore := hostRequestMetrics.dropped.Load()
+	for i := 0; i < relaySendQueueSize+1; i++ {
+		sendToConn(conn, WSMessage{Type: "late"})
+	}
+	if hostRequestMetrics.dropped.Load() == droppedBefore {
+		t.Fatal("expected sends after close to be dropped")
+	}
+}
+
+func TestRelayKeepaliveSettingsRejectsInvalidValues(t *testing.T) {
+	previousPing, previousPong := relayPingInterval, relayPongTimeout
+	t.Cleanup(func() { relayPingInterval, relayPongTimeout = previousPing, previousPong })
+
+	cases := []struct {
+		ping, pong         string
+		wantPing, wantPong time.Duration
+		wantErr            bool
+	}{
+		{ping: "", pong: "", wantPing: defaultRelayPingInterval, wantPong: defaultRelayPongTimeout},
+		{ping: "40s", pong: "", wantPing: 40 * time.Second, wantPong: 80 * time.Second},
+		{ping: "10s", pong: "30s", wantPing: 10 * time.Second, wantPong: 30 * time.Second},
+		{ping: "25", pong: "", wantErr: true},
+		{ping: "-5s", pong: "", wantErr: true},
+		{ping: "", pong: "soon", wantErr: true},
+		{ping: "30s", pong: "30s", wantErr: true},
+		{ping: "", pong: "20s", wantErr: true},
+	}
+	for _, tc := range cases {
+		relayPingInterval, relayPongTimeout = tc.ping, tc.pong
+		ping, pong, err := relayKeepaliveSettings()
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ping %q pong %q: expected an error, got %s/%s", tc.ping, tc.pong, ping, pong)
+			}
+			continue
+		}
+		if err != nil || ping != tc.wantPing || pong != tc.wantPong {
+			t.Errorf("ping %q pong %q: got %s/%s %v, want %s/%s", tc.ping, tc.pong, ping, pong, err, tc.wantPing, tc.wantPong)
+		}
+	}
+}
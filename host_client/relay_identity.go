@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"gochat/db"
 	"strings"
 )
 
@@ -31,43 +30,7 @@ func upsertHostUserByPublicKey(publicKey string, encPublicKey string, username s
 		return DashDataUser{}, fmt.Errorf("missing encryption public key")
 	}
 
-	trimmedUsername := strings.TrimSpace(username)
-	resolvedUsername := normalizeUsername(trimmedUsername, key)
-
-	_, err := db.ChatDB.Exec(
-		`INSERT INTO chat_users (public_key, enc_public_key, username)
-		 VALUES (?, ?, ?)
-		 ON CONFLICT(public_key) DO UPDATE SET
-		   enc_public_key = CASE
-		     WHEN ? <> '' THEN ?
-		     ELSE chat_users.enc_public_key
-		   END,
-		   username = CASE
-		     WHEN ? <> '' THEN ?
-		     ELSE chat_users.username
-		   END,
-		   updated_at = CURRENT_TIMESTAMP`,
-		key,
-		encKey,
-		resolvedUsername,
-		encKey,
-		encKey,
-		trimmedUsername,
-		resolvedUsername,
-	)
-	if err != nil {
-		return DashDataUser{}, err
-	}
-
-	var user DashDataUser
-	err = db.ChatDB.QueryRow(
-		`SELECT id, username, public_key, enc_public_key FROM chat_users WHERE public_key = ?`,
-		key,
-	).Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncPublicKey)
-	if err != nil {
-		return DashDataUser{}, err
-	}
-	return user, nil
+	return hostStore.UpsertUser(key, encKey, strings.TrimSpace(username))
 }
 
 func lookupHostUserByPublicKey(publicKey string) (DashDataUser, error) {
@@ -76,15 +39,7 @@ func lookupHostUserByPublicKey(publicKey string) (DashDataUser, error) {
 		return DashDataUser{}, fmt.Errorf("missing public key")
 	}
 
-	var user DashDataUser
-	err := db.ChatDB.QueryRow(
-		`SELECT id, username, public_key, enc_public_key FROM chat_users WHERE public_key = ?`,
-		key,
-	).Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncPublicKey)
-	if err != nil {
-		return DashDataUser{}, err
-	}
-	return user, nil
+	return hostStore.UserByPublicKey(key)
 }
 
 func lookupHostUserByID(userID int) (DashDataUser, error) {
@@ -92,15 +47,7 @@ func lookupHostUserByID(userID int) (DashDataUser, error) {
 		return DashDataUser{}, fmt.Errorf("invalid user id")
 	}
 
-	var user DashDataUser
-	err := db.ChatDB.QueryRow(
-		`SELECT id, username, public_key, enc_public_key FROM chat_users WHERE id = ?`,
-		userID,
-	).Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncPublicKey)
-	if err != nil {
-		return DashDataUser{}, err
-	}
-	return user, nil
+	return hostStore.UserByID(userID)
 }
 
 func lookupHostUsersByIDs(userIDs []int) ([]DashDataUser, error) {
@@ -118,32 +65,7 @@ func lookupHostUsersByIDs(userIDs []int) ([]DashDataUser, error) {
 		return []DashDataUser{}, nil
 	}
 
-	placeholders := make([]string, len(filtered))
-	args := make([]interface{}, len(filtered))
-	for i, userID := range filtered {
-		placeholders[i] = "?"
-		args[i] = userID
-	}
-
-	query := fmt.Sprintf(
-		`SELECT id, username, public_key, enc_public_key FROM chat_users WHERE id IN (%s)`,
-		strings.Join(placeholders, ","),
-	)
-	rows, err := db.ChatDB.Query(query, args...)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var users []DashDataUser
-	for rows.Next() {
-		var user DashDataUser
-		if err := rows.Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncPublicKey); err != nil {
-			continue
-		}
-		users = append(users, user)
-	}
-	return users, rows.Err()
+	return hostStore.UsersByIDs(filtered)
 }
 
 func resolveHostUserIdentity(userID int, userPublicKey string, userEncPublicKey string, fallbackUsername string) (DashDataUser, error) {
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The relay reports this host's quota usage on connect, after a quota turns
+// someone away, and when asked. The latest report is served by the local API
+// at GET /api/relay_quota.
+
+const relayQuotaPollInterval = time.Minute
+
+var latestRelayQuota atomic.Pointer[RelayQuotaUsage]
+
+func handleQuotaUsage(wsMsg *WSMessage) {
+	usage, err := decodeData[RelayQuotaUsage](wsMsg.Data)
+	if err != nil {
+		log.Println("Error decoding quota_usage:", err)
+		return
+	}
+	usage.ReceivedAt = storeTimestamp()
+	var seen map[string]int64
+	if prev := latestRelayQuota.Load(); prev != nil {
+		seen = prev.Rejections
+	}
+	for quota, count := range usage.Rejections {
+		if count > seen[quota] {
+			log.Printf("Relay quota %s turned away %d more requests (%d total)", quota, count-seen[quota], count)
+		}
+	}
+	latestRelayQuota.Store(&usage)
+}
+
+// pollRelayQuota asks the relay for fresh usage until the connection closes.
+func pollRelayQuota(conn *relayConn) {
+	ticker := time.NewTicker(relayQuotaPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sendToConn(conn, WSMessage{Type: "get_quota_usage"})
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+func handleRelayQuota(w http.ResponseWriter, r *http.Request) {
+	usage := latestRelayQuota.Load()
+	if usage == nil {
+		writeBotAPIError(w, http.StatusNotFound, "no quota report from the relay yet")
+		return
+	}
+	writeBotAPIJSON(w, http.StatusOK, usage)
+}
@@ -1,11 +1,61 @@
 package main
 
 import (
+	"database/sql"
+	"embed"
 	"fmt"
 	"gochat/db"
 )
 
-func ensureHostClientSchema() error {
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const migrationsPath = "migrations"
+
+// Versions that adoption can recognise in a DB created before the host used
+// versioned migrations. New schema changes only need a new migration file.
+const (
+	hostSchemaBaselineVersion = 20261018090000
+	hostSchemaBotsVersion     = 20261018090100
+)
+
+func openHostDatabase(dbPath string) (*sql.DB, error) {
+	return db.InitDB(dbPath, migrationFiles, migrationsPath, adoptLegacyHostSchema)
+}
+
+func migrateHostDatabase(conn *sql.DB) error {
+	return db.Migrate(conn, migrationFiles, migrationsPath, adoptLegacyHostSchema)
+}
+
+func adoptLegacyHostSchema(conn *sql.DB) (uint, error) {
+	found := false
+	for _, tableName := range []string{"chat_users", "spaces", "channels", "messages", "space_users"} {
+		exists, _, err := tableColumns(conn, tableName)
+		if err != nil {
+			return 0, err
+		}
+		found = found || exists
+	}
+	if !found {
+		return 0, nil
+	}
+
+	if err := normalizeLegacyHostSchema(conn); err != nil {
+		return 0, err
+	}
+	hasBots, _, err := tableColumns(conn, "bots")
+	if err != nil {
+		return 0, err
+	}
+	if hasBots {
+		return hostSchemaBotsVersion, nil
+	}
+	return hostSchemaBaselineVersion, nil
+}
+
+// normalizeLegacyHostSchema is the pre-migrations bootstrap. Adoption runs it
+// once so any DB created by an older host ends up exactly at the baseline.
+func normalizeLegacyHostSchema(conn *sql.DB) error {
 	statements := []string{
 		`CREATE TABLE IF NOT EXISTS chat_users (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -52,36 +102,36 @@ func ensureHostClientSchema() error {
 	}
 
 	for _, stmt := range statements {
-		if _, err := db.ChatDB.Exec(stmt); err != nil {
+		if _, err := conn.Exec(stmt); err != nil {
 			return fmt.Errorf("schema exec failed: %w", err)
 		}
 	}
 
-	if err := ensureColumnExists("channels", "allow_voice", `ALTER TABLE channels ADD COLUMN allow_voice INTEGER DEFAULT 0`); err != nil {
+	if err := ensureColumnExists(conn, "channels", "allow_voice", `ALTER TABLE channels ADD COLUMN allow_voice INTEGER DEFAULT 0`); err != nil {
 		return err
 	}
-	if err := ensureColumnExists("chat_users", "created_at", `ALTER TABLE chat_users ADD COLUMN created_at TEXT`); err != nil {
+	if err := ensureColumnExists(conn, "chat_users", "created_at", `ALTER TABLE chat_users ADD COLUMN created_at TEXT`); err != nil {
 		return err
 	}
-	if err := ensureColumnExists("chat_users", "updated_at", `ALTER TABLE chat_users ADD COLUMN updated_at TEXT`); err != nil {
+	if err := ensureColumnExists(conn, "chat_users", "updated_at", `ALTER TABLE chat_users ADD COLUMN updated_at TEXT`); err != nil {
 		return err
 	}
-	if err := ensureColumnExists("chat_users", "enc_public_key", `ALTER TABLE chat_users ADD COLUMN enc_public_key TEXT NOT NULL DEFAULT ''`); err != nil {
+	if err := ensureColumnExists(conn, "chat_users", "enc_public_key", `ALTER TABLE chat_users ADD COLUMN enc_public_key TEXT NOT NULL DEFAULT ''`); err != nil {
 		return err
 	}
-	if err := ensureColumnExists("messages", "message_id", `ALTER TABLE messages ADD COLUMN message_id TEXT NOT NULL DEFAULT ''`); err != nil {
+	if err := ensureColumnExists(conn, "messages", "message_id", `ALTER TABLE messages ADD COLUMN message_id TEXT NOT NULL DEFAULT ''`); err != nil {
 		return err
 	}
-	if err := ensureColumnExists("messages", "sender_auth_public_key", `ALTER TABLE messages ADD COLUMN sender_auth_public_key TEXT NOT NULL DEFAULT ''`); err != nil {
+	if err := ensureColumnExists(conn, "messages", "sender_auth_public_key", `ALTER TABLE messages ADD COLUMN sender_auth_public_key TEXT NOT NULL DEFAULT ''`); err != nil {
 		return err
 	}
-	if _, err := db.ChatDB.Exec(`UPDATE chat_users SET created_at = COALESCE(created_at, CURRENT_TIMESTAMP)`); err != nil {
+	if _, err := conn.Exec(`UPDATE chat_users SET created_at = COALESCE(created_at, CURRENT_TIMESTAMP)`); err != nil {
 		return fmt.Errorf("failed to backfill chat_users.created_at: %w", err)
 	}
-	if _, err := db.ChatDB.Exec(`UPDATE chat_users SET updated_at = COALESCE(updated_at, CURRENT_TIMESTAMP)`); err != nil {
+	if _, err := conn.Exec(`UPDATE chat_users SET updated_at = COALESCE(updated_at, CURRENT_TIMESTAMP)`); err != nil {
 		return fmt.Errorf("failed to backfill chat_users.updated_at: %w", err)
 	}
-	if _, err := db.ChatDB.Exec(`
+	if _, err := conn.Exec(`
 		DELETE FROM space_users
 		 WHERE id NOT IN (
 			SELECT MIN(id)
@@ -91,75 +141,57 @@ func ensureHostClientSchema() error {
 	`); err != nil {
 		return fmt.Errorf("failed to dedupe space_users before unique index: %w", err)
 	}
-	if _, err := db.ChatDB.Exec(`DROP INDEX IF EXISTS idx_space_users_space_user`); err != nil {
+	if _, err := conn.Exec(`DROP INDEX IF EXISTS idx_space_users_space_user`); err != nil {
 		return fmt.Errorf("failed to drop legacy non-unique space_users index: %w", err)
 	}
-	if _, err := db.ChatDB.Exec(`
+	if _, err := conn.Exec(`
 		CREATE UNIQUE INDEX IF NOT EXISTS idx_space_users_unique_space_user
 			ON space_users(space_uuid, user_id)
 	`); err != nil {
 		return fmt.Errorf("failed to create unique space_users index: %w", err)
 	}
-	if _, err := db.ChatDB.Exec(`
+	if _, err := conn.Exec(`
 		CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_channel_sender_msgid
 			ON messages(channel_uuid, sender_auth_public_key, message_id)
 			WHERE message_id <> '' AND sender_auth_public_key <> ''
 	`); err != nil {
 		return fmt.Errorf("failed to create message replay-protection index: %w", err)
 	}
+	return nil
+}
 
+// ensureOfficialSpace seeds the community space and its channels on the
+// official host instance. It is data, not schema, so it stays out of the
+// migrations.
+func ensureOfficialSpace() error {
 	if !isOfficialHostInstance() {
 		return nil
 	}
 
-	seedStatements := []string{
-		fmt.Sprintf(`INSERT OR IGNORE INTO spaces (uuid, name, author_id) VALUES (%q, %q, 0)`, officialSpaceUUID, officialSpaceName),
-	}
+	space := DashDataSpace{UUID: officialSpaceUUID, Name: officialSpaceName}
+	var channels []DashDataChannel
 	for _, channelName := range officialSpaceChannels {
-		channelUUID := fmt.Sprintf("%s-%s", officialSpaceUUID, channelName)
-		seedStatements = append(seedStatements, fmt.Sprintf(
-			`INSERT OR IGNORE INTO channels (uuid, name, space_uuid) VALUES (%q, %q, %q)`,
-			channelUUID,
-			channelName,
-			officialSpaceUUID,
-		))
+		channels = append(channels, DashDataChannel{
+			UUID: fmt.Sprintf("%s-%s", officialSpaceUUID, channelName),
+			Name: channelName,
+		})
 	}
-
-	for _, stmt := range seedStatements {
-		if _, err := db.ChatDB.Exec(stmt); err != nil {
-			return fmt.Errorf("seed exec failed: %w", err)
-		}
+	if err := hostStore.SeedSpace(space, channels); err != nil {
+		return fmt.Errorf("seed exec failed: %w", err)
 	}
-
 	return nil
 }
 
-func ensureColumnExists(tableName, columnName, alterStmt string) error {
-	rows, err := db.ChatDB.Query("PRAGMA table_info(" + tableName + ")")
+func ensureColumnExists(conn *sql.DB, tableName, columnName, alterStmt string) error {
+	exists, columns, err := tableColumns(conn, tableName)
 	if err != nil {
 		return fmt.Errorf("table_info query failed for %s: %w", tableName, err)
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var cid int
-		var name string
-		var ctype string
-		var notNull int
-		var defaultValue interface{}
-		var pk int
-		if err := rows.Scan(&cid, &name, &ctype, &notNull, &defaultValue, &pk); err != nil {
-			return fmt.Errorf("table_info scan failed for %s: %w", tableName, err)
-		}
-		if name == columnName {
-			return nil
-		}
-	}
-	if err := rows.Err(); err != nil {
-		return fmt.Errorf("table_info row error for %s: %w", tableName, err)
+	if !exists || columns[columnName] {
+		return nil
 	}
 
-	if _, err := db.ChatDB.Exec(alterStmt); err != nil {
+	if _, err := conn.Exec(alterStmt); err != nil {
 		return fmt.Errorf("alter table failed for %s.%s: %w", tableName, columnName, err)
 	}
 	return nil
@@ -25,13 +25,13 @@ func decodeData[T any](raw interface{}) (T, error) {
 }
 
 // Entry point for the client
-func SocketClient(ctx context.Context, hostUUID string) error {
-	runClientLoop(ctx, hostUUID)
+func SocketClient(ctx context.Context, hostUUID string, pingInterval, pongTimeout time.Duration) error {
+	runClientLoop(ctx, hostUUID, pingInterval, pongTimeout)
 	return nil
 }
 
 // Reconnect loop
-func runClientLoop(ctx context.Context, hostUUID string) {
+func runClientLoop(ctx context.Context, hostUUID string, pingInterval, pongTimeout time.Duration) {
 
 	for {
 		select {
@@ -55,29 +55,41 @@ func runClientLoop(ctx context.Context, hostUUID string) {
 				continue
 			}
 
-			if err := handleSocketMessages(ctx, conn); err != nil {
+			relay := newRelayConn(conn)
+			relay.keepalive(pingInterval, pongTimeout)
+			go pollRelayQuota(relay)
+			workers, maxPending := requestPoolSettings()
+			dispatcher := newRequestDispatcher(relay, workers, maxPending)
+			if err := handleSocketMessages(ctx, relay, dispatcher, pongTimeout); err != nil {
 				log.Printf("Socket closed: %v", err)
 			}
-			conn.Close()
+			dispatcher.stop()
+			relay.close()
 
-			log.Println("Reconnecting in 2 seconds...")
-			time.Sleep(2 * time.Second)
+			delay := 2 * time.Second
+			if relay.reconnectAfter > 0 && relay.reconnectAfter < time.Minute {
+				delay = relay.reconnectAfter
+			}
+			log.Printf("Reconnecting in %s...", delay)
+			time.Sleep(delay)
 		}
 	}
 }
 
-// Read loop
-func handleSocketMessages(ctx context.Context, conn *websocket.Conn) error {
+// Read loop. Connection control messages are handled inline; requests go to
+// the dispatcher so a slow request cannot hold up the rest.
+func handleSocketMessages(ctx context.Context, conn *relayConn, dispatcher *requestDispatcher, pongTimeout time.Duration) error {
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("Context cancelled, stopping socket read loop")
 			return nil
 		default:
-			_, msgBytes, err := conn.ReadMessage()
+			_, msgBytes, err := conn.ws.ReadMessage()
 			if err != nil {
 				return err
 			}
+			conn.touch(pongTimeout)
 
 			var wsMsg WSMessage
 			if err := json.Unmarshal(msgBytes, &wsMsg); err != nil {
@@ -99,8 +111,8 @@ func handleSocketMessages(ctx context.Context, conn *websocket.Conn) error {
 					return fmt.Errorf("join host failed")
 				}
 				errMsg := strings.TrimSpace(data.Content)
-				if strings.Contains(strings.ToLower(errMsg), "not upgraded for capability auth") && runtimeHostConfig != nil {
-					if syncErr := ensureHostRegisteredWithRelay(runtimeHostConfig); syncErr != nil {
+				if cfg := runtimeHostConfig.Load(); strings.Contains(strings.ToLower(errMsg), "not upgraded for capability auth") && cfg != nil {
+					if syncErr := ensureHostRegisteredWithRelay(cfg); syncErr != nil {
 						log.Printf("Failed to sync host registration after join_error: %v", syncErr)
 					}
 				}
@@ -119,6 +131,22 @@ func handleSocketMessages(ctx context.Context, conn *websocket.Conn) error {
 				}
 			case "host_auth_success":
 				log.Println("host_auth_success")
+				sendDeviceDenyList(conn)
+				if reissueCapabilitiesAfterAuth {
+					reissueCapabilitiesAfterAuth = false
+					sendToConn(conn, WSMessage{Type: "reissue_capabilities"})
+				}
+			case "relay_shutdown":
+				data, err := decodeData[RelayShutdown](wsMsg.Data)
+				if err != nil {
+					continue
+				}
+				log.Printf("Relay is shutting down: %s", data.Reason)
+				conn.reconnectAfter = time.Duration(data.ReconnectAfterMs) * time.Millisecond
+			case "quota_usage":
+				handleQuotaUsage(&wsMsg)
+			case "host_key_rotated":
+				handleHostKeyRotated(&wsMsg)
 			case "relay_health_check":
 				data, err := decodeData[RelayHealthCheck](wsMsg.Data)
 				if err != nil || data.Nonce == "" {
@@ -128,48 +156,16 @@ func handleSocketMessages(ctx context.Context, conn *websocket.Conn) error {
 					Type: "relay_health_check_ack",
 					Data: RelayHealthCheckAck{Nonce: data.Nonce},
 				})
-			case "update_username_request":
-				handleUpdateUsername(conn, &wsMsg)
-			case "get_dash_data_request":
-				handleGetDashData(conn, &wsMsg)
-			case "create_space_request":
-				handleCreateSpace(conn, &wsMsg)
-			case "delete_space_request":
-				handleDeleteSpace(conn, &wsMsg)
-			case "create_channel_request":
-				handleCreateChannel(conn, &wsMsg)
-			case "delete_channel_request":
-				handleDeleteChannel(conn, &wsMsg)
-			case "invite_user_request":
-				handleInviteUser(conn, &wsMsg)
-			case "accept_invite_request":
-				handleAcceptInvite(conn, &wsMsg)
-			case "decline_invite_request":
-				handleDeclineInvite(conn, &wsMsg)
-			case "leave_space_request":
-				handleLeaveSpace(conn, &wsMsg)
-			case "remove_space_user_request":
-				handleRemoveSpaceUser(conn, &wsMsg)
-			case "save_chat_message_request":
-				handleSaveChatMessage(&wsMsg)
-			case "get_messages_request":
-				handleGetMessages(conn, &wsMsg)
-			case "channel_allow_voice_request":
-				handleChannelAllowVoice(conn, &wsMsg)
 
 			default:
-				log.Println("Unhandled message type:", wsMsg.Type)
+				if !dispatcher.submit(wsMsg) {
+					log.Println("Unhandled message type:", wsMsg.Type)
+				}
 			}
 		}
 	}
 }
 
-func sendToConn(conn *websocket.Conn, msg WSMessage) {
-	if err := conn.WriteJSON(msg); err != nil {
-		log.Printf("SendToClient: failed to send message to client: %v\n", err)
-	}
-}
-
 // Join host message
 func joinHost(conn *websocket.Conn, hostUUID string) error {
 	payload := WSMessage{
@@ -186,21 +182,22 @@ func joinHost(conn *websocket.Conn, hostUUID string) error {
 	return conn.WriteMessage(websocket.TextMessage, msgBytes)
 }
 
-func sendHostAuth(conn *websocket.Conn, challenge string) error {
+func sendHostAuth(conn *relayConn, challenge string) error {
 	priv, err := currentSigningPrivateKey()
 	if err != nil {
 		return err
 	}
 	message := hostAuthMessage(currentHostUUID, challenge)
 	signature := ed25519.Sign(priv, []byte(message))
-	payload := WSMessage{
+	sendToConn(conn, WSMessage{
 		Type: "host_auth",
 		Data: HostAuthClient{
-			Challenge: challenge,
-			Signature: base64.RawStdEncoding.EncodeToString(signature),
+			Challenge:  challenge,
+			Signature:  base64.RawStdEncoding.EncodeToString(signature),
+			RequestIDs: true,
 		},
-	}
-	return conn.WriteJSON(payload)
+	})
+	return nil
 }
 
 func hostAuthMessage(hostUUID, challenge string) string {
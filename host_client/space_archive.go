@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A space archive moves a space to another host: its channels, the keys of
+// everyone who belongs to it or wrote in it, every stored envelope and
+// sender key distribution, and the audit chain. Envelopes stay encrypted;
+// the host never sees plaintext. The archive is gzipped JSON signed by the
+// exporting host.
+//
+// Envelope signatures cover the space and channel UUIDs, so an import keeps
+// them; only the host serving the space changes.
+
+const (
+	spaceArchiveVersion         = 1
+	spaceArchiveSignaturePrefix = "parch-space-archive-v1:"
+	spaceArchivePageSize        = 500
+	// spaceArchiveChunkSize keeps each export_space_response well under the
+	// relay's 256 KiB message limit once base64 and JSON are added.
+	spaceArchiveChunkSize = 128 * 1024
+)
+
+type SpaceArchive struct {
+	Version          int               `json:"v"`
+	SourceHostUUID   string            `json:"source_host_uuid"`
+	ExportedAt       string            `json:"exported_at"`
+	Space            ArchivedSpace     `json:"space"`
+	Users            []ArchivedUser    `json:"users"`
+	Channels         []ArchivedChannel `json:"channels"`
+	AuditLog         []AuditEntry      `json:"audit_log"`
+	SigningPublicKey string            `json:"signing_public_key"`
+	Signature        string            `json:"sig,omitempty"`
+}
+
+type ArchivedSpace struct {
+	UUID            string `json:"uuid"`
+	Name            string `json:"name"`
+	AuthorPublicKey string `json:"author_public_key"`
+}
+
+// ArchivedUser is anyone the space refers to. Member is false for the
+// author when they never joined, and for past members whose messages
+// remain.
+type ArchivedUser struct {
+	PublicKey    string `json:"public_key"`
+	EncPublicKey string `json:"enc_public_key"`
+	Username     string `json:"username"`
+	Member       bool   `json:"member"`
+}
+
+// ArchivedChannel keeps LastSeq apart from the messages, since deleted
+// messages leave gaps at the end of the sequence too. Archives written
+// before it existed omit it.
+type ArchivedChannel struct {
+	UUID       string              `json:"uuid"`
+	Name       string              `json:"name"`
+	AllowVoice int                 `json:"allow_voice"`
+	LastSeq    int64               `json:"last_seq,omitempty"`
+	Messages   []ArchivedMessage   `json:"messages"`
+	SenderKeys []ArchivedSenderKey `json:"sender_keys"`
+}
+
+// ArchivedMessage keeps the message's place in its channel. UserPublicKey
+// is the identity the message belongs to on the host, which differs from
+// the envelope signer after the user migrated to a new key.
+type ArchivedMessage struct {
+	MessageID           string `json:"message_id"`
+	SenderAuthPublicKey string `json:"sender_auth_public_key"`
+	UserPublicKey       string `json:"user_public_key"`
+	Timestamp           string `json:"timestamp"`
+	Seq                 int64  `json:"seq"`
+	Content             string `json:"content"`
+}
+
+type ArchivedSenderKey struct {
+	SenderAuthPublicKey string `json:"sender_auth_public_key"`
+	Epoch               int64  `json:"epoch"`
+	Content             string `json:"content"`
+	CreatedAt           string `json:"created_at"`
+}
+
+func (a SpaceArchive) messageCount() int {
+	count := 0
+	for _, channel := range a.Channels {
+		count += len(channel.Messages)
+	}
+	return count
+}
+
+// buildSpaceArchive reads the whole space from the store and signs it with
+// the current host key.
+func buildSpaceArchive(spaceUUID string) (SpaceArchive, error) {
+	space, err := hostStore.Space(spaceUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SpaceArchive{}, fmt.Errorf("space not found")
+	}
+	if err != nil {
+		return SpaceArchive{}, err
+	}
+
+	// Everyone the archive mentions, by host user ID.
+	users := make(map[int]*ArchivedUser)
+	memberIDs, err := hostStore.SpaceMemberIDs(spaceUUID)
+	if err != nil {
+		return SpaceArchive{}, err
+	}
+	wanted := append([]int{space.AuthorID}, memberIDs...)
+
+	channels, err := hostStore.SpaceChannels(spaceUUID)
+	if err != nil {
+		return SpaceArchive{}, err
+	}
+	archived := make([]ArchivedChannel, 0, len(channels))
+	var messageUserIDs [][]int
+	for _, channel := range channels {
+		messages, userIDs, err := archiveChannelMessages(channel.UUID)
+		if err != nil {
+			return SpaceArchive{}, fmt.Errorf("channel %s: %w", channel.UUID, err)
+		}
+		keys, err := hostStore.ChannelSenderKeys(channel.UUID)
+		if err != nil {
+			return SpaceArchive{}, fmt.Errorf("channel %s: %w", channel.UUID, err)
+		}
+		lastSeq, err := hostStore.ChannelLastSeq(channel.UUID)
+		if err != nil {
+			return SpaceArchive{}, fmt.Errorf("channel %s: %w", channel.UUID, err)
+		}
+		senderKeys := make([]ArchivedSenderKey, 0, len(keys))
+		for _, key := range keys {
+			senderKeys = append(senderKeys, ArchivedSenderKey{
+				SenderAuthPublicKey: key.SenderAuthPublicKey,
+				Epoch:               key.Epoch,
+				Content:             key.Content,
+				CreatedAt:           key.CreatedAt,
+			})
+		}
+		archived = append(archived, ArchivedChannel{
+			UUID:       channel.UUID,
+			Name:       channel.Name,
+			AllowVoice: channel.AllowVoice,
+			LastSeq:    lastSeq,
+			Messages:   messages,
+			SenderKeys: senderKeys,
+		})
+		messageUserIDs = append(messageUserIDs, userIDs)
+		wanted = append(wanted, userIDs...)
+	}
+
+	found, err := hostStore.UsersByIDs(uniqueInts(wanted))
+	if err != nil {
+		return SpaceArchive{}, err
+	}
+	for _, user := range found {
+		users[user.ID] = &ArchivedUser{PublicKey: user.PublicKey, EncPublicKey: user.EncPublicKey, Username: user.Username}
+	}
+	author, ok := users[space.AuthorID]
+	if !ok {
+		return SpaceArchive{}, fmt.Errorf("space author %d not found", space.AuthorID)
+	}
+	for _, memberID := range memberIDs {
+		if user, ok := users[memberID]; ok {
+			user.Member = true
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for i, channel := range archived {
+		for j := range channel.Messages {
+			msg := &channel.Messages[j]
+			if user, ok := users[messageUserIDs[i][j]]; ok {
+				msg.UserPublicKey = user.PublicKey
+			} else {
+				// The user is gone; the message stays with its signer.
+				msg.UserPublicKey = msg.SenderAuthPublicKey
+			}
+			referenced[msg.UserPublicKey] = true
+		}
+	}
+
+	archive := SpaceArchive{
+		Version:        spaceArchiveVersion,
+		SourceHostUUID: currentHostUUID,
+		ExportedAt:     storeTimestamp(),
+		Space:          ArchivedSpace{UUID: space.UUID, Name: space.Name, AuthorPublicKey: author.PublicKey},
+		Channels:       archived,
+	}
+	seen := make(map[string]bool)
+	for _, userID := range uniqueInts(wanted) {
+		user, ok := users[userID]
+		if !ok || seen[user.PublicKey] {
+			continue
+		}
+		seen[user.PublicKey] = true
+		archive.Users = append(archive.Users, *user)
+	}
+	for publicKey := range referenced {
+		if !seen[publicKey] {
+			seen[publicKey] = true
+			archive.Users = append(archive.Users, ArchivedUser{PublicKey: publicKey})
+		}
+	}
+
+	if archive.AuditLog, err = loadAuditChain(spaceUUID); err != nil {
+		return SpaceArchive{}, err
+	}
+
+	signingKey, err := currentSigningPrivateKey()
+	if err != nil {
+		return SpaceArchive{}, err
+	}
+	if err := signSpaceArchive(&archive, signingKey); err != nil {
+		return SpaceArchive{}, err
+	}
+	return archive, nil
+}
+
+// archiveChannelMessages returns the channel's messages oldest first, with
+// the host user ID of each.
+func archiveChannelMessages(channelUUID string) ([]ArchivedMessage, []int, error) {
+	messages := []ArchivedMessage{}
+	var userIDs []int
+	fromSeq := int64(1)
+	for {
+		page, err := hostStore.MessagesInRange(channelUUID, fromSeq, math.MaxInt64, spaceArchivePageSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, msg := range page {
+			messages = append(messages, ArchivedMessage{
+				MessageID:           msg.MessageID,
+				SenderAuthPublicKey: msg.SenderAuthPublicKey,
+				Timestamp:           msg.Timestamp,
+				Seq:                 msg.Seq,
+				Content:             msg.Content,
+			})
+			userIDs = append(userIDs, msg.UserID)
+		}
+		if len(page) < spaceArchivePageSize {
+			return messages, userIDs, nil
+		}
+		fromSeq = page[len(page)-1].Seq + 1
+	}
+}
+
+func uniqueInts(values []int) []int {
+	seen := make(map[int]bool, len(values))
+	unique := make([]int, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// spaceArchiveHash covers everything but the signature.
+func spaceArchiveHash(archive SpaceArchive) (string, error) {
+	archive.Signature = ""
+	encoded, err := encodeCanonicalJSON(archive)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func signSpaceArchive(archive *SpaceArchive, signingKey ed25519.PrivateKey) error {
+	archive.SigningPublicKey = base64.RawStdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey))
+	hash, err := spaceArchiveHash(*archive)
+	if err != nil {
+		return err
+	}
+	archive.Signature = base64.RawStdEncoding.EncodeToString(ed25519.Sign(signingKey, []byte(spaceArchiveSignaturePrefix+hash)))
+	return nil
+}
+
+// verifySpaceArchive checks the archive against the key it names. Callers
+// that know the old host's key should compare it with SigningPublicKey.
+func verifySpaceArchive(archive SpaceArchive) error {
+	if archive.Version != spaceArchiveVersion {
+		return fmt.Errorf("unsupported space archive version %d", archive.Version)
+	}
+	publicKey, err := base64.RawStdEncoding.DecodeString(archive.SigningPublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid archive signing public key")
+	}
+	signature, err := base64.RawStdEncoding.DecodeString(archive.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid archive signature encoding")
+	}
+	hash, err := spaceArchiveHash(archive)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), []byte(spaceArchiveSignaturePrefix+hash), signature) {
+		return fmt.Errorf("bad archive signature")
+	}
+	return nil
+}
+
+func encodeSpaceArchive(archive SpaceArchive) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(archive); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeSpaceArchive reads and verifies an archive.
+func decodeSpaceArchive(r io.Reader) (SpaceArchive, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return SpaceArchive{}, fmt.Errorf("not a space archive: %w", err)
+	}
+	defer gz.Close()
+	var archive SpaceArchive
+	if err := json.NewDecoder(gz).Decode(&archive); err != nil {
+		return SpaceArchive{}, fmt.Errorf("not a space archive: %w", err)
+	}
+	if err := verifySpaceArchive(archive); err != nil {
+		return SpaceArchive{}, err
+	}
+	return archive, nil
+}
+
+func writeSpaceArchiveFile(path string, archive SpaceArchive) error {
+	encoded, err := encodeSpaceArchive(archive)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, encoded, 0o600)
+}
+
+func readSpaceArchiveFile(path string) (SpaceArchive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return SpaceArchive{}, err
+	}
+	defer file.Close()
+	return decodeSpaceArchive(file)
+}
+
+// verifyArchivedEnvelopes checks every stored envelope the way
+// handleSaveChatMessage did when it first arrived: signed by its sender and
+// addressed to its space and channel. The archive signature only says which
+// host wrote the file, not that the host kept the envelopes intact.
+func verifyArchivedEnvelopes(archive SpaceArchive) error {
+	for _, channel := range archive.Channels {
+		for _, msg := range channel.Messages {
+			if _, err := verifyArchivedEnvelope(msg.Content, archive.Space.UUID, channel.UUID, msg.SenderAuthPublicKey); err != nil {
+				return fmt.Errorf("message %s in channel %s: %w", msg.MessageID, channel.UUID, err)
+			}
+		}
+		for _, key := range channel.SenderKeys {
+			envelope, err := verifyArchivedEnvelope(key.Content, archive.Space.UUID, channel.UUID, key.SenderAuthPublicKey)
+			if err == nil {
+				if kind, epoch, ok := senderKeyEnvelopeInfo(envelope); !ok || kind != envelopeKindSenderKey || epoch != key.Epoch {
+					err = fmt.Errorf("malformed sender key envelope")
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("sender key %s/%d in channel %s: %w", key.SenderAuthPublicKey, key.Epoch, channel.UUID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyArchivedEnvelope verifies one envelope and that its signer is the
+// sender the archive files it under.
+func verifyArchivedEnvelope(content, spaceUUID, channelUUID, senderAuthPublicKey string) (map[string]interface{}, error) {
+	if err := verifyEnvelope([]byte(content), spaceUUID, channelUUID); err != nil {
+		return nil, err
+	}
+	var envelope map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &envelope); err != nil {
+		return nil, fmt.Errorf("malformed envelope")
+	}
+	if stringField(envelope, "sender_auth_public_key") != senderAuthPublicKey {
+		return nil, fmt.Errorf("envelope was not signed by its archived sender")
+	}
+	return envelope, nil
+}
+
+// importSpaceArchive recreates a verified archive on this host. Users the
+// host already knows keep their name and keys; the rest are created. The
+// audit chain comes along unless this host already has entries for the
+// space, e.g. from before it moved away. A single envelope or audit entry
+// that fails verification rejects the whole archive before anything is
+// written.
+func importSpaceArchive(archive SpaceArchive) error {
+	if err := verifyArchivedEnvelopes(archive); err != nil {
+		return fmt.Errorf("archived envelope failed verification: %w", err)
+	}
+	if len(archive.AuditLog) > 0 {
+		if err := verifyAuditChain(archive.AuditLog); err != nil {
+			return fmt.Errorf("archived audit log failed verification: %w", err)
+		}
+	}
+
+	userIDs := make(map[string]int, len(archive.Users))
+	var memberIDs []int
+	for _, archived := range archive.Users {
+		if archived.PublicKey == "" {
+			return fmt.Errorf("archive lists a user without a public key")
+		}
+		user, err := hostStore.UserByPublicKey(archived.PublicKey)
+		if errors.Is(err, sql.ErrNoRows) {
+			user, err = hostStore.UpsertUser(archived.PublicKey, archived.EncPublicKey, archived.Username)
+		}
+		if err != nil {
+			return fmt.Errorf("user %s: %w", archived.PublicKey, err)
+		}
+		userIDs[archived.PublicKey] = user.ID
+		if archived.Member {
+			memberIDs = append(memberIDs, user.ID)
+		}
+	}
+	authorID, ok := userIDs[archive.Space.AuthorPublicKey]
+	if !ok {
+		return fmt.Errorf("archive does not list the space author")
+	}
+
+	space := SpaceImport{
+		Space:     DashDataSpace{UUID: archive.Space.UUID, Name: archive.Space.Name, AuthorID: authorID},
+		MemberIDs: memberIDs,
+		LastSeq:   make(map[string]int64, len(archive.Channels)),
+	}
+	for _, channel := range archive.Channels {
+		space.LastSeq[channel.UUID] = channel.LastSeq
+		space.Channels = append(space.Channels, DashDataChannel{
+			UUID:       channel.UUID,
+			Name:       channel.Name,
+			SpaceUUID:  archive.Space.UUID,
+			AllowVoice: channel.AllowVoice,
+		})
+		for _, msg := range channel.Messages {
+			userID, ok := userIDs[msg.UserPublicKey]
+			if !ok {
+				return fmt.Errorf("message %s names an unknown user", msg.MessageID)
+			}
+			space.Messages = append(space.Messages, StoredMessage{
+				ChannelUUID:         channel.UUID,
+				Content:             msg.Content,
+				UserID:              userID,
+				MessageID:           msg.MessageID,
+				SenderAuthPublicKey: msg.SenderAuthPublicKey,
+				Timestamp:           msg.Timestamp,
+				Seq:                 msg.Seq,
+			})
+		}
+		for _, key := range channel.SenderKeys {
+			space.SenderKeys = append(space.SenderKeys, StoredSenderKey{
+				ChannelUUID:         channel.UUID,
+				SenderAuthPublicKey: key.SenderAuthPublicKey,
+				Epoch:               key.Epoch,
+				Content:             key.Content,
+				CreatedAt:           key.CreatedAt,
+			})
+		}
+	}
+
+	if len(archive.AuditLog) > 0 {
+		head, err := hostStore.LastAuditHash(archive.Space.UUID)
+		if err != nil {
+			return err
+		}
+		if head == "" {
+			for _, entry := range archive.AuditLog {
+				if entry.Details == nil {
+					entry.Details = map[string]string{}
+				}
+				space.AuditLog = append(space.AuditLog, entry)
+			}
+		} else {
+			log.Printf("Space %s already has an audit log on this host; not importing the archived one", archive.Space.UUID)
+		}
+	}
+
+	if err := hostStore.ImportSpace(space); err != nil {
+		if errors.Is(err, errStoreConflict) {
+			return fmt.Errorf("space %s or one of its channels already exists on this host", archive.Space.UUID)
+		}
+		return err
+	}
+	return nil
+}
+
+func spaceArchiveAuditDetails(archive SpaceArchive) map[string]string {
+	return map[string]string{
+		"source_host_uuid": archive.SourceHostUUID,
+		"channels":         strconv.Itoa(len(archive.Channels)),
+		"messages":         strconv.Itoa(archive.messageCount()),
+	}
+}
+
+// A browser export is pulled one chunk at a time: the first export_space
+// builds the archive and answers with chunk 0 and an export ID, and the
+// client asks for each following chunk with that ID. Every chunk is its own
+// relay request, so a large archive never floods the client's relay queue
+// and a lost chunk is simply asked for again. Built archives are kept for
+// spaceExportTTL after their last pull.
+const (
+	spaceExportTTL         = 10 * time.Minute
+	maxPendingSpaceExports = 8
+)
+
+type pendingSpaceExport struct {
+	spaceUUID   string
+	requesterID int
+	payload     string
+	lastPull    time.Time
+}
+
+var (
+	spaceExportsMu sync.Mutex
+	spaceExports   = map[string]*pendingSpaceExport{}
+)
+
+// storeSpaceExport keeps payload for its requester and returns its export
+// ID, dropping expired exports and, past the limit, the least recently
+// pulled one.
+func storeSpaceExport(spaceUUID string, requesterID int, payload string) string {
+	spaceExportsMu.Lock()
+	defer spaceExportsMu.Unlock()
+	now := time.Now()
+	oldestID := ""
+	for id, export := range spaceExports {
+		if now.Sub(export.lastPull) > spaceExportTTL {
+			delete(spaceExports, id)
+			continue
+		}
+		if oldestID == "" || export.lastPull.Before(spaceExports[oldestID].lastPull) {
+			oldestID = id
+		}
+	}
+	if len(spaceExports) >= maxPendingSpaceExports {
+		delete(spaceExports, oldestID)
+	}
+	exportID := uuid.NewString()
+	spaceExports[exportID] = &pendingSpaceExport{spaceUUID: spaceUUID, requesterID: requesterID, payload: payload, lastPull: now}
+	return exportID
+}
+
+// pendingSpaceExportPayload returns a stored export if it is still live and
+// belongs to the same space and requester.
+func pendingSpaceExportPayload(exportID, spaceUUID string, requesterID int) (string, bool) {
+	spaceExportsMu.Lock()
+	defer spaceExportsMu.Unlock()
+	export, ok := spaceExports[exportID]
+	if !ok || time.Since(export.lastPull) > spaceExportTTL {
+		delete(spaceExports, exportID)
+		return "", false
+	}
+	if export.spaceUUID != spaceUUID || export.requesterID != requesterID {
+		return "", false
+	}
+	export.lastPull = time.Now()
+	return export.payload, true
+}
+
+// handleExportSpace sends the space author one chunk of a signed archive of
+// the space, building the archive on the first request.
+func handleExportSpace(conn *relayConn, wsMsg *WSMessage) {
+	data, err := decodeData[ExportSpaceRequest](wsMsg.Data)
+	if err != nil {
+		log.Println("error decoding export_space_request:", err)
+		return
+	}
+
+	requester, err := resolveHostUserIdentityStrict(data.RequesterUserID, data.RequesterUserPublicKey, data.RequesterUserEncPublicKey)
+	if err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Failed to resolve requester identity", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	if err := ensureSpaceAuthor(data.SpaceUUID, requester.ID); err != nil {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Not authorized to export this space", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+
+	exportID, chunk := data.ExportID, data.Chunk
+	var payload string
+	if exportID == "" {
+		archive, err := buildSpaceArchive(data.SpaceUUID)
+		var encoded []byte
+		if err == nil {
+			encoded, err = encodeSpaceArchive(archive)
+		}
+		if err != nil {
+			log.Printf("Error exporting space %s: %v", data.SpaceUUID, err)
+			sendToConn(conn, WSMessage{
+				Type: "error",
+				Data: ChatError{Content: "Failed to export space", ClientUUID: data.ClientUUID},
+			})
+			return
+		}
+		recordAudit(data.SpaceUUID, requester, auditActionExportSpace, spaceArchiveAuditDetails(archive))
+		payload = base64.StdEncoding.EncodeToString(encoded)
+		exportID, chunk = storeSpaceExport(data.SpaceUUID, requester.ID, payload), 0
+	} else {
+		var ok bool
+		if payload, ok = pendingSpaceExportPayload(exportID, data.SpaceUUID, requester.ID); !ok {
+			sendToConn(conn, WSMessage{
+				Type: "error",
+				Data: ChatError{Content: "The space export expired; please export again", ClientUUID: data.ClientUUID},
+			})
+			return
+		}
+	}
+
+	chunks := (len(payload) + spaceArchiveChunkSize - 1) / spaceArchiveChunkSize
+	if chunk < 0 || chunk >= chunks {
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{Content: "Invalid space export chunk", ClientUUID: data.ClientUUID},
+		})
+		return
+	}
+	end := min((chunk+1)*spaceArchiveChunkSize, len(payload))
+	sendToConn(conn, WSMessage{
+		Type: "export_space_response",
+		Data: ExportSpaceResponse{
+			SpaceUUID:  data.SpaceUUID,
+			ExportID:   exportID,
+			Chunk:      chunk,
+			Chunks:     chunks,
+			Data:       payload[chunk*spaceArchiveChunkSize : end],
+			ClientUUID: data.ClientUUID,
+		},
+	})
+}
@@ -2,14 +2,11 @@ package main
 
 import (
 	"database/sql"
-	"gochat/db"
+	"errors"
 	"log"
-	"strings"
-
-	"github.com/gorilla/websocket"
 )
 
-func handleInviteUser(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleInviteUser(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[InviteUserRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding invite_user_request:", err)
@@ -62,13 +59,23 @@ func handleInviteUser(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
+	banned, err := hostStore.IsKeyBanned(data.SpaceUUID, user.PublicKey)
+	if err != nil || banned {
+		msg := "User is banned from this space"
+		if err != nil {
+			msg = "Database error validating invite target"
+		}
+		sendToConn(conn, WSMessage{
+			Type: "error",
+			Data: ChatError{
+				Content:    msg,
+				ClientUUID: data.ClientUUID,
+			},
+		})
+		return
+	}
 
-	var existingJoined int
-	err = db.ChatDB.QueryRow(
-		`SELECT joined FROM space_users WHERE space_uuid = ? AND user_id = ?`,
-		data.SpaceUUID,
-		user.ID,
-	).Scan(&existingJoined)
+	existingJoined, err := hostStore.Membership(data.SpaceUUID, user.ID)
 	if err == nil {
 		msg := "User already has a pending invite"
 		if existingJoined == 1 {
@@ -93,22 +100,10 @@ func handleInviteUser(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
-	var spaceUser DashDataInvite
-
 	// First, insert into space_users
-	query := `
-INSERT INTO space_users (space_uuid, user_id)
-VALUES (?, ?)
-RETURNING id, space_uuid, user_id, joined
-`
-	err = db.ChatDB.QueryRow(query, data.SpaceUUID, user.ID).Scan(
-		&spaceUser.ID,
-		&spaceUser.SpaceUUID,
-		&spaceUser.UserID,
-		&spaceUser.Joined,
-	)
+	spaceUser, err := hostStore.CreateInvite(data.SpaceUUID, user.ID)
 	if err != nil {
-		if strings.Contains(strings.ToLower(err.Error()), "unique") {
+		if errors.Is(err, errStoreConflict) {
 			sendToConn(conn, WSMessage{
 				Type: "error",
 				Data: ChatError{
@@ -131,8 +126,7 @@ RETURNING id, space_uuid, user_id, joined
 	spaceUser.UserPublicKey = user.PublicKey
 
 	// Then, query for space name
-	query = `SELECT name FROM spaces WHERE uuid = ?`
-	err = db.ChatDB.QueryRow(query, spaceUser.SpaceUUID).Scan(&spaceUser.Name)
+	space, err := hostStore.Space(spaceUser.SpaceUUID)
 	if err != nil {
 		log.Println("Space name lookup error:", err)
 		sendToConn(conn, WSMessage{
@@ -144,6 +138,10 @@ RETURNING id, space_uuid, user_id, joined
 		})
 		return
 	}
+	spaceUser.Name = space.Name
+	recordAudit(data.SpaceUUID, requester, auditActionInviteUser, map[string]string{
+		"user_public_key": user.PublicKey,
+	})
 
 	sendToConn(conn, WSMessage{
 		Type: "invite_user_success",
@@ -158,13 +156,19 @@ RETURNING id, space_uuid, user_id, joined
 	})
 }
 
-func handleRemoveSpaceUser(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleRemoveSpaceUser(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[RemoveSpaceUserRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding invite_user_request:", err)
 		return
 	}
+	removeSpaceUser(conn, data)
+}
 
+// removeSpaceUser removes a member on behalf of the space author and tells
+// the relay, which drops the member's sessions from the space. Failures are
+// reported to the requester; the result says whether the member was removed.
+func removeSpaceUser(conn *relayConn, data RemoveSpaceUserRequest) bool {
 	requester, err := resolveHostUserIdentityStrict(
 		data.RequesterUserID,
 		data.RequesterUserPublicKey,
@@ -178,7 +182,7 @@ func handleRemoveSpaceUser(conn *websocket.Conn, wsMsg *WSMessage) {
 				ClientUUID: data.ClientUUID,
 			},
 		})
-		return
+		return false
 	}
 	if err := ensureSpaceAuthor(data.SpaceUUID, requester.ID); err != nil {
 		sendToConn(conn, WSMessage{
@@ -188,7 +192,7 @@ func handleRemoveSpaceUser(conn *websocket.Conn, wsMsg *WSMessage) {
 				ClientUUID: data.ClientUUID,
 			},
 		})
-		return
+		return false
 	}
 	targetUser, err := resolveHostUserIdentity(data.UserID, data.UserPublicKey, data.UserEncPublicKey, "")
 	if err != nil {
@@ -199,10 +203,10 @@ func handleRemoveSpaceUser(conn *websocket.Conn, wsMsg *WSMessage) {
 				ClientUUID: data.ClientUUID,
 			},
 		})
-		return
+		return false
 	}
-	var authorID int
-	if err := db.ChatDB.QueryRow(`SELECT author_id FROM spaces WHERE uuid = ?`, data.SpaceUUID).Scan(&authorID); err != nil {
+	space, err := hostStore.Space(data.SpaceUUID)
+	if err != nil {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -210,9 +214,9 @@ func handleRemoveSpaceUser(conn *websocket.Conn, wsMsg *WSMessage) {
 				ClientUUID: data.ClientUUID,
 			},
 		})
-		return
+		return false
 	}
-	if targetUser.ID == authorID {
+	if targetUser.ID == space.AuthorID {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -220,11 +224,11 @@ func handleRemoveSpaceUser(conn *websocket.Conn, wsMsg *WSMessage) {
 				ClientUUID: data.ClientUUID,
 			},
 		})
-		return
+		return false
 	}
 
-	res, err := db.ChatDB.Exec("DELETE FROM space_users WHERE space_uuid = ? AND user_id = ?", data.SpaceUUID, targetUser.ID)
-	if err != nil {
+	err = hostStore.RemoveMember(data.SpaceUUID, targetUser.ID)
+	if err != nil && err != sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -232,9 +236,9 @@ func handleRemoveSpaceUser(conn *websocket.Conn, wsMsg *WSMessage) {
 				ClientUUID: data.ClientUUID,
 			},
 		})
-		return
+		return false
 	}
-	if rows, _ := res.RowsAffected(); rows == 0 {
+	if err == sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -242,19 +246,23 @@ func handleRemoveSpaceUser(conn *websocket.Conn, wsMsg *WSMessage) {
 				ClientUUID: data.ClientUUID,
 			},
 		})
-		return
+		return false
 	}
 
 	data.UserID = targetUser.ID
 	data.UserPublicKey = targetUser.PublicKey
+	recordAudit(data.SpaceUUID, requester, auditActionRemoveSpaceUser, map[string]string{
+		"user_public_key": targetUser.PublicKey,
+	})
 
 	sendToConn(conn, WSMessage{
 		Type: "remove_space_user_success",
 		Data: data,
 	})
+	return true
 }
 
-func handleLeaveSpace(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleLeaveSpace(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[LeaveSpaceRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding invite_user_request:", err)
@@ -273,8 +281,8 @@ func handleLeaveSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
-	res, err := db.ChatDB.Exec("DELETE FROM space_users WHERE space_uuid = ? AND user_id = ?", data.SpaceUUID, user.ID)
-	if err != nil {
+	err = hostStore.RemoveMember(data.SpaceUUID, user.ID)
+	if err != nil && err != sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -284,7 +292,7 @@ func handleLeaveSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
-	if rows, _ := res.RowsAffected(); rows == 0 {
+	if err == sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -297,6 +305,7 @@ func handleLeaveSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 
 	data.UserID = user.ID
 	data.UserPublicKey = user.PublicKey
+	recordAudit(data.SpaceUUID, user, auditActionLeaveSpace, nil)
 
 	sendToConn(conn, WSMessage{
 		Type: "leave_space_success",
@@ -1,14 +1,14 @@
 package main
 
 import (
-	"gochat/db"
+	"database/sql"
+	"errors"
 	"log"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 )
 
-func handleCreateSpace(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleCreateSpace(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[CreateSpaceRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding create_space_request:", err)
@@ -30,14 +30,9 @@ func handleCreateSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
-	var space DashDataSpace
-
-	query := `INSERT INTO spaces (uuid, name, author_id) VALUES (?, ?, ?) RETURNING *`
-	err = db.ChatDB.QueryRow(query, spaceUUID, data.Name, user.ID).Scan(&space.ID, &space.UUID, &space.Name, &space.AuthorID)
-
+	space, err := hostStore.CreateSpace(spaceUUID.String(), data.Name, user.ID)
 	if err != nil {
-		// Check if the error message contains "UNIQUE constraint failed"
-		if err.Error() == "UNIQUE constraint failed: spaces.uuid" {
+		if errors.Is(err, errStoreConflict) {
 			sendToConn(conn, WSMessage{
 				Type: "error",
 				Data: ChatError{
@@ -63,14 +58,13 @@ func handleCreateSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 	channelUUID := uuid.New()
 	initalChannelName := "Initial Channel"
 
-	var channel DashDataChannel
-
-	query = `INSERT INTO channels (uuid, name, space_uuid) VALUES (?, ?, ?) RETURNING *`
-	err = db.ChatDB.QueryRow(query, channelUUID, initalChannelName, space.UUID).Scan(&channel.ID, &channel.UUID, &channel.Name, &channel.SpaceUUID, &channel.AllowVoice)
-
+	_, err = hostStore.CreateChannel(DashDataChannel{
+		UUID:      channelUUID.String(),
+		Name:      initalChannelName,
+		SpaceUUID: space.UUID,
+	})
 	if err != nil {
-		// Check if the error message contains "UNIQUE constraint failed"
-		if err.Error() == "UNIQUE constraint failed: channels.uuid" {
+		if errors.Is(err, errStoreConflict) {
 			sendToConn(conn, WSMessage{
 				Type: "error",
 				Data: ChatError{
@@ -92,6 +86,11 @@ func handleCreateSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 		return
 	}
 
+	recordAudit(space.UUID, user, auditActionCreateSpace, map[string]string{
+		"name":            space.Name,
+		"initial_channel": channelUUID.String(),
+	})
+
 	AppendspaceChannelsAndUsers(&space)
 	caps, err := issueSpaceCapabilitiesForUser(user, []DashDataSpace{space})
 	if err != nil {
@@ -120,7 +119,7 @@ func handleCreateSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 
 }
 
-func handleDeleteSpace(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleDeleteSpace(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[DeleteSpaceRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding delete_space_request:", err)
@@ -153,8 +152,8 @@ func handleDeleteSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 	}
 
 	// Delete the space (cascades to channels, messages, space_users)
-	res, err := db.ChatDB.Exec("DELETE FROM spaces WHERE uuid = ?", data.UUID)
-	if err != nil {
+	err = hostStore.DeleteSpace(data.UUID)
+	if err != nil && err != sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -164,7 +163,7 @@ func handleDeleteSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
-	if rows, _ := res.RowsAffected(); rows == 0 {
+	if err == sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -174,6 +173,8 @@ func handleDeleteSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
+	// The audit log has no foreign key on spaces, so the entry outlives them.
+	recordAudit(data.UUID, requester, auditActionDeleteSpace, nil)
 
 	sendToConn(conn, WSMessage{
 		Type: "delete_space_response",
@@ -184,7 +185,7 @@ func handleDeleteSpace(conn *websocket.Conn, wsMsg *WSMessage) {
 	})
 }
 
-func handleGetDashData(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleGetDashData(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[GetDashDataRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding get_dash_data_request:", err)
@@ -206,6 +207,23 @@ func handleGetDashData(conn *websocket.Conn, wsMsg *WSMessage) {
 	if user.Username == "" {
 		user.Username = data.Username
 	}
+	if data.DeviceID != "" {
+		// The first device key an identity registers switches the relay to
+		// refusing its unkeyed sessions, so it needs the updated list now.
+		firstKeyed := false
+		if isKeyedDeviceID(data.DeviceID) {
+			keyed, err := hasKeyedDevice(user.ID)
+			if err != nil {
+				log.Println("Error loading devices:", err)
+			}
+			firstKeyed = err == nil && !keyed
+		}
+		if err := hostStore.RecordDevice(user.ID, data.DeviceID, data.DeviceName, user.EncPublicKey); err != nil {
+			log.Println("Error recording device:", err)
+		} else if firstKeyed {
+			sendDeviceDenyList(conn)
+		}
+	}
 
 	userSpaces, err := GetUserSpaces(user.ID)
 	if err != nil {
@@ -236,14 +254,7 @@ func handleGetDashData(conn *websocket.Conn, wsMsg *WSMessage) {
 	}
 
 	// Collect invites (space_users.joined = 0) + space.name
-	query := `
-				SELECT su.id, su.space_uuid, su.user_id, su.joined, s.name
-				FROM space_users su
-				JOIN spaces s ON su.space_uuid = s.uuid
-				WHERE su.user_id = ? AND su.joined = 0
-			`
-
-	rows, err := db.ChatDB.Query(query, user.ID)
+	spaceInvites, err := hostStore.PendingInvites(user.ID)
 	if err != nil {
 		sendToConn(conn, WSMessage{
 			Type: "error",
@@ -254,17 +265,6 @@ func handleGetDashData(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
-	defer rows.Close()
-
-	var spaceInvites []DashDataInvite
-	for rows.Next() {
-		var spaceInvite DashDataInvite
-		err := rows.Scan(&spaceInvite.ID, &spaceInvite.SpaceUUID, &spaceInvite.UserID, &spaceInvite.Joined, &spaceInvite.Name)
-		if err != nil {
-			continue
-		}
-		spaceInvites = append(spaceInvites, spaceInvite)
-	}
 	spaceInvites = hydrateInvitePublicKeys(spaceInvites)
 
 	// Official host auto-invite: every authenticated user gets a pending invite
@@ -285,12 +285,8 @@ func handleGetDashData(conn *websocket.Conn, wsMsg *WSMessage) {
 				}
 			}
 		}
-		if !alreadyInOfficialSpace {
-			var autoInvite DashDataInvite
-			err := db.ChatDB.QueryRow(
-				`INSERT INTO space_users (space_uuid, user_id) VALUES (?, ?) RETURNING id, space_uuid, user_id, joined`,
-				officialSpaceUUID, user.ID,
-			).Scan(&autoInvite.ID, &autoInvite.SpaceUUID, &autoInvite.UserID, &autoInvite.Joined)
+		if !alreadyInOfficialSpace && !isKeyBannedFromSpace(officialSpaceUUID, user.PublicKey) {
+			autoInvite, err := hostStore.CreateInvite(officialSpaceUUID, user.ID)
 			if err != nil {
 				log.Println("Auto-invite insert error:", err)
 			} else {
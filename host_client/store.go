@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gochat/db"
+	"log"
+	"strings"
+)
+
+// errStoreConflict wraps unique-constraint violations so callers can tell
+// "already exists" apart from other database failures on every backend.
+// Lookups that find nothing return sql.ErrNoRows.
+var errStoreConflict = errors.New("already exists")
+
+// HostStore is everything the host persists: users, spaces, channels,
+// memberships and invites, messages and bots. Handlers only talk to the
+// store, so the same code runs on SQLite and PostgreSQL.
+type HostStore interface {
+	// UpsertUser creates the user for publicKey or refreshes its encryption
+	// key. The username is only changed when one is given; new users without
+	// one are named after their key.
+	UpsertUser(publicKey, encPublicKey, username string) (DashDataUser, error)
+	UserByPublicKey(publicKey string) (DashDataUser, error)
+	UserByID(userID int) (DashDataUser, error)
+	UsersByIDs(userIDs []int) ([]DashDataUser, error)
+	SetUsername(userID int, username string) error
+	DeleteUser(userID int) error
+
+	CreateSpace(spaceUUID, name string, authorID int) (DashDataSpace, error)
+	Space(spaceUUID string) (DashDataSpace, error)
+	ListSpaces() ([]DashDataSpace, error)
+	// UserSpaces lists the spaces userID authored or has joined.
+	UserSpaces(userID int) ([]DashDataSpace, error)
+	DeleteSpace(spaceUUID string) error
+	// SeedSpace creates the space and channels that do not exist yet and
+	// leaves existing ones untouched.
+	SeedSpace(space DashDataSpace, channels []DashDataChannel) error
+
+	CreateChannel(channel DashDataChannel) (DashDataChannel, error)
+	Channel(channelUUID string) (DashDataChannel, error)
+	SpaceChannels(spaceUUID string) ([]DashDataChannel, error)
+	DeleteChannel(channelUUID string) error
+	SetChannelAllowVoice(channelUUID string, allow int) error
+
+	// SpaceMemberIDs lists users that have joined the space; pending invites
+	// are not members.
+	SpaceMemberIDs(spaceUUID string) ([]int, error)
+	// JoinedSpaceUUIDs lists the spaces userID has joined, ordered by UUID.
+	JoinedSpaceUUIDs(userID int) ([]string, error)
+	// Membership reports the joined flag of userID's row in the space.
+	Membership(spaceUUID string, userID int) (int, error)
+	CreateInvite(spaceUUID string, userID int) (DashDataInvite, error)
+	// AcceptInvite marks a pending invite owned by userID as joined and
+	// returns its space.
+	AcceptInvite(inviteID, userID int) (string, error)
+	DeclineInvite(inviteID, userID int) error
+	// PendingInvites lists userID's invites with the space name filled in.
+	PendingInvites(userID int) ([]DashDataInvite, error)
+	// AddMember joins userID to the space, accepting any pending invite.
+	AddMember(spaceUUID string, userID int) error
+	RemoveMember(spaceUUID string, userID int) error
+
+	// SaveMessage stores a message under the channel's next sequence number
+	// and returns it with its row ID and Seq filled in.
+	SaveMessage(msg StoredMessage) (StoredMessage, error)
+	// MessagesBefore returns up to limit messages older than before, newest
+	// first.
+	MessagesBefore(channelUUID, before string, limit int) ([]StoredMessage, error)
+	// MessagesInRange returns up to limit messages with fromSeq <= seq <=
+	// toSeq, oldest first.
+	MessagesInRange(channelUUID string, fromSeq, toSeq int64, limit int) ([]StoredMessage, error)
+	// ChannelLastSeq returns the last sequence number handed out in the
+	// channel, which is ahead of its newest message once that is deleted.
+	ChannelLastSeq(channelUUID string) (int64, error)
+	// SaveSenderKey stores a sender key distribution and returns its row ID;
+	// a second one for the same channel, sender and epoch returns
+	// errStoreConflict.
+	SaveSenderKey(key StoredSenderKey) (int, error)
+	// SenderKeys loads the distributions for refs in the channel. Refs with
+	// no stored distribution are skipped.
+	SenderKeys(channelUUID string, refs []SenderKeyRef) ([]StoredSenderKey, error)
+	// ChannelSenderKeys lists every distribution stored for the channel,
+	// oldest first.
+	ChannelSenderKeys(channelUUID string) ([]StoredSenderKey, error)
+
+	// DeleteMessage removes one message sent by senderAuthPublicKey. Its seq
+	// is not reused.
+	DeleteMessage(channelUUID, senderAuthPublicKey, messageID string) error
+
+	// CreateReport files a moderation report and returns it with its ID,
+	// status and creation time filled in.
+	CreateReport(report ModerationReport) (ModerationReport, error)
+	Report(reportID int) (ModerationReport, error)
+	// SpaceReports lists up to limit reports for the space, newest first.
+	// An empty status matches every report.
+	SpaceReports(spaceUUID, status string, limit int) ([]ModerationReport, error)
+	// ResolveReport closes an open report; closed reports return
+	// sql.ErrNoRows.
+	ResolveReport(reportID int, action string, resolvedBy int) error
+	// BanKey keeps publicKey out of the space. Banning it twice returns
+	// errStoreConflict.
+	BanKey(spaceUUID, publicKey string, bannedBy int) error
+	IsKeyBanned(spaceUUID, publicKey string) (bool, error)
+
+	// LastAuditHash returns the hash of the newest entry in the space's
+	// audit chain, or "" when the chain is empty.
+	LastAuditHash(spaceUUID string) (string, error)
+	// AppendAuditEntry stores a sealed entry and returns its ID. A second
+	// entry chained to the same PrevHash returns errStoreConflict.
+	AppendAuditEntry(entry AuditEntry) (int, error)
+	// AuditEntries lists up to limit entries of the space older than
+	// beforeID, or the newest when beforeID is 0, newest first.
+	AuditEntries(spaceUUID string, beforeID, limit int) ([]AuditEntry, error)
+
+	CreateBot(userID int, name, signingPrivateKey, encPrivateKey, tokenHash string) (int, error)
+	BotByID(botID int) (botIdentity, error)
+	BotByTokenHash(tokenHash string) (botIdentity, error)
+	ListBots() ([]botIdentity, error)
+	// DeleteBot removes the bot and its memberships. Its chat_users row stays
+	// so earlier messages still resolve to a sender.
+	DeleteBot(botID, userID int) error
+
+	// RecordDevice notes a sign-in from deviceID, creating the record or
+	// refreshing its name, key and last_seen. Revoked devices stay revoked.
+	RecordDevice(userID int, deviceID, deviceName, encPublicKey string) error
+	// UserDevices lists userID's devices, most recently seen first.
+	UserDevices(userID int) ([]HostDevice, error)
+	RevokeDevice(userID int, deviceID string) error
+	// RevokedDevices is the deny list for every identity on the host.
+	RevokedDevices() ([]RevokedDevice, error)
+	// KeyedDeviceIdentities lists the identities that have registered a
+	// device key, revoked or not. The relay refuses their unkeyed sessions.
+	KeyedDeviceIdentities() ([]string, error)
+
+	// MigrateUserKey moves the user holding oldPublicKey onto new keys,
+	// keeping its ID and with it every membership, authored space and ban. A row
+	// already created for the new key is dropped if it owns nothing;
+	// otherwise, or when the user is a bot, errStoreConflict is returned.
+	MigrateUserKey(oldPublicKey, newPublicKey, newEncPublicKey string) (DashDataUser, error)
+
+	// ImportSpace recreates a space moved from another host in one
+	// transaction, keeping its UUIDs, message IDs, sequence numbers and
+	// timestamps. A space or channel that already exists returns
+	// errStoreConflict.
+	ImportSpace(space SpaceImport) error
+
+	Close() error
+}
+
+// StoredMessage is a persisted chat message; Content is the envelope JSON.
+type StoredMessage struct {
+	ID                  int
+	ChannelUUID         string
+	Content             string
+	UserID              int
+	MessageID           string
+	SenderAuthPublicKey string
+	Timestamp           string
+	// Seq orders messages within a channel. The host assigns it on save,
+	// starting at 1 with no gaps.
+	Seq int64
+}
+
+// StoredSenderKey is a persisted sender key distribution; Content is the
+// envelope JSON.
+type StoredSenderKey struct {
+	ChannelUUID         string
+	SenderAuthPublicKey string
+	Epoch               int64
+	Content             string
+	CreatedAt           string
+}
+
+// SpaceImport is a space with its history, ready to be stored on this host.
+// Users must exist already; messages and memberships refer to them by ID.
+type SpaceImport struct {
+	Space      DashDataSpace
+	Channels   []DashDataChannel
+	MemberIDs  []int
+	Messages   []StoredMessage
+	SenderKeys []StoredSenderKey
+	// LastSeq is each channel's counter on the old host, by channel UUID.
+	// A channel never restarts below its newest imported message.
+	LastSeq map[string]int64
+	// AuditLog is the space's chain from the old host, oldest first. The
+	// entries are stored as they are so their signatures still verify.
+	AuditLog []AuditEntry
+}
+
+type SenderKeyRef struct {
+	SenderAuthPublicKey string
+	Epoch               int64
+}
+
+var hostStore HostStore
+
+func usingPostgresStore() bool {
+	return strings.TrimSpace(hostDatabaseURL) != ""
+}
+
+// openHostStore opens the backend selected by HOST_DATABASE_URL, falling back
+// to the SQLite file in the host config. The SQLite connection is also kept
+// in db.ChatDB for backups.
+func openHostStore(cfg *HostConfig) (HostStore, error) {
+	if usingPostgresStore() {
+		log.Println("Using PostgreSQL host storage")
+		return openPostgresHostStore(hostDatabaseURL)
+	}
+
+	if err := prepareHostDatabase(cfg.DBFile); err != nil {
+		return nil, fmt.Errorf("error preparing host database: %w", err)
+	}
+	conn, err := openHostDatabase(cfg.DBFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	db.ChatDB = conn
+	return newSQLiteHostStore(conn), nil
+}
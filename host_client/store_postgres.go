@@ -0,0 +1,52 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"gochat/db"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+//go:embed migrations_postgres/*.sql
+var postgresMigrationFiles embed.FS
+
+const postgresMigrationsPath = "migrations_postgres"
+
+// openPostgresHostStore connects to dsn and migrates it. Several host
+// processes can share one database.
+func openPostgresHostStore(dsn string) (*sqlHostStore, error) {
+	conn, err := db.InitPostgres(dsn, postgresMigrationFiles, postgresMigrationsPath)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlHostStore{
+		db:         conn,
+		rebind:     rebindPostgres,
+		isConflict: isPostgresUniqueViolation,
+	}, nil
+}
+
+// rebindPostgres rewrites ? placeholders to $1, $2, ... The store's queries
+// never contain a literal question mark.
+func rebindPostgres(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isPostgresUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,1014 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqlHostStore implements HostStore with SQL that both SQLite and PostgreSQL
+// accept. Queries are written with ? placeholders; the dialect rewrites them
+// and recognises its own unique-constraint errors.
+type sqlHostStore struct {
+	db         *sql.DB
+	rebind     func(query string) string
+	isConflict func(err error) bool
+}
+
+func newSQLiteHostStore(conn *sql.DB) *sqlHostStore {
+	return &sqlHostStore{
+		db:     conn,
+		rebind: func(query string) string { return query },
+		isConflict: func(err error) bool {
+			return strings.Contains(strings.ToLower(err.Error()), "unique constraint")
+		},
+	}
+}
+
+func (s *sqlHostStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := s.db.Exec(s.rebind(query), args...)
+	return res, s.wrapErr(err)
+}
+
+func (s *sqlHostStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.rebind(query), args...)
+}
+
+func (s *sqlHostStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.rebind(query), args...)
+}
+
+func (s *sqlHostStore) wrapErr(err error) error {
+	if err != nil && s.isConflict(err) {
+		return fmt.Errorf("%w: %v", errStoreConflict, err)
+	}
+	return err
+}
+
+// execOne runs a write that must touch a row, returning sql.ErrNoRows when
+// nothing matched.
+func (s *sqlHostStore) execOne(query string, args ...interface{}) error {
+	res, err := s.exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// storeTimestamp matches SQLite's CURRENT_TIMESTAMP so both backends store
+// the same text.
+func storeTimestamp() string {
+	return time.Now().UTC().Format("2006-01-02 15:04:05")
+}
+
+func (s *sqlHostStore) Close() error {
+	return s.db.Close()
+}
+
+const userColumns = `SELECT id, username, public_key, enc_public_key FROM chat_users`
+
+func scanUsers(rows *sql.Rows, err error) ([]DashDataUser, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []DashDataUser
+	for rows.Next() {
+		var user DashDataUser
+		if err := rows.Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncPublicKey); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlHostStore) UpsertUser(publicKey, encPublicKey, username string) (DashDataUser, error) {
+	update := `enc_public_key = excluded.enc_public_key, updated_at = excluded.updated_at`
+	if username != "" {
+		update += `, username = excluded.username`
+	}
+	now := storeTimestamp()
+	_, err := s.exec(
+		`INSERT INTO chat_users (public_key, enc_public_key, username, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT(public_key) DO UPDATE SET `+update,
+		publicKey,
+		encPublicKey,
+		normalizeUsername(username, publicKey),
+		now,
+		now,
+	)
+	if err != nil {
+		return DashDataUser{}, err
+	}
+	return s.UserByPublicKey(publicKey)
+}
+
+func (s *sqlHostStore) UserByPublicKey(publicKey string) (DashDataUser, error) {
+	var user DashDataUser
+	err := s.queryRow(userColumns+` WHERE public_key = ?`, publicKey).
+		Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncPublicKey)
+	return user, err
+}
+
+func (s *sqlHostStore) UserByID(userID int) (DashDataUser, error) {
+	var user DashDataUser
+	err := s.queryRow(userColumns+` WHERE id = ?`, userID).
+		Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncPublicKey)
+	return user, err
+}
+
+func (s *sqlHostStore) UsersByIDs(userIDs []int) ([]DashDataUser, error) {
+	if len(userIDs) == 0 {
+		return []DashDataUser{}, nil
+	}
+	placeholders := make([]string, len(userIDs))
+	args := make([]interface{}, len(userIDs))
+	for i, userID := range userIDs {
+		placeholders[i] = "?"
+		args[i] = userID
+	}
+	return scanUsers(s.query(userColumns+` WHERE id IN (`+strings.Join(placeholders, ",")+`)`, args...))
+}
+
+func (s *sqlHostStore) SetUsername(userID int, username string) error {
+	return s.execOne(`UPDATE chat_users SET username = ?, updated_at = ? WHERE id = ?`, username, storeTimestamp(), userID)
+}
+
+func (s *sqlHostStore) DeleteUser(userID int) error {
+	_, err := s.exec(`DELETE FROM chat_users WHERE id = ?`, userID)
+	return err
+}
+
+const spaceColumns = `SELECT s.id, s.uuid, s.name, s.author_id FROM spaces s`
+
+func scanSpaces(rows *sql.Rows, err error) ([]DashDataSpace, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var spaces []DashDataSpace
+	for rows.Next() {
+		var space DashDataSpace
+		if err := rows.Scan(&space.ID, &space.UUID, &space.Name, &space.AuthorID); err != nil {
+			return nil, err
+		}
+		spaces = append(spaces, space)
+	}
+	return spaces, rows.Err()
+}
+
+func (s *sqlHostStore) CreateSpace(spaceUUID, name string, authorID int) (DashDataSpace, error) {
+	var space DashDataSpace
+	err := s.queryRow(
+		`INSERT INTO spaces (uuid, name, author_id) VALUES (?, ?, ?) RETURNING id, uuid, name, author_id`,
+		spaceUUID, name, authorID,
+	).Scan(&space.ID, &space.UUID, &space.Name, &space.AuthorID)
+	return space, s.wrapErr(err)
+}
+
+func (s *sqlHostStore) Space(spaceUUID string) (DashDataSpace, error) {
+	var space DashDataSpace
+	err := s.queryRow(spaceColumns+` WHERE s.uuid = ?`, spaceUUID).
+		Scan(&space.ID, &space.UUID, &space.Name, &space.AuthorID)
+	return space, err
+}
+
+func (s *sqlHostStore) ListSpaces() ([]DashDataSpace, error) {
+	return scanSpaces(s.query(spaceColumns + ` ORDER BY s.name`))
+}
+
+func (s *sqlHostStore) UserSpaces(userID int) ([]DashDataSpace, error) {
+	return scanSpaces(s.query(
+		`SELECT DISTINCT s.id, s.uuid, s.name, s.author_id
+		   FROM spaces s
+		   LEFT JOIN space_users su ON su.space_uuid = s.uuid
+		  WHERE s.author_id = ?
+		     OR (su.user_id = ? AND su.joined = 1)`,
+		userID, userID,
+	))
+}
+
+func (s *sqlHostStore) DeleteSpace(spaceUUID string) error {
+	// Cascades to channels, messages and space_users.
+	return s.execOne(`DELETE FROM spaces WHERE uuid = ?`, spaceUUID)
+}
+
+func (s *sqlHostStore) SeedSpace(space DashDataSpace, channels []DashDataChannel) error {
+	if _, err := s.exec(
+		`INSERT INTO spaces (uuid, name, author_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+		space.UUID, space.Name, space.AuthorID,
+	); err != nil {
+		return err
+	}
+	for _, channel := range channels {
+		if _, err := s.exec(
+			`INSERT INTO channels (uuid, name, space_uuid, allow_voice) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+			channel.UUID, channel.Name, space.UUID, channel.AllowVoice,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const channelColumns = `SELECT id, uuid, name, space_uuid, COALESCE(allow_voice, 0) FROM channels`
+
+func (s *sqlHostStore) CreateChannel(channel DashDataChannel) (DashDataChannel, error) {
+	var created DashDataChannel
+	err := s.queryRow(
+		`INSERT INTO channels (uuid, name, space_uuid, allow_voice) VALUES (?, ?, ?, ?)
+		 RETURNING id, uuid, name, space_uuid, allow_voice`,
+		channel.UUID, channel.Name, channel.SpaceUUID, channel.AllowVoice,
+	).Scan(&created.ID, &created.UUID, &created.Name, &created.SpaceUUID, &created.AllowVoice)
+	return created, s.wrapErr(err)
+}
+
+func (s *sqlHostStore) Channel(channelUUID string) (DashDataChannel, error) {
+	var channel DashDataChannel
+	err := s.queryRow(channelColumns+` WHERE uuid = ?`, channelUUID).
+		Scan(&channel.ID, &channel.UUID, &channel.Name, &channel.SpaceUUID, &channel.AllowVoice)
+	return channel, err
+}
+
+func (s *sqlHostStore) SpaceChannels(spaceUUID string) ([]DashDataChannel, error) {
+	rows, err := s.query(channelColumns+` WHERE space_uuid = ? ORDER BY id`, spaceUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []DashDataChannel
+	for rows.Next() {
+		var channel DashDataChannel
+		if err := rows.Scan(&channel.ID, &channel.UUID, &channel.Name, &channel.SpaceUUID, &channel.AllowVoice); err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	return channels, rows.Err()
+}
+
+func (s *sqlHostStore) DeleteChannel(channelUUID string) error {
+	return s.execOne(`DELETE FROM channels WHERE uuid = ?`, channelUUID)
+}
+
+func (s *sqlHostStore) SetChannelAllowVoice(channelUUID string, allow int) error {
+	return s.execOne(`UPDATE channels SET allow_voice = ? WHERE uuid = ?`, allow, channelUUID)
+}
+
+func (s *sqlHostStore) SpaceMemberIDs(spaceUUID string) ([]int, error) {
+	rows, err := s.query(`SELECT user_id FROM space_users WHERE space_uuid = ? AND joined = 1`, spaceUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+func (s *sqlHostStore) JoinedSpaceUUIDs(userID int) ([]string, error) {
+	rows, err := s.query(
+		`SELECT space_uuid FROM space_users WHERE user_id = ? AND joined = 1 ORDER BY space_uuid`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	spaceUUIDs := []string{}
+	for rows.Next() {
+		var spaceUUID string
+		if err := rows.Scan(&spaceUUID); err != nil {
+			return nil, err
+		}
+		spaceUUIDs = append(spaceUUIDs, spaceUUID)
+	}
+	return spaceUUIDs, rows.Err()
+}
+
+func (s *sqlHostStore) Membership(spaceUUID string, userID int) (int, error) {
+	var joined int
+	err := s.queryRow(`SELECT joined FROM space_users WHERE space_uuid = ? AND user_id = ?`, spaceUUID, userID).Scan(&joined)
+	return joined, err
+}
+
+func (s *sqlHostStore) CreateInvite(spaceUUID string, userID int) (DashDataInvite, error) {
+	var invite DashDataInvite
+	err := s.queryRow(
+		`INSERT INTO space_users (space_uuid, user_id) VALUES (?, ?) RETURNING id, space_uuid, user_id, joined`,
+		spaceUUID, userID,
+	).Scan(&invite.ID, &invite.SpaceUUID, &invite.UserID, &invite.Joined)
+	return invite, s.wrapErr(err)
+}
+
+func (s *sqlHostStore) AcceptInvite(inviteID, userID int) (string, error) {
+	// Matching on user_id as well keeps users from accepting others' invites.
+	var spaceUUID string
+	err := s.queryRow(
+		`UPDATE space_users SET joined = 1 WHERE id = ? AND user_id = ? AND joined = 0 RETURNING space_uuid`,
+		inviteID, userID,
+	).Scan(&spaceUUID)
+	return spaceUUID, err
+}
+
+func (s *sqlHostStore) DeclineInvite(inviteID, userID int) error {
+	return s.execOne(`DELETE FROM space_users WHERE id = ? AND user_id = ?`, inviteID, userID)
+}
+
+func (s *sqlHostStore) PendingInvites(userID int) ([]DashDataInvite, error) {
+	rows, err := s.query(
+		`SELECT su.id, su.space_uuid, su.user_id, su.joined, s.name
+		   FROM space_users su
+		   JOIN spaces s ON su.space_uuid = s.uuid
+		  WHERE su.user_id = ? AND su.joined = 0
+		  ORDER BY su.id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []DashDataInvite
+	for rows.Next() {
+		var invite DashDataInvite
+		if err := rows.Scan(&invite.ID, &invite.SpaceUUID, &invite.UserID, &invite.Joined, &invite.Name); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+func (s *sqlHostStore) AddMember(spaceUUID string, userID int) error {
+	_, err := s.exec(
+		`INSERT INTO space_users (space_uuid, user_id, joined)
+		 VALUES (?, ?, 1)
+		 ON CONFLICT(space_uuid, user_id) DO UPDATE SET joined = 1`,
+		spaceUUID,
+		userID,
+	)
+	return err
+}
+
+func (s *sqlHostStore) RemoveMember(spaceUUID string, userID int) error {
+	return s.execOne(`DELETE FROM space_users WHERE space_uuid = ? AND user_id = ?`, spaceUUID, userID)
+}
+
+func (s *sqlHostStore) SaveMessage(msg StoredMessage) (StoredMessage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return msg, err
+	}
+	defer tx.Rollback()
+
+	// Bumping the channel's counter locks its row, so concurrent saves to
+	// one channel get consecutive numbers. A failed insert rolls it back.
+	if err := tx.QueryRow(
+		s.rebind(`UPDATE channels SET last_seq = last_seq + 1 WHERE uuid = ? RETURNING last_seq`),
+		msg.ChannelUUID,
+	).Scan(&msg.Seq); err != nil {
+		return msg, err
+	}
+	err = tx.QueryRow(
+		s.rebind(`INSERT INTO messages (channel_uuid, content, user_id, message_id, sender_auth_public_key, timestamp, seq)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)
+		 RETURNING id`),
+		msg.ChannelUUID,
+		msg.Content,
+		msg.UserID,
+		msg.MessageID,
+		msg.SenderAuthPublicKey,
+		msg.Timestamp,
+		msg.Seq,
+	).Scan(&msg.ID)
+	if err != nil {
+		return msg, s.wrapErr(err)
+	}
+	return msg, tx.Commit()
+}
+
+func (s *sqlHostStore) ChannelLastSeq(channelUUID string) (int64, error) {
+	var lastSeq int64
+	err := s.queryRow(`SELECT last_seq FROM channels WHERE uuid = ?`, channelUUID).Scan(&lastSeq)
+	return lastSeq, err
+}
+
+const messageColumns = `SELECT id, channel_uuid, content, user_id, message_id, sender_auth_public_key, timestamp, seq FROM messages`
+
+func scanMessages(rows *sql.Rows, err error) ([]StoredMessage, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []StoredMessage
+	for rows.Next() {
+		var msg StoredMessage
+		if err := rows.Scan(&msg.ID, &msg.ChannelUUID, &msg.Content, &msg.UserID, &msg.MessageID, &msg.SenderAuthPublicKey, &msg.Timestamp, &msg.Seq); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func (s *sqlHostStore) MessagesBefore(channelUUID, before string, limit int) ([]StoredMessage, error) {
+	return scanMessages(s.query(
+		messageColumns+`
+		  WHERE channel_uuid = ? AND timestamp < ?
+		  ORDER BY timestamp DESC, seq DESC
+		  LIMIT ?`,
+		channelUUID, before, limit,
+	))
+}
+
+func (s *sqlHostStore) MessagesInRange(channelUUID string, fromSeq, toSeq int64, limit int) ([]StoredMessage, error) {
+	return scanMessages(s.query(
+		messageColumns+`
+		  WHERE channel_uuid = ? AND seq >= ? AND seq <= ?
+		  ORDER BY seq
+		  LIMIT ?`,
+		channelUUID, fromSeq, toSeq, limit,
+	))
+}
+
+func (s *sqlHostStore) SaveSenderKey(key StoredSenderKey) (int, error) {
+	var id int
+	err := s.queryRow(
+		`INSERT INTO sender_keys (channel_uuid, sender_auth_public_key, epoch, content, created_at)
+		 VALUES (?, ?, ?, ?, ?)
+		 RETURNING id`,
+		key.ChannelUUID, key.SenderAuthPublicKey, key.Epoch, key.Content, storeTimestamp(),
+	).Scan(&id)
+	return id, s.wrapErr(err)
+}
+
+func (s *sqlHostStore) SenderKeys(channelUUID string, refs []SenderKeyRef) ([]StoredSenderKey, error) {
+	keys := []StoredSenderKey{}
+	for _, ref := range refs {
+		key := StoredSenderKey{ChannelUUID: channelUUID, SenderAuthPublicKey: ref.SenderAuthPublicKey, Epoch: ref.Epoch}
+		err := s.queryRow(
+			`SELECT content FROM sender_keys WHERE channel_uuid = ? AND sender_auth_public_key = ? AND epoch = ?`,
+			channelUUID, ref.SenderAuthPublicKey, ref.Epoch,
+		).Scan(&key.Content)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *sqlHostStore) ChannelSenderKeys(channelUUID string) ([]StoredSenderKey, error) {
+	rows, err := s.query(
+		`SELECT channel_uuid, sender_auth_public_key, epoch, content, created_at
+		   FROM sender_keys
+		  WHERE channel_uuid = ?
+		  ORDER BY id`,
+		channelUUID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []StoredSenderKey{}
+	for rows.Next() {
+		var key StoredSenderKey
+		if err := rows.Scan(&key.ChannelUUID, &key.SenderAuthPublicKey, &key.Epoch, &key.Content, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqlHostStore) DeleteMessage(channelUUID, senderAuthPublicKey, messageID string) error {
+	return s.execOne(
+		`DELETE FROM messages WHERE channel_uuid = ? AND sender_auth_public_key = ? AND message_id = ?`,
+		channelUUID, senderAuthPublicKey, messageID,
+	)
+}
+
+const reportColumns = `
+	SELECT r.id, r.space_uuid, r.channel_uuid, r.kind, r.reporter_user_id, u.public_key,
+	       r.target_public_key, r.message_id, r.envelope, r.excerpt, r.reason, r.status,
+	       r.action, COALESCE(r.resolved_by, 0), r.created_at, COALESCE(r.resolved_at, '')
+	  FROM moderation_reports r
+	  JOIN chat_users u ON u.id = r.reporter_user_id`
+
+func scanReport(row interface{ Scan(...interface{}) error }) (ModerationReport, error) {
+	var report ModerationReport
+	err := row.Scan(
+		&report.ID,
+		&report.SpaceUUID,
+		&report.ChannelUUID,
+		&report.Kind,
+		&report.ReporterUserID,
+		&report.ReporterPublicKey,
+		&report.TargetPublicKey,
+		&report.MessageID,
+		&report.Envelope,
+		&report.Excerpt,
+		&report.Reason,
+		&report.Status,
+		&report.Action,
+		&report.ResolvedBy,
+		&report.CreatedAt,
+		&report.ResolvedAt,
+	)
+	return report, err
+}
+
+func (s *sqlHostStore) CreateReport(report ModerationReport) (ModerationReport, error) {
+	var id int
+	err := s.queryRow(
+		`INSERT INTO moderation_reports
+		    (space_uuid, channel_uuid, kind, reporter_user_id, target_public_key, message_id, envelope, excerpt, reason, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 RETURNING id`,
+		report.SpaceUUID,
+		report.ChannelUUID,
+		report.Kind,
+		report.ReporterUserID,
+		report.TargetPublicKey,
+		report.MessageID,
+		report.Envelope,
+		report.Excerpt,
+		report.Reason,
+		storeTimestamp(),
+	).Scan(&id)
+	if err != nil {
+		return ModerationReport{}, s.wrapErr(err)
+	}
+	return s.Report(id)
+}
+
+func (s *sqlHostStore) Report(reportID int) (ModerationReport, error) {
+	return scanReport(s.queryRow(reportColumns+` WHERE r.id = ?`, reportID))
+}
+
+func (s *sqlHostStore) SpaceReports(spaceUUID, status string, limit int) ([]ModerationReport, error) {
+	query := reportColumns + ` WHERE r.space_uuid = ?`
+	args := []interface{}{spaceUUID}
+	if status != "" {
+		query += ` AND r.status = ?`
+		args = append(args, status)
+	}
+	rows, err := s.query(query+` ORDER BY r.id DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []ModerationReport{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+func (s *sqlHostStore) ResolveReport(reportID int, action string, resolvedBy int) error {
+	return s.execOne(
+		`UPDATE moderation_reports SET status = 'resolved', action = ?, resolved_by = ?, resolved_at = ?
+		  WHERE id = ? AND status = 'open'`,
+		action, resolvedBy, storeTimestamp(), reportID,
+	)
+}
+
+func (s *sqlHostStore) BanKey(spaceUUID, publicKey string, bannedBy int) error {
+	_, err := s.exec(
+		`INSERT INTO space_bans (space_uuid, public_key, banned_by, created_at) VALUES (?, ?, ?, ?)`,
+		spaceUUID, publicKey, bannedBy, storeTimestamp(),
+	)
+	return err
+}
+
+func (s *sqlHostStore) IsKeyBanned(spaceUUID, publicKey string) (bool, error) {
+	var banned bool
+	err := s.queryRow(
+		`SELECT EXISTS (SELECT 1 FROM space_bans WHERE space_uuid = ? AND public_key = ?)`,
+		spaceUUID, publicKey,
+	).Scan(&banned)
+	return banned, err
+}
+
+func (s *sqlHostStore) LastAuditHash(spaceUUID string) (string, error) {
+	var hash string
+	err := s.queryRow(
+		`SELECT hash FROM audit_log WHERE space_uuid = ? ORDER BY id DESC LIMIT 1`,
+		spaceUUID,
+	).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+func (s *sqlHostStore) AppendAuditEntry(entry AuditEntry) (int, error) {
+	details, err := json.Marshal(entry.Details)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = s.queryRow(
+		`INSERT INTO audit_log
+		    (space_uuid, actor_user_id, actor_public_key, action, details, created_at, prev_hash, hash, signing_public_key, signature)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 RETURNING id`,
+		entry.SpaceUUID,
+		entry.ActorUserID,
+		entry.ActorPublicKey,
+		entry.Action,
+		string(details),
+		entry.CreatedAt,
+		entry.PrevHash,
+		entry.Hash,
+		entry.SigningPublicKey,
+		entry.Signature,
+	).Scan(&id)
+	return id, s.wrapErr(err)
+}
+
+func (s *sqlHostStore) AuditEntries(spaceUUID string, beforeID, limit int) ([]AuditEntry, error) {
+	query := `SELECT id, space_uuid, actor_user_id, actor_public_key, action, details, created_at,
+	                 prev_hash, hash, signing_public_key, signature
+	            FROM audit_log
+	           WHERE space_uuid = ?`
+	args := []interface{}{spaceUUID}
+	if beforeID > 0 {
+		query += ` AND id < ?`
+		args = append(args, beforeID)
+	}
+	rows, err := s.query(query+` ORDER BY id DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var details string
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.SpaceUUID,
+			&entry.ActorUserID,
+			&entry.ActorPublicKey,
+			&entry.Action,
+			&details,
+			&entry.CreatedAt,
+			&entry.PrevHash,
+			&entry.Hash,
+			&entry.SigningPublicKey,
+			&entry.Signature,
+		); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(details), &entry.Details); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+const botSelectColumns = `
+	SELECT b.id, b.user_id, b.name, u.public_key, u.enc_public_key, b.created_at,
+	       b.signing_private_key, b.enc_private_key
+	  FROM bots b
+	  JOIN chat_users u ON u.id = b.user_id`
+
+func scanBot(row interface{ Scan(...interface{}) error }) (botIdentity, error) {
+	var bot botIdentity
+	err := row.Scan(
+		&bot.ID,
+		&bot.UserID,
+		&bot.Name,
+		&bot.PublicKey,
+		&bot.EncPublicKey,
+		&bot.CreatedAt,
+		&bot.signingPrivateKey,
+		&bot.encPrivateKey,
+	)
+	return bot, err
+}
+
+func (s *sqlHostStore) CreateBot(userID int, name, signingPrivateKey, encPrivateKey, tokenHash string) (int, error) {
+	var botID int
+	err := s.queryRow(
+		`INSERT INTO bots (user_id, name, signing_private_key, enc_private_key, api_token_hash, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)
+		 RETURNING id`,
+		userID, name, signingPrivateKey, encPrivateKey, tokenHash, storeTimestamp(),
+	).Scan(&botID)
+	return botID, s.wrapErr(err)
+}
+
+func (s *sqlHostStore) BotByID(botID int) (botIdentity, error) {
+	return scanBot(s.queryRow(botSelectColumns+` WHERE b.id = ?`, botID))
+}
+
+func (s *sqlHostStore) BotByTokenHash(tokenHash string) (botIdentity, error) {
+	return scanBot(s.queryRow(botSelectColumns+` WHERE b.api_token_hash = ?`, tokenHash))
+}
+
+func (s *sqlHostStore) ListBots() ([]botIdentity, error) {
+	rows, err := s.query(botSelectColumns + ` ORDER BY b.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := []botIdentity{}
+	for rows.Next() {
+		bot, err := scanBot(rows)
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, bot)
+	}
+	return bots, rows.Err()
+}
+
+func (s *sqlHostStore) DeleteBot(botID, userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.rebind(`DELETE FROM space_users WHERE user_id = ?`), userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.rebind(`DELETE FROM bots WHERE id = ?`), botID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlHostStore) RecordDevice(userID int, deviceID, deviceName, encPublicKey string) error {
+	now := storeTimestamp()
+	_, err := s.exec(
+		`INSERT INTO user_devices (user_id, device_id, device_name, enc_public_key, first_seen, last_seen)
+		 VALUES (?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(user_id, device_id) DO UPDATE SET
+		   device_name = excluded.device_name,
+		   enc_public_key = excluded.enc_public_key,
+		   last_seen = excluded.last_seen`,
+		userID, deviceID, deviceName, encPublicKey, now, now,
+	)
+	return err
+}
+
+func (s *sqlHostStore) UserDevices(userID int) ([]HostDevice, error) {
+	rows, err := s.query(
+		`SELECT device_id, device_name, enc_public_key, first_seen, last_seen, COALESCE(revoked_at, '')
+		   FROM user_devices
+		  WHERE user_id = ?
+		  ORDER BY last_seen DESC, id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []HostDevice{}
+	for rows.Next() {
+		var device HostDevice
+		if err := rows.Scan(&device.DeviceID, &device.DeviceName, &device.EncPublicKey, &device.FirstSeen, &device.LastSeen, &device.RevokedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+func (s *sqlHostStore) RevokeDevice(userID int, deviceID string) error {
+	return s.execOne(
+		`UPDATE user_devices SET revoked_at = ? WHERE user_id = ? AND device_id = ? AND revoked_at IS NULL`,
+		storeTimestamp(), userID, deviceID,
+	)
+}
+
+func (s *sqlHostStore) RevokedDevices() ([]RevokedDevice, error) {
+	rows, err := s.query(
+		`SELECT u.public_key, d.device_id
+		   FROM user_devices d
+		   JOIN chat_users u ON u.id = d.user_id
+		  WHERE d.revoked_at IS NOT NULL
+		  ORDER BY d.id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revoked := []RevokedDevice{}
+	for rows.Next() {
+		var device RevokedDevice
+		if err := rows.Scan(&device.UserPublicKey, &device.DeviceID); err != nil {
+			return nil, err
+		}
+		revoked = append(revoked, device)
+	}
+	return revoked, rows.Err()
+}
+
+func (s *sqlHostStore) KeyedDeviceIdentities() ([]string, error) {
+	rows, err := s.query(
+		`SELECT DISTINCT u.public_key
+		   FROM user_devices d
+		   JOIN chat_users u ON u.id = d.user_id
+		  WHERE d.device_id LIKE ?
+		  ORDER BY u.public_key`,
+		keyedDevicePrefix+"%",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []string{}
+	for rows.Next() {
+		var publicKey string
+		if err := rows.Scan(&publicKey); err != nil {
+			return nil, err
+		}
+		identities = append(identities, publicKey)
+	}
+	return identities, rows.Err()
+}
+
+func (s *sqlHostStore) MigrateUserKey(oldPublicKey, newPublicKey, newEncPublicKey string) (DashDataUser, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return DashDataUser{}, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	if err := tx.QueryRow(s.rebind(`SELECT id FROM chat_users WHERE public_key = ?`), oldPublicKey).Scan(&userID); err != nil {
+		return DashDataUser{}, err
+	}
+	var isBot bool
+	if err := tx.QueryRow(s.rebind(`SELECT EXISTS (SELECT 1 FROM bots WHERE user_id = ?)`), userID).Scan(&isBot); err != nil {
+		return DashDataUser{}, err
+	}
+	if isBot {
+		return DashDataUser{}, fmt.Errorf("%w: bot identities cannot be migrated", errStoreConflict)
+	}
+
+	var placeholderID int
+	err = tx.QueryRow(s.rebind(`SELECT id FROM chat_users WHERE public_key = ?`), newPublicKey).Scan(&placeholderID)
+	if err != nil && err != sql.ErrNoRows {
+		return DashDataUser{}, err
+	}
+	if err == nil {
+		// Signing in with the new key before migrating creates an empty user;
+		// anything more means the new key is already someone in its own right.
+		var owns bool
+		if err := tx.QueryRow(s.rebind(
+			`SELECT EXISTS (SELECT 1 FROM spaces WHERE author_id = ?)
+			     OR EXISTS (SELECT 1 FROM space_users WHERE user_id = ?)
+			     OR EXISTS (SELECT 1 FROM messages WHERE user_id = ?)
+			     OR EXISTS (SELECT 1 FROM bots WHERE user_id = ?)`),
+			placeholderID, placeholderID, placeholderID, placeholderID,
+		).Scan(&owns); err != nil {
+			return DashDataUser{}, err
+		}
+		if owns {
+			return DashDataUser{}, fmt.Errorf("%w: the new key already belongs to a user", errStoreConflict)
+		}
+		if _, err := tx.Exec(s.rebind(`DELETE FROM user_devices WHERE user_id = ?`), placeholderID); err != nil {
+			return DashDataUser{}, err
+		}
+		if _, err := tx.Exec(s.rebind(`DELETE FROM chat_users WHERE id = ?`), placeholderID); err != nil {
+			return DashDataUser{}, err
+		}
+	}
+
+	if _, err := tx.Exec(
+		s.rebind(`UPDATE chat_users SET public_key = ?, enc_public_key = ?, updated_at = ? WHERE id = ?`),
+		newPublicKey, newEncPublicKey, storeTimestamp(), userID,
+	); err != nil {
+		return DashDataUser{}, s.wrapErr(err)
+	}
+	// Bans follow the identity, or a banned user could rotate their way back.
+	if _, err := tx.Exec(s.rebind(`UPDATE space_bans SET public_key = ? WHERE public_key = ?`), newPublicKey, oldPublicKey); err != nil {
+		return DashDataUser{}, s.wrapErr(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return DashDataUser{}, err
+	}
+	return s.UserByID(userID)
+}
+
+func (s *sqlHostStore) ImportSpace(space SpaceImport) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	exec := func(query string, args ...interface{}) error {
+		_, err := tx.Exec(s.rebind(query), args...)
+		return s.wrapErr(err)
+	}
+
+	if err := exec(
+		`INSERT INTO spaces (uuid, name, author_id) VALUES (?, ?, ?)`,
+		space.Space.UUID, space.Space.Name, space.Space.AuthorID,
+	); err != nil {
+		return err
+	}
+	lastSeq := make(map[string]int64, len(space.Channels))
+	for channelUUID, seq := range space.LastSeq {
+		lastSeq[channelUUID] = seq
+	}
+	for _, msg := range space.Messages {
+		lastSeq[msg.ChannelUUID] = max(lastSeq[msg.ChannelUUID], msg.Seq)
+	}
+	for _, channel := range space.Channels {
+		// last_seq carries on from the old host so new messages do not reuse
+		// a number clients already saw, even one whose message was deleted.
+		if err := exec(
+			`INSERT INTO channels (uuid, name, space_uuid, allow_voice, last_seq) VALUES (?, ?, ?, ?, ?)`,
+			channel.UUID, channel.Name, space.Space.UUID, channel.AllowVoice, lastSeq[channel.UUID],
+		); err != nil {
+			return err
+		}
+	}
+	for _, userID := range space.MemberIDs {
+		if err := exec(
+			`INSERT INTO space_users (space_uuid, user_id, joined) VALUES (?, ?, 1)`,
+			space.Space.UUID, userID,
+		); err != nil {
+			return err
+		}
+	}
+	for _, msg := range space.Messages {
+		if err := exec(
+			`INSERT INTO messages (channel_uuid, content, user_id, message_id, sender_auth_public_key, timestamp, seq)
+			 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			msg.ChannelUUID, msg.Content, msg.UserID, msg.MessageID, msg.SenderAuthPublicKey, msg.Timestamp, msg.Seq,
+		); err != nil {
+			return err
+		}
+	}
+	for _, key := range space.SenderKeys {
+		createdAt := key.CreatedAt
+		if createdAt == "" {
+			createdAt = storeTimestamp()
+		}
+		if err := exec(
+			`INSERT INTO sender_keys (channel_uuid, sender_auth_public_key, epoch, content, created_at) VALUES (?, ?, ?, ?, ?)`,
+			key.ChannelUUID, key.SenderAuthPublicKey, key.Epoch, key.Content, createdAt,
+		); err != nil {
+			return err
+		}
+	}
+	for _, entry := range space.AuditLog {
+		details, err := json.Marshal(entry.Details)
+		if err != nil {
+			return err
+		}
+		if err := exec(
+			`INSERT INTO audit_log
+			    (space_uuid, actor_user_id, actor_public_key, action, details, created_at, prev_hash, hash, signing_public_key, signature)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			entry.SpaceUUID, entry.ActorUserID, entry.ActorPublicKey, entry.Action, string(details),
+			entry.CreatedAt, entry.PrevHash, entry.Hash, entry.SigningPublicKey, entry.Signature,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,1014 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The PostgreSQL store runs against HOST_TEST_POSTGRES_URL when it is set,
+// e.g. postgres://postgres@localhost/parch_test?sslmode=disable. The tests
+// empty every host table in that database first.
+func hostStoreBackends(t *testing.T) map[string]func(t *testing.T) HostStore {
+	t.Helper()
+	backends := map[string]func(t *testing.T) HostStore{
+		"sqlite": func(t *testing.T) HostStore {
+			conn, err := openHostDatabase(filepath.Join(t.TempDir(), "host.db"))
+			if err != nil {
+				t.Fatalf("open sqlite store: %v", err)
+			}
+			return newSQLiteHostStore(conn)
+		},
+	}
+	if dsn := os.Getenv("HOST_TEST_POSTGRES_URL"); dsn != "" {
+		backends["postgres"] = func(t *testing.T) HostStore {
+			store, err := openPostgresHostStore(dsn)
+			if err != nil {
+				t.Fatalf("open postgres store: %v", err)
+			}
+			if _, err := store.db.Exec(`TRUNCATE audit_log, space_bans, moderation_reports, sender_keys, user_devices, bots, messages, space_users, channels, spaces, chat_users RESTART IDENTITY CASCADE`); err != nil {
+				t.Fatalf("reset postgres store: %v", err)
+			}
+			return store
+		}
+	}
+	return backends
+}
+
+func runHostStoreTest(t *testing.T, test func(t *testing.T, store HostStore)) {
+	for name, open := range hostStoreBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			t.Cleanup(func() { _ = store.Close() })
+			test(t, store)
+		})
+	}
+}
+
+func TestHostStoreUsers(t *testing.T) {
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		user, err := store.UpsertUser("pub-alice", "enc-1", "")
+		if err != nil {
+			t.Fatalf("insert user: %v", err)
+		}
+		if user.Username != "user-pub-alic" || user.EncPublicKey != "enc-1" {
+			t.Fatalf("unexpected new user: %+v", user)
+		}
+
+		// An empty username keeps the stored one; the encryption key follows.
+		again, err := store.UpsertUser("pub-alice", "enc-2", "")
+		if err != nil {
+			t.Fatalf("upsert user: %v", err)
+		}
+		if again.ID != user.ID || again.Username != user.Username || again.EncPublicKey != "enc-2" {
+			t.Fatalf("unexpected upserted user: %+v", again)
+		}
+		if _, err := store.UpsertUser("pub-alice", "enc-2", "Alice"); err != nil {
+			t.Fatalf("rename through upsert: %v", err)
+		}
+
+		if err := store.SetUsername(user.ID, "Alicia"); err != nil {
+			t.Fatalf("set username: %v", err)
+		}
+		if err := store.SetUsername(user.ID+100, "Nobody"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows renaming a missing user, got %v", err)
+		}
+		bob, _ := store.UpsertUser("pub-bob", "enc-b", "Bob")
+		users, err := store.UsersByIDs([]int{user.ID, bob.ID})
+		if err != nil || len(users) != 2 {
+			t.Fatalf("users by ids: %v %+v", err, users)
+		}
+		byKey, err := store.UserByPublicKey("pub-alice")
+		if err != nil || byKey.Username != "Alicia" {
+			t.Fatalf("user by key: %v %+v", err, byKey)
+		}
+		if _, err := store.UserByID(user.ID + 100); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows for a missing user, got %v", err)
+		}
+	})
+}
+
+func TestHostStoreSpacesAndInvites(t *testing.T) {
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		author, _ := store.UpsertUser("pub-author", "enc-a", "Author")
+		guest, _ := store.UpsertUser("pub-guest", "enc-g", "Guest")
+
+		space, err := store.CreateSpace("space-1", "Space One", author.ID)
+		if err != nil {
+			t.Fatalf("create space: %v", err)
+		}
+		if _, err := store.CreateSpace("space-1", "Duplicate", author.ID); !errors.Is(err, errStoreConflict) {
+			t.Fatalf("expected errStoreConflict for a duplicate space, got %v", err)
+		}
+		channel, err := store.CreateChannel(DashDataChannel{UUID: "channel-1", Name: "general", SpaceUUID: space.UUID})
+		if err != nil {
+			t.Fatalf("create channel: %v", err)
+		}
+		if err := store.SetChannelAllowVoice(channel.UUID, 1); err != nil {
+			t.Fatalf("allow voice: %v", err)
+		}
+		if channel, _ = store.Channel(channel.UUID); channel.AllowVoice != 1 {
+			t.Fatalf("allow_voice not stored: %+v", channel)
+		}
+
+		invite, err := store.CreateInvite(space.UUID, guest.ID)
+		if err != nil {
+			t.Fatalf("create invite: %v", err)
+		}
+		if _, err := store.CreateInvite(space.UUID, guest.ID); !errors.Is(err, errStoreConflict) {
+			t.Fatalf("expected errStoreConflict for a second invite, got %v", err)
+		}
+		pending, err := store.PendingInvites(guest.ID)
+		if err != nil || len(pending) != 1 || pending[0].Name != "Space One" {
+			t.Fatalf("pending invites: %v %+v", err, pending)
+		}
+		if _, err := store.AcceptInvite(invite.ID, author.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected another user's accept to fail, got %v", err)
+		}
+		spaceUUID, err := store.AcceptInvite(invite.ID, guest.ID)
+		if err != nil || spaceUUID != space.UUID {
+			t.Fatalf("accept invite: %v %q", err, spaceUUID)
+		}
+		if joined, err := store.Membership(space.UUID, guest.ID); err != nil || joined != 1 {
+			t.Fatalf("membership after accept: %v %d", err, joined)
+		}
+
+		spaces, err := store.UserSpaces(guest.ID)
+		if err != nil || len(spaces) != 1 || spaces[0].UUID != space.UUID {
+			t.Fatalf("guest spaces: %v %+v", err, spaces)
+		}
+		members, err := store.SpaceMemberIDs(space.UUID)
+		if err != nil || len(members) != 1 || members[0] != guest.ID {
+			t.Fatalf("space members: %v %v", err, members)
+		}
+
+		if err := store.RemoveMember(space.UUID, guest.ID); err != nil {
+			t.Fatalf("remove member: %v", err)
+		}
+		if err := store.RemoveMember(space.UUID, guest.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows removing twice, got %v", err)
+		}
+
+		// Deleting the space cascades to its channels.
+		if err := store.DeleteSpace(space.UUID); err != nil {
+			t.Fatalf("delete space: %v", err)
+		}
+		if _, err := store.Channel(channel.UUID); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected the channel to be deleted with its space, got %v", err)
+		}
+	})
+}
+
+func TestHostStoreSeedSpaceIsIdempotent(t *testing.T) {
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		space := DashDataSpace{UUID: "seeded", Name: "Seeded"}
+		channels := []DashDataChannel{{UUID: "seeded-general", Name: "general"}}
+		for i := 0; i < 2; i++ {
+			if err := store.SeedSpace(space, channels); err != nil {
+				t.Fatalf("seed %d: %v", i, err)
+			}
+		}
+		got, err := store.SpaceChannels(space.UUID)
+		if err != nil || len(got) != 1 {
+			t.Fatalf("seeded channels: %v %+v", err, got)
+		}
+	})
+}
+
+func TestHostStoreMessages(t *testing.T) {
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		user, _ := store.UpsertUser("pub-sender", "enc-s", "Sender")
+		space, _ := store.CreateSpace("space-m", "Messages", user.ID)
+		channel, _ := store.CreateChannel(DashDataChannel{UUID: "channel-m", Name: "general", SpaceUUID: space.UUID})
+
+		lastID := 0
+		for i, ts := range []string{"2026-10-18T09:00:00Z", "2026-10-18T09:01:00Z", "2026-10-18T09:02:00Z"} {
+			saved, err := store.SaveMessage(StoredMessage{
+				ChannelUUID:         channel.UUID,
+				Content:             `{"ciphertext":"x"}`,
+				UserID:              user.ID,
+				MessageID:           string(rune('a' + i)),
+				SenderAuthPublicKey: user.PublicKey,
+				Timestamp:           ts,
+			})
+			if err != nil {
+				t.Fatalf("save message %d: %v", i, err)
+			}
+			if saved.ID <= lastID || saved.Seq != int64(i+1) {
+				t.Fatalf("save message %d: expected an increasing row id and seq %d, got %+v", i, i+1, saved)
+			}
+			lastID = saved.ID
+		}
+		replay := StoredMessage{
+			ChannelUUID:         channel.UUID,
+			Content:             `{}`,
+			UserID:              user.ID,
+			MessageID:           "a",
+			SenderAuthPublicKey: user.PublicKey,
+			Timestamp:           "2026-10-18T09:03:00Z",
+		}
+		if _, err := store.SaveMessage(replay); !errors.Is(err, errStoreConflict) {
+			t.Fatalf("expected errStoreConflict for a replayed message, got %v", err)
+		}
+		replay.MessageID = "d"
+		if saved, err := store.SaveMessage(replay); err != nil || saved.Seq != 4 {
+			t.Fatalf("expected the rejected replay not to use up a seq, got %+v %v", saved, err)
+		}
+
+		messages, err := store.MessagesBefore(channel.UUID, "2026-10-18T09:02:00Z", 10)
+		if err != nil {
+			t.Fatalf("messages before: %v", err)
+		}
+		if len(messages) != 2 || messages[0].MessageID != "b" || messages[1].MessageID != "a" {
+			t.Fatalf("expected b, a newest first, got %+v", messages)
+		}
+
+		ranged, err := store.MessagesInRange(channel.UUID, 2, 3, 10)
+		if err != nil {
+			t.Fatalf("messages in range: %v", err)
+		}
+		if len(ranged) != 2 || ranged[0].Seq != 2 || ranged[1].Seq != 3 || ranged[0].MessageID != "b" {
+			t.Fatalf("expected seq 2 and 3 oldest first, got %+v", ranged)
+		}
+
+		if err := store.DeleteMessage(channel.UUID, user.PublicKey, "d"); err != nil {
+			t.Fatalf("delete message: %v", err)
+		}
+		if lastSeq, err := store.ChannelLastSeq(channel.UUID); err != nil || lastSeq != 4 {
+			t.Fatalf("expected last_seq to stay 4 after deleting the newest message, got %d %v", lastSeq, err)
+		}
+	})
+}
+
+func TestHostStoreBots(t *testing.T) {
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		user, _ := store.UpsertUser("pub-bot", "enc-bot", "Helper")
+		space, _ := store.CreateSpace("space-b", "Bots", user.ID)
+
+		botID, err := store.CreateBot(user.ID, "Helper", "signing", "enc", "token-hash")
+		if err != nil {
+			t.Fatalf("create bot: %v", err)
+		}
+		if _, err := store.CreateBot(user.ID, "Again", "signing", "enc", "other-hash"); !errors.Is(err, errStoreConflict) {
+			t.Fatalf("expected errStoreConflict for a second bot on one user, got %v", err)
+		}
+		bot, err := store.BotByTokenHash("token-hash")
+		if err != nil || bot.ID != botID || bot.PublicKey != "pub-bot" || bot.signingPrivateKey != "signing" {
+			t.Fatalf("bot by token: %v %+v", err, bot)
+		}
+
+		if err := store.AddMember(space.UUID, user.ID); err != nil {
+			t.Fatalf("add member: %v", err)
+		}
+		if err := store.AddMember(space.UUID, user.ID); err != nil {
+			t.Fatalf("add member twice: %v", err)
+		}
+		if joined, _ := store.JoinedSpaceUUIDs(user.ID); len(joined) != 1 || joined[0] != space.UUID {
+			t.Fatalf("joined spaces: %v", joined)
+		}
+
+		if err := store.DeleteBot(botID, user.ID); err != nil {
+			t.Fatalf("delete bot: %v", err)
+		}
+		if _, err := store.BotByID(botID); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected the bot to be gone, got %v", err)
+		}
+		if joined, _ := store.JoinedSpaceUUIDs(user.ID); len(joined) != 0 {
+			t.Fatalf("expected memberships removed with the bot, got %v", joined)
+		}
+		if _, err := store.UserByID(user.ID); err != nil {
+			t.Fatalf("bot user should be kept: %v", err)
+		}
+	})
+}
+
+func TestHostStoreDevices(t *testing.T) {
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		user, _ := store.UpsertUser("pub-dev", "enc-dev", "Dev")
+		if err := store.RecordDevice(user.ID, "laptop", "Laptop", "enc-1"); err != nil {
+			t.Fatalf("record device: %v", err)
+		}
+		if err := store.RecordDevice(user.ID, "phone", "Phone", "enc-2"); err != nil {
+			t.Fatalf("record second device: %v", err)
+		}
+		first, _ := store.UserDevices(user.ID)
+
+		// Seeing a device again renames it but keeps when it was first seen.
+		if err := store.RecordDevice(user.ID, "laptop", "Work laptop", "enc-3"); err != nil {
+			t.Fatalf("record device again: %v", err)
+		}
+		devices, err := store.UserDevices(user.ID)
+		if err != nil || len(devices) != 2 {
+			t.Fatalf("list devices: %v %+v", err, devices)
+		}
+		var laptop HostDevice
+		for _, device := range devices {
+			if device.DeviceID == "laptop" {
+				laptop = device
+			}
+		}
+		if laptop.DeviceName != "Work laptop" || laptop.EncPublicKey != "enc-3" {
+			t.Fatalf("unexpected laptop: %+v", laptop)
+		}
+		for _, device := range first {
+			if device.DeviceID == "laptop" && device.FirstSeen != laptop.FirstSeen {
+				t.Fatalf("first_seen changed from %q to %q", device.FirstSeen, laptop.FirstSeen)
+			}
+		}
+
+		if err := store.RevokeDevice(user.ID, "phone"); err != nil {
+			t.Fatalf("revoke device: %v", err)
+		}
+		if err := store.RevokeDevice(user.ID, "phone"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows revoking twice, got %v", err)
+		}
+		if err := store.RevokeDevice(user.ID, "missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows revoking a missing device, got %v", err)
+		}
+
+		// A revoked device signing in again stays revoked.
+		if err := store.RecordDevice(user.ID, "phone", "Phone", "enc-2"); err != nil {
+			t.Fatalf("record revoked device: %v", err)
+		}
+		revoked, err := store.RevokedDevices()
+		if err != nil || len(revoked) != 1 || revoked[0].UserPublicKey != "pub-dev" || revoked[0].DeviceID != "phone" {
+			t.Fatalf("revoked devices: %v %+v", err, revoked)
+		}
+
+		// Only identities with a device key must keep using one.
+		if keyed, err := store.KeyedDeviceIdentities(); err != nil || len(keyed) != 0 {
+			t.Fatalf("expected no keyed identities yet: %v %v", err, keyed)
+		}
+		if err := store.RecordDevice(user.ID, keyedDevicePrefix+"abc", "Browser", "enc-4"); err != nil {
+			t.Fatalf("record keyed device: %v", err)
+		}
+		keyed, err := store.KeyedDeviceIdentities()
+		if err != nil || len(keyed) != 1 || keyed[0] != "pub-dev" {
+			t.Fatalf("keyed identities: %v %v", err, keyed)
+		}
+	})
+}
+
+func TestHostStoreMigrateUserKey(t *testing.T) {
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		alice, _ := store.UpsertUser("pub-old", "enc-old", "Alice")
+		space, _ := store.CreateSpace("space-m", "Migrated", alice.ID)
+		if err := store.AddMember(space.UUID, alice.ID); err != nil {
+			t.Fatalf("add member: %v", err)
+		}
+		// Signing in with the new key first leaves an empty user behind.
+		if _, err := store.UpsertUser("pub-new", "enc-new", ""); err != nil {
+			t.Fatalf("insert placeholder: %v", err)
+		}
+
+		migrated, err := store.MigrateUserKey("pub-old", "pub-new", "enc-new-2")
+		if err != nil {
+			t.Fatalf("migrate user key: %v", err)
+		}
+		if migrated.ID != alice.ID || migrated.Username != "Alice" || migrated.PublicKey != "pub-new" || migrated.EncPublicKey != "enc-new-2" {
+			t.Fatalf("unexpected migrated user: %+v", migrated)
+		}
+		if _, err := store.UserByPublicKey("pub-old"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected the old key to be gone, got %v", err)
+		}
+		if joined, _ := store.JoinedSpaceUUIDs(alice.ID); len(joined) != 1 || joined[0] != space.UUID {
+			t.Fatalf("expected memberships to carry over, got %v", joined)
+		}
+		if spaces, _ := store.UserSpaces(alice.ID); len(spaces) != 1 || spaces[0].AuthorID != alice.ID {
+			t.Fatalf("expected the authored space to carry over, got %+v", spaces)
+		}
+
+		if _, err := store.MigrateUserKey("pub-old", "pub-other", "enc"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows migrating a missing key, got %v", err)
+		}
+		bob, _ := store.UpsertUser("pub-bob", "enc-bob", "Bob")
+		if err := store.AddMember(space.UUID, bob.ID); err != nil {
+			t.Fatalf("add bob: %v", err)
+		}
+		if _, err := store.MigrateUserKey("pub-new", "pub-bob", "enc"); !errors.Is(err, errStoreConflict) {
+			t.Fatalf("expected errStoreConflict moving onto a key in use, got %v", err)
+		}
+	})
+}
+
+func TestHostStoreSenderKeys(t *testing.T) {
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		user, _ := store.UpsertUser("pub-sk", "enc-sk", "Keys")
+		space, _ := store.CreateSpace("space-k", "Keys", user.ID)
+		channel, _ := store.CreateChannel(DashDataChannel{UUID: "channel-k", Name: "general", SpaceUUID: space.UUID})
+
+		key := StoredSenderKey{ChannelUUID: channel.UUID, SenderAuthPublicKey: "pub-sk", Epoch: 1700000000000, Content: `{"v":2}`}
+		if _, err := store.SaveSenderKey(key); err != nil {
+			t.Fatalf("save sender key: %v", err)
+		}
+		if _, err := store.SaveSenderKey(key); !errors.Is(err, errStoreConflict) {
+			t.Fatalf("expected errStoreConflict for a repeated epoch, got %v", err)
+		}
+
+		keys, err := store.SenderKeys(channel.UUID, []SenderKeyRef{
+			{SenderAuthPublicKey: "pub-sk", Epoch: 1700000000000},
+			{SenderAuthPublicKey: "pub-sk", Epoch: 2},
+		})
+		if err != nil || len(keys) != 1 || keys[0].Content != key.Content || keys[0].Epoch != key.Epoch {
+			t.Fatalf("sender keys: %v %+v", err, keys)
+		}
+	})
+}
+
+func TestHostStoreModeration(t *testing.T) {
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		owner, _ := store.UpsertUser("pub-owner", "enc-owner", "Owner")
+		reporter, _ := store.UpsertUser("pub-reporter", "enc-reporter", "Reporter")
+		space, _ := store.CreateSpace("space-r", "Reports", owner.ID)
+		channel, _ := store.CreateChannel(DashDataChannel{UUID: "channel-r", Name: "general", SpaceUUID: space.UUID})
+		if _, err := store.SaveMessage(StoredMessage{ChannelUUID: channel.UUID, Content: `{"v":1}`, UserID: owner.ID, MessageID: "m-1", SenderAuthPublicKey: "pub-spam", Timestamp: "2026-10-18T09:00:00Z"}); err != nil {
+			t.Fatalf("save message: %v", err)
+		}
+
+		report, err := store.CreateReport(ModerationReport{
+			SpaceUUID:       space.UUID,
+			ChannelUUID:     channel.UUID,
+			Kind:            "message",
+			ReporterUserID:  reporter.ID,
+			TargetPublicKey: "pub-spam",
+			MessageID:       "m-1",
+			Envelope:        `{"v":1}`,
+			Excerpt:         "buy now",
+		})
+		if err != nil || report.ID == 0 || report.Status != "open" || report.ReporterPublicKey != "pub-reporter" || report.CreatedAt == "" {
+			t.Fatalf("create report: %v %+v", err, report)
+		}
+		if _, err := store.CreateReport(ModerationReport{SpaceUUID: space.UUID, Kind: "user", ReporterUserID: reporter.ID, TargetPublicKey: "pub-spam"}); err != nil {
+			t.Fatalf("create user report: %v", err)
+		}
+
+		open, err := store.SpaceReports(space.UUID, "open", 10)
+		if err != nil || len(open) != 2 || open[0].Kind != "user" {
+			t.Fatalf("open reports, newest first: %v %+v", err, open)
+		}
+
+		if err := store.DeleteMessage(channel.UUID, "pub-spam", "m-1"); err != nil {
+			t.Fatalf("delete message: %v", err)
+		}
+		if err := store.DeleteMessage(channel.UUID, "pub-spam", "m-1"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows deleting twice, got %v", err)
+		}
+		if err := store.ResolveReport(report.ID, "delete_message", owner.ID); err != nil {
+			t.Fatalf("resolve report: %v", err)
+		}
+		if err := store.ResolveReport(report.ID, "dismiss", owner.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows resolving twice, got %v", err)
+		}
+		resolved, err := store.Report(report.ID)
+		if err != nil || resolved.Status != "resolved" || resolved.Action != "delete_message" || resolved.ResolvedBy != owner.ID || resolved.ResolvedAt == "" {
+			t.Fatalf("resolved report: %v %+v", err, resolved)
+		}
+		if open, _ := store.SpaceReports(space.UUID, "open", 10); len(open) != 1 {
+			t.Fatalf("expected one open report left, got %+v", open)
+		}
+		if all, _ := store.SpaceReports(space.UUID, "", 10); len(all) != 2 {
+			t.Fatalf("expected both reports without a status filter, got %+v", all)
+		}
+
+		if err := store.BanKey(space.UUID, "pub-spam", owner.ID); err != nil {
+			t.Fatalf("ban key: %v", err)
+		}
+		if err := store.BanKey(space.UUID, "pub-spam", owner.ID); !errors.Is(err, errStoreConflict) {
+			t.Fatalf("expected errStoreConflict banning twice, got %v", err)
+		}
+		if banned, err := store.IsKeyBanned(space.UUID, "pub-spam"); err != nil || !banned {
+			t.Fatalf("expected the key to be banned: %v %v", banned, err)
+		}
+		if banned, _ := store.IsKeyBanned(space.UUID, "pub-reporter"); banned {
+			t.Fatal("expected other keys not to be banned")
+		}
+
+		// A ban follows the identity to its new key.
+		if _, err := store.UpsertUser("pub-spam", "enc-spam", "Spam"); err != nil {
+			t.Fatalf("insert banned user: %v", err)
+		}
+		if _, err := store.MigrateUserKey("pub-spam", "pub-spam-2", "enc-spam-2"); err != nil {
+			t.Fatalf("migrate banned user: %v", err)
+		}
+		if banned, _ := store.IsKeyBanned(space.UUID, "pub-spam-2"); !banned {
+			t.Fatal("expected the ban to move to the new key")
+		}
+	})
+}
+
+func TestHostStoreAuditLog(t *testing.T) {
+	_, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate signing key: %v", err)
+	}
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		if head, err := store.LastAuditHash("space-a"); err != nil || head != "" {
+			t.Fatalf("expected an empty chain: %q %v", head, err)
+		}
+
+		var chain []AuditEntry
+		for i, action := range []string{"create_space", "create_channel", "invite_user"} {
+			prevHash, err := store.LastAuditHash("space-a")
+			if err != nil {
+				t.Fatalf("last audit hash: %v", err)
+			}
+			entry := AuditEntry{
+				SpaceUUID:      "space-a",
+				ActorUserID:    1,
+				ActorPublicKey: "pub-owner",
+				Action:         action,
+				Details:        map[string]string{"step": strconv.Itoa(i)},
+				CreatedAt:      "2026-10-18 09:00:00",
+				PrevHash:       prevHash,
+			}
+			if err := sealAuditEntry(&entry, signingKey); err != nil {
+				t.Fatalf("seal entry: %v", err)
+			}
+			if entry.ID, err = store.AppendAuditEntry(entry); err != nil || entry.ID == 0 {
+				t.Fatalf("append entry: %v", err)
+			}
+			chain = append(chain, entry)
+		}
+
+		// A second writer building on a stale head is refused.
+		stale := chain[2]
+		stale.PrevHash = chain[1].Hash
+		if _, err := store.AppendAuditEntry(stale); !errors.Is(err, errStoreConflict) {
+			t.Fatalf("expected errStoreConflict on a forked chain, got %v", err)
+		}
+
+		newest, err := store.AuditEntries("space-a", 0, 2)
+		if err != nil || len(newest) != 2 || newest[0].Action != "invite_user" || newest[0].Details["step"] != "2" {
+			t.Fatalf("newest entries: %v %+v", err, newest)
+		}
+		older, err := store.AuditEntries("space-a", newest[1].ID, 2)
+		if err != nil || len(older) != 1 || older[0].Action != "create_space" {
+			t.Fatalf("older entries: %v %+v", err, older)
+		}
+		if other, _ := store.AuditEntries("space-b", 0, 10); len(other) != 0 {
+			t.Fatalf("expected no entries for another space, got %+v", other)
+		}
+
+		stored := []AuditEntry{older[0], newest[1], newest[0]}
+		if err := verifyAuditChain(stored); err != nil {
+			t.Fatalf("verify stored chain: %v", err)
+		}
+		tampered := append([]AuditEntry(nil), stored...)
+		tampered[1].Details = map[string]string{"step": "9"}
+		if err := verifyAuditChain(tampered); err == nil {
+			t.Fatal("expected edited details to fail verification")
+		}
+		if err := verifyAuditChain(stored[1:]); err == nil {
+			t.Fatal("expected a chain missing its first entry to fail verification")
+		}
+
+		db := store.(*sqlHostStore).db
+		if _, err := db.Exec(`UPDATE audit_log SET action = 'forged'`); err == nil {
+			t.Fatal("expected audit_log to refuse updates")
+		}
+		if _, err := db.Exec(`DELETE FROM audit_log`); err == nil {
+			t.Fatal("expected audit_log to refuse deletes")
+		}
+	})
+}
+
+func TestHostStoreImportSpace(t *testing.T) {
+	runHostStoreTest(t, func(t *testing.T, store HostStore) {
+		author, _ := store.UpsertUser("pub-mover", "enc-mover", "Mover")
+		member, _ := store.UpsertUser("pub-member", "enc-member", "Member")
+		space := SpaceImport{
+			Space:     DashDataSpace{UUID: "space-moved", Name: "Moved", AuthorID: author.ID},
+			Channels:  []DashDataChannel{{UUID: "channel-moved", Name: "general", AllowVoice: 1}},
+			MemberIDs: []int{member.ID},
+			Messages: []StoredMessage{
+				{ChannelUUID: "channel-moved", Content: `{"v":2}`, UserID: author.ID, MessageID: "m-1", SenderAuthPublicKey: "pub-mover", Timestamp: "2026-01-02 03:04:05", Seq: 1},
+				{ChannelUUID: "channel-moved", Content: `{"v":2}`, UserID: member.ID, MessageID: "m-3", SenderAuthPublicKey: "pub-member", Timestamp: "2026-01-02 03:04:07", Seq: 3},
+			},
+			SenderKeys: []StoredSenderKey{
+				{ChannelUUID: "channel-moved", SenderAuthPublicKey: "pub-mover", Epoch: 7, Content: `{"k":1}`, CreatedAt: "2026-01-02 03:00:00"},
+			},
+		}
+		if err := store.ImportSpace(space); err != nil {
+			t.Fatalf("import space: %v", err)
+		}
+		if err := store.ImportSpace(space); !errors.Is(err, errStoreConflict) {
+			t.Fatalf("expected errStoreConflict importing the space twice, got %v", err)
+		}
+
+		stored, err := store.MessagesInRange("channel-moved", 1, 10, 10)
+		if err != nil || len(stored) != 2 || stored[1].MessageID != "m-3" || stored[1].Seq != 3 || stored[1].Timestamp != "2026-01-02 03:04:07" || stored[1].UserID != member.ID {
+			t.Fatalf("imported messages: %v %+v", err, stored)
+		}
+		// New messages continue after the imported history.
+		next, err := store.SaveMessage(StoredMessage{ChannelUUID: "channel-moved", Content: "{}", UserID: author.ID, MessageID: "m-4", SenderAuthPublicKey: "pub-mover", Timestamp: "2026-02-01 00:00:00"})
+		if err != nil || next.Seq != 4 {
+			t.Fatalf("save after import: %v %+v", err, next)
+		}
+		keys, err := store.ChannelSenderKeys("channel-moved")
+		if err != nil || len(keys) != 1 || keys[0].Epoch != 7 || keys[0].CreatedAt != "2026-01-02 03:00:00" {
+			t.Fatalf("imported sender keys: %v %+v", err, keys)
+		}
+		if joined, err := store.Membership("space-moved", member.ID); err != nil || joined != 1 {
+			t.Fatalf("imported membership: %d %v", joined, err)
+		}
+	})
+}
+
+func TestSpaceArchiveRoundTrip(t *testing.T) {
+	openStore := func() HostStore {
+		conn, err := openHostDatabase(filepath.Join(t.TempDir(), "host.db"))
+		if err != nil {
+			t.Fatalf("open sqlite store: %v", err)
+		}
+		store := newSQLiteHostStore(conn)
+		t.Cleanup(func() { _ = store.Close() })
+		return store
+	}
+	_, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate signing key: %v", err)
+	}
+	previousStore, previousConfig, previousUUID := hostStore, runtimeHostConfig.Load(), currentHostUUID
+	t.Cleanup(func() {
+		hostStore, currentHostUUID = previousStore, previousUUID
+		runtimeHostConfig.Store(previousConfig)
+	})
+	runtimeHostConfig.Store(&HostConfig{SigningPrivateKey: base64.RawStdEncoding.EncodeToString(signingKey)})
+	currentHostUUID = "old-host"
+
+	// The envelopes are real: the owner's are encrypted here and the guest's
+	// are the browser vectors, so the archive uses the vectors' space and
+	// channel.
+	var guestMessage, guestSenderKey map[string]interface{}
+	if err := json.Unmarshal([]byte(testBrowserMessageV3), &guestMessage); err != nil {
+		t.Fatalf("decode guest message: %v", err)
+	}
+	if err := json.Unmarshal([]byte(testBrowserSenderKeyV3), &guestSenderKey); err != nil {
+		t.Fatalf("decode guest sender key: %v", err)
+	}
+	guestKey, guestEncKey := stringField(guestMessage, "sender_auth_public_key"), stringField(guestMessage, "sender_enc_public_key")
+	_, guestEpoch, _ := senderKeyEnvelopeInfo(guestSenderKey)
+	owner := newTestEnvelopeSender(t)
+
+	source := openStore()
+	hostStore = source
+	author, _ := source.UpsertUser(owner.AuthPublicKey, owner.EncPublicKey, "Owner")
+	member, _ := source.UpsertUser(guestKey, guestEncKey, "Guest")
+	space, _ := source.CreateSpace(testEnvelopeSpaceUUID, "Round Trip", author.ID)
+	channel, _ := source.CreateChannel(DashDataChannel{UUID: testEnvelopeChannelUUID, Name: "general", SpaceUUID: space.UUID})
+	if err := source.AddMember(space.UUID, member.ID); err != nil {
+		t.Fatalf("add member: %v", err)
+	}
+	for i, sender := range []DashDataUser{author, member, author} {
+		content := testBrowserMessageV3
+		if sender.ID == author.ID {
+			envelope, err := encryptEnvelope(owner, space.UUID, channel.UUID, "message "+strconv.Itoa(i), []DashDataUser{author, member})
+			if err != nil {
+				t.Fatalf("encrypt message: %v", err)
+			}
+			encoded, _ := json.Marshal(envelope)
+			content = string(encoded)
+		}
+		if _, err := source.SaveMessage(StoredMessage{
+			ChannelUUID:         channel.UUID,
+			Content:             content,
+			UserID:              sender.ID,
+			MessageID:           "msg-" + strconv.Itoa(i),
+			SenderAuthPublicKey: sender.PublicKey,
+			Timestamp:           "2026-03-0" + strconv.Itoa(i+1) + " 10:00:00",
+		}); err != nil {
+			t.Fatalf("save message: %v", err)
+		}
+	}
+	if _, err := source.SaveSenderKey(StoredSenderKey{ChannelUUID: channel.UUID, SenderAuthPublicKey: guestKey, Epoch: guestEpoch, Content: testBrowserSenderKeyV3}); err != nil {
+		t.Fatalf("save sender key: %v", err)
+	}
+	for _, action := range []string{auditActionCreateSpace, auditActionCreateChannel} {
+		if err := appendAudit(AuditEntry{SpaceUUID: space.UUID, ActorUserID: author.ID, ActorPublicKey: owner.AuthPublicKey, Action: action}); err != nil {
+			t.Fatalf("append audit: %v", err)
+		}
+	}
+
+	archive, err := buildSpaceArchive(space.UUID)
+	if err != nil {
+		t.Fatalf("build archive: %v", err)
+	}
+	encoded, err := encodeSpaceArchive(archive)
+	if err != nil {
+		t.Fatalf("encode archive: %v", err)
+	}
+	decoded, err := decodeSpaceArchive(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode archive: %v", err)
+	}
+
+	tampered := decoded
+	tampered.Space.Name = "Hijacked"
+	if err := verifySpaceArchive(tampered); err == nil {
+		t.Fatal("expected an edited archive to fail verification")
+	}
+
+	// The new host already knows the guest under another name; that is kept.
+	target := openStore()
+	hostStore = target
+	if _, err := target.UpsertUser(guestKey, "enc-guest-new", "Guest Renamed"); err != nil {
+		t.Fatalf("seed target user: %v", err)
+	}
+
+	// A host signature does not vouch for the envelopes or the audit log:
+	// an archive re-signed around a forged or misattributed envelope, or an
+	// edited audit chain, is refused before anything is written.
+	const badEnvelope, badAudit = "envelope failed verification", "audit log failed verification"
+	forgeries := map[string]struct {
+		forge   func(*SpaceArchive)
+		wantErr string
+	}{
+		"edited message": {func(a *SpaceArchive) {
+			a.Channels[0].Messages[0].Content = strings.Replace(a.Channels[0].Messages[0].Content, `"ciphertext":"`, `"ciphertext":"AAAA`, 1)
+		}, badEnvelope},
+		"misattributed message":        {func(a *SpaceArchive) { a.Channels[0].Messages[1].SenderAuthPublicKey = owner.AuthPublicKey }, badEnvelope},
+		"message from another channel": {func(a *SpaceArchive) { a.Channels[0].UUID = "channel-elsewhere" }, badEnvelope},
+		"relabelled sender key epoch":  {func(a *SpaceArchive) { a.Channels[0].SenderKeys[0].Epoch++ }, badEnvelope},
+		"message as sender key": {func(a *SpaceArchive) {
+			a.Channels[0].SenderKeys[0].Content = testBrowserMessageV3
+		}, badEnvelope},
+		"edited audit action":     {func(a *SpaceArchive) { a.AuditLog[1].Action = auditActionDeleteChannel }, badAudit},
+		"reattributed audit":      {func(a *SpaceArchive) { a.AuditLog[0].ActorPublicKey = guestKey }, badAudit},
+		"dropped audit entry":     {func(a *SpaceArchive) { a.AuditLog = a.AuditLog[1:] }, badAudit},
+		"reordered audit entries": {func(a *SpaceArchive) { a.AuditLog[0], a.AuditLog[1] = a.AuditLog[1], a.AuditLog[0] }, badAudit},
+	}
+	for name, tc := range forgeries {
+		forged := decoded
+		forged.Channels = append([]ArchivedChannel(nil), decoded.Channels...)
+		forged.Channels[0].Messages = append([]ArchivedMessage(nil), decoded.Channels[0].Messages...)
+		forged.Channels[0].SenderKeys = append([]ArchivedSenderKey(nil), decoded.Channels[0].SenderKeys...)
+		forged.AuditLog = append([]AuditEntry(nil), decoded.AuditLog...)
+		tc.forge(&forged)
+		if err := signSpaceArchive(&forged, signingKey); err != nil {
+			t.Fatalf("%s: sign: %v", name, err)
+		}
+		if err := importSpaceArchive(forged); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Fatalf("%s: expected the import to be refused with %q, got %v", name, tc.wantErr, err)
+		}
+	}
+	if _, err := target.UserByPublicKey(owner.AuthPublicKey); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("a refused import created users: %v", err)
+	}
+	if err := importSpaceArchive(decoded); err != nil {
+		t.Fatalf("import archive: %v", err)
+	}
+	if err := importSpaceArchive(decoded); err == nil {
+		t.Fatal("expected a second import to fail")
+	}
+
+	imported, err := target.Space(space.UUID)
+	if err != nil || imported.Name != "Round Trip" {
+		t.Fatalf("imported space: %v %+v", err, imported)
+	}
+	importedOwner, err := target.UserByPublicKey(owner.AuthPublicKey)
+	if err != nil || imported.AuthorID != importedOwner.ID || importedOwner.EncPublicKey != owner.EncPublicKey {
+		t.Fatalf("imported author: %v %+v", err, importedOwner)
+	}
+	guest, _ := target.UserByPublicKey(guestKey)
+	if guest.Username != "Guest Renamed" || guest.EncPublicKey != "enc-guest-new" {
+		t.Fatalf("existing user was overwritten: %+v", guest)
+	}
+	if joined, err := target.Membership(space.UUID, guest.ID); err != nil || joined != 1 {
+		t.Fatalf("imported membership: %d %v", joined, err)
+	}
+	messages, err := target.MessagesInRange(channel.UUID, 1, 10, 10)
+	if err != nil || len(messages) != 3 || messages[1].MessageID != "msg-1" || messages[1].UserID != guest.ID || messages[2].Seq != 3 || messages[0].Timestamp != "2026-03-01 10:00:00" {
+		t.Fatalf("imported messages: %v %+v", err, messages)
+	}
+	if keys, err := target.ChannelSenderKeys(channel.UUID); err != nil || len(keys) != 1 || keys[0].Content != testBrowserSenderKeyV3 {
+		t.Fatalf("imported sender keys: %v %+v", err, keys)
+	}
+	chain, err := loadAuditChain(space.UUID)
+	if err != nil || len(chain) != 2 || verifyAuditChain(chain) != nil {
+		t.Fatalf("imported audit chain: %v %+v", err, chain)
+	}
+}
+
+// Deleted messages leave gaps in a channel's sequence, including at its end.
+// An import keeps every message's seq and the channel's counter, so clients
+// that synced from the old host never see a number reused.
+func TestSpaceArchiveKeepsSequenceNumbers(t *testing.T) {
+	openStore := func() HostStore {
+		conn, err := openHostDatabase(filepath.Join(t.TempDir(), "host.db"))
+		if err != nil {
+			t.Fatalf("open sqlite store: %v", err)
+		}
+		store := newSQLiteHostStore(conn)
+		t.Cleanup(func() { _ = store.Close() })
+		return store
+	}
+	_, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate signing key: %v", err)
+	}
+	previousStore, previousConfig := hostStore, runtimeHostConfig.Load()
+	t.Cleanup(func() {
+		hostStore = previousStore
+		runtimeHostConfig.Store(previousConfig)
+	})
+	runtimeHostConfig.Store(&HostConfig{SigningPrivateKey: base64.RawStdEncoding.EncodeToString(signingKey)})
+	owner := newTestEnvelopeSender(t)
+
+	source := openStore()
+	hostStore = source
+	author, _ := source.UpsertUser(owner.AuthPublicKey, owner.EncPublicKey, "Owner")
+	space, _ := source.CreateSpace(testEnvelopeSpaceUUID, "Sequences", author.ID)
+	general, _ := source.CreateChannel(DashDataChannel{UUID: testEnvelopeChannelUUID, Name: "general", SpaceUUID: space.UUID})
+	quiet, _ := source.CreateChannel(DashDataChannel{UUID: "channel-quiet", Name: "quiet", SpaceUUID: space.UUID})
+	save := func(channelUUID, messageID string) {
+		t.Helper()
+		envelope, err := encryptEnvelope(owner, space.UUID, channelUUID, messageID, []DashDataUser{author})
+		if err != nil {
+			t.Fatalf("encrypt message: %v", err)
+		}
+		encoded, _ := json.Marshal(envelope)
+		if _, err := source.SaveMessage(StoredMessage{
+			ChannelUUID:         channelUUID,
+			Content:             string(encoded),
+			UserID:              author.ID,
+			MessageID:           messageID,
+			SenderAuthPublicKey: author.PublicKey,
+			Timestamp:           "2026-03-01 10:00:00",
+		}); err != nil {
+			t.Fatalf("save message: %v", err)
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		save(general.UUID, "msg-"+strconv.Itoa(i))
+	}
+	save(quiet.UUID, "msg-quiet")
+	for _, deleted := range []struct{ channel, messageID string }{
+		{general.UUID, "msg-1"}, {general.UUID, "msg-3"}, {general.UUID, "msg-5"}, {quiet.UUID, "msg-quiet"},
+	} {
+		if err := source.DeleteMessage(deleted.channel, author.PublicKey, deleted.messageID); err != nil {
+			t.Fatalf("delete %s: %v", deleted.messageID, err)
+		}
+	}
+
+	archive, err := buildSpaceArchive(space.UUID)
+	if err != nil {
+		t.Fatalf("build archive: %v", err)
+	}
+	encoded, err := encodeSpaceArchive(archive)
+	if err != nil {
+		t.Fatalf("encode archive: %v", err)
+	}
+	decoded, err := decodeSpaceArchive(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode archive: %v", err)
+	}
+
+	target := openStore()
+	hostStore = target
+	if err := importSpaceArchive(decoded); err != nil {
+		t.Fatalf("import archive: %v", err)
+	}
+	messages, err := target.MessagesInRange(general.UUID, 1, 10, 10)
+	if err != nil || len(messages) != 2 || messages[0].MessageID != "msg-2" || messages[0].Seq != 2 || messages[1].MessageID != "msg-4" || messages[1].Seq != 4 {
+		t.Fatalf("expected msg-2 and msg-4 at seq 2 and 4, got %v %+v", err, messages)
+	}
+	for channelUUID, want := range map[string]int64{general.UUID: 5, quiet.UUID: 1} {
+		if lastSeq, err := target.ChannelLastSeq(channelUUID); err != nil || lastSeq != want {
+			t.Fatalf("%s: expected last_seq %d, got %d %v", channelUUID, want, lastSeq, err)
+		}
+	}
+	next, err := target.SaveMessage(StoredMessage{ChannelUUID: general.UUID, Content: "{}", UserID: messages[0].UserID, MessageID: "msg-6", SenderAuthPublicKey: author.PublicKey})
+	if err != nil || next.Seq != 6 {
+		t.Fatalf("expected the next message at seq 6, got %+v %v", next, err)
+	}
+
+	// An archive without last_seq, like those written before it was
+	// recorded, carries each channel on from its newest message.
+	for i := range decoded.Channels {
+		decoded.Channels[i].LastSeq = 0
+	}
+	if err := signSpaceArchive(&decoded, signingKey); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := verifySpaceArchive(decoded); err != nil {
+		t.Fatalf("verify an archive without last_seq: %v", err)
+	}
+	older := openStore()
+	hostStore = older
+	if err := importSpaceArchive(decoded); err != nil {
+		t.Fatalf("import an archive without last_seq: %v", err)
+	}
+	for channelUUID, want := range map[string]int64{general.UUID: 4, quiet.UUID: 0} {
+		if lastSeq, err := older.ChannelLastSeq(channelUUID); err != nil || lastSeq != want {
+			t.Fatalf("%s: expected last_seq %d without an archived counter, got %d %v", channelUUID, want, lastSeq, err)
+		}
+	}
+}
+
+func TestExportSpaceIsPulledOneChunkAtATime(t *testing.T) {
+	conn, err := openHostDatabase(filepath.Join(t.TempDir(), "host.db"))
+	if err != nil {
+		t.Fatalf("open sqlite store: %v", err)
+	}
+	store := newSQLiteHostStore(conn)
+	t.Cleanup(func() { _ = store.Close() })
+	_, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate signing key: %v", err)
+	}
+	previousStore, previousConfig := hostStore, runtimeHostConfig.Load()
+	t.Cleanup(func() {
+		hostStore = previousStore
+		runtimeHostConfig.Store(previousConfig)
+	})
+	runtimeHostConfig.Store(&HostConfig{SigningPrivateKey: base64.RawStdEncoding.EncodeToString(signingKey)})
+	hostStore = store
+
+	author, _ := store.UpsertUser("pub-exporter", "enc-exporter", "Exporter")
+	member, _ := store.UpsertUser("pub-bystander", "enc-bystander", "Bystander")
+	space, _ := store.CreateSpace("space-export", "Export", author.ID)
+	channel, _ := store.CreateChannel(DashDataChannel{UUID: "channel-export", Name: "general", SpaceUUID: space.UUID})
+	// Random content does not compress, so the archive needs several chunks.
+	noise := make([]byte, spaceArchiveChunkSize*2)
+	if _, err := rand.Read(noise); err != nil {
+		t.Fatalf("random content: %v", err)
+	}
+	if _, err := store.SaveMessage(StoredMessage{
+		ChannelUUID:         channel.UUID,
+		Content:             base64.StdEncoding.EncodeToString(noise),
+		UserID:              author.ID,
+		MessageID:           "msg-large",
+		SenderAuthPublicKey: author.PublicKey,
+		Timestamp:           "2026-03-01 10:00:00",
+	}); err != nil {
+		t.Fatalf("save message: %v", err)
+	}
+
+	relay := newQueueOnlyRelayConn(8)
+	pull := func(requester DashDataUser, exportID string, chunk int) WSMessage {
+		t.Helper()
+		handleExportSpace(relay, &WSMessage{Type: "export_space_request", Data: ExportSpaceRequest{
+			SpaceUUID:              space.UUID,
+			ExportID:               exportID,
+			Chunk:                  chunk,
+			RequesterUserPublicKey: requester.PublicKey,
+			ClientUUID:             "client-1",
+		}})
+		if len(relay.send) != 1 {
+			t.Fatalf("expected exactly one reply per request, got %d", len(relay.send))
+		}
+		return <-relay.send
+	}
+	chunkOf := func(msg WSMessage) ExportSpaceResponse {
+		t.Helper()
+		data, ok := msg.Data.(ExportSpaceResponse)
+		if msg.Type != "export_space_response" || !ok {
+			t.Fatalf("expected an export chunk, got %+v", msg)
+		}
+		return data
+	}
+
+	first := chunkOf(pull(author, "", 0))
+	if first.Chunk != 0 || first.Chunks < 3 || first.ExportID == "" {
+		t.Fatalf("unexpected first chunk: %d of %d, export %q", first.Chunk, first.Chunks, first.ExportID)
+	}
+	parts := []string{first.Data}
+	for chunk := 1; chunk < first.Chunks; chunk++ {
+		next := chunkOf(pull(author, first.ExportID, chunk))
+		if next.Chunk != chunk || next.Chunks != first.Chunks || next.ExportID != first.ExportID {
+			t.Fatalf("unexpected chunk %d: %+v", chunk, next)
+		}
+		parts = append(parts, next.Data)
+	}
+	// A chunk the client lost can be pulled again.
+	if again := chunkOf(pull(author, first.ExportID, 1)); again.Data != parts[1] {
+		t.Fatal("expected a repeated pull to return the same chunk")
+	}
+	encoded, err := base64.StdEncoding.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		t.Fatalf("decode chunks: %v", err)
+	}
+	archive, err := decodeSpaceArchive(bytes.NewReader(encoded))
+	if err != nil || archive.messageCount() != 1 {
+		t.Fatalf("reassembled archive: %v %d messages", err, archive.messageCount())
+	}
+
+	for name, msg := range map[string]WSMessage{
+		"another user":   pull(member, first.ExportID, 1),
+		"unknown export": pull(author, "export-unknown", 1),
+		"chunk past end": pull(author, first.ExportID, first.Chunks),
+	} {
+		if msg.Type != "error" {
+			t.Fatalf("%s: expected an error, got %+v", name, msg)
+		}
+	}
+}
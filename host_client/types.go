@@ -52,6 +52,9 @@ type SpaceUser struct {
 type WSMessage struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
+	// RequestID is set by the relay on requests it forwards; every message
+	// sent while handling one carries it back.
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type ChatError struct {
@@ -72,6 +75,30 @@ type RelayHealthCheckAck struct {
 	Nonce string `json:"nonce"`
 }
 
+// RelayQuota mirrors the relay's per-host limits; 0 means unlimited.
+type RelayQuota struct {
+	MaxClients            int `json:"max_clients"`
+	MaxSessionsPerKey     int `json:"max_sessions_per_key"`
+	MaxChannelSubscribers int `json:"max_channel_subscribers"`
+	MaxMessagesPerMinute  int `json:"max_messages_per_minute"`
+}
+
+// RelayQuotaUsage is the relay's quota_usage report for this host.
+type RelayQuotaUsage struct {
+	Limits                    RelayQuota       `json:"limits"`
+	Clients                   int              `json:"clients"`
+	BusiestKeySessions        int              `json:"busiest_key_sessions"`
+	BusiestChannelSubscribers int              `json:"busiest_channel_subscribers"`
+	MessagesThisMinute        int              `json:"messages_this_minute"`
+	Rejections                map[string]int64 `json:"rejections"`
+	ReceivedAt                string           `json:"received_at"`
+}
+
+type RelayShutdown struct {
+	Reason           string `json:"reason"`
+	ReconnectAfterMs int64  `json:"reconnect_after_ms"`
+}
+
 type HostAuthChallenge struct {
 	Challenge string `json:"challenge"`
 }
@@ -79,6 +106,41 @@ type HostAuthChallenge struct {
 type HostAuthClient struct {
 	Challenge string `json:"challenge"`
 	Signature string `json:"signature"`
+	// RequestIDs tells the relay this host echoes request_id, so it may
+	// time out requests the host leaves unanswered.
+	RequestIDs bool `json:"request_ids"`
+}
+
+type RotateHostKeyRequest struct {
+	UUID                string `json:"uuid"`
+	OldSigningPublicKey string `json:"old_signing_public_key"`
+	NewSigningPublicKey string `json:"new_signing_public_key"`
+	IssuedAt            int64  `json:"issued_at"`
+	Signature           string `json:"signature"`
+	NewKeySignature     string `json:"new_key_signature"`
+}
+
+type HostKeyRotated struct {
+	SigningPublicKey string `json:"signing_public_key"`
+}
+
+type RelayHostInfo struct {
+	UUID            string `json:"uuid"`
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	IconURL         string `json:"icon_url"`
+	SoftwareVersion string `json:"software_version"`
+}
+
+type UpdateHostRequest struct {
+	Name            *string `json:"name,omitempty"`
+	Description     *string `json:"description,omitempty"`
+	IconURL         *string `json:"icon_url,omitempty"`
+	SoftwareVersion *string `json:"software_version,omitempty"`
+}
+
+type ReissueCapabilitiesRequest struct {
+	Clients []GetDashDataRequest `json:"clients"`
 }
 
 type UpdateUsernameRequest struct {
@@ -97,12 +159,89 @@ type UpdateUsernameResponse struct {
 	ClientUUID       string `json:"client_uuid"`
 }
 
+// IdentityMigrateRequest moves a user onto the keys the requesting session
+// signed in with. Signature is the old Ed25519 key's signature over
+// identityMigrationMessage.
+type IdentityMigrateRequest struct {
+	OldPublicKey    string `json:"old_public_key"`
+	NewPublicKey    string `json:"new_public_key"`
+	NewEncPublicKey string `json:"new_enc_public_key"`
+	IssuedAt        int64  `json:"issued_at"`
+	Signature       string `json:"signature"`
+	ClientUUID      string `json:"client_uuid"`
+}
+
+type IdentityMigrateResponse struct {
+	UserID          int      `json:"user_id"`
+	Username        string   `json:"username"`
+	OldPublicKey    string   `json:"old_public_key"`
+	NewPublicKey    string   `json:"new_public_key"`
+	NewEncPublicKey string   `json:"new_enc_public_key"`
+	SpaceUUIDs      []string `json:"space_uuids"`
+	ClientUUID      string   `json:"client_uuid"`
+}
+
 type GetDashDataRequest struct {
 	UserID           int    `json:"user_id"`
 	UserPublicKey    string `json:"user_public_key,omitempty"`
 	UserEncPublicKey string `json:"user_enc_public_key,omitempty"`
 	Username         string `json:"username"`
 	ClientUUID       string `json:"client_uuid"`
+	DeviceID         string `json:"device_id,omitempty"`
+	DeviceName       string `json:"device_name,omitempty"`
+	// RequestID tags the answer to one entry of a batched reissue.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// HostDevice is a device an identity has signed in from, as recorded by the
+// host.
+type HostDevice struct {
+	DeviceID     string `json:"device_id"`
+	DeviceName   string `json:"device_name"`
+	EncPublicKey string `json:"enc_public_key,omitempty"`
+	FirstSeen    string `json:"first_seen"`
+	LastSeen     string `json:"last_seen"`
+	RevokedAt    string `json:"revoked_at,omitempty"`
+}
+
+type ListDevicesRequest struct {
+	UserID           int    `json:"user_id"`
+	UserPublicKey    string `json:"user_public_key,omitempty"`
+	UserEncPublicKey string `json:"user_enc_public_key,omitempty"`
+	Username         string `json:"username"`
+	ClientUUID       string `json:"client_uuid"`
+}
+
+type ListDevicesResponse struct {
+	Devices    []HostDevice `json:"devices"`
+	ClientUUID string       `json:"client_uuid"`
+}
+
+type RevokeDeviceRequest struct {
+	UserID           int    `json:"user_id"`
+	UserPublicKey    string `json:"user_public_key,omitempty"`
+	UserEncPublicKey string `json:"user_enc_public_key,omitempty"`
+	Username         string `json:"username"`
+	DeviceID         string `json:"device_id"`
+	ClientUUID       string `json:"client_uuid"`
+}
+
+type RevokeDeviceResponse struct {
+	DeviceID   string `json:"device_id"`
+	ClientUUID string `json:"client_uuid"`
+}
+
+// RevokedDevice is one deny-list entry pushed to the relay.
+type RevokedDevice struct {
+	UserPublicKey string `json:"user_public_key"`
+	DeviceID      string `json:"device_id"`
+}
+
+type DeviceDenyList struct {
+	Devices []RevokedDevice `json:"devices"`
+	// KeyedIdentities have registered a device key; the relay refuses
+	// their sessions that do not present one.
+	KeyedIdentities []string `json:"keyed_identities"`
 }
 
 type DashDataUser struct {
@@ -293,12 +432,33 @@ type SaveChatMessageRequest struct {
 	Username         string                 `json:"username,omitempty"`
 	ChannelUUID      string                 `json:"channel_uuid"`
 	Envelope         map[string]interface{} `json:"envelope"`
+	ClientUUID       string                 `json:"client_uuid,omitempty"`
+	// Strict is set when the relay waits for the save before broadcasting.
+	Strict bool `json:"strict,omitempty"`
+}
+
+// SaveChatMessageResponse reports whether a message was stored. Error is set
+// on failure; otherwise ID and Timestamp are the host's row ID and time.
+type SaveChatMessageResponse struct {
+	MessageID   string `json:"message_id"`
+	ChannelUUID string `json:"channel_uuid"`
+	ID          int    `json:"id,omitempty"`
+	Timestamp   string `json:"timestamp,omitempty"`
+	Seq         int64  `json:"seq,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Envelope is returned for strict saves so the relay can broadcast it.
+	Envelope   map[string]interface{} `json:"envelope,omitempty"`
+	ClientUUID string                 `json:"client_uuid"`
 }
 
 type GetMessagesRequest struct {
 	ChannelUUID    string `json:"channel_uuid"`
 	ClientUUID     string `json:"client_uuid"`
 	BeforeUnixTime string `json:"before_unix_time"` // optional
+	// FromSeq and ToSeq request an exact sequence range instead of a page
+	// before BeforeUnixTime. ToSeq 0 means no upper bound.
+	FromSeq int64 `json:"from_seq,omitempty"`
+	ToSeq   int64 `json:"to_seq,omitempty"`
 }
 
 type GetMessagesMessage struct {
@@ -310,13 +470,19 @@ type GetMessagesMessage struct {
 	UserPublicKey    string                 `json:"user_public_key,omitempty"`
 	UserEncPublicKey string                 `json:"user_enc_public_key,omitempty"`
 	Timestamp        string                 `json:"timestamp"`
+	Seq              int64                  `json:"seq,omitempty"`
 }
 
 type GetMessagesResponse struct {
-	Messages        []GetMessagesMessage `json:"messages"`
-	HasMoreMessages bool                 `json:"has_more_messages"`
-	ChannelUUID     string               `json:"channel_uuid"`
-	ClientUUID      string               `json:"client_uuid"`
+	Messages []GetMessagesMessage `json:"messages"`
+	// SenderKeys are the sender key envelopes the sender-key messages in
+	// this page were encrypted under.
+	SenderKeys      []map[string]interface{} `json:"sender_keys,omitempty"`
+	HasMoreMessages bool                     `json:"has_more_messages"`
+	// FromSeq echoes a range request so clients can tell it from paging.
+	FromSeq     int64  `json:"from_seq,omitempty"`
+	ChannelUUID string `json:"channel_uuid"`
+	ClientUUID  string `json:"client_uuid"`
 }
 
 type ChannelAllowVoiceRequest struct {
@@ -324,3 +490,182 @@ type ChannelAllowVoiceRequest struct {
 	Allow      int    `json:"allow"`
 	ClientUUID string `json:"client_uuid"`
 }
+
+// ModerationReport is a report filed against a message or a member of a
+// space. Envelope is the reported message's envelope JSON and Excerpt the
+// plaintext, if any, the reporter chose to disclose.
+type ModerationReport struct {
+	ID                int    `json:"id"`
+	SpaceUUID         string `json:"space_uuid"`
+	ChannelUUID       string `json:"channel_uuid,omitempty"`
+	Kind              string `json:"kind"`
+	ReporterUserID    int    `json:"reporter_user_id"`
+	ReporterPublicKey string `json:"reporter_public_key,omitempty"`
+	TargetPublicKey   string `json:"target_public_key"`
+	MessageID         string `json:"message_id,omitempty"`
+	Envelope          string `json:"envelope,omitempty"`
+	Excerpt           string `json:"excerpt,omitempty"`
+	Reason            string `json:"reason,omitempty"`
+	Status            string `json:"status"`
+	Action            string `json:"action,omitempty"`
+	ResolvedBy        int    `json:"resolved_by,omitempty"`
+	CreatedAt         string `json:"created_at"`
+	ResolvedAt        string `json:"resolved_at,omitempty"`
+}
+
+// AuditEntry is one administrative action in a space's audit chain. Hash
+// covers the entry and PrevHash; Signature is the host signing key's
+// signature over Hash.
+type AuditEntry struct {
+	ID               int               `json:"id"`
+	SpaceUUID        string            `json:"space_uuid"`
+	ActorUserID      int               `json:"actor_user_id,omitempty"`
+	ActorPublicKey   string            `json:"actor_public_key,omitempty"`
+	Action           string            `json:"action"`
+	Details          map[string]string `json:"details,omitempty"`
+	CreatedAt        string            `json:"created_at"`
+	PrevHash         string            `json:"prev_hash"`
+	Hash             string            `json:"hash"`
+	SigningPublicKey string            `json:"signing_public_key"`
+	Signature        string            `json:"signature"`
+}
+
+type GetAuditLogRequest struct {
+	SpaceUUID                 string `json:"space_uuid"`
+	BeforeID                  int    `json:"before_id,omitempty"`
+	RequesterUserID           int    `json:"requester_user_id"`
+	RequesterUserPublicKey    string `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string `json:"client_uuid"`
+}
+
+type GetAuditLogResponse struct {
+	SpaceUUID  string       `json:"space_uuid"`
+	Entries    []AuditEntry `json:"entries"`
+	HasMore    bool         `json:"has_more"`
+	ClientUUID string       `json:"client_uuid"`
+}
+
+// ExportSpaceRequest asks for chunk Chunk of the export ExportID, or for a
+// new export when ExportID is empty.
+type ExportSpaceRequest struct {
+	SpaceUUID                 string `json:"space_uuid"`
+	ExportID                  string `json:"export_id,omitempty"`
+	Chunk                     int    `json:"chunk,omitempty"`
+	RequesterUserID           int    `json:"requester_user_id"`
+	RequesterUserPublicKey    string `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string `json:"client_uuid"`
+}
+
+// ExportSpaceResponse carries one piece of a space archive: the base64 of
+// the gzipped file, split so each message fits through the relay. Chunk
+// counts from 0 to Chunks-1.
+type ExportSpaceResponse struct {
+	SpaceUUID  string `json:"space_uuid"`
+	ExportID   string `json:"export_id"`
+	Chunk      int    `json:"chunk"`
+	Chunks     int    `json:"chunks"`
+	Data       string `json:"data"`
+	ClientUUID string `json:"client_uuid"`
+}
+
+type ReportMessageRequest struct {
+	SpaceUUID                 string                 `json:"space_uuid"`
+	ChannelUUID               string                 `json:"channel_uuid"`
+	Envelope                  map[string]interface{} `json:"envelope"`
+	Excerpt                   string                 `json:"excerpt,omitempty"`
+	Reason                    string                 `json:"reason,omitempty"`
+	RequesterUserID           int                    `json:"requester_user_id"`
+	RequesterUserPublicKey    string                 `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string                 `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string                 `json:"client_uuid"`
+}
+
+type ReportUserRequest struct {
+	SpaceUUID                 string `json:"space_uuid"`
+	UserPublicKey             string `json:"user_public_key"`
+	Reason                    string `json:"reason,omitempty"`
+	RequesterUserID           int    `json:"requester_user_id"`
+	RequesterUserPublicKey    string `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string `json:"client_uuid"`
+}
+
+type ReportResponse struct {
+	ReportID   int    `json:"report_id"`
+	Kind       string `json:"kind"`
+	SpaceUUID  string `json:"space_uuid"`
+	ClientUUID string `json:"client_uuid"`
+}
+
+type ListReportsRequest struct {
+	SpaceUUID                 string `json:"space_uuid"`
+	Status                    string `json:"status,omitempty"`
+	RequesterUserID           int    `json:"requester_user_id"`
+	RequesterUserPublicKey    string `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string `json:"client_uuid"`
+}
+
+type ListReportsResponse struct {
+	SpaceUUID  string             `json:"space_uuid"`
+	Reports    []ModerationReport `json:"reports"`
+	ClientUUID string             `json:"client_uuid"`
+}
+
+type ResolveReportRequest struct {
+	SpaceUUID                 string `json:"space_uuid"`
+	ReportID                  int    `json:"report_id"`
+	Action                    string `json:"action"`
+	RequesterUserID           int    `json:"requester_user_id"`
+	RequesterUserPublicKey    string `json:"requester_user_public_key,omitempty"`
+	RequesterUserEncPublicKey string `json:"requester_user_enc_public_key,omitempty"`
+	ClientUUID                string `json:"client_uuid"`
+}
+
+// ResolveReportResponse carries the closed report. DeletedMessageID is set
+// when the action removed the reported message, so the relay can tell the
+// channel.
+type ResolveReportResponse struct {
+	Report           ModerationReport `json:"report"`
+	DeletedMessageID string           `json:"deleted_message_id,omitempty"`
+	ClientUUID       string           `json:"client_uuid"`
+}
+
+// Client-role payloads used by host-managed bot sessions.
+
+type AuthChallenge struct {
+	Challenge string `json:"challenge"`
+}
+
+type AuthPubKeyClient struct {
+	PublicKey    string `json:"public_key"`
+	EncPublicKey string `json:"enc_public_key"`
+	DeviceID     string `json:"device_id,omitempty"`
+	DeviceName   string `json:"device_name,omitempty"`
+	Username     string `json:"username"`
+	Challenge    string `json:"challenge"`
+	Signature    string `json:"signature"`
+}
+
+type DashDataPayload struct {
+	User         DashDataUser      `json:"user"`
+	Spaces       []DashDataSpace   `json:"spaces"`
+	Capabilities []SpaceCapability `json:"capabilities,omitempty"`
+}
+
+type JoinAllSpacesClient struct {
+	SpaceUUIDs       []string          `json:"space_uuids"`
+	CapabilityTokens map[string]string `json:"capability_tokens,omitempty"`
+}
+
+type JoinChannelClient struct {
+	UUID            string `json:"uuid"`
+	CapabilityToken string `json:"capability_token,omitempty"`
+}
+
+type ChatClient struct {
+	Envelope        chatEnvelope `json:"envelope"`
+	CapabilityToken string       `json:"capability_token,omitempty"`
+}
@@ -1,13 +1,11 @@
 package main
 
 import (
-	"gochat/db"
+	"database/sql"
 	"log"
-
-	"github.com/gorilla/websocket"
 )
 
-func handleUpdateUsername(conn *websocket.Conn, wsMsg *WSMessage) {
+func handleUpdateUsername(conn *relayConn, wsMsg *WSMessage) {
 	data, err := decodeData[UpdateUsernameRequest](wsMsg.Data)
 	if err != nil {
 		log.Println("error decoding update_username_request:", err)
@@ -27,12 +25,8 @@ func handleUpdateUsername(conn *websocket.Conn, wsMsg *WSMessage) {
 	}
 
 	newName := normalizeUsername(data.Username, user.PublicKey)
-	res, err := db.ChatDB.Exec(
-		`UPDATE chat_users SET username = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
-		newName,
-		user.ID,
-	)
-	if err != nil {
+	err = hostStore.SetUsername(user.ID, newName)
+	if err != nil && err != sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
@@ -42,7 +36,7 @@ func handleUpdateUsername(conn *websocket.Conn, wsMsg *WSMessage) {
 		})
 		return
 	}
-	if rows, _ := res.RowsAffected(); rows == 0 {
+	if err == sql.ErrNoRows {
 		sendToConn(conn, WSMessage{
 			Type: "error",
 			Data: ChatError{
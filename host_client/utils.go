@@ -1,41 +1,25 @@
 package main
 
 import (
-	"gochat/db"
 	"log"
 )
 
 func AppendspaceChannelsAndUsers(space *DashDataSpace) {
 	// Fetch channels
-	channelsQuery := `SELECT id, uuid, name, space_uuid, allow_voice FROM channels WHERE space_uuid = ?`
-	channelRows, err := db.ChatDB.Query(channelsQuery, space.UUID)
-	if err == nil {
-		defer channelRows.Close()
-		var channels []DashDataChannel
-		for channelRows.Next() {
-			var channel DashDataChannel
-			if err := channelRows.Scan(&channel.ID, &channel.UUID, &channel.Name, &channel.SpaceUUID, &channel.AllowVoice); err == nil {
-				channels = append(channels, channel)
-			}
-		}
+	if channels, err := hostStore.SpaceChannels(space.UUID); err == nil {
 		space.Channels = channels
 	}
 
 	// Fetch user IDs in space
-	usersQuery := `SELECT user_id FROM space_users WHERE space_uuid = ? AND joined = 1`
-	userRows, err := db.ChatDB.Query(usersQuery, space.UUID)
+	memberIDs, err := hostStore.SpaceMemberIDs(space.UUID)
 	if err != nil {
 		log.Println("Error fetching space_users:", err)
 		return
 	}
-	defer userRows.Close()
 
 	userIDSet := make(map[int]struct{})
-	for userRows.Next() {
-		var uid int
-		if err := userRows.Scan(&uid); err == nil {
-			userIDSet[uid] = struct{}{}
-		}
+	for _, uid := range memberIDs {
+		userIDSet[uid] = struct{}{}
 	}
 
 	// Add author if not already included
@@ -67,28 +51,5 @@ func AppendspaceChannelsAndUsers(space *DashDataSpace) {
 }
 
 func GetUserSpaces(userID int) ([]DashDataSpace, error) {
-	query := `
-		SELECT DISTINCT s.id, s.uuid, s.name, s.author_id
-		FROM spaces s
-		LEFT JOIN space_users su ON su.space_uuid = s.uuid
-		WHERE s.author_id = ?
-			 OR (su.user_id = ? AND su.joined = 1)
-	`
-
-	rows, err := db.ChatDB.Query(query, userID, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var userSpaces []DashDataSpace
-	for rows.Next() {
-		var space DashDataSpace
-		if err := rows.Scan(&space.ID, &space.UUID, &space.Name, &space.AuthorID); err != nil {
-			continue
-		}
-		userSpaces = append(userSpaces, space)
-	}
-
-	return userSpaces, nil
+	return hostStore.UserSpaces(userID)
 }
@@ -59,6 +59,10 @@ class ChatBoxComponent {
       }
     }
 
+    // Plaintexts of sent messages by message ID, kept until the relay
+    // echoes them back so they can be resent under a rotated sender key.
+    this.pendingMessages = new Map();
+
     this.chatBoxMessagesComponent = new ChatBoxMessagesComponent({
       domElem: createElement("div", {
         class: "chat-box-messages",
@@ -66,12 +70,66 @@ class ChatBoxComponent {
       }),
       channelUUID: this.channelUUID,
       spaceUUID: this.space?.uuid || "",
+      userPublicKey: this.data.user?.public_key || "",
       socketConn: this.socketConn,
     });
 
     this.render();
   }
 
+  recipients = () =>
+    (this.space?.users || [])
+      .filter((user) => user?.public_key && user?.enc_public_key)
+      .map((user) => ({
+        authPublicKey: user.public_key,
+        encPublicKey: user.enc_public_key,
+      }));
+
+  // sendEncrypted sends content under this client's sender key for the
+  // channel, distributing a new key first when members have changed.
+  sendEncrypted = async (content) => {
+    const identity = await identityManager.getOrCreateIdentity();
+    const recipients = this.recipients();
+    const context = {
+      spaceUUID: this.space?.uuid,
+      channelUUID: this.channelUUID,
+      identity,
+    };
+
+    let senderKey = e2ee.currentSenderKey(this.channelUUID, recipients, identity);
+    if (!senderKey) {
+      const distribution = await e2ee.createSenderKeyDistribution({ ...context, recipients });
+      this.socketConn.sendMessage({ envelope: distribution.envelope }, this.space?.uuid);
+      senderKey = distribution.senderKey;
+    }
+
+    const envelope = await e2ee.encryptWithSenderKey({
+      ...context,
+      plaintext: content,
+      senderKey,
+    });
+    this.pendingMessages.set(envelope.message_id, content);
+    this.socketConn.sendMessage({ envelope }, this.space?.uuid);
+  };
+
+  confirmSent = (messageID) => {
+    this.pendingMessages.delete(messageID);
+  };
+
+  resendWithNewSenderKey = async (messageID) => {
+    const content = this.pendingMessages.get(messageID);
+    e2ee.forgetOwnSenderKey(this.channelUUID);
+    if (content === undefined) return;
+
+    this.pendingMessages.delete(messageID);
+    try {
+      await this.sendEncrypted(content);
+    } catch (err) {
+      console.error(err);
+      platform.alert(err?.message || "Failed to encrypt message");
+    }
+  };
+
   render = () => {
     this.domElem.innerHTML = "";
     this.domElem.append(
@@ -108,27 +166,7 @@ class ChatBoxComponent {
                   const content = textarea.value.trim();
                   if (content) {
                     try {
-                      const identity = await identityManager.getOrCreateIdentity();
-                      const recipients = (this.space?.users || [])
-                        .filter(
-                          (user) =>
-                            user?.public_key &&
-                            user?.enc_public_key
-                        )
-                        .map((user) => ({
-                          authPublicKey: user.public_key,
-                          encPublicKey: user.enc_public_key,
-                        }));
-
-                      const envelope = await e2ee.encryptMessageForSpace({
-                        plaintext: content,
-                        spaceUUID: this.space?.uuid,
-                        channelUUID: this.channelUUID,
-                        identity,
-                        recipients,
-                      });
-
-                      this.socketConn.sendMessage({ envelope }, this.space?.uuid);
+                      await this.sendEncrypted(content);
                       textarea.value = "";
                       textarea.style.height = "auto";
                       textarea.focus();
@@ -149,6 +187,7 @@ class ChatBoxComponent {
   };
 
   destroy = () => {
+    this.pendingMessages.clear();
     this.chatBoxMessagesComponent?.destroy?.();
     this.chatBoxMessagesComponent = null;
     this.domElem.innerHTML = "";
@@ -158,8 +197,14 @@ class ChatBoxComponent {
 class ChatBoxMessagesComponent {
   constructor(props) {
     this.chatBoxMessages = [];
+    // Delivery state of this client's own messages by message ID: "sending"
+    // until the host acknowledges the save, then "saved" or "failed".
+    this.deliveryByMessageID = new Map();
+    // Highest host sequence number seen live, used to spot missed messages.
+    this.lastSeq = 0;
     this.channelUUID = props.channelUUID;
     this.spaceUUID = props.spaceUUID || "";
+    this.userPublicKey = props.userPublicKey || "";
     this.socketConn = props.socketConn;
 
     this.messageRequestSize = 50;
@@ -220,15 +265,108 @@ class ChatBoxMessagesComponent {
     );
   };
 
+  messageKey = (data) =>
+    `${data.envelope?.sender_auth_public_key || ""}|${data.envelope?.message_id || data.id}`;
+
+  // Messages are shown in host sequence order once every message has one;
+  // until then (relays without strict delivery) arrival order is kept.
+  sortBySeq = () => {
+    if (this.chatBoxMessages.every((message) => message.seq)) {
+      this.chatBoxMessages.sort((a, b) => a.seq - b.seq);
+    }
+  };
+
+  mergeMessages = (messages) => {
+    const seen = new Set(this.chatBoxMessages.map(this.messageKey));
+    const fresh = messages.filter((message) => !seen.has(this.messageKey(message)));
+    this.chatBoxMessages = [...fresh, ...this.chatBoxMessages];
+    this.sortBySeq();
+    for (const message of fresh) {
+      this.lastSeq = Math.max(this.lastSeq, message.seq || 0);
+    }
+  };
+
+  // requestMissing asks the host for exactly the messages between the last
+  // one seen and a newly arrived one.
+  requestMissing = (seq) => {
+    if (this.lastSeq > 0 && seq > this.lastSeq + 1) {
+      this.socketConn.getMessageRange(this.lastSeq + 1, seq - 1, this.spaceUUID);
+    }
+    this.lastSeq = Math.max(this.lastSeq, seq);
+  };
+
+  setSeq = (messageID, seq) => {
+    const message = this.chatBoxMessages.find((item) => item.envelope?.message_id === messageID);
+    if (!message || !seq) return;
+    message.seq = seq;
+    this.sortBySeq();
+  };
+
   appendNewMessage = (data) => {
     const wasAtBottom = this.isScrolledToBottom();
+    const key = this.messageKey(data);
+    if (this.chatBoxMessages.some((message) => this.messageKey(message) === key)) return;
+    if (data.seq) {
+      this.requestMissing(data.seq);
+    }
     this.chatBoxMessages.push(data);
+    this.sortBySeq();
     this.render();
     if (wasAtBottom) {
       requestAnimationFrame(() => this.scrollDown());
     }
   };
 
+  setDelivery = (messageID, state) => {
+    if (!messageID) return;
+    this.deliveryByMessageID.set(messageID, state);
+    this.render();
+  };
+
+  createDeliveryLabel = (data) => {
+    const state = this.deliveryByMessageID.get(data.envelope?.message_id);
+    if (!state) return null;
+    const labels = { sending: "sending...", saved: "saved", failed: "not saved" };
+    return createElement(
+      "small",
+      { class: `chat-box-message-delivery ${state}` },
+      labels[state] || state
+    );
+  };
+
+  // Messages deleted by a moderator leave a gap in seq; it is not refetched
+  // because lastSeq has already moved past it.
+  removeMessage = (messageID) => {
+    if (!messageID) return;
+    this.chatBoxMessages = this.chatBoxMessages.filter((message) => message.envelope?.message_id !== messageID);
+    this.render();
+  };
+
+  // reportMessage hands the space owner the envelope as received. The text
+  // is only included when the reporter agrees to disclose it.
+  reportMessage = async (data) => {
+    const confirmed = await platform.confirm("Report this message to the space owner?");
+    if (!confirmed) return;
+    const disclose = await platform.confirm(
+      "Include the message text? Without it the owner only sees who sent the message."
+    );
+    this.socketConn.reportMessage({
+      space_uuid: this.spaceUUID,
+      channel_uuid: this.channelUUID,
+      envelope: data.envelope,
+      excerpt: disclose ? data.content : "",
+    });
+  };
+
+  createReportButton = (data) => {
+    const sender = data.envelope?.sender_auth_public_key;
+    if (!sender || sender === this.userPublicKey) return null;
+    return createElement("small", { class: "chat-box-message-report" }, "report", {
+      type: "click",
+      event: () => this.reportMessage(data),
+    });
+  };
+
   createMessage = (data) => {
     const parseMessageContent = (content) => {
       const urlRegexAll = /(https?:\/\/[^\s]+)/g;
@@ -271,7 +409,9 @@ class ChatBoxMessagesComponent {
           },
           data.username
         ),
-      ]),
+        this.createDeliveryLabel(data),
+        this.createReportButton(data),
+      ].filter(Boolean)),
       createElement("div", { class: "chat-box-message-text" }, [
         ...parseMessageContent(data.content),
       ]),
@@ -286,6 +426,7 @@ class ChatBoxMessagesComponent {
   };
 
   destroy = () => {
+    this.deliveryByMessageID.clear();
     if (this.debounceTimeout) {
       clearTimeout(this.debounceTimeout);
       this.debounceTimeout = null;
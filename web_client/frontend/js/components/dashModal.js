@@ -104,6 +104,47 @@ export default class DashModal {
           }),
         ]),
       ]),
+      createElement("div", { class: "settings-section" }, [
+        createElement("h3", {}, "Moderation"),
+        createElement("div", { class: "settings-actions" }, [
+          createElement("button", { class: "btn" }, "Refresh Reports", {
+            type: "click",
+            event: () => this.socketConn.listReports({ space_uuid: space.uuid }),
+          }),
+        ]),
+        createElement(
+          "div",
+          { class: "moderation-reports-list", id: "moderation-reports-list" },
+          createElement("div", { class: "moderation-report-empty" }, "Loading reports...")
+        ),
+      ]),
+      createElement("div", { class: "settings-section" }, [
+        createElement("h3", {}, "Audit Log"),
+        createElement("div", { class: "settings-actions" }, [
+          createElement("button", { class: "btn" }, "Load Audit Log", {
+            type: "click",
+            event: () => {
+              this.auditLogAppend = false;
+              this.socketConn.getAuditLog({ space_uuid: space.uuid });
+            },
+          }),
+        ]),
+        createElement("div", { class: "audit-log-list", id: "audit-log-list" }),
+      ]),
+      createElement("div", { class: "settings-section" }, [
+        createElement("h3", {}, "Export"),
+        createElement(
+          "p",
+          {},
+          "Download a signed archive of this space and its encrypted history to move it to another host."
+        ),
+        createElement("div", { class: "settings-actions" }, [
+          createElement("button", { class: "btn" }, "Export Space", {
+            type: "click",
+            event: () => this.socketConn.exportSpace({ space_uuid: space.uuid }),
+          }),
+        ]),
+      ]),
       createElement("div", { class: "settings-section" }, [
         createElement("h3", {}, "Channel Management"),
         createElement("div", { class: "settings-actions" }, [
@@ -155,6 +196,105 @@ export default class DashModal {
     ];
   };
 
+  renderReports = (spaceUUID, reports = []) => {
+    const listElem = this.domElem.querySelector("#moderation-reports-list");
+    if (!listElem) return;
+    listElem.innerHTML = "";
+    if (!Array.isArray(reports) || reports.length === 0) {
+      listElem.append(createElement("div", { class: "moderation-report-empty" }, "No open reports."));
+      return;
+    }
+    const shortKey = (key) => (key && key.length > 20 ? `${key.slice(0, 10)}...${key.slice(-8)}` : key || "Unknown");
+    const resolve = async (report, action, question) => {
+      if (question && !(await platform.confirm(question))) return;
+      this.socketConn.resolveReport({ space_uuid: spaceUUID, report_id: report.id, action });
+    };
+    const nodes = reports.map((report) => {
+      const target = shortKey(report.target_public_key);
+      const actions = [
+        createElement("button", { class: "btn-small" }, "Dismiss", {
+          type: "click",
+          event: () => resolve(report, "dismiss"),
+        }),
+      ];
+      if (report.kind === "message") {
+        actions.push(
+          createElement("button", { class: "btn-small btn-red" }, "Delete Message", {
+            type: "click",
+            event: () => resolve(report, "delete_message", "Delete the reported message for everyone?"),
+          })
+        );
+      }
+      actions.push(
+        createElement("button", { class: "btn-small btn-red" }, "Remove User", {
+          type: "click",
+          event: () => resolve(report, "remove_user", `Remove ${target} from this space?`),
+        }),
+        createElement("button", { class: "btn-small btn-red" }, "Ban Key", {
+          type: "click",
+          event: () => resolve(report, "ban_user", `Ban ${target} from this space? They cannot be invited back.`),
+        })
+      );
+      return createElement("div", { class: "moderation-report-item" }, [
+        createElement(
+          "div",
+          {},
+          report.kind === "message" ? `Message from ${target}` : `User ${target}`
+        ),
+        createElement(
+          "div",
+          { class: "moderation-report-meta" },
+          `Reported by ${shortKey(report.reporter_public_key)} on ${report.created_at}${report.reason ? ` | ${report.reason}` : ""}`
+        ),
+        report.excerpt
+          ? createElement("div", { class: "moderation-report-excerpt" }, report.excerpt)
+          : createElement("div", { class: "moderation-report-meta" }, "Message text not disclosed."),
+        createElement("div", {}, actions),
+      ]);
+    });
+    listElem.append(...nodes);
+  };
+
+  // renderAuditLog shows a page of entries, newest first. "Load Older" asks
+  // for the entries before the oldest one shown and appends them.
+  renderAuditLog = (spaceUUID, entries = [], hasMore = false) => {
+    const listElem = this.domElem.querySelector("#audit-log-list");
+    if (!listElem) return;
+    if (!this.auditLogAppend) {
+      listElem.innerHTML = "";
+    }
+    this.auditLogAppend = false;
+    listElem.querySelector(".audit-log-more")?.remove();
+    if (entries.length === 0 && !listElem.querySelector(".audit-log-item")) {
+      listElem.append(createElement("div", { class: "moderation-report-empty" }, "No audit entries yet."));
+      return;
+    }
+    const shortKey = (key) => (key && key.length > 20 ? `${key.slice(0, 10)}...${key.slice(-8)}` : key || "host");
+    const nodes = entries.map((entry) => {
+      const details = Object.entries(entry.details || {})
+        .map(([key, value]) => `${key}: ${value}`)
+        .join(", ");
+      return createElement("div", { class: "audit-log-item" }, [
+        createElement("div", {}, `${entry.action} by ${shortKey(entry.actor_public_key)}`),
+        createElement("div", { class: "moderation-report-meta" }, `${entry.created_at}${details ? ` | ${details}` : ""}`),
+        createElement("div", { class: "audit-log-hash" }, `#${entry.id} ${entry.hash}`),
+      ]);
+    });
+    listElem.append(...nodes);
+    const oldest = entries[entries.length - 1];
+    if (hasMore && oldest) {
+      listElem.append(
+        createElement("button", { class: "btn-small audit-log-more" }, "Load Older", {
+          type: "click",
+          event: () => {
+            this.auditLogAppend = true;
+            this.socketConn.getAuditLog({ space_uuid: spaceUUID, before_id: oldest.id });
+          },
+        })
+      );
+    }
+  };
+
   renderSpaceUserSettings = (space, user) => {
     return [
       createElement("div", { class: "settings-section" }, [
@@ -329,6 +469,23 @@ export default class DashModal {
                     }
                   },
                 }),
+                createElement("button", { class: "btn", id: "rotate-identity-btn" }, "Generate New Key", {
+                  type: "click",
+                  event: async () => {
+                    const confirmed = await platform.confirm(
+                      "Replace this identity with a new keypair? Your memberships on this host move to the new key and members are told it changed. Other hosts and devices keep the old key, so export a backup first."
+                    );
+                    if (!confirmed) return;
+                    try {
+                      await identityManager.rotateIdentity(localStorage.getItem("hostUUID"));
+                      platform.alert("New key generated. Reconnecting to migrate...");
+                      window.location.reload();
+                    } catch (err) {
+                      console.error(err);
+                      platform.alert(err?.message || "Failed to generate a new key");
+                    }
+                  },
+                }),
               ]),
               createElement(
                 "p",
@@ -345,6 +502,15 @@ export default class DashModal {
               ),
               createElement("div", { id: "active-devices-list", class: "account-device-list" }),
             ]),
+            createElement("div", { class: "settings-section account-card" }, [
+              createElement("div", { class: "account-card-title" }, "Registered Devices"),
+              createElement(
+                "p",
+                { class: "account-help" },
+                "Every device this identity has signed in from. Revoked devices can no longer connect to this host."
+              ),
+              createElement("div", { id: "registered-devices-list", class: "account-device-list" }),
+            ]),
           ]),
           createElement("div", { class: "account-grid" }, [
             createElement("div", { class: "settings-section account-card" }, [
@@ -621,6 +787,52 @@ export default class DashModal {
       });
     updateLastExportedLabel();
     renderActiveDevices();
+    this.socketConn?.listDevices?.();
+  };
+
+  renderRegisteredDevices = (devices = []) => {
+    const listElem = this.domElem.querySelector("#registered-devices-list");
+    if (!listElem) return;
+    listElem.innerHTML = "";
+    if (!Array.isArray(devices) || devices.length === 0) {
+      listElem.append(
+        createElement("div", { class: "account-device-empty" }, "No devices recorded on this host yet.")
+      );
+      return;
+    }
+    const formatDateTime = (isoText) => {
+      if (!isoText) return "Never";
+      const date = new Date(isoText);
+      if (Number.isNaN(date.getTime())) return "Unknown";
+      return date.toLocaleString();
+    };
+    const nodes = devices.map((device) => {
+      const name = device.device_name || "Unknown Device";
+      const label = `${name}${device.is_current ? " (This device)" : ""}${device.online ? " - online" : ""}`;
+      const details = device.revoked_at
+        ? `Revoked: ${formatDateTime(device.revoked_at)}`
+        : `First seen: ${formatDateTime(device.first_seen)} | Last seen: ${formatDateTime(device.last_seen)}`;
+      const children = [
+        createElement("div", { class: "account-device-name" }, label),
+        createElement("div", { class: "account-device-meta" }, details),
+      ];
+      if (!device.revoked_at && !device.is_current) {
+        children.push(
+          createElement("button", { class: "btn" }, "Revoke", {
+            type: "click",
+            event: async () => {
+              const confirmed = await platform.confirm(
+                `Revoke "${name}"? It will be signed out and cannot reconnect to this host.`
+              );
+              if (!confirmed) return;
+              this.socketConn?.revokeDevice?.(device.device_id);
+            },
+          })
+        );
+      }
+      return createElement("div", { class: "account-device-item" }, children);
+    });
+    listElem.append(...nodes);
   };
 
   renderInvites = (invites, user) => {
@@ -716,6 +928,9 @@ export default class DashModal {
               ),
             ])
           );
+          if (isAuthor) {
+            this.socketConn?.listReports?.({ space_uuid: space.uuid });
+          }
         }
         break;
       default:
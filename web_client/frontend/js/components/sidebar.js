@@ -235,6 +235,15 @@ class SpaceUserListComponent extends Component {
                 });
               }
             });
+          } else if (this.data.user.id !== user.id && user.public_key) {
+            platform.confirm(`Report ${user.username} to the space owner?`).then((confirmed) => {
+              if (confirmed) {
+                this.socketConn.reportUser({
+                  space_uuid: currentSpace.uuid,
+                  user_public_key: user.public_key,
+                });
+              }
+            });
           }
         },
       }
@@ -5,6 +5,10 @@ import MainContentComponent from "./components/mainContent.js";
 import SocketConn from "./lib/socketConn.js";
 import identityManager from "./lib/identityManager.js";
 import e2ee from "./lib/e2ee.js";
+import platform from "./platform/index.js";
+
+const SPACE_EXPORT_CHUNK_TIMEOUT_MS = 20000;
+const SPACE_EXPORT_CHUNK_RETRIES = 3;
 
 export default class DashboardApp extends Component {
   constructor(props) {
@@ -53,9 +57,20 @@ export default class DashboardApp extends Component {
       handleLeaveSpace: this.handleLeaveSpace,
       handleLeaveSpaceUpdate: this.handleLeaveSpaceUpdate,
       handleIncomingMessages: this.handleIncomingMessages,
+      handleListDevices: this.handleListDevices,
+      handleIdentityKeyChanged: this.handleIdentityKeyChanged,
+      handleSenderKeyRequired: this.handleSenderKeyRequired,
+      handleChatSaveResult: this.handleChatSaveResult,
+      handleMessageDeleted: this.handleMessageDeleted,
+      handleListReports: this.handleListReports,
+      handleResolveReport: this.handleResolveReport,
+      handleAuditLog: this.handleAuditLog,
+      handleSpaceExport: this.handleSpaceExport,
     });
 
     this.onCleanup(() => {
+      Object.values(this.spaceExports || {}).forEach((pending) => clearTimeout(pending.timer));
+      this.spaceExports = {};
       this.socketConn?.hardClose?.();
       this.socketConn = null;
     });
@@ -102,6 +117,80 @@ export default class DashboardApp extends Component {
     });
   };
 
+  handleListDevices = (data) => {
+    this.dashModal?.renderRegisteredDevices(data.data?.devices || []);
+  };
+
+  handleListReports = (data) => {
+    this.dashModal?.renderReports(data.data?.space_uuid, data.data?.reports || []);
+  };
+
+  handleResolveReport = (data) => {
+    const spaceUUID = data.data?.report?.space_uuid;
+    if (spaceUUID) {
+      this.socketConn?.listReports({ space_uuid: spaceUUID });
+    }
+  };
+
+  handleAuditLog = (data) => {
+    this.dashModal?.renderAuditLog(data.data?.space_uuid, data.data?.entries || [], !!data.data?.has_more);
+  };
+
+  // handleSpaceExport collects the chunks of a space archive, asking the
+  // host for the next one as each arrives, and saves the file once it has
+  // them all.
+  handleSpaceExport = (data) => {
+    const { space_uuid: spaceUUID, export_id: exportID, chunk, chunks, data: part } = data.data || {};
+    if (!spaceUUID || !exportID || !chunks) return;
+    this.spaceExports ??= {};
+    let pending = this.spaceExports[spaceUUID];
+    if (chunk === 0 && pending?.exportID !== exportID) {
+      clearTimeout(pending?.timer);
+      pending = { exportID, parts: new Array(chunks), retries: 0, timer: null };
+      this.spaceExports[spaceUUID] = pending;
+    }
+    if (pending?.exportID !== exportID || typeof part !== "string") return;
+    pending.parts[chunk] = part;
+    pending.retries = 0;
+    const next = pending.parts.findIndex((p) => typeof p !== "string");
+    if (next !== -1) {
+      this.requestSpaceExportChunk(spaceUUID, next);
+      return;
+    }
+    clearTimeout(pending.timer);
+    delete this.spaceExports[spaceUUID];
+    const binary = atob(pending.parts.join(""));
+    const bytes = Uint8Array.from(binary, (c) => c.charCodeAt(0));
+    const url = URL.createObjectURL(new Blob([bytes], { type: "application/gzip" }));
+    const link = document.createElement("a");
+    link.href = url;
+    link.download = `parch-space-${spaceUUID}.json.gz`;
+    document.body.appendChild(link);
+    link.click();
+    link.remove();
+    URL.revokeObjectURL(url);
+  };
+
+  // requestSpaceExportChunk asks for one chunk and asks again if it does not
+  // arrive: the relay drops chunks rather than disconnecting a client that
+  // has fallen behind.
+  requestSpaceExportChunk = (spaceUUID, chunk) => {
+    const pending = this.spaceExports?.[spaceUUID];
+    if (!pending) return;
+    clearTimeout(pending.timer);
+    if (pending.retries > SPACE_EXPORT_CHUNK_RETRIES) {
+      delete this.spaceExports[spaceUUID];
+      platform.alert("The space export was incomplete; please try again.");
+      return;
+    }
+    pending.timer = setTimeout(() => {
+      if (this.spaceExports?.[spaceUUID] !== pending) return;
+      pending.retries += 1;
+      this.requestSpaceExportChunk(spaceUUID, chunk);
+    }, SPACE_EXPORT_CHUNK_TIMEOUT_MS);
+    this.socketConn?.exportSpace({ space_uuid: spaceUUID, export_id: pending.exportID, chunk });
+  };
+
   getCurrentSpaceUUID = () => {
     return this.currentSpaceUUID;
   };
@@ -265,6 +354,23 @@ export default class DashboardApp extends Component {
     }
   };
 
+  handleIdentityKeyChanged = (data) => {
+    if (!this.data) return;
+
+    const change = data.data || {};
+    const space = this.data.spaces.find((candidate) => candidate.uuid === change.space_uuid);
+    const member = (space?.users || []).find(
+      (user) => user.id === change.user_id || user.public_key === change.old_public_key
+    );
+    if (!member) return;
+
+    member.public_key = change.new_public_key;
+    member.enc_public_key = change.new_enc_public_key;
+    if (this.currentSpaceUUID === space.uuid) {
+      this.sidebar.spaceUserListComponent.render();
+    }
+  };
+
   handleCreateChannel = (data) => {
     if (!this.data) return;
 
@@ -445,7 +551,44 @@ export default class DashboardApp extends Component {
     };
   };
 
+  openSenderKeys = async (envelopes) => {
+    const identity = await identityManager.getOrCreateIdentity();
+    for (const envelope of envelopes || []) {
+      try {
+        await e2ee.openSenderKeyDistribution({ envelope, identity });
+      } catch (err) {
+        console.error(err);
+      }
+    }
+  };
+
+  handleSenderKeyRequired = async (data) => {
+    const chatBox = this.mainContent?.chatApp?.chatBoxComponent;
+    if (!chatBox || chatBox.channelUUID !== data.data?.channel_uuid) return;
+    await chatBox.resendWithNewSenderKey(data.data?.message_id);
+  };
+
+  handleChatSaveResult = (data, state) => {
+    const chatBox = this.mainContent?.chatApp?.chatBoxComponent;
+    if (state === "failed") {
+      console.error("Message not saved:", data.data?.error);
+    }
+    if (!chatBox || chatBox.channelUUID !== data.data?.channel_uuid) return;
+    chatBox.chatBoxMessagesComponent?.setSeq(data.data?.message_id, data.data?.seq);
+    chatBox.chatBoxMessagesComponent?.setDelivery(data.data?.message_id, state);
+  };
+
+  handleMessageDeleted = (data) => {
+    const chatBox = this.mainContent?.chatApp?.chatBoxComponent;
+    if (!chatBox || chatBox.channelUUID !== data.data?.channel_uuid) return;
+    chatBox.chatBoxMessagesComponent?.removeMessage(data.data?.message_id);
+  };
+
   renderChatAppMessage = async (data) => {
+    if (e2ee.isSenderKeyDistribution(data.data?.envelope)) {
+      await this.openSenderKeys([data.data.envelope]);
+      return;
+    }
     if (!this.mainContent?.chatApp) {
       return;
     }
@@ -455,13 +598,18 @@ export default class DashboardApp extends Component {
         data.data,
         this.currentSpaceUUID
       );
-      const messageComponent =
-        this.mainContent.chatApp.chatBoxComponent.chatBoxMessagesComponent;
-
+      const chatBox = this.mainContent.chatApp.chatBoxComponent;
+      chatBox.confirmSent(data.data?.envelope?.message_id);
+      const messageComponent = chatBox.chatBoxMessagesComponent;
+
+      const messageID = decryptedMessage.envelope?.message_id;
+      const isOwnMessage =
+        decryptedMessage.sender_auth_public_key === this.data.user.public_key;
+      if (isOwnMessage && !messageComponent.deliveryByMessageID.has(messageID)) {
+        messageComponent.deliveryByMessageID.set(messageID, "sending");
+      }
       messageComponent.appendNewMessage(decryptedMessage);
-      if (
-        decryptedMessage.sender_auth_public_key === this.data.user.public_key
-      ) {
+      if (isOwnMessage) {
         messageComponent.scrollDown();
       } else if (messageComponent.isScrolledToBottom()) {
         messageComponent.scrollDown();
@@ -486,9 +634,14 @@ export default class DashboardApp extends Component {
     const previousHeight = container.scrollHeight;
     const previousScrollTop = container.scrollTop;
 
-    component.hasMoreMessages = data.data.has_more_messages;
-    component.isLoading = false;
+    // A range fills a gap and leaves paging through older history alone.
+    const isRange = Boolean(data.data.from_seq);
+    if (!isRange) {
+      component.hasMoreMessages = data.data.has_more_messages;
+      component.isLoading = false;
+    }
 
+    await this.openSenderKeys(data.data.sender_keys);
     const space = this.findSpaceByChannelUUID(data.data.channel_uuid);
     const decryptedMessages = await Promise.all(
       data.data.messages.map(async (message) => {
@@ -506,7 +659,7 @@ export default class DashboardApp extends Component {
       })
     );
 
-    component.chatBoxMessages = [...decryptedMessages, ...component.chatBoxMessages];
+    component.mergeMessages(decryptedMessages);
 
     component.render();
 
@@ -0,0 +1,63 @@
+import { relayBaseURL } from "./config.js";
+
+// Activity emails go to Parch accounts. The account pages served next to the
+// relay keep their session token under this key; without one there is nobody
+// to email, so these calls are skipped.
+const ACCOUNT_TOKEN_KEY = "call_app:auth_token";
+
+function accountToken() {
+  try {
+    return localStorage.getItem(ACCOUNT_TOKEN_KEY) || "";
+  } catch {
+    return "";
+  }
+}
+
+// Notification bookkeeping never blocks chat: failures are logged and dropped.
+async function postNotification(path, body) {
+  const token = accountToken();
+  if (!token || !body.host_uuid || !body.space_uuid) {
+    return;
+  }
+  try {
+    const response = await fetch(`${relayBaseURL}/call/api/notifications${path}`, {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+        Authorization: `Bearer ${token}`,
+      },
+      body: JSON.stringify(body),
+    });
+    if (!response.ok) {
+      console.warn(`notifications ${path} returned ${response.status}`);
+    }
+  } catch (err) {
+    console.warn(`notifications ${path} failed:`, err);
+  }
+}
+
+export function recordSpaceMembership(hostUUID, spaceUUID, capabilityToken) {
+  if (!capabilityToken) {
+    return;
+  }
+  postNotification("/memberships", {
+    host_uuid: hostUUID,
+    space_uuid: spaceUUID,
+    capability_token: capabilityToken,
+  });
+}
+
+export function recordSpaceLeave(hostUUID, spaceUUID) {
+  postNotification("/memberships/leave", { host_uuid: hostUUID, space_uuid: spaceUUID });
+}
+
+export function recordSpaceActivity(hostUUID, spaceUUID, capabilityToken) {
+  if (!capabilityToken) {
+    return;
+  }
+  postNotification("/activity", {
+    host_uuid: hostUUID,
+    space_uuid: spaceUUID,
+    capability_token: capabilityToken,
+  });
+}
@@ -1,5 +1,17 @@
 import identityManager from "./identityManager.js";
 
+const ENVELOPE_ALGORITHM = "p256-hkdf-aesgcm+ed25519";
+// Version 3 sorts wrapped keys by code unit and sends them in that order.
+// Version 2 sorted them with localeCompare, which depends on the signer's
+// locale; it is still read.
+const SENDER_KEY_VERSION = 3;
+const LEGACY_SENDER_KEY_VERSION = 2;
+
+// Chain keys received in sender-key distributions, by channel, sender and
+// epoch, and the key this client currently sends with in each channel.
+const senderKeys = new Map();
+const ownSenderKeys = new Map();
+
 function getCrypto() {
   const runtimeCrypto = globalThis?.crypto;
   if (!runtimeCrypto?.subtle) {
@@ -28,12 +40,72 @@ function fromBase64Raw(str) {
   return bytes;
 }
 
-function canonicalEnvelopeForSignature(envelope) {
+function isSenderKeyVersion(version) {
+  return version === SENDER_KEY_VERSION || version === LEGACY_SENDER_KEY_VERSION;
+}
+
+function compareOrdinal(a, b) {
+  if (a < b) return -1;
+  return a > b ? 1 : 0;
+}
+
+// signedWrappedKeyOrders lists the wrapped-key orders a signature over the
+// envelope may cover. Older versions were sorted in the signer's locale, so
+// the order they were sent in is tried after this browser's own.
+function signedWrappedKeyOrders(envelope) {
+  if (envelope.v === SENDER_KEY_VERSION) {
+    return ["ordinal"];
+  }
+  return ["locale", "as_sent"];
+}
+
+function sortWrappedKeys(wrappedKeys, order) {
+  const sorted = [...wrappedKeys];
+  if (order === "ordinal") {
+    sorted.sort((a, b) =>
+      compareOrdinal(String(a.recipient_auth_public_key), String(b.recipient_auth_public_key))
+    );
+  } else if (order === "locale") {
+    sorted.sort((a, b) =>
+      String(a.recipient_auth_public_key).localeCompare(String(b.recipient_auth_public_key))
+    );
+  }
+  return sorted;
+}
+
+function canonicalWrappedKeys(envelope, order) {
   const wrappedKeys = Array.isArray(envelope.wrapped_keys)
-    ? [...envelope.wrapped_keys].sort((a, b) =>
-        String(a.recipient_auth_public_key).localeCompare(String(b.recipient_auth_public_key))
-      )
+    ? sortWrappedKeys(envelope.wrapped_keys, order)
     : [];
+  return wrappedKeys.map((item) => ({
+    recipient_auth_public_key: item.recipient_auth_public_key,
+    iv: item.iv,
+    ciphertext: item.ciphertext,
+  }));
+}
+
+function canonicalEnvelopeForSignature(envelope, order = signedWrappedKeyOrders(envelope)[0]) {
+  if (isSenderKeyVersion(envelope.v)) {
+    const canonical = {
+      v: envelope.v,
+      alg: envelope.alg,
+      kind: envelope.kind,
+      message_id: envelope.message_id,
+      sender_timestamp: envelope.sender_timestamp,
+      space_uuid: envelope.space_uuid,
+      channel_uuid: envelope.channel_uuid,
+      sender_auth_public_key: envelope.sender_auth_public_key,
+      sender_enc_public_key: envelope.sender_enc_public_key,
+      epoch: envelope.epoch,
+    };
+    if (envelope.kind === "sender_key") {
+      canonical.wrapped_keys = canonicalWrappedKeys(envelope, order);
+    } else {
+      canonical.content_iv = envelope.content_iv;
+      canonical.ciphertext = envelope.ciphertext;
+    }
+    return JSON.stringify(canonical);
+  }
 
   const canonical = {
     v: envelope.v,
@@ -46,11 +118,7 @@ function canonicalEnvelopeForSignature(envelope) {
     sender_enc_public_key: envelope.sender_enc_public_key,
     content_iv: envelope.content_iv,
     ciphertext: envelope.ciphertext,
-    wrapped_keys: wrappedKeys.map((item) => ({
-      recipient_auth_public_key: item.recipient_auth_public_key,
-      iv: item.iv,
-      ciphertext: item.ciphertext,
-    })),
+    wrapped_keys: canonicalWrappedKeys(envelope, order),
   };
 
   return JSON.stringify(canonical);
@@ -125,6 +193,81 @@ async function deriveWrapKey(privateKey, publicKey, envelopeContext) {
   );
 }
 
+function uniqueRecipientsWithSelf(recipients, identity) {
+  const uniqueRecipients = [];
+  const seenAuthKeys = new Set();
+  for (const recipient of recipients) {
+    if (!recipient?.authPublicKey || !recipient?.encPublicKey) continue;
+    if (seenAuthKeys.has(recipient.authPublicKey)) continue;
+    seenAuthKeys.add(recipient.authPublicKey);
+    uniqueRecipients.push(recipient);
+  }
+
+  if (!seenAuthKeys.has(identity.publicKey)) {
+    uniqueRecipients.push({
+      authPublicKey: identity.publicKey,
+      encPublicKey: identity.encPublicKey,
+    });
+  }
+  return uniqueRecipients;
+}
+
+async function wrapKeyForRecipients(rawKey, envelope, identity, recipients) {
+  const crypto = getCrypto();
+  const senderEncPrivate = await resolveOwnEncPrivateKey(identity);
+  const wrappedKeys = [];
+  for (const recipient of recipients) {
+    const recipientPublic = await importRecipientEncPublicKey(recipient.encPublicKey);
+    const wrapKey = await deriveWrapKey(senderEncPrivate, recipientPublic, envelope);
+    const wrapIV = crypto.getRandomValues(new Uint8Array(12));
+    const wrapped = await crypto.subtle.encrypt(
+      { name: "AES-GCM", iv: wrapIV },
+      wrapKey,
+      rawKey
+    );
+    wrappedKeys.push({
+      recipient_auth_public_key: recipient.authPublicKey,
+      iv: toBase64Raw(wrapIV),
+      ciphertext: toBase64Raw(wrapped),
+    });
+  }
+  return wrappedKeys;
+}
+
+async function unwrapKeyForIdentity(envelope, identity) {
+  const crypto = getCrypto();
+  const wrapped = (envelope.wrapped_keys || []).find(
+    (item) => item.recipient_auth_public_key === identity.publicKey
+  );
+  if (!wrapped) {
+    throw new Error("No wrapped key for this identity");
+  }
+
+  const recipientPrivate = await resolveOwnEncPrivateKey(identity);
+  const senderPublic = await importSenderEncPublicKey(envelope.sender_enc_public_key);
+  const wrapKey = await deriveWrapKey(recipientPrivate, senderPublic, envelope);
+
+  return crypto.subtle.decrypt(
+    { name: "AES-GCM", iv: fromBase64Raw(wrapped.iv) },
+    wrapKey,
+    fromBase64Raw(wrapped.ciphertext)
+  );
+}
+
+async function verifyEnvelopeSignature(envelope) {
+  for (const order of signedWrappedKeyOrders(envelope)) {
+    const signatureValid = await identityManager.verifyAuthSignature(
+      envelope.sender_auth_public_key,
+      canonicalEnvelopeForSignature(envelope, order),
+      envelope.sig
+    );
+    if (signatureValid) {
+      return;
+    }
+  }
+  throw new Error("Invalid message signature");
+}
+
 async function encryptMessageForSpace(params) {
   const crypto = getCrypto();
   const {
@@ -145,21 +288,7 @@ async function encryptMessageForSpace(params) {
     throw new Error("No recipient keys available for encryption");
   }
 
-  const uniqueRecipients = [];
-  const seenAuthKeys = new Set();
-  for (const recipient of recipients) {
-    if (!recipient?.authPublicKey || !recipient?.encPublicKey) continue;
-    if (seenAuthKeys.has(recipient.authPublicKey)) continue;
-    seenAuthKeys.add(recipient.authPublicKey);
-    uniqueRecipients.push(recipient);
-  }
-
-  if (!seenAuthKeys.has(identity.publicKey)) {
-    uniqueRecipients.push({
-      authPublicKey: identity.publicKey,
-      encPublicKey: identity.encPublicKey,
-    });
-  }
+  const uniqueRecipients = uniqueRecipientsWithSelf(recipients, identity);
 
   const messageKey = await crypto.subtle.generateKey(
     { name: "AES-GCM", length: 256 },
@@ -175,11 +304,9 @@ async function encryptMessageForSpace(params) {
     contentPlain
   );
 
-  const senderEncPrivate = await resolveOwnEncPrivateKey(identity);
-
   const envelope = {
     v: 1,
-    alg: "p256-hkdf-aesgcm+ed25519",
+    alg: ENVELOPE_ALGORITHM,
     message_id: createMessageID(),
     sender_timestamp: new Date().toISOString(),
     space_uuid: spaceUUID,
@@ -191,21 +318,12 @@ async function encryptMessageForSpace(params) {
     wrapped_keys: [],
   };
 
-  for (const recipient of uniqueRecipients) {
-    const recipientPublic = await importRecipientEncPublicKey(recipient.encPublicKey);
-    const wrapKey = await deriveWrapKey(senderEncPrivate, recipientPublic, envelope);
-    const wrapIV = crypto.getRandomValues(new Uint8Array(12));
-    const wrapped = await crypto.subtle.encrypt(
-      { name: "AES-GCM", iv: wrapIV },
-      wrapKey,
-      rawMessageKey
-    );
-    envelope.wrapped_keys.push({
-      recipient_auth_public_key: recipient.authPublicKey,
-      iv: toBase64Raw(wrapIV),
-      ciphertext: toBase64Raw(wrapped),
-    });
-  }
+  // Keys go out in the order they are signed in, so a verifier whose
+  // localeCompare differs can fall back to the transmitted order.
+  envelope.wrapped_keys = sortWrappedKeys(
+    await wrapKeyForRecipients(rawMessageKey, envelope, identity, uniqueRecipients),
+    "locale"
+  );
 
   const canonical = canonicalEnvelopeForSignature(envelope);
   envelope.sig = await identityManager.signAuthMessage(identity, canonical);
@@ -224,32 +342,12 @@ async function decryptMessageForIdentity(params) {
     throw new Error("Missing recipient identity");
   }
 
-  const canonical = canonicalEnvelopeForSignature(envelope);
-  const signatureValid = await identityManager.verifyAuthSignature(
-    envelope.sender_auth_public_key,
-    canonical,
-    envelope.sig
-  );
-  if (!signatureValid) {
-    throw new Error("Invalid message signature");
+  await verifyEnvelopeSignature(envelope);
+  if (isSenderKeyVersion(envelope.v)) {
+    return decryptSenderKeyMessage(envelope);
   }
 
-  const wrapped = (envelope.wrapped_keys || []).find(
-    (item) => item.recipient_auth_public_key === identity.publicKey
-  );
-  if (!wrapped) {
-    throw new Error("No wrapped key for this identity");
-  }
-
-  const recipientPrivate = await resolveOwnEncPrivateKey(identity);
-  const senderPublic = await importSenderEncPublicKey(envelope.sender_enc_public_key);
-  const wrapKey = await deriveWrapKey(recipientPrivate, senderPublic, envelope);
-
-  const rawMessageKey = await crypto.subtle.decrypt(
-    { name: "AES-GCM", iv: fromBase64Raw(wrapped.iv) },
-    wrapKey,
-    fromBase64Raw(wrapped.ciphertext)
-  );
+  const rawMessageKey = await unwrapKeyForIdentity(envelope, identity);
   const messageKey = await crypto.subtle.importKey(
     "raw",
     rawMessageKey,
@@ -267,8 +365,187 @@ async function decryptMessageForIdentity(params) {
   return new TextDecoder().decode(plaintextBuffer);
 }
 
+function senderKeyID(channelUUID, senderAuthPublicKey, epoch) {
+  return `${channelUUID}|${senderAuthPublicKey}|${epoch}`;
+}
+
+// deriveSenderMessageKey derives a one-off message key from a sender's chain
+// key, bound to the message ID so no two messages share a key.
+async function deriveSenderMessageKey(chainKey, envelope, usages) {
+  const crypto = getCrypto();
+  const hkdfBase = await crypto.subtle.importKey("raw", chainKey, "HKDF", false, [
+    "deriveKey",
+  ]);
+  const salt = new TextEncoder().encode(`parch-e2ee-sender-salt:${envelope.message_id}`);
+  const info = new TextEncoder().encode(
+    `parch-e2ee-sender-info:${envelope.space_uuid}:${envelope.channel_uuid}:${envelope.sender_auth_public_key}:${envelope.epoch}`
+  );
+  return crypto.subtle.deriveKey(
+    { name: "HKDF", hash: "SHA-256", salt, info },
+    hkdfBase,
+    { name: "AES-GCM", length: 256 },
+    false,
+    usages
+  );
+}
+
+function recipientsFingerprint(recipients) {
+  return recipients
+    .map((recipient) => recipient.authPublicKey)
+    .sort()
+    .join(",");
+}
+
+// currentSenderKey returns the key this client sends with in a channel, or
+// null when it has to distribute a new one because there is none yet or the
+// members have changed since the last distribution.
+function currentSenderKey(channelUUID, recipients, identity) {
+  const current = ownSenderKeys.get(channelUUID);
+  if (!current) return null;
+  const fingerprint = recipientsFingerprint(uniqueRecipientsWithSelf(recipients, identity));
+  return current.fingerprint === fingerprint ? current : null;
+}
+
+// forgetOwnSenderKey forces the next send in a channel to distribute a new
+// key. The old epoch is kept so the new one still increases.
+function forgetOwnSenderKey(channelUUID) {
+  const current = ownSenderKeys.get(channelUUID);
+  if (current) current.fingerprint = null;
+}
+
+async function createSenderKeyDistribution(params) {
+  const crypto = getCrypto();
+  const { spaceUUID, channelUUID, identity, recipients } = params;
+
+  if (!identity?.publicKey || !identity?.encPublicKey) {
+    throw new Error("Missing sender identity keys");
+  }
+  if (!spaceUUID || !channelUUID) {
+    throw new Error("Missing space/channel context");
+  }
+
+  const uniqueRecipients = uniqueRecipientsWithSelf(recipients || [], identity);
+  // Epochs only ever increase, including across reloads, so the relay can
+  // refuse a replayed distribution.
+  const previous = ownSenderKeys.get(channelUUID);
+  const epoch = Math.max(Date.now(), (previous?.epoch || 0) + 1);
+  const chainKey = crypto.getRandomValues(new Uint8Array(32));
+
+  const envelope = {
+    v: SENDER_KEY_VERSION,
+    alg: ENVELOPE_ALGORITHM,
+    kind: "sender_key",
+    message_id: createMessageID(),
+    sender_timestamp: new Date().toISOString(),
+    space_uuid: spaceUUID,
+    channel_uuid: channelUUID,
+    sender_auth_public_key: identity.publicKey,
+    sender_enc_public_key: identity.encPublicKey,
+    epoch,
+  };
+  envelope.wrapped_keys = sortWrappedKeys(
+    await wrapKeyForRecipients(chainKey, envelope, identity, uniqueRecipients),
+    "ordinal"
+  );
+  envelope.sig = await identityManager.signAuthMessage(
+    identity,
+    canonicalEnvelopeForSignature(envelope)
+  );
+
+  const senderKey = {
+    epoch,
+    chainKey,
+    fingerprint: recipientsFingerprint(uniqueRecipients),
+  };
+  ownSenderKeys.set(channelUUID, senderKey);
+  senderKeys.set(senderKeyID(channelUUID, identity.publicKey, epoch), chainKey);
+
+  return { envelope, senderKey };
+}
+
+async function encryptWithSenderKey(params) {
+  const crypto = getCrypto();
+  const { plaintext, spaceUUID, channelUUID, identity, senderKey } = params;
+
+  if (!senderKey?.chainKey || !senderKey?.epoch) {
+    throw new Error("Missing sender key");
+  }
+
+  const envelope = {
+    v: SENDER_KEY_VERSION,
+    alg: ENVELOPE_ALGORITHM,
+    kind: "message",
+    message_id: createMessageID(),
+    sender_timestamp: new Date().toISOString(),
+    space_uuid: spaceUUID,
+    channel_uuid: channelUUID,
+    sender_auth_public_key: identity.publicKey,
+    sender_enc_public_key: identity.encPublicKey,
+    epoch: senderKey.epoch,
+  };
+  const messageKey = await deriveSenderMessageKey(senderKey.chainKey, envelope, ["encrypt"]);
+  const contentIV = crypto.getRandomValues(new Uint8Array(12));
+  const contentCipher = await crypto.subtle.encrypt(
+    { name: "AES-GCM", iv: contentIV },
+    messageKey,
+    new TextEncoder().encode(plaintext)
+  );
+  envelope.content_iv = toBase64Raw(contentIV);
+  envelope.ciphertext = toBase64Raw(contentCipher);
+  envelope.sig = await identityManager.signAuthMessage(
+    identity,
+    canonicalEnvelopeForSignature(envelope)
+  );
+
+  return envelope;
+}
+
+// openSenderKeyDistribution verifies a sender-key distribution and keeps the
+// chain key it wraps for this identity.
+async function openSenderKeyDistribution(params) {
+  const { envelope, identity } = params;
+
+  if (!envelope?.sender_auth_public_key || !envelope?.sender_enc_public_key || !envelope?.sig) {
+    throw new Error("Invalid sender key envelope");
+  }
+  await verifyEnvelopeSignature(envelope);
+
+  const id = senderKeyID(envelope.channel_uuid, envelope.sender_auth_public_key, envelope.epoch);
+  if (senderKeys.has(id)) return;
+  const chainKey = await unwrapKeyForIdentity(envelope, identity);
+  senderKeys.set(id, new Uint8Array(chainKey));
+}
+
+async function decryptSenderKeyMessage(envelope) {
+  const crypto = getCrypto();
+  const chainKey = senderKeys.get(
+    senderKeyID(envelope.channel_uuid, envelope.sender_auth_public_key, envelope.epoch)
+  );
+  if (!chainKey) {
+    throw new Error("Missing sender key for message");
+  }
+
+  const messageKey = await deriveSenderMessageKey(chainKey, envelope, ["decrypt"]);
+  const plaintextBuffer = await crypto.subtle.decrypt(
+    { name: "AES-GCM", iv: fromBase64Raw(envelope.content_iv) },
+    messageKey,
+    fromBase64Raw(envelope.ciphertext)
+  );
+  return new TextDecoder().decode(plaintextBuffer);
+}
+
+function isSenderKeyDistribution(envelope) {
+  return isSenderKeyVersion(envelope?.v) && envelope?.kind === "sender_key";
+}
+
 export default {
   encryptMessageForSpace,
   decryptMessageForIdentity,
   canonicalEnvelopeForSignature,
+  createSenderKeyDistribution,
+  encryptWithSenderKey,
+  openSenderKeyDistribution,
+  currentSenderKey,
+  forgetOwnSenderKey,
+  isSenderKeyDistribution,
 };
@@ -2,11 +2,13 @@ const IDENTITY_KEY = "parch.chat.identity";
 const IDENTITY_SEALED_KEY = "parch.chat.identity.sealed";
 const DEVICE_ID_KEY = "parch.chat.device_id";
 const LAST_EXPORTED_AT_KEY = "parch.chat.identity.last_exported_at";
+const PENDING_MIGRATION_KEY = "parch.chat.identity.pending_migration";
 
 const IDENTITY_DB_NAME = "parch.chat.identity.keys";
 const IDENTITY_DB_VERSION = 1;
 const IDENTITY_DB_STORE = "kv";
 const DEVICE_WRAP_KEY_ID = "device_wrap_key";
+const DEVICE_SIGNING_KEY_ID = "device_signing_key";
 const PASSPHRASE_ITERATIONS = 210000;
 
 let cachedIdentity = null;
@@ -15,6 +17,7 @@ let cachedSigningPrivateKey = null;
 let cachedEncryptionPrivateKey = null;
 let idbPromise = null;
 let deviceWrapKeyPromise = null;
+let deviceSigningKeyPromise = null;
 
 function getCrypto() {
   const runtimeCrypto = globalThis?.crypto;
@@ -336,6 +339,52 @@ async function getOrCreateDeviceWrapKey() {
   return deviceWrapKeyPromise;
 }
 
+// The device signing key never leaves this browser. The identity certifies
+// it, and the relay derives the device ID from it, so a revoked browser
+// cannot come back under a new or missing device ID.
+async function getOrCreateDeviceSigningKey() {
+  if (!supportsSecureKeyVault()) {
+    return null;
+  }
+  if (deviceSigningKeyPromise) {
+    return deviceSigningKeyPromise;
+  }
+
+  deviceSigningKeyPromise = (async () => {
+    const db = await openIdentityDB();
+    if (!db) {
+      return null;
+    }
+    const existing = await idbGet(db, DEVICE_SIGNING_KEY_ID);
+    if (existing?.privateKey && existing?.publicKey) {
+      return existing;
+    }
+    const keyPair = await getCrypto().subtle.generateKey({ name: "Ed25519" }, false, ["sign", "verify"]);
+    const stored = await idbPut(db, DEVICE_SIGNING_KEY_ID, {
+      privateKey: keyPair.privateKey,
+      publicKey: keyPair.publicKey,
+    });
+    return stored ? keyPair : null;
+  })().catch(() => null);
+
+  return deviceSigningKeyPromise;
+}
+
+// getDeviceCredential proves this session runs on a device the identity
+// certified. It returns null when the browser cannot keep a device key.
+async function getDeviceCredential(identity, hostUUID, challenge) {
+  const keyPair = await getOrCreateDeviceSigningKey();
+  if (!keyPair) {
+    return null;
+  }
+  const crypto = getCrypto();
+  const devicePublicKey = toBase64Raw(await crypto.subtle.exportKey("raw", keyPair.publicKey));
+  const certificate = await signAuthMessage(identity, `parch-device-cert:${identity.publicKey}:${devicePublicKey}`);
+  const payload = new TextEncoder().encode(`parch-device-auth:${hostUUID}:${challenge}:${identity.publicKey}`);
+  const signature = toBase64Raw(await crypto.subtle.sign({ name: "Ed25519" }, keyPair.privateKey, payload));
+  return { devicePublicKey, certificate, signature };
+}
+
 async function derivePassphraseKey(passphrase, salt, usages) {
   const passphraseBytes = new TextEncoder().encode(passphrase);
   const baseKey = await getCrypto().subtle.importKey("raw", passphraseBytes, "PBKDF2", false, ["deriveKey"]);
@@ -485,7 +534,7 @@ async function persistIdentity(identity) {
   return cachedIdentity;
 }
 
-async function generateIdentity() {
+async function generateIdentityMaterial() {
   const crypto = getCrypto();
   const authKeyPair = await crypto.subtle.generateKey(
     { name: "Ed25519" },
@@ -497,13 +546,17 @@ async function generateIdentity() {
   const privateKeyPkcs8 = await crypto.subtle.exportKey("pkcs8", authKeyPair.privateKey);
   const encIdentity = await generateEncryptionIdentity();
 
-  return persistIdentity({
+  return {
     publicKey: toBase64Raw(publicKeyRaw),
     privateKey: toBase64Raw(privateKeyPkcs8),
     encPublicKey: encIdentity.encPublicKey,
     encPrivateKey: encIdentity.encPrivateKey,
     username: "",
-  });
+  };
+}
+
+async function generateIdentity() {
+  return persistIdentity(await generateIdentityMaterial());
 }
 
 async function ensureIdentityLoaded() {
@@ -691,6 +744,52 @@ function setIdentityUsername(username) {
   }
 }
 
+// rotateIdentity replaces the local identity with a fresh keypair. Before the
+// old key is dropped it signs a statement handing the identity on hostUUID
+// over to the new keys; it is kept as the pending migration until the new
+// identity has signed in and sent it as identity_migrate.
+async function rotateIdentity(hostUUID) {
+  if (!hostUUID) {
+    throw new Error("Missing host");
+  }
+  const oldIdentity = await ensureIdentityLoaded();
+  const oldSigningKey = await getSigningPrivateKey();
+  const next = await generateIdentityMaterial();
+  next.username = oldIdentity.username || "";
+
+  const issuedAt = Math.floor(Date.now() / 1000);
+  const message = `parch-identity-migrate:${hostUUID}:${oldIdentity.publicKey}:${next.publicKey}:${next.encPublicKey}:${issuedAt}`;
+  const signature = await getCrypto().subtle.sign(
+    { name: "Ed25519" },
+    oldSigningKey,
+    new TextEncoder().encode(message)
+  );
+
+  writeJSONStorage(PENDING_MIGRATION_KEY, {
+    host_uuid: hostUUID,
+    old_public_key: oldIdentity.publicKey,
+    issued_at: issuedAt,
+    signature: toBase64Raw(signature),
+  });
+  return persistIdentity(next);
+}
+
+function getPendingMigration(hostUUID) {
+  const pending = readJSONStorage(PENDING_MIGRATION_KEY);
+  if (!pending || pending.host_uuid !== hostUUID) {
+    return null;
+  }
+  return {
+    old_public_key: pending.old_public_key,
+    issued_at: pending.issued_at,
+    signature: pending.signature,
+  };
+}
+
+function clearPendingMigration() {
+  localStorage.removeItem(PENDING_MIGRATION_KEY);
+}
+
 function clearIdentity() {
   clearIdentityCache();
   localStorage.removeItem(IDENTITY_KEY);
@@ -709,6 +808,7 @@ function clearIdentity() {
 export default {
   getOrCreateIdentity,
   getDeviceMetadata,
+  getDeviceCredential,
   getSigningPrivateKey,
   getEncryptionPrivateKey,
   signAuthMessage,
@@ -720,5 +820,8 @@ export default {
   importIdentity,
   importEncryptedIdentity,
   setIdentityUsername,
+  rotateIdentity,
+  getPendingMigration,
+  clearPendingMigration,
   clearIdentity,
 };
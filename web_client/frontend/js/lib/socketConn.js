@@ -1,6 +1,7 @@
 import { relayBaseURLWS } from "./config.js";
 import platform from "../platform/index.js";
 import identityManager from "./identityManager.js";
+import { recordSpaceActivity, recordSpaceLeave, recordSpaceMembership } from "./activityNotifications.js";
 
 export default class SocketConn {
   constructor(props) {
@@ -24,11 +25,21 @@ export default class SocketConn {
     this.handleLeaveSpace = props.handleLeaveSpace;
     this.handleLeaveSpaceUpdate = props.handleLeaveSpaceUpdate;
     this.handleIncomingMessages = props.handleIncomingMessages;
+    this.handleListDevices = props.handleListDevices;
+    this.handleIdentityKeyChanged = props.handleIdentityKeyChanged;
+    this.handleSenderKeyRequired = props.handleSenderKeyRequired;
+    this.handleChatSaveResult = props.handleChatSaveResult;
+    this.handleMessageDeleted = props.handleMessageDeleted;
+    this.handleListReports = props.handleListReports;
+    this.handleResolveReport = props.handleResolveReport;
+    this.handleAuditLog = props.handleAuditLog;
+    this.handleSpaceExport = props.handleSpaceExport;
 
     this.socket = null;
     this.manualClose = false;
     this.retryCount = 0;
     this.maxRetries = 2;
+    this.relayShutdownDelayMs = null;
     this.capabilityBySpaceUUID = new Map();
     this.hasInitialDashboardData = false;
     this.capabilityRefreshPromise = null;
@@ -39,6 +50,7 @@ export default class SocketConn {
     this.capabilitySkewMs = 30 * 1000;
     this.capabilityRefreshTimeoutMs = 7000;
     this.capabilityRetryWindowMs = 10 * 1000;
+    this.pendingLeaveSpaceUUID = null;
 
     this.hostUUID = localStorage.getItem("hostUUID");
 
@@ -50,8 +62,7 @@ export default class SocketConn {
     }
   }
 
-  retryConnection = () => {
-    const retryDelay = 2000;
+  retryConnection = (retryDelay = 2000) => {
     this.retryCount += 1;
     if (this.retryCount > this.maxRetries) {
       platform.alert("Unable to reconnect to host. Returning to home.");
@@ -93,6 +104,7 @@ export default class SocketConn {
             break;
           case "auth_pubkey_success":
             this.closeDashModal();
+            this.sendPendingMigration();
             this.getDashboardData();
             break;
           case "dash_data_payload":
@@ -108,8 +120,15 @@ export default class SocketConn {
             this.updateAccountUsername(data, this.hostUUID);
             identityManager.setIdentityUsername(data.data.username);
             break;
+          case "list_devices_success":
+            this.handleListDevices?.(data);
+            break;
+          case "revoke_device_success":
+            this.listDevices();
+            break;
           case "create_space_success":
             this.setCapability(data.data?.capability);
+            this.recordMembership(data.data?.capability);
             this.handleCreateSpace(data);
             break;
           case "delete_space_success":
@@ -135,6 +154,7 @@ export default class SocketConn {
             break;
           case "accept_invite_success":
             this.setCapability(data.data?.capability);
+            this.recordMembership(data.data?.capability);
             this.handleAcceptInvite(data);
             break;
           case "accept_invite_update":
@@ -144,8 +164,20 @@ export default class SocketConn {
             this.handleDeclineInvite(data);
             break;
           case "leave_space_success":
+            if (this.pendingLeaveSpaceUUID) {
+              recordSpaceLeave(this.hostUUID, this.pendingLeaveSpaceUUID);
+              this.pendingLeaveSpaceUUID = null;
+            }
             this.handleLeaveSpace();
             break;
+          case "identity_key_changed":
+            this.handleIdentityKeyChanged?.(data);
+            break;
+          case "identity_migrate_success":
+            identityManager.clearPendingMigration();
+            platform.alert("Identity migrated. Reloading...");
+            window.location.reload();
+            break;
           case "leave_space_update":
             this.handleLeaveSpaceUpdate(data);
             break;
@@ -155,7 +187,39 @@ export default class SocketConn {
           case "get_messages_success":
             await this.handleIncomingMessages(data);
             break;
+          case "sender_key_required":
+            await this.handleSenderKeyRequired?.(data);
+            break;
+          case "chat_saved":
+            this.handleChatSaveResult?.(data, "saved");
+            break;
+          case "chat_save_failed":
+            this.handleChatSaveResult?.(data, "failed");
+            break;
+          case "message_deleted":
+            this.handleMessageDeleted?.(data);
+            break;
+          case "report_success":
+            platform.alert("Report sent to the space owner.");
+            break;
+          case "list_reports_success":
+            this.handleListReports?.(data);
+            break;
+          case "resolve_report_success":
+            this.handleResolveReport?.(data);
+            break;
+          case "get_audit_log_success":
+            this.handleAuditLog?.(data);
+            break;
+          case "export_space_success":
+            this.handleSpaceExport?.(data);
+            break;
           case "error":
+          case "host_error":
+            // A refused migration will not succeed on retry; stop resending it.
+            if ((data.data?.error || "").startsWith("Identity migration")) {
+              identityManager.clearPendingMigration();
+            }
             if (!this.retryCapabilityActionFromError(data.data?.error || "")) {
               platform.alert(data.data.error);
             }
@@ -163,6 +227,16 @@ export default class SocketConn {
           case "authentication-error":
             platform.alert(data.data.error || "Authentication failed");
             break;
+          case "quota_exceeded":
+            platform.alert(data.data?.error || "This host is over its relay quota");
+            break;
+          case "request_timeout":
+            platform.alert("The host did not respond in time. Please try again.");
+            break;
+          case "relay_shutdown":
+            // The relay closes the socket next; reconnect when it says to.
+            this.relayShutdownDelayMs = data.data?.reconnect_after_ms || 2000;
+            break;
           case "author_error":
             platform.alert("Failed to connect to host. Host is offline.");
             this.rejectCapabilityRefreshRequest(new Error("host unavailable"));
@@ -179,6 +253,14 @@ export default class SocketConn {
     this.socket.onclose = () => {
       this.rejectCapabilityRefreshRequest(new Error("socket closed"));
       if (this.manualClose) return;
+      if (this.relayShutdownDelayMs !== null) {
+        // A planned restart is not a failed attempt.
+        const delay = this.relayShutdownDelayMs;
+        this.relayShutdownDelayMs = null;
+        this.retryCount = 0;
+        this.retryConnection(delay);
+        return;
+      }
       this.retryConnection();
     };
   };
@@ -194,6 +276,7 @@ export default class SocketConn {
       const device = identityManager.getDeviceMetadata();
       const authMessage = `parch-chat-auth:${this.hostUUID}:${challenge}:${identity.encPublicKey}`;
       const signature = await identityManager.signAuthMessage(identity, authMessage);
+      const credential = await identityManager.getDeviceCredential(identity, this.hostUUID, challenge);
 
       const wsMessage = {
         type: "auth_pubkey",
@@ -202,6 +285,9 @@ export default class SocketConn {
           enc_public_key: identity.encPublicKey,
           device_id: device.deviceId,
           device_name: device.deviceName,
+          device_public_key: credential?.devicePublicKey || "",
+          device_certificate: credential?.certificate || "",
+          device_signature: credential?.signature || "",
           username: identity.username || "",
           challenge,
           signature,
@@ -248,6 +334,14 @@ export default class SocketConn {
     this.scheduleCapabilityRefresh();
   };
 
+  // recordMembership signs the Parch account up for activity emails from the
+  // space the capability was issued for.
+  recordMembership = (capability) => {
+    if (capability?.space_uuid && capability?.token) {
+      recordSpaceMembership(this.hostUUID, capability.space_uuid, capability.token);
+    }
+  };
+
   getCapabilityToken = (spaceUUID) => {
     if (!spaceUUID) {
       return "";
@@ -436,6 +530,9 @@ export default class SocketConn {
           },
         })
       );
+      Object.entries(capabilityTokens).forEach(([spaceUUID, token]) => {
+        recordSpaceMembership(this.hostUUID, spaceUUID, token);
+      });
     }
   };
 
@@ -445,6 +542,27 @@ export default class SocketConn {
     }
   };
 
+  listDevices = () => {
+    if (this.socket?.readyState === WebSocket.OPEN) {
+      this.socket.send(JSON.stringify({ type: "list_devices", data: {} }));
+    }
+  };
+
+  revokeDevice = (deviceID) => {
+    if (this.socket?.readyState === WebSocket.OPEN) {
+      this.socket.send(JSON.stringify({ type: "revoke_device", data: { device_id: deviceID } }));
+    }
+  };
+
+  // sendPendingMigration asks the host to move the previous identity onto the
+  // keys this session signed in with; see identityManager.rotateIdentity.
+  sendPendingMigration = () => {
+    const pending = identityManager.getPendingMigration(this.hostUUID);
+    if (pending && this.socket?.readyState === WebSocket.OPEN) {
+      this.socket.send(JSON.stringify({ type: "identity_migrate", data: pending }));
+    }
+  };
+
   createSpace = (data) => {
     if (this.socket?.readyState === WebSocket.OPEN) {
       this.socket.send(JSON.stringify({ type: "create_space", data }));
@@ -517,6 +635,7 @@ export default class SocketConn {
 
   leaveSpace = (data) => {
     if (this.socket?.readyState === WebSocket.OPEN) {
+      this.pendingLeaveSpaceUUID = data?.space_uuid || null;
       this.socket.send(JSON.stringify({ type: "leave_space", data }));
     }
   };
@@ -534,6 +653,31 @@ export default class SocketConn {
     }
   };
 
+  // Moderation and audit log requests all carry the space's capability token.
+  sendSpaceRequest = (type, data) => {
+    if (this.socket?.readyState === WebSocket.OPEN) {
+      this.sendWithCapability(data?.space_uuid || null, (capabilityToken) => {
+        const payload = { ...data };
+        if (capabilityToken) {
+          payload.capability_token = capabilityToken;
+        }
+        this.socket.send(JSON.stringify({ type, data: payload }));
+      });
+    }
+  };
+
+  reportMessage = (data) => this.sendSpaceRequest("report_message", data);
+
+  reportUser = (data) => this.sendSpaceRequest("report_user", data);
+
+  listReports = (data) => this.sendSpaceRequest("list_reports", data);
+
+  resolveReport = (data) => this.sendSpaceRequest("resolve_report", data);
+
+  getAuditLog = (data) => this.sendSpaceRequest("get_audit_log", data);
+
+  exportSpace = (data) => this.sendSpaceRequest("export_space", data);
+
   joinChannel = (spaceUUIDOrChannelUUID, maybeChannelUUID = null) => {
     const channelUUID = maybeChannelUUID || spaceUUIDOrChannelUUID;
     const spaceUUID = maybeChannelUUID ? spaceUUIDOrChannelUUID : null;
@@ -557,6 +701,9 @@ export default class SocketConn {
           payload.capability_token = capabilityToken;
         }
         this.socket.send(JSON.stringify({ type: "chat", data: payload }));
+        if (data?.envelope?.kind === "message") {
+          recordSpaceActivity(this.hostUUID, resolvedSpaceUUID, capabilityToken);
+        }
       });
     }
   };
@@ -578,6 +725,18 @@ export default class SocketConn {
     }
   };
 
+  getMessageRange = (fromSeq, toSeq, spaceUUID = null) => {
+    if (this.socket?.readyState === WebSocket.OPEN) {
+      this.sendWithCapability(spaceUUID, (capabilityToken) => {
+        const payload = { from_seq: fromSeq, to_seq: toSeq };
+        if (capabilityToken) {
+          payload.capability_token = capabilityToken;
+        }
+        this.socket.send(JSON.stringify({ type: "get_messages", data: payload }));
+      });
+    }
+  };
+
   hardClose = () => {
     this.manualClose = true;
     this.close();